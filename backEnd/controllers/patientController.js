@@ -1,4 +1,5 @@
 const axios = require('axios');
+const { URLSearchParams } = require('url');
 const crypto = require('crypto');
 const { pool } = require('../config/db');
 const { encryptPII, decryptPII } = require('../utils/encryption');
@@ -72,14 +73,16 @@ class PatientController {
 
     try {
       // Query blockchain for patient asset
-      const response = await axios.get(`${process.env.BLOCKCHAIN_API_URL}/query`, {
-        params: {
+      const response = await axios.post(
+        `${process.env.BLOCKCHAIN_API_URL}/records/access`,
+        new URLSearchParams({
           channelid: process.env.CHANNEL_ID,
           chaincodeid: process.env.CHAINCODE_ID,
-          function: "ReadAsset",
-          args: patientId,
-        },
-      });
+          patientId,
+          purpose: 'View prescriptions'
+        }),
+        { headers: { 'Content-Type': 'application/x-www-form-urlencoded', Authorization: req.headers.authorization } }
+      );
 
       if (!response.data || response.data.error) {
         return res.status(404).json({
@@ -131,15 +134,18 @@ class PatientController {
     }
 
     try {
-      // Query blockchain for asset history
-      const response = await axios.get(`${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/query`, {
-        params: {
+      // Read asset history through the audited access endpoint
+      const response = await axios.post(
+        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/records/access`,
+        new URLSearchParams({
           channelid: process.env.CHANNEL_ID || 'mychannel',
           chaincodeid: process.env.CHAINCODE_ID || 'basic',
-          function: "GetAssetHistory",
-          args: patientId,
-        },
-      });
+          patientId,
+          purpose: 'View prescription history',
+          view: 'history'
+        }),
+        { headers: { 'Content-Type': 'application/x-www-form-urlencoded', Authorization: req.headers.authorization } }
+      );
 
       if (!response.data || response.data.error) {
         return res.status(404).json({
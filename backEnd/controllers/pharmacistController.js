@@ -111,14 +111,16 @@ class PharmacistController {
 
     try {
       // Query blockchain for prescriptions using the correct function
-      const response = await axios.get(`${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/query`, {
-        params: {
+      const response = await axios.post(
+        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/records/access`,
+        new URLSearchParams({
           channelid: process.env.CHANNEL_ID || 'mychannel',
           chaincodeid: process.env.CHAINCODE_ID || 'basic',
-          function: "ReadAsset",
-          args: patientId,
-        },
-      });
+          patientId,
+          purpose: 'Dispensing review'
+        }),
+        { headers: { 'Content-Type': 'application/x-www-form-urlencoded', Authorization: req.headers.authorization } }
+      );
 
       // Log the raw response for debugging
       console.log(`Raw blockchain response for patient ${patientId}:`, response.data);
@@ -13,7 +13,7 @@ const CODE_EXPIRY_MINUTES = parseInt(process.env.CODE_EXPIRY_MINUTES || '5', 10)
 dotenv.config();
 
 // Import blockchain utilities
-const { processBlockchainResponse, queryBlockchainWithRetries } = require('../utils/blockchainUtils');
+const { processBlockchainResponse } = require('../utils/blockchainUtils');
 
 const decodeJWT = (token) => {
   const [header, payload] = token.split('.');
@@ -44,6 +44,15 @@ const createClientAssertion = async () => {
   return jwt.sign(payload, PRIVATE_KEY_PEM, { algorithm: 'RS256' });
 };
 
+// isValidDate checks for a real calendar date written as YYYY-MM-DD
+const isValidDate = (value) => {
+  if (typeof value !== 'string' || !/^\d{4}-\d{2}-\d{2}$/.test(value)) {
+    return false;
+  }
+  const date = new Date(`${value}T00:00:00Z`);
+  return !Number.isNaN(date.getTime()) && date.toISOString().startsWith(value);
+};
+
 class PrescriptionController {
   static async createPrescription(req, res) {
     const { patientId, doctorId, patientName, prescriptions } = req.body;
@@ -56,48 +65,64 @@ class PrescriptionController {
       });
     }
 
-    try {
-      // Generate prescription IDs upfront so we can track them
-      const prescriptionsWithIds = prescriptions.map(p => ({
-        ...p,
-        prescriptionId: crypto.randomBytes(8).toString('hex')
-      }));
+    // The ledger only accepts medicines on the formulary, identified by code
+    if (prescriptions.some(p => !p.MedicationCode)) {
+      return res.status(400).json({
+        success: false,
+        error: 'Every prescription needs a formulary MedicationCode'
+      });
+    }
 
+    // Prescriptions are signed on the prescriber's device and passed to the ledger unchanged
+    if (prescriptions.some(p => !p.PrescriptionId || !p.Signature || !p.SignerCertificate)) {
+      return res.status(400).json({
+        success: false,
+        error: "Every prescription must carry its PrescriptionId and the prescriber's Signature and SignerCertificate"
+      });
+    }
+
+    // ICD-10 diagnosis codes are signed with each prescription and go to the ledger as they are
+    if (prescriptions.some(p => p.DiagnosisCodes !== undefined &&
+        (!Array.isArray(p.DiagnosisCodes) || p.DiagnosisCodes.some(code => typeof code !== 'string')))) {
+      return res.status(400).json({
+        success: false,
+        error: 'DiagnosisCodes must be a list of ICD-10 codes'
+      });
+    }
+
+    // Age-banded dose checks need a real date of birth. An unknown one is left out, and the ledger then
+    // records that structured doses could not be checked against age bands.
+    const { dateOfBirth } = req.body;
+    if (dateOfBirth && !isValidDate(dateOfBirth)) {
+      return res.status(400).json({
+        success: false,
+        error: 'dateOfBirth must be a YYYY-MM-DD date, or omitted when unknown'
+      });
+    }
+
+    try {
       // Create a properly formatted asset object
       const assetObject = {
         PatientId: patientId,
         DoctorId: doctorId,
         PatientName: patientName,
-        DateOfBirth: req.body.dateOfBirth || "N/A",
-        Prescriptions: prescriptionsWithIds.map(p => ({
-          PrescriptionId: p.prescriptionId,
-          MedicationName: p.medicationName || p.medication || 'Unknown',
-          Dosage: p.dosage,
-          Instructions: p.instructions ,
-          Diagnosis : p.diagnosis ,
-          Status: "Active",
-          CreatedBy: doctorId,
-          TxID: "",
-          Timestamp: new Date().toISOString(),
-          ExpiryDate: new Date(Date.now() + 30 * 24 * 60 * 60 * 1000).toISOString().split('T')[0], // 30 days from now
-          DispensingPharmacist: "N/A",
-          DispensingTimestamp: "N/A"
-        }))
+        Prescriptions: prescriptions
       };
+      if (dateOfBirth) {
+        assetObject.DateOfBirth = dateOfBirth;
+      }
 
       // Prepare blockchain request
       const requestData = new URLSearchParams();
       requestData.append('channelid', process.env.CHANNEL_ID || 'mychannel');
       requestData.append('chaincodeid', process.env.CHAINCODE_ID || 'basic');
-      requestData.append('function', 'CreateAsset');
-      // The args should be a single string in an array, not JSON object itself
-      requestData.append('args', JSON.stringify(assetObject));
+      requestData.append('asset', JSON.stringify(assetObject));
 
       console.log(`Creating prescription for patient ${patientId}:`, JSON.stringify(assetObject));
 
       // Send to blockchain
       const blockchainResponse = await axios.post(
-        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/invoke`, 
+        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/prescriptions`, 
         requestData,
         { headers: { 'Content-Type': 'application/x-www-form-urlencoded' } }
       );
@@ -113,12 +138,13 @@ class PrescriptionController {
           doctorId,
           patientId,
           patientName,
-          prescriptions: prescriptionsWithIds.map(p => ({
-            prescriptionId: p.prescriptionId,
-            medicationName: p.medicationName || p.medication || 'Unknown',
-            dosage: p.dosage,
-            instructions: p.instructions, 
-            diagnosis: p.diagnosis
+          prescriptions: prescriptions.map(p => ({
+            prescriptionId: p.PrescriptionId,
+            medicationCode: p.MedicationCode,
+            dosage: p.Dosage,
+            instructions: p.Instructions,
+            diagnosisCodes: p.DiagnosisCodes || [],
+            expiryDate: p.ExpiryDate
           })),
           txId: blockchainResponse.data.txId,
           createdAt: new Date().toISOString()
@@ -128,17 +154,20 @@ class PrescriptionController {
       // After responding to client, verify the prescription was created
       // This runs asynchronously and doesn't block the response
       try {
-        // Use exponential backoff for verification
-        await queryBlockchainWithRetries({
-          channelid: process.env.CHANNEL_ID || 'mychannel',
-          chaincodeid: process.env.CHAINCODE_ID || 'basic',
-          function: "ReadAsset",
-          args: patientId
-        }, {
-          maxRetries: 6,      
-          initialDelay: 3000, 
-          maxDelay: 30000      
-        });
+        // Read the record back through the audited access endpoint
+        const verifyResponse = await axios.post(
+          `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/records/access`,
+          new URLSearchParams({
+            channelid: process.env.CHANNEL_ID || 'mychannel',
+            chaincodeid: process.env.CHAINCODE_ID || 'basic',
+            patientId,
+            purpose: 'Verify issued prescription'
+          }),
+          { headers: { 'Content-Type': 'application/x-www-form-urlencoded', Authorization: req.headers.authorization } }
+        );
+        if (typeof verifyResponse.data === 'string' && verifyResponse.data.startsWith('Error')) {
+          throw new Error(verifyResponse.data);
+        }
         
         console.log(`✅ Verified prescription creation for patient ${patientId}`);
       } catch (verifyError) {
@@ -161,14 +190,16 @@ class PrescriptionController {
     }
 
     try {
-      const response = await axios.get(`${process.env.BLOCKCHAIN_API_URL || "http://localhost:45000"}/query`, {
-        params: {
+      const response = await axios.post(
+        `${process.env.BLOCKCHAIN_API_URL || "http://localhost:45000"}/records/access`,
+        new URLSearchParams({
           channelid: process.env.CHANNEL_ID || "mychannel",
           chaincodeid: process.env.CHAINCODE_ID || "basic",
-          function: "ReadAsset",
-          args: patientId, 
-        },
-      });
+          patientId,
+          purpose: 'View prescriptions'
+        }),
+        { headers: { 'Content-Type': 'application/x-www-form-urlencoded', Authorization: req.headers.authorization } }
+      );
 
       // Check if response contains valid data
       if (!response.data || response.data.error) {
@@ -205,7 +236,7 @@ class PrescriptionController {
         });
       }
 
-      // The ReadAsset function returns a single asset object, not an array
+      // AccessPatientRecord returns a single asset object, not an array
       if (!assetData || !assetData.PatientId) {
         return res.status(404).json({
           success: false,
@@ -314,6 +345,50 @@ class PrescriptionController {
     }
   };
 
+  // SearchFormulary - looks up formulary medicines by name so prescriptions can refer to their codes
+  static async searchFormulary(req, res) {
+    const { name } = req.query;
+
+    if (!name) {
+      return res.status(400).json({
+        success: false,
+        error: 'A medication name is required'
+      });
+    }
+
+    try {
+      const response = await axios.get(`${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/query`, {
+        params: {
+          channelid: process.env.CHANNEL_ID || 'mychannel',
+          chaincodeid: process.env.CHAINCODE_ID || 'basic',
+          function: 'SearchFormulary',
+          args: name,
+        },
+      });
+
+      const matches = processBlockchainResponse(response.data) || [];
+      res.status(200).json({
+        success: true,
+        data: matches.map(match => ({
+          code: match.Entry.Code,
+          genericName: match.Entry.GenericName,
+          atcCode: match.Entry.AtcCode,
+          strengths: match.Entry.Strengths || [],
+          dosageForms: match.Entry.DosageForms || [],
+          matchedOn: match.MatchedOn,
+          score: match.Score
+        }))
+      });
+    } catch (error) {
+      console.error('Error searching formulary:', error.message);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to search formulary',
+        details: error.response?.data || error.message
+      });
+    }
+  }
+
   // RevokePrescription - allows a doctor to revoke an active prescription
   static async revokePrescription(req, res) {
     const { patientId, prescriptionId, doctorId } = req.body;
@@ -601,106 +676,49 @@ class PrescriptionController {
     }
   }
 
-  // UpdatePrescription - allows a doctor to update an existing prescription
+  // UpdatePrescription - allows a doctor to update an existing prescription. The changed prescription is
+  // signed on the prescriber's device and passed to the ledger unchanged; only its issuer can update it.
   static async updatePrescription(req, res) {
-    const { patientId, prescriptionId, doctorId, updates } = req.body;
+    const { patientId, prescription } = req.body;
 
     // Validate request
-    if (!patientId || !prescriptionId || !doctorId || !updates) {
+    if (!patientId || !prescription || !prescription.PrescriptionId) {
       return res.status(400).json({
         success: false,
         error: 'Missing required fields',
-        details: { patientId, prescriptionId, doctorId }
+        details: { patientId, prescriptionId: prescription?.PrescriptionId }
+      });
+    }
+    if (!prescription.Signature || !prescription.SignerCertificate) {
+      return res.status(400).json({
+        success: false,
+        error: "The updated prescription must carry the prescriber's Signature and SignerCertificate"
       });
     }
 
     try {
-      // First, get the current prescription data
-      const getResponse = await axios.get(`${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/query`, {
-        params: {
-          channelid: process.env.CHANNEL_ID || 'mychannel',
-          chaincodeid: process.env.CHAINCODE_ID || 'basic',
-          function: "ReadAsset",
-          args: patientId
-        },
-      });
-      
-      // Process the response
-      let assetData;
-      try {
-        assetData = processBlockchainResponse(getResponse.data);
-      } catch (err) {
-        return res.status(500).json({
-          success: false,
-          error: "Failed to parse blockchain response",
-          details: err.message
-        });
-      }
-      
-      if (!assetData) {
-        return res.status(404).json({
-          success: false,
-          error: "Patient record not found"
-        });
-      }
-      
-      // Find the specific prescription to update
-      let prescriptionFound = false;
-      if (assetData.Prescriptions && Array.isArray(assetData.Prescriptions)) {
-        for (let i = 0; i < assetData.Prescriptions.length; i++) {
-          if (assetData.Prescriptions[i].PrescriptionId === prescriptionId) {
-            // Update prescription fields
-            if (updates.dosage) assetData.Prescriptions[i].Dosage = updates.dosage;
-            if (updates.instructions) assetData.Prescriptions[i].Instructions = updates.instructions;
-            if (updates.diagnosis) assetData.Prescriptions[i].Diagnosis = updates.diagnosis;
-            if (updates.medicationName) assetData.Prescriptions[i].MedicationName = updates.medicationName;
-            if (updates.expiryDate) assetData.Prescriptions[i].ExpiryDate = updates.expiryDate;
-            
-            // Only update if the doctor is the original creator
-            if (assetData.Prescriptions[i].CreatedBy !== doctorId) {
-              return res.status(403).json({
-                success: false,
-                error: "Only the prescribing doctor can update this prescription"
-              });
-            }
-            
-            prescriptionFound = true;
-            break;
-          }
-        }
-      }
-      
-      if (!prescriptionFound) {
-        return res.status(404).json({
-          success: false,
-          error: "Prescription not found"
-        });
-      }
-      
-      // Prepare blockchain request for UpdatePrescription
       const requestData = new URLSearchParams();
       requestData.append('channelid', process.env.CHANNEL_ID || 'mychannel');
       requestData.append('chaincodeid', process.env.CHAINCODE_ID || 'basic');
-      requestData.append('function', 'UpdatePrescription');
-      
-      // The args should be patientId and the prescription JSON
-      requestData.append('args', JSON.stringify([patientId, JSON.stringify(assetData)]));
+      requestData.append('patientId', patientId);
+      requestData.append('prescription', JSON.stringify(prescription));
 
       // Send to blockchain
       const blockchainResponse = await axios.post(
-        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/invoke`, 
+        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/prescriptions/update`, 
         requestData,
         { headers: { 'Content-Type': 'application/x-www-form-urlencoded' } }
       );
+      if (typeof blockchainResponse.data === 'string' && blockchainResponse.data.startsWith('Error')) {
+        throw new Error(blockchainResponse.data);
+      }
 
       return res.status(200).json({
         success: true,
         message: 'Prescription updated successfully',
         data: {
           patientId,
-          prescriptionId,
-          doctorId,
-          updates,
+          prescriptionId: prescription.PrescriptionId,
           txId: blockchainResponse.data.txId,
           updatedAt: new Date().toISOString()
         }
@@ -715,6 +733,43 @@ class PrescriptionController {
     }
   }
 
+  // GetPrescriptionContent - returns the canonical content a prescriber signs on their device for a prescription
+  static async getPrescriptionContent(req, res) {
+    const { patientId, prescriberId, prescription } = req.body;
+
+    if (!patientId || !prescriberId || !prescription) {
+      return res.status(400).json({
+        success: false,
+        error: 'Missing required fields',
+        details: { patientId, prescriberId }
+      });
+    }
+
+    try {
+      const response = await axios.post(
+        `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/prescriptions/content`,
+        new URLSearchParams({
+          patientId,
+          prescriberId,
+          prescription: JSON.stringify(prescription)
+        }),
+        { headers: { 'Content-Type': 'application/x-www-form-urlencoded' } }
+      );
+
+      res.status(200).json({
+        success: true,
+        data: response.data
+      });
+    } catch (error) {
+      console.error('Error getting prescription content:', error.response?.data || error.message);
+      res.status(error.response?.status === 400 ? 400 : 500).json({
+        success: false,
+        error: 'Failed to get prescription content',
+        details: error.response?.data || error.message
+      });
+    }
+  }
+
 }
 
 module.exports = PrescriptionController;
\ No newline at end of file
@@ -5,6 +5,12 @@ const router = express.Router();
 // POST: Create a prescription
 router.post('/prescriptions', PrescriptionController.createPrescription);
 
+// POST: Get the canonical content a prescriber signs for a prescription
+router.post('/prescriptions/content', PrescriptionController.getPrescriptionContent);
+
+// GET: Search the formulary by medication name
+router.get('/formulary', PrescriptionController.searchFormulary);
+
 // GET: Retrieve a prescription by patientId (query param)
 router.get('/prescriptions', PrescriptionController.getPrescription);
 
@@ -0,0 +1,79 @@
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+
+// The controller loads its client assertion key when it is required
+process.env.PRIVATE_KEY_JWK = JSON.stringify(
+  crypto.generateKeyPairSync('rsa', { modulusLength: 2048 }).privateKey.export({ format: 'jwk' })
+);
+
+const axios = require('axios');
+const PrescriptionController = require('../controllers/prescriptionController');
+
+const response = () => {
+  const res = {};
+  res.status = (code) => { res.statusCode = code; return res; };
+  res.json = (body) => { res.body = body; return res; };
+  return res;
+};
+
+test('createPrescription forwards ICD-10 diagnosis codes to the ledger', async (t) => {
+  const posts = [];
+  t.mock.method(axios, 'post', async (url, data) => {
+    posts.push({ url, data });
+    return { data: { txId: 'tx1' } };
+  });
+
+  const req = {
+    headers: { authorization: 'Bearer session' },
+    body: {
+      patientId: 'P1',
+      doctorId: 'DOC1',
+      patientName: 'Chikondi Banda',
+      prescriptions: [{
+        PrescriptionId: 'RX1',
+        MedicationCode: 'AMX500',
+        Dosage: '500 mg',
+        Instructions: 'Three times a day',
+        DiagnosisCodes: ['J18.9', 'B54'],
+        ExpiryDate: '2026-11-19',
+        Signature: 'c2lnbmF0dXJl',
+        SignerCertificate: '-----BEGIN CERTIFICATE-----'
+      }]
+    }
+  };
+  const res = response();
+  await PrescriptionController.createPrescription(req, res);
+
+  assert.strictEqual(res.statusCode, 201);
+  const issue = posts.find(post => post.url.endsWith('/prescriptions'));
+  assert.ok(issue, 'no prescriptions were submitted to the ledger');
+  const asset = JSON.parse(issue.data.get('asset'));
+  assert.deepStrictEqual(asset.Prescriptions[0].DiagnosisCodes, ['J18.9', 'B54']);
+  assert.deepStrictEqual(res.body.data.prescriptions[0].diagnosisCodes, ['J18.9', 'B54']);
+});
+
+test('createPrescription rejects diagnosis codes that are not a list', async (t) => {
+  const post = t.mock.method(axios, 'post', async () => ({ data: {} }));
+
+  const req = {
+    headers: {},
+    body: {
+      patientId: 'P1',
+      doctorId: 'DOC1',
+      patientName: 'Chikondi Banda',
+      prescriptions: [{
+        PrescriptionId: 'RX1',
+        MedicationCode: 'AMX500',
+        DiagnosisCodes: 'J18.9',
+        Signature: 'c2lnbmF0dXJl',
+        SignerCertificate: '-----BEGIN CERTIFICATE-----'
+      }]
+    }
+  };
+  const res = response();
+  await PrescriptionController.createPrescription(req, res);
+
+  assert.strictEqual(res.statusCode, 400);
+  assert.strictEqual(post.mock.callCount(), 0);
+});
@@ -1,6 +1,5 @@
 const amqp = require('amqplib');
 const { Contract } = require('fabric-contract-api');
-const crypto = require('crypto');
 
 /**
  * Processes blockchain write tasks from the queue.
@@ -24,34 +23,34 @@ const processBlockchainWrite = async () => {
           const axios = require('axios');
           const { URLSearchParams } = require('url');
           
-          // Format the asset data according to the smart contract requirements
+          // The ledger only accepts formulary medicines, identified by code, in prescriptions signed on the
+          // prescriber's device; retrying cannot fix either
+          const invalid = transactionData.prescriptions.find(p =>
+            !p.MedicationCode || !p.PrescriptionId || !p.Signature || !p.SignerCertificate);
+          if (invalid) {
+            console.error(`Dropping blockchain write: prescription ${invalid.PrescriptionId || ''} needs a formulary MedicationCode and the prescriber's signature`);
+            channel.nack(msg, false, false);
+            return;
+          }
+
+          // The signed prescriptions are passed through unchanged, or their signatures would not verify
           const assetData = {
             PatientId: transactionData.patientId,
             DoctorId: transactionData.doctorId,
             PatientName: transactionData.patientName,
             DateOfBirth: transactionData.dateOfBirth || "",
-            Prescriptions: transactionData.prescriptions.map(p => ({
-              PrescriptionId: p.prescriptionId || crypto.randomBytes(8).toString('hex'),
-              PatientId: transactionData.patientId,
-              CreatedBy: transactionData.doctorId,
-              MedicationName: p.medicationName || p.medication || 'Unknown',
-              Dosage: p.dosage,
-              Instructions: p.instructions || '',
-              Status: "Active",
-              ExpiryDate: p.expiryDate || new Date(Date.now() + 30 * 24 * 60 * 60 * 1000).toISOString().split('T')[0]
-            }))
+            Prescriptions: transactionData.prescriptions
           };
           
           // Prepare blockchain request
           const requestData = new URLSearchParams();
           requestData.append('channelid', process.env.CHANNEL_ID || 'mychannel');
           requestData.append('chaincodeid', process.env.CHAINCODE_ID || 'basic');
-          requestData.append('function', 'CreateAsset');
-          requestData.append('args', JSON.stringify(assetData));
+          requestData.append('asset', JSON.stringify(assetData));
           
           // Submit to blockchain
           const response = await axios.post(
-            `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/invoke`, 
+            `${process.env.BLOCKCHAIN_API_URL || 'http://localhost:45000'}/prescriptions`, 
             requestData,
             { headers: { 'Content-Type': 'application/x-www-form-urlencoded' } }
           );
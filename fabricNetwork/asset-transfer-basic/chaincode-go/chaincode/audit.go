@@ -0,0 +1,192 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const accessObjectType = "access"
+
+// AccessRecord is an audit entry written whenever a clinician reads a patient's record through a submitted transaction.
+// UserId names the person who read it, from the enrolment of their own client identity.
+type AccessRecord struct {
+    PatientId  string `json:"PatientId"`
+    UserId     string `json:"UserId"`
+    CallerId   string `json:"CallerId"`
+    CallerMSP  string `json:"CallerMSP"`
+    CallerRole string `json:"CallerRole"`
+    FacilityId string `json:"FacilityId"`
+    Purpose    string `json:"Purpose"`
+    BreakGlass bool   `json:"BreakGlass"`
+    AccessedAt string `json:"AccessedAt"`
+    TxID       string `json:"TxID"`
+}
+
+// AccessPatientRecord - reads a patient's record and records who read it and why.
+// Unlike ReadAsset this must be submitted, so the audit entry is committed to the ledger.
+func (s *SmartContract) AccessPatientRecord(ctx contractapi.TransactionContextInterface, patientId string, purpose string) (*Asset, error) {
+    purpose = strings.TrimSpace(purpose)
+    if purpose == "" {
+        return nil, fmt.Errorf("a purpose of access is required")
+    }
+
+    if err := s.requireConsent(ctx, patientId, ScopeRead); err != nil {
+        return nil, err
+    }
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.recordAccess(ctx, patientId, role, purpose, false); err != nil {
+        return nil, err
+    }
+
+    return asset, nil
+}
+
+// auditRead checks read consent for a query that returns a patient's record and, unless the caller is the patient
+// or their proxy, records the access as AccessPatientRecord does
+func (s *SmartContract) auditRead(ctx contractapi.TransactionContextInterface, patientId string, purpose string) error {
+    if s.isPatientOrProxy(ctx, patientId) {
+        return nil
+    }
+    if err := s.requireConsent(ctx, patientId, ScopeRead); err != nil {
+        return err
+    }
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    return s.recordAccess(ctx, patientId, role, purpose, false)
+}
+
+// ReadPrescription - reads a single prescription by ID, without knowing the patient, and records the access like
+// AccessPatientRecord. The returned record holds only that prescription.
+func (s *SmartContract) ReadPrescription(ctx contractapi.TransactionContextInterface, prescriptionId string, purpose string) (*Asset, error) {
+    patientId, err := s.findPrescriptionPatient(ctx, prescriptionId)
+    if err != nil {
+        return nil, err
+    }
+    if patientId == "" {
+        return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+    }
+
+    asset, err := s.AccessPatientRecord(ctx, patientId, purpose)
+    if err != nil {
+        return nil, err
+    }
+    for _, prescription := range asset.Prescriptions {
+        if prescription.PrescriptionId == prescriptionId {
+            asset.Prescriptions = []Prescription{prescription}
+            return asset, nil
+        }
+    }
+    return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+}
+
+// GetAccessLog - lets a patient, or their proxy, see who viewed their record
+func (s *SmartContract) GetAccessLog(ctx contractapi.TransactionContextInterface, patientId string) ([]*AccessRecord, error) {
+    if _, err := s.requirePatientOrProxy(ctx, patientId); err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(accessObjectType, []string{patientId})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    records := []*AccessRecord{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var record AccessRecord
+        if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+            return nil, err
+        }
+        records = append(records, &record)
+    }
+
+    // Most recent first
+    sort.Slice(records, func(i, j int) bool {
+        return records[i].AccessedAt > records[j].AccessedAt
+    })
+
+    return records, nil
+}
+
+// recordAccess writes an audit entry for the current transaction under the patient's access log
+func (s *SmartContract) recordAccess(ctx contractapi.TransactionContextInterface, patientId string, role string, purpose string, breakGlass bool) error {
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    userId, err := callerUserId(ctx)
+    if err != nil {
+        return err
+    }
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return fmt.Errorf("failed to get MSP ID: %v", err)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    record := AccessRecord{
+        PatientId:  patientId,
+        UserId:     userId,
+        CallerId:   callerId,
+        CallerMSP:  mspID,
+        CallerRole: role,
+        FacilityId: facilityId,
+        Purpose:    purpose,
+        BreakGlass: breakGlass,
+        AccessedAt: now.Format(time.RFC3339),
+        TxID:       ctx.GetStub().GetTxID(),
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(accessObjectType, []string{patientId, record.TxID})
+    if err != nil {
+        return err
+    }
+    recordJSON, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, recordJSON)
+}
+
+// callerUserId returns the person behind the caller's client identity: their "prescriberId" certificate attribute,
+// or the enrolment ID Fabric CA records in every certificate it issues. It names the end user only when each user
+// submits with their own enrolment.
+func callerUserId(ctx contractapi.TransactionContextInterface) (string, error) {
+    for _, attribute := range []string{"prescriberId", "hf.EnrollmentID"} {
+        value, ok, err := ctx.GetClientIdentity().GetAttributeValue(attribute)
+        if err != nil {
+            return "", fmt.Errorf("failed to get %s attribute: %v", attribute, err)
+        }
+        if ok && value != "" {
+            return value, nil
+        }
+    }
+    return "", fmt.Errorf("the caller's certificate identifies no user; enrol each user with their own identity")
+}
@@ -0,0 +1,126 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestClinicalReadsAreAudited(t *testing.T) {
+    clinician := newIdentity("dr-banda", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH", "prescriberId": "DOC7"})
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        read    func(ctx contractapi.TransactionContextInterface) error
+        wantErr string
+        audited bool
+    }{
+        {
+            name:    "clinician cannot use ReadAsset",
+            caller:  clinician,
+            read:    func(ctx contractapi.TransactionContextInterface) error { _, err := contract.ReadAsset(ctx, "P1"); return err },
+            wantErr: "AccessPatientRecord",
+        },
+        {
+            name:   "patient reads own record with ReadAsset",
+            caller: patient("P1"),
+            read:   func(ctx contractapi.TransactionContextInterface) error { _, err := contract.ReadAsset(ctx, "P1"); return err },
+        },
+        {
+            name:    "clinician read through AccessPatientRecord",
+            caller:  clinician,
+            read:    func(ctx contractapi.TransactionContextInterface) error { _, err := contract.AccessPatientRecord(ctx, "P1", "Review"); return err },
+            audited: true,
+        },
+        {
+            name:    "clinician read through ReadPrescription",
+            caller:  clinician,
+            read:    func(ctx contractapi.TransactionContextInterface) error { _, err := contract.ReadPrescription(ctx, "RX1", "Update"); return err },
+            audited: true,
+        },
+        {
+            name:    "clinician query by status",
+            caller:  clinician,
+            read:    func(ctx contractapi.TransactionContextInterface) error { _, err := contract.GetPrescriptionsByStatus(ctx, "P1", "Active"); return err },
+            audited: true,
+        },
+        {
+            name:    "clinician record history",
+            caller:  clinician,
+            read:    func(ctx contractapi.TransactionContextInterface) error { _, err := contract.GetAssetHistory(ctx, "P1"); return err },
+            audited: true,
+        },
+        {
+            name:   "patient query by status is not logged",
+            caller: patient("P1"),
+            read:   func(ctx contractapi.TransactionContextInterface) error { _, err := contract.GetPrescriptionsByStatus(ctx, "P1", "Active"); return err },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{PrescriptionId: "RX1", Status: "Active"}}})
+            ledger.grantConsent("P1", GranteePractitioner, "DOC7", ScopeRead)
+
+            err := ledger.submit(tt.caller, tt.read)
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            ctx, _ := ledger.context(patient("P1"))
+            log, err := contract.GetAccessLog(ctx, "P1")
+            require.NoError(t, err)
+            if tt.audited {
+                require.Len(t, log, 1)
+                require.Equal(t, "DOC7", log[0].UserId)
+                require.Equal(t, clinician.id, log[0].CallerId)
+            } else {
+                require.Empty(t, log)
+            }
+        })
+    }
+}
+
+func TestAccessLogNamesTheEnrolledUser(t *testing.T) {
+    contract := &SmartContract{}
+    tests := []struct {
+        name       string
+        caller     *testIdentity
+        wantUserId string
+        wantErr    string
+    }{
+        {name: "prescriber ID", caller: newIdentity("dr-banda", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "KCH", "prescriberId": "DOC7"}), wantUserId: "DOC7"},
+        {name: "enrolment ID", caller: newIdentity("ph-mwale", "Org2MSP", map[string]string{"role": RolePharmacist, "facilityId": "KCH"}), wantUserId: "ph-mwale"},
+        {name: "no user in the certificate", caller: newIdentity("User1", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "KCH", "hf.EnrollmentID": ""}), wantErr: "identifies no user"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopeRead)
+
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                _, err := contract.AccessPatientRecord(ctx, "P1", "Review")
+                return err
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            ctx, _ := ledger.context(patient("P1"))
+            log, err := contract.GetAccessLog(ctx, "P1")
+            require.NoError(t, err)
+            require.Len(t, log, 1)
+            require.Equal(t, tt.wantUserId, log[0].UserId)
+        })
+    }
+}
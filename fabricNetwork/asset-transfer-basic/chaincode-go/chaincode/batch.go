@@ -0,0 +1,267 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const (
+    batchDispenseObjectType = "batchdispense"
+    recallObjectType        = "recall"
+)
+
+// BatchDispense indexes a dispensation by the batch it was supplied from. Batch numbers are only unique per
+// manufacturer and product, so batches are identified by medication code and batch number.
+type BatchDispense struct {
+    BatchNumber    string `json:"BatchNumber"`
+    PatientId      string `json:"PatientId"`
+    PrescriptionId string `json:"PrescriptionId"`
+    MedicationCode string `json:"MedicationCode,omitempty"`
+    MedicationName string `json:"MedicationName"`
+    FacilityId     string `json:"FacilityId"`
+    DispensedAt    string `json:"DispensedAt"`
+    TxID           string `json:"TxID"`
+}
+
+// Recall records a regulator's recall of a batch of a medication
+type Recall struct {
+    MedicationCode string          `json:"MedicationCode"`
+    BatchNumber    string          `json:"BatchNumber"`
+    Reason         string          `json:"Reason"`
+    RecalledBy     string          `json:"RecalledBy"`
+    RecalledAt     string          `json:"RecalledAt"`
+    Affected       []BatchDispense `json:"Affected"`
+    TxID           string          `json:"TxID"`
+}
+
+// FindPatientsByBatch - lists the dispensations supplied from a batch of a medication. Regulators see every
+// facility, pharmacy staff only their own.
+func (s *SmartContract) FindPatientsByBatch(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string) ([]BatchDispense, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator && !isDispenserRole(role) {
+        return nil, fmt.Errorf("only regulators and pharmacy staff can trace batches")
+    }
+
+    dispensations, err := s.listBatchDispensations(ctx, medicationCode, batchNumber)
+    if err != nil {
+        return nil, err
+    }
+    if role == RoleRegulator {
+        return dispensations, nil
+    }
+
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+    own := []BatchDispense{}
+    for _, dispensation := range dispensations {
+        if dispensation.FacilityId == facilityId {
+            own = append(own, dispensation)
+        }
+    }
+    return own, nil
+}
+
+// RecallBatch - regulator transaction that flags every dispensation from a batch of a medication as recalled
+// and emits a BatchRecalled event listing the affected patients so pharmacies can contact them
+func (s *SmartContract) RecallBatch(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string, reason string) (*Recall, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator {
+        return nil, fmt.Errorf("only regulators can recall a batch")
+    }
+    medicationCode = strings.TrimSpace(medicationCode)
+    batchNumber = strings.TrimSpace(batchNumber)
+    if medicationCode == "" || batchNumber == "" || strings.TrimSpace(reason) == "" {
+        return nil, fmt.Errorf("medicationCode, batchNumber and reason are required")
+    }
+
+    existing, err := s.getRecall(ctx, medicationCode, batchNumber)
+    if err != nil {
+        return nil, err
+    }
+    if existing != nil {
+        return nil, fmt.Errorf("batch %s of %s was already recalled on %s", batchNumber, medicationCode, existing.RecalledAt)
+    }
+
+    affected, err := s.listBatchDispensations(ctx, medicationCode, batchNumber)
+    if err != nil {
+        return nil, err
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    timestamp, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    now := timestamp.Format(time.RFC3339)
+
+    // Flag the affected prescriptions, one asset write per patient
+    byPatient := map[string][]string{}
+    patientOrder := []string{}
+    for _, dispensation := range affected {
+        if _, seen := byPatient[dispensation.PatientId]; !seen {
+            patientOrder = append(patientOrder, dispensation.PatientId)
+        }
+        byPatient[dispensation.PatientId] = append(byPatient[dispensation.PatientId], dispensation.PrescriptionId)
+    }
+    for _, patientId := range patientOrder {
+        asset, err := s.readAsset(ctx, patientId)
+        if err != nil {
+            return nil, err
+        }
+        for i := range asset.Prescriptions {
+            if containsString(byPatient[patientId], asset.Prescriptions[i].PrescriptionId) && asset.Prescriptions[i].DispensedBatch == batchNumber && asset.Prescriptions[i].DispensedCode == medicationCode {
+                asset.Prescriptions[i].Recalled = true
+                asset.Prescriptions[i].RecallReason = reason
+                asset.Prescriptions[i].RecalledAt = now
+            }
+        }
+        asset.LastUpdated = now
+        assetJSON, err := json.Marshal(asset)
+        if err != nil {
+            return nil, err
+        }
+        if err := ctx.GetStub().PutState(patientId, assetJSON); err != nil {
+            return nil, err
+        }
+    }
+
+    recall := Recall{
+        MedicationCode: medicationCode,
+        BatchNumber:    batchNumber,
+        Reason:         reason,
+        RecalledBy:     callerId,
+        RecalledAt:     now,
+        Affected:       affected,
+        TxID:           ctx.GetStub().GetTxID(),
+    }
+    key, err := ctx.GetStub().CreateCompositeKey(recallObjectType, []string{medicationCode, batchNumber})
+    if err != nil {
+        return nil, err
+    }
+    recallJSON, err := json.Marshal(recall)
+    if err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().PutState(key, recallJSON); err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().SetEvent("BatchRecalled", recallJSON); err != nil {
+        return nil, fmt.Errorf("failed to set event: %v", err)
+    }
+
+    return &recall, nil
+}
+
+// validateDispenseBatch checks that a batch held in stock can be dispensed. It takes the batch details from the
+// stock record, so the expiry and recall checks, and the batch recorded for tracing and recalls, never depend on
+// what the dispensing client claims.
+func (s *SmartContract) validateDispenseBatch(ctx contractapi.TransactionContextInterface, item *StockItem) error {
+    if item.BatchExpiry == "" {
+        return fmt.Errorf("the stock record of batch %s has no expiry date", item.BatchNumber)
+    }
+    expiry, err := parseDate(item.BatchExpiry)
+    if err != nil {
+        return fmt.Errorf("invalid batch expiry date: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    if now.After(expiry.AddDate(0, 0, 1)) {
+        return fmt.Errorf("batch %s expired on %s and cannot be dispensed", item.BatchNumber, item.BatchExpiry)
+    }
+
+    recall, err := s.getRecall(ctx, item.MedicationCode, item.BatchNumber)
+    if err != nil {
+        return err
+    }
+    if recall != nil {
+        return fmt.Errorf("batch %s of %s was recalled on %s: %s", item.BatchNumber, item.MedicationCode, recall.RecalledAt, recall.Reason)
+    }
+    return nil
+}
+
+// indexBatchDispense records which batch a dispensation was supplied from
+func (s *SmartContract) indexBatchDispense(ctx contractapi.TransactionContextInterface, patientId string, prescription *Prescription) error {
+    entry := BatchDispense{
+        BatchNumber:    prescription.DispensedBatch,
+        PatientId:      patientId,
+        PrescriptionId: prescription.PrescriptionId,
+        MedicationCode: prescription.DispensedCode,
+        MedicationName: prescription.DispensedName,
+        FacilityId:     prescription.DispensingFacility,
+        DispensedAt:    prescription.DispensingTimestamp,
+        TxID:           ctx.GetStub().GetTxID(),
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(batchDispenseObjectType, []string{entry.MedicationCode, entry.BatchNumber, patientId, entry.PrescriptionId})
+    if err != nil {
+        return err
+    }
+    entryJSON, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, entryJSON)
+}
+
+// listBatchDispensations reads every dispensation indexed under a batch of a medication
+func (s *SmartContract) listBatchDispensations(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string) ([]BatchDispense, error) {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(batchDispenseObjectType, []string{medicationCode, batchNumber})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    dispensations := []BatchDispense{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var entry BatchDispense
+        if err := json.Unmarshal(queryResponse.Value, &entry); err != nil {
+            return nil, err
+        }
+        dispensations = append(dispensations, entry)
+    }
+
+    return dispensations, nil
+}
+
+// getRecall returns the recall of a batch of a medication, or nil if it has not been recalled
+func (s *SmartContract) getRecall(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string) (*Recall, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(recallObjectType, []string{medicationCode, batchNumber})
+    if err != nil {
+        return nil, err
+    }
+    recallJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if recallJSON == nil {
+        return nil, nil
+    }
+
+    var recall Recall
+    if err := json.Unmarshal(recallJSON, &recall); err != nil {
+        return nil, err
+    }
+    return &recall, nil
+}
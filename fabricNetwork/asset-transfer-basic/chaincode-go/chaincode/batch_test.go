@@ -0,0 +1,157 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+// batchLedger holds two medications whose suppliers both use batch number B1, with one of each dispensed to P1
+// and another of each waiting to be dispensed to P2
+func batchLedger(t *testing.T) *testLedger {
+    ledger := newTestLedger(t)
+    ledger.seedFormulary(
+        FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"500mg"}},
+        FormularyEntry{Code: "PARA", AtcCode: "N02BE01", GenericName: "Paracetamol", Strengths: []string{"500mg"}},
+    )
+    for _, code := range []string{"AMOX", "PARA"} {
+        ledger.putStock(StockItem{FacilityId: "KCH-PHARM", MedicationCode: code, BatchNumber: "B1", BatchExpiry: "2999-01-01", Quantity: 100})
+    }
+    for _, patientId := range []string{"P1", "P2"} {
+        ledger.put(patientId, Asset{PatientId: patientId, DoctorId: "DOC1", Prescriptions: []Prescription{
+            {PrescriptionId: patientId + "-AMOX", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "500mg", Status: "Active", Quantity: 10},
+            {PrescriptionId: patientId + "-PARA", MedicationCode: "PARA", MedicationName: "Paracetamol", Strength: "500mg", Status: "Active", Quantity: 10},
+        }})
+        ledger.grantConsent(patientId, GranteeFacility, "KCH-PHARM", ScopeDispense)
+    }
+    ledger.mustSubmit(pharmacist("ph-mwale"), dispenseFromBatch("P1", "P1-AMOX", "B1"))
+    ledger.mustSubmit(pharmacist("ph-mwale"), dispenseFromBatch("P1", "P1-PARA", "B1"))
+    return ledger
+}
+
+func dispenseFromBatch(patientId string, prescriptionId string, batchNumber string) func(ctx contractapi.TransactionContextInterface) error {
+    return func(ctx contractapi.TransactionContextInterface) error {
+        return (&SmartContract{}).DispensePrescription(ctx, `{"patientId":"`+patientId+`","prescriptionId":"`+prescriptionId+`","pharmacistId":"PH1","batchNumber":"`+batchNumber+`"}`)
+    }
+}
+
+func TestRecallBlocksOnlyTheRecalledProduct(t *testing.T) {
+    tests := []struct {
+        name           string
+        prescriptionId string
+        wantErr        string
+    }{
+        {name: "recalled batch", prescriptionId: "P2-AMOX", wantErr: "batch B1 of AMOX was recalled"},
+        {name: "same batch number of another medication", prescriptionId: "P2-PARA"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := batchLedger(t)
+            ledger.mustSubmit(regulator("reg-kalua"), func(ctx contractapi.TransactionContextInterface) error {
+                recall, err := (&SmartContract{}).RecallBatch(ctx, "AMOX", "B1", "Failed dissolution testing")
+                if err == nil {
+                    require.Len(t, recall.Affected, 1)
+                    require.Equal(t, "P1-AMOX", recall.Affected[0].PrescriptionId)
+                }
+                return err
+            })
+            require.True(t, ledger.prescription("P1", "P1-AMOX").Recalled)
+            require.False(t, ledger.prescription("P1", "P1-PARA").Recalled)
+
+            err := ledger.submit(pharmacist("ph-mwale"), dispenseFromBatch("P2", tt.prescriptionId, "B1"))
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, "Active", ledger.prescription("P2", tt.prescriptionId).Status)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, "Dispensed", ledger.prescription("P2", tt.prescriptionId).Status)
+        })
+    }
+}
+
+func TestFindPatientsByBatch(t *testing.T) {
+    ledger := batchLedger(t)
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        code    string
+        want    []string
+        wantErr string
+    }{
+        {name: "regulator", caller: regulator("reg-kalua"), code: "AMOX", want: []string{"P1-AMOX"}},
+        {name: "other medication", caller: regulator("reg-kalua"), code: "PARA", want: []string{"P1-PARA"}},
+        {name: "own pharmacy", caller: pharmacist("ph-banda"), code: "AMOX", want: []string{"P1-AMOX"}},
+        {name: "other pharmacy", caller: newIdentity("ph-zulu", "Org2MSP", map[string]string{"role": RolePharmacist, "facilityId": "MZH-PHARM"}), code: "AMOX"},
+        {name: "prescriber", caller: doctor("dr-banda"), code: "AMOX", wantErr: "only regulators and pharmacy staff"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ctx, _ := ledger.context(tt.caller)
+            dispensations, err := (&SmartContract{}).FindPatientsByBatch(ctx, tt.code, "B1")
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+            got := []string{}
+            for _, dispensation := range dispensations {
+                got = append(got, dispensation.PrescriptionId)
+            }
+            if tt.want == nil {
+                tt.want = []string{}
+            }
+            require.Equal(t, tt.want, got)
+        })
+    }
+}
+
+func TestDispenseRecordsTheStockBatch(t *testing.T) {
+    tests := []struct {
+        name         string
+        batchExpiry  string
+        manufacturer string
+        wantErr      string
+    }{
+        {name: "stock record details"},
+        {name: "matching details", batchExpiry: "2999-01-01", manufacturer: "Medopharm"},
+        {name: "mismatched expiry", batchExpiry: "2998-06-30", wantErr: "expires on 2999-01-01 according to the stock record"},
+        {name: "mismatched manufacturer", manufacturer: "Other Pharma", wantErr: "made by Medopharm according to the stock record"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"500mg"}})
+            ledger.putStock(StockItem{FacilityId: "KCH-PHARM", MedicationCode: "AMOX", BatchNumber: "B1", Manufacturer: "Medopharm", BatchExpiry: "2999-01-01", Quantity: 100})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+                {PrescriptionId: "RX1", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "500mg", Status: "Active", Quantity: 10},
+            }})
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeDispense)
+
+            dispensation := `{"patientId":"P1","prescriptionId":"RX1","pharmacistId":"PH1","batchNumber":"B1","batchExpiry":"` + tt.batchExpiry + `","manufacturer":"` + tt.manufacturer + `"}`
+            err := ledger.submit(pharmacist("ph-mwale"), func(ctx contractapi.TransactionContextInterface) error {
+                return (&SmartContract{}).DispensePrescription(ctx, dispensation)
+            })
+            ctx, _ := ledger.context(regulator("reg-kalua"))
+            traced, traceErr := (&SmartContract{}).FindPatientsByBatch(ctx, "AMOX", "B1")
+            require.NoError(t, traceErr)
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+                require.Empty(t, traced)
+                return
+            }
+            require.NoError(t, err)
+            dispensed := ledger.prescription("P1", "RX1")
+            require.Equal(t, "2999-01-01", dispensed.BatchExpiry)
+            require.Equal(t, "Medopharm", dispensed.BatchManufacturer)
+            require.Len(t, traced, 1)
+            require.Equal(t, "RX1", traced[0].PrescriptionId)
+        })
+    }
+}
@@ -0,0 +1,222 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const breakGlassObjectType = "breakglass"
+
+// breakGlassWindow is how long a break-glass grant allows the caller to read the patient's record
+const breakGlassWindow = 4 * time.Hour
+
+// minJustificationLength keeps justifications from being a single word
+const minJustificationLength = 15
+
+// BreakGlassRecord is an immutable record of an emergency access to a patient's record
+type BreakGlassRecord struct {
+    PatientId     string `json:"PatientId"`
+    CallerId      string `json:"CallerId"`   // client identity of the clinician
+    CallerMSP     string `json:"CallerMSP"`
+    CallerRole    string `json:"CallerRole"`
+    FacilityId    string `json:"FacilityId"`
+    Justification string `json:"Justification"`
+    AccessedAt    string `json:"AccessedAt"`
+    ExpiresAt     string `json:"ExpiresAt"`  // end of the time-limited read grant
+    TxID          string `json:"TxID"`
+}
+
+// BreakGlassRead - emergency access to a patient's active medications without their consent.
+// The access is recorded permanently with the caller's identity and justification, and the
+// caller may read the full record until the grant expires.
+func (s *SmartContract) BreakGlassRead(ctx contractapi.TransactionContextInterface, patientId string, justification string) ([]Prescription, error) {
+    justification = strings.TrimSpace(justification)
+    if len(justification) < minJustificationLength {
+        return nil, fmt.Errorf("a justification of at least %d characters is required for break-glass access", minJustificationLength)
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if !isPrescriberRole(role) {
+        return nil, fmt.Errorf("only clinicians can use break-glass access")
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get MSP ID: %v", err)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    record := BreakGlassRecord{
+        PatientId:     patientId,
+        CallerId:      callerId,
+        CallerMSP:     mspID,
+        CallerRole:    role,
+        FacilityId:    facilityId,
+        Justification: justification,
+        AccessedAt:    now.Format(time.RFC3339),
+        ExpiresAt:     now.Add(breakGlassWindow).Format(time.RFC3339),
+        TxID:          ctx.GetStub().GetTxID(),
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(breakGlassObjectType, []string{patientId, record.TxID})
+    if err != nil {
+        return nil, err
+    }
+    recordJSON, err := json.Marshal(record)
+    if err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+        return nil, err
+    }
+    if err := s.recordAccess(ctx, patientId, role, "break-glass: "+justification, true); err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().SetEvent("BreakGlassAccess", recordJSON); err != nil {
+        return nil, fmt.Errorf("failed to set event: %v", err)
+    }
+
+    active := []Prescription{}
+    for _, prescription := range asset.Prescriptions {
+        if prescription.Status == "Active" {
+            active = append(active, prescription)
+        }
+    }
+
+    return active, nil
+}
+
+// GetBreakGlassRecords - regulator query listing every break-glass access in a date range for review
+func (s *SmartContract) GetBreakGlassRecords(ctx contractapi.TransactionContextInterface, startDate string, endDate string) ([]*BreakGlassRecord, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator {
+        return nil, fmt.Errorf("only regulators can review break-glass access")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    start, end, err := parseDateRange(startDate, endDate, now)
+    if err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(breakGlassObjectType, []string{})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    records := []*BreakGlassRecord{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var record BreakGlassRecord
+        if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+            return nil, err
+        }
+        accessedAt, err := time.Parse(time.RFC3339, record.AccessedAt)
+        if err != nil || accessedAt.Before(start) || !accessedAt.Before(end) {
+            continue
+        }
+        records = append(records, &record)
+    }
+
+    sort.Slice(records, func(i, j int) bool {
+        return records[i].AccessedAt < records[j].AccessedAt
+    })
+
+    return records, nil
+}
+
+// hasActiveBreakGlass reports whether the caller holds an unexpired break-glass grant for the patient
+func (s *SmartContract) hasActiveBreakGlass(ctx contractapi.TransactionContextInterface, patientId string, callerId string) (bool, error) {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(breakGlassObjectType, []string{patientId})
+    if err != nil {
+        return false, err
+    }
+    defer iterator.Close()
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return false, err
+    }
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return false, err
+        }
+
+        var record BreakGlassRecord
+        if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+            return false, err
+        }
+        if record.CallerId != callerId {
+            continue
+        }
+        expiresAt, err := time.Parse(time.RFC3339, record.ExpiresAt)
+        if err == nil && now.Before(expiresAt) {
+            return true, nil
+        }
+    }
+
+    return false, nil
+}
+
+// parseDateRange parses an inclusive start and end date; an empty end date means now
+func parseDateRange(startDate string, endDate string, now time.Time) (time.Time, time.Time, error) {
+    start := time.Time{}
+    if startDate != "" {
+        parsed, err := parseDate(startDate)
+        if err != nil {
+            return time.Time{}, time.Time{}, fmt.Errorf("invalid start date: %v", err)
+        }
+        start = parsed
+    }
+
+    end := now
+    if endDate != "" {
+        parsed, err := parseDate(endDate)
+        if err != nil {
+            return time.Time{}, time.Time{}, fmt.Errorf("invalid end date: %v", err)
+        }
+        end = parsed
+        // A plain date covers the whole day
+        if len(endDate) == len("2006-01-02") {
+            end = end.AddDate(0, 0, 1)
+        }
+    }
+
+    return start, end, nil
+}
@@ -0,0 +1,150 @@
+package chaincode
+
+import (
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+// breakGlassLedger holds a record for P1, who has given no consent to anyone, with one active and one dispensed
+// prescription
+func breakGlassLedger(t *testing.T) *testLedger {
+    ledger := newTestLedger(t)
+    ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+        {PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC1"},
+        {PrescriptionId: "RX2", MedicationName: "Paracetamol", Status: "Dispensed"},
+    }})
+    return ledger
+}
+
+func TestBreakGlassRead(t *testing.T) {
+    tests := []struct {
+        name          string
+        caller        *testIdentity
+        justification string
+        wantErr       string
+    }{
+        {name: "clinician with justification", caller: doctor("dr-banda"), justification: "Unconscious patient in casualty"},
+        {name: "short justification", caller: doctor("dr-banda"), justification: "emergency", wantErr: "justification of at least 15 characters"},
+        {name: "padded short justification", caller: doctor("dr-banda"), justification: "   emergency          ", wantErr: "justification of at least 15 characters"},
+        {name: "pharmacist", caller: pharmacist("ph-mwale"), justification: "Unconscious patient in casualty", wantErr: "only clinicians"},
+        {name: "patient", caller: patient("P1"), justification: "Unconscious patient in casualty", wantErr: "only clinicians"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := breakGlassLedger(t)
+            var active []Prescription
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                var err error
+                active, err = (&SmartContract{}).BreakGlassRead(ctx, "P1", tt.justification)
+                return err
+            })
+
+            ctx, _ := ledger.context(regulator("reg-kalua"))
+            records, recordsErr := (&SmartContract{}).GetBreakGlassRecords(ctx, "", "")
+            require.NoError(t, recordsErr)
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Empty(t, records)
+                return
+            }
+            require.NoError(t, err)
+            require.Len(t, active, 1)
+            require.Equal(t, "RX1", active[0].PrescriptionId)
+            require.Len(t, records, 1)
+            require.Equal(t, tt.caller.id, records[0].CallerId)
+            require.Equal(t, tt.justification, records[0].Justification)
+        })
+    }
+}
+
+func TestBreakGlassGrantsReadForFourHours(t *testing.T) {
+    clinician := doctor("dr-banda")
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        after   time.Duration // time since the break-glass access
+        scopes  []string
+        wantErr bool
+    }{
+        {name: "read within the window", caller: clinician, after: time.Minute, scopes: []string{ScopeRead}},
+        {name: "read near the end of the window", caller: clinician, after: breakGlassWindow - time.Minute, scopes: []string{ScopeRead}},
+        {name: "read after the window", caller: clinician, after: breakGlassWindow, scopes: []string{ScopeRead}, wantErr: true},
+        {name: "prescribe within the window", caller: clinician, after: time.Minute, scopes: []string{ScopePrescribe}, wantErr: true},
+        {name: "dispense within the window", caller: clinician, after: time.Minute, scopes: []string{ScopeDispense}, wantErr: true},
+        {name: "another clinician", caller: doctor("dr-phiri"), after: time.Minute, scopes: []string{ScopeRead}, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := breakGlassLedger(t)
+            ledger.mustSubmit(clinician, func(ctx contractapi.TransactionContextInterface) error {
+                _, err := contract.BreakGlassRead(ctx, "P1", "Unconscious patient in casualty")
+                return err
+            })
+            ledger.clock = ledger.clock.Add(tt.after)
+
+            ctx, _ := ledger.context(tt.caller)
+            err := contract.requireConsent(ctx, "P1", tt.scopes...)
+            if tt.wantErr {
+                require.ErrorIs(t, err, ErrConsentDenied)
+            } else {
+                require.NoError(t, err)
+            }
+        })
+    }
+}
+
+func TestBreakGlassDoesNotAllowWrites(t *testing.T) {
+    clinician := doctor("dr-banda")
+    ledger := breakGlassLedger(t)
+    ledger.mustSubmit(clinician, func(ctx contractapi.TransactionContextInterface) error {
+        _, err := (&SmartContract{}).BreakGlassRead(ctx, "P1", "Unconscious patient in casualty")
+        return err
+    })
+
+    err := ledger.submit(clinician, func(ctx contractapi.TransactionContextInterface) error {
+        return (&SmartContract{}).RevokePrescriptionJSON(ctx, `{"patientId":"P1","prescriptionId":"RX1","doctorId":"DOC1"}`)
+    })
+    require.ErrorIs(t, err, ErrConsentDenied)
+    require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+}
+
+func TestGetBreakGlassRecordsIsRegulatorOnly(t *testing.T) {
+    ledger := breakGlassLedger(t)
+    ledger.mustSubmit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+        _, err := (&SmartContract{}).BreakGlassRead(ctx, "P1", "Unconscious patient in casualty")
+        return err
+    })
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        wantErr string
+    }{
+        {name: "regulator", caller: regulator("reg-kalua")},
+        {name: "clinician", caller: doctor("dr-banda"), wantErr: "only regulators"},
+        {name: "admin", caller: admin("admin-banda"), wantErr: "only regulators"},
+        {name: "pharmacist", caller: pharmacist("ph-mwale"), wantErr: "only regulators"},
+        {name: "patient", caller: patient("P1"), wantErr: "only regulators"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ctx, _ := ledger.context(tt.caller)
+            records, err := (&SmartContract{}).GetBreakGlassRecords(ctx, "", "")
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+            require.Len(t, records, 1)
+            require.Equal(t, "P1", records[0].PatientId)
+        })
+    }
+}
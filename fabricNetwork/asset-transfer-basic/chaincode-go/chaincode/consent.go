@@ -0,0 +1,363 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// Consent scopes a patient can grant
+const (
+    ScopeRead      = "read"
+    ScopePrescribe = "prescribe"
+    ScopeDispense  = "dispense"
+)
+
+// Grantee types for a consent record
+const (
+    GranteePractitioner = "practitioner"
+    GranteeFacility     = "facility"
+)
+
+const consentObjectType = "consent"
+
+// ErrConsentDenied is returned when the caller holds no active consent for the requested scope
+var ErrConsentDenied = errors.New("consent denied")
+
+// Consent records a patient's permission for a practitioner or facility to access their record
+type Consent struct {
+    ConsentId   string   `json:"ConsentId"`
+    PatientId   string   `json:"PatientId"`
+    GranteeType string   `json:"GranteeType"`           // practitioner or facility
+    GranteeId   string   `json:"GranteeId"`             // prescriber ID of a practitioner, or a facility ID
+    Scopes      []string `json:"Scopes"`                // read, prescribe, dispense
+    StartDate   string   `json:"StartDate"`             // YYYY-MM-DD or RFC3339
+    ExpiryDate  string   `json:"ExpiryDate,omitempty"`  // YYYY-MM-DD or RFC3339, open-ended if empty
+    Status      string   `json:"Status"`                // Active, Revoked
+    GrantedBy   string   `json:"GrantedBy"`             // identity of the patient or proxy who granted it
+    GrantedAt   string   `json:"GrantedAt"`
+    RevokedBy   string   `json:"RevokedBy,omitempty"`
+    RevokedAt   string   `json:"RevokedAt,omitempty"`
+    TxID        string   `json:"TxID"`
+}
+
+// GrantConsent - allows a patient, or their proxy, to grant a practitioner or facility access to their record
+func (s *SmartContract) GrantConsent(ctx contractapi.TransactionContextInterface, consentJSON string) (*Consent, error) {
+    var consent Consent
+    err := json.Unmarshal([]byte(consentJSON), &consent)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse consent JSON: %v", err)
+    }
+
+    if consent.PatientId == "" || consent.GranteeId == "" {
+        return nil, fmt.Errorf("patientId and granteeId are required")
+    }
+    if consent.GranteeType != GranteePractitioner && consent.GranteeType != GranteeFacility {
+        return nil, fmt.Errorf("granteeType must be '%s' or '%s'", GranteePractitioner, GranteeFacility)
+    }
+    if len(consent.Scopes) == 0 {
+        return nil, fmt.Errorf("at least one scope is required")
+    }
+    for _, scope := range consent.Scopes {
+        if scope != ScopeRead && scope != ScopePrescribe && scope != ScopeDispense {
+            return nil, fmt.Errorf("invalid scope '%s'", scope)
+        }
+    }
+
+    grantor, err := s.requirePatientOrProxy(ctx, consent.PatientId)
+    if err != nil {
+        return nil, err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if consent.StartDate == "" {
+        consent.StartDate = now.Format(time.RFC3339)
+    }
+    start, err := parseDate(consent.StartDate)
+    if err != nil {
+        return nil, fmt.Errorf("invalid start date: %v", err)
+    }
+    if consent.ExpiryDate != "" {
+        expiry, err := parseDate(consent.ExpiryDate)
+        if err != nil {
+            return nil, fmt.Errorf("invalid expiry date: %v", err)
+        }
+        if !expiry.After(start) {
+            return nil, fmt.Errorf("expiry date must be after start date")
+        }
+    }
+
+    if consent.ConsentId == "" {
+        consent.ConsentId = ctx.GetStub().GetTxID()
+    }
+    key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{consent.PatientId, consent.ConsentId})
+    if err != nil {
+        return nil, err
+    }
+    existing, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil {
+        return nil, fmt.Errorf("consent %s already exists", consent.ConsentId)
+    }
+
+    consent.Status = "Active"
+    consent.GrantedBy = grantor
+    consent.GrantedAt = now.Format(time.RFC3339)
+    consent.RevokedBy = ""
+    consent.RevokedAt = ""
+    consent.TxID = ctx.GetStub().GetTxID()
+
+    consentBytes, err := json.Marshal(consent)
+    if err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().PutState(key, consentBytes); err != nil {
+        return nil, err
+    }
+
+    return &consent, nil
+}
+
+// RevokeConsent - allows a patient, or their proxy, to withdraw a previously granted consent
+func (s *SmartContract) RevokeConsent(ctx contractapi.TransactionContextInterface, patientId string, consentId string) error {
+    revoker, err := s.requirePatientOrProxy(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{patientId, consentId})
+    if err != nil {
+        return err
+    }
+    consentBytes, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if consentBytes == nil {
+        return fmt.Errorf("consent %s does not exist", consentId)
+    }
+
+    var consent Consent
+    if err := json.Unmarshal(consentBytes, &consent); err != nil {
+        return err
+    }
+    if consent.Status != "Active" {
+        return fmt.Errorf("consent %s is not active", consentId)
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    consent.Status = "Revoked"
+    consent.RevokedBy = revoker
+    consent.RevokedAt = now.Format(time.RFC3339)
+    consent.TxID = ctx.GetStub().GetTxID()
+
+    consentBytes, err = json.Marshal(consent)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, consentBytes)
+}
+
+// GetConsents - lists all consent records for a patient, visible only to the patient or their proxy
+func (s *SmartContract) GetConsents(ctx contractapi.TransactionContextInterface, patientId string) ([]*Consent, error) {
+    if _, err := s.requirePatientOrProxy(ctx, patientId); err != nil {
+        return nil, err
+    }
+    return s.listConsents(ctx, patientId)
+}
+
+// listConsents reads every consent record stored for a patient
+func (s *SmartContract) listConsents(ctx contractapi.TransactionContextInterface, patientId string) ([]*Consent, error) {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentObjectType, []string{patientId})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    consents := []*Consent{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var consent Consent
+        if err := json.Unmarshal(queryResponse.Value, &consent); err != nil {
+            return nil, err
+        }
+        consents = append(consents, &consent)
+    }
+
+    return consents, nil
+}
+
+// requireConsent checks that the caller may act on the patient's record with at least one of the given scopes.
+// The patient and their proxies can always read the record but never prescribe or dispense; everyone else needs
+// an active, unexpired consent. A practitioner consent only matches a caller enrolled under their own identity
+// with a "prescriberId" attribute; a client identity shared by several clinicians, such as the REST server's,
+// carries none and is only ever granted access through facility consents.
+func (s *SmartContract) requireConsent(ctx contractapi.TransactionContextInterface, patientId string, scopes ...string) error {
+    if s.isPatientOrProxy(ctx, patientId) {
+        for _, wanted := range scopes {
+            if wanted == ScopeRead {
+                return nil
+            }
+        }
+        return fmt.Errorf("%w: patients and their proxies cannot act with %s scope", ErrConsentDenied, strings.Join(scopes, "/"))
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+    practitionerId, _, err := ctx.GetClientIdentity().GetAttributeValue("prescriberId")
+    if err != nil {
+        return fmt.Errorf("failed to get prescriberId attribute: %v", err)
+    }
+
+    // An unexpired break-glass grant allows the clinician to read the record
+    for _, wanted := range scopes {
+        if wanted != ScopeRead {
+            continue
+        }
+        active, err := s.hasActiveBreakGlass(ctx, patientId, callerId)
+        if err != nil {
+            return err
+        }
+        if active {
+            return nil
+        }
+    }
+
+    consents, err := s.listConsents(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    for _, consent := range consents {
+        if !consent.isActiveAt(now) {
+            continue
+        }
+        if consent.GranteeType == GranteePractitioner && (practitionerId == "" || consent.GranteeId != practitionerId) {
+            continue
+        }
+        if consent.GranteeType == GranteeFacility && consent.GranteeId != facilityId {
+            continue
+        }
+        for _, granted := range consent.Scopes {
+            for _, wanted := range scopes {
+                if granted == wanted {
+                    return nil
+                }
+            }
+        }
+    }
+
+    return fmt.Errorf("%w: no active %s consent from patient %s", ErrConsentDenied, strings.Join(scopes, "/"), patientId)
+}
+
+// isActiveAt reports whether the consent is in force at the given time
+func (c *Consent) isActiveAt(now time.Time) bool {
+    if c.Status != "Active" {
+        return false
+    }
+    start, err := parseDate(c.StartDate)
+    if err != nil || now.Before(start) {
+        return false
+    }
+    if c.ExpiryDate != "" {
+        expiry, err := parseDate(c.ExpiryDate)
+        if err != nil || !now.Before(expiry) {
+            return false
+        }
+    }
+    return true
+}
+
+// requirePatientOrProxy returns the caller's identity if the caller is the patient or one of their proxies
+func (s *SmartContract) requirePatientOrProxy(ctx contractapi.TransactionContextInterface, patientId string) (string, error) {
+    if !s.isPatientOrProxy(ctx, patientId) {
+        return "", fmt.Errorf("only patient %s or their proxy can perform this action", patientId)
+    }
+    return ctx.GetClientIdentity().GetID()
+}
+
+// isPatientOrProxy checks the certificate attributes of a caller with the patient role: "patientId"
+// identifies the patient themselves, and "proxyFor" holds a comma-separated list of patient IDs the
+// caller may act for.
+func (s *SmartContract) isPatientOrProxy(ctx contractapi.TransactionContextInterface, patientId string) bool {
+    role, err := s.GetUserRole(ctx)
+    if err != nil || role != RolePatient {
+        return false
+    }
+
+    ownId, ok, err := ctx.GetClientIdentity().GetAttributeValue("patientId")
+    if err == nil && ok && ownId == patientId {
+        return true
+    }
+
+    proxyFor, ok, err := ctx.GetClientIdentity().GetAttributeValue("proxyFor")
+    if err == nil && ok {
+        for _, id := range strings.Split(proxyFor, ",") {
+            if strings.TrimSpace(id) == patientId {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// getCallerFacility returns the caller's "facilityId" certificate attribute, falling back to the MSP ID
+func getCallerFacility(ctx contractapi.TransactionContextInterface) (string, error) {
+    facilityId, ok, err := ctx.GetClientIdentity().GetAttributeValue("facilityId")
+    if err != nil {
+        return "", fmt.Errorf("failed to get facilityId attribute: %v", err)
+    }
+    if ok && facilityId != "" {
+        return facilityId, nil
+    }
+
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return "", fmt.Errorf("failed to get MSP ID: %v", err)
+    }
+    return mspID, nil
+}
+
+// txTime returns the transaction's timestamp. Every endorser sees the same value, unlike the peer's clock, so it is
+// used for every time the chaincode stores or decides on.
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+    }
+    return timestamp.AsTime().UTC(), nil
+}
+
+// parseDate accepts either an RFC3339 timestamp or a plain YYYY-MM-DD date
+func parseDate(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", value)
+}
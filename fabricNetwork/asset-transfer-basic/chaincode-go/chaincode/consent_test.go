@@ -0,0 +1,224 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRequireConsent(t *testing.T) {
+    practitioner := newIdentity("dr-banda", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH", "prescriberId": "DOC7"})
+    shared := newIdentity("User1", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH"})
+    other := doctor("dr-phiri")
+    pharmacy := pharmacist("ph-mwale")
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        scopes  []string
+        wantErr bool
+    }{
+        {name: "patient reads own record", caller: patient("P1"), scopes: []string{ScopeRead}},
+        {name: "patient cannot prescribe", caller: patient("P1"), scopes: []string{ScopePrescribe}, wantErr: true},
+        {name: "patient cannot dispense", caller: patient("P1"), scopes: []string{ScopeDispense}, wantErr: true},
+        {name: "patient passes a read-or-prescribe check", caller: patient("P1"), scopes: []string{ScopeRead, ScopePrescribe}},
+        {name: "patient cannot read another record", caller: patient("P2"), scopes: []string{ScopeRead}, wantErr: true},
+        {name: "proxy reads", caller: proxy("guardian", "P9, P1"), scopes: []string{ScopeRead}},
+        {name: "proxy cannot prescribe", caller: proxy("guardian", "P1"), scopes: []string{ScopePrescribe}, wantErr: true},
+        {name: "practitioner consent allows read", caller: practitioner, scopes: []string{ScopeRead}},
+        {name: "practitioner consent does not allow prescribe", caller: practitioner, scopes: []string{ScopePrescribe}, wantErr: true},
+        {name: "shared identity does not match a practitioner consent", caller: shared, scopes: []string{ScopeRead}, wantErr: true},
+        {name: "facility consent allows prescribe", caller: other, scopes: []string{ScopePrescribe}},
+        {name: "pharmacy consent allows dispense", caller: pharmacy, scopes: []string{ScopeDispense}},
+        {name: "no consent", caller: newIdentity("dr-tembo", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "ZCH"}), scopes: []string{ScopeRead}, wantErr: true},
+    }
+
+    ledger := newTestLedger(t)
+    ledger.grantConsent("P1", GranteePractitioner, "DOC7", ScopeRead)
+    ledger.grantConsent("P1", GranteePractitioner, shared.id, ScopeRead) // a client identity ID is not a practitioner
+    ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+    ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeDispense)
+    contract := &SmartContract{}
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ctx, _ := ledger.context(tt.caller)
+            err := contract.requireConsent(ctx, "P1", tt.scopes...)
+            if tt.wantErr {
+                require.ErrorIs(t, err, ErrConsentDenied)
+            } else {
+                require.NoError(t, err)
+            }
+        })
+    }
+}
+
+func TestRequireConsentIgnoresInactiveConsents(t *testing.T) {
+    practitioner := newIdentity("dr-banda", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH", "prescriberId": "DOC7"})
+    tests := []struct {
+        name    string
+        consent Consent
+    }{
+        {name: "revoked", consent: Consent{Status: "Revoked", StartDate: "2000-01-01"}},
+        {name: "expired", consent: Consent{Status: "Active", StartDate: "2000-01-01", ExpiryDate: "2001-01-01"}},
+        {name: "not yet started", consent: Consent{Status: "Active", StartDate: "2999-01-01"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            consent := tt.consent
+            consent.ConsentId, consent.PatientId = "C1", "P1"
+            consent.GranteeType, consent.GranteeId = GranteePractitioner, "DOC7"
+            consent.Scopes = []string{ScopeRead}
+            ledger.putComposite(consentObjectType, []string{"P1", "C1"}, consent)
+
+            ctx, _ := ledger.context(practitioner)
+            require.ErrorIs(t, (&SmartContract{}).requireConsent(ctx, "P1", ScopeRead), ErrConsentDenied)
+        })
+    }
+}
+
+func TestPatientCannotChangeOwnPrescriptions(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ledger := newTestLedger(t)
+    ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+        {PrescriptionId: "RX1", Status: "Active", CreatedBy: "DOC1", IssuedBy: prescriber.id, Quantity: 10},
+    }})
+    ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+    contract := &SmartContract{}
+
+    err := ledger.submit(patient("P1"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.UpdatePrescription(ctx, "P1", `{"PrescriptionId":"RX1","Status":"Active","Quantity":100}`)
+    })
+    require.ErrorContains(t, err, "only prescribers")
+
+    err = ledger.submit(patient("P1"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.RevokePrescriptionJSON(ctx, `{"patientId":"P1","prescriptionId":"RX1","doctorId":"DOC1"}`)
+    })
+    require.ErrorContains(t, err, "only prescribers")
+
+    err = ledger.submit(patient("P1"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.DispensePrescription(ctx, `{"patientId":"P1","prescriptionId":"RX1","pharmacistId":"P1","batchNumber":"B1"}`)
+    })
+    require.Error(t, err)
+    require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+}
+
+func TestRevokeRequiresIssuingIdentity(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ledger := newTestLedger(t)
+    ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+        {PrescriptionId: "RX1", Status: "Active", CreatedBy: "DOC1", IssuedBy: prescriber.id},
+    }})
+    ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+    contract := &SmartContract{}
+    revoke := func(ctx contractapi.TransactionContextInterface) error {
+        return contract.RevokePrescriptionJSON(ctx, `{"patientId":"P1","prescriptionId":"RX1","doctorId":"DOC1"}`)
+    }
+
+    require.ErrorContains(t, ledger.submit(doctor("dr-phiri"), revoke), "only the prescribing doctor")
+    ledger.mustSubmit(prescriber, revoke)
+
+    revoked := ledger.prescription("P1", "RX1")
+    require.Equal(t, "Revoked", revoked.Status)
+    require.Equal(t, revoked.Timestamp, revoked.RevokedAt)
+}
+
+func TestLegacyPrescriptionChangedByItsPrescriber(t *testing.T) {
+    ca := newTestCA(t, "ca.org1")
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name       string
+        issuedBy   string // empty for a legacy prescription
+        signer     string // prescriber ID an update is signed with
+        revokeAs   string // doctorId named by a revocation, instead of an update
+        wantErr    string
+        wantStatus string
+        wantDosage string
+    }{
+        {name: "legacy update signed by the prescriber", signer: "DOC1", wantStatus: "Active", wantDosage: "1 capsule"},
+        {name: "legacy update signed by another prescriber", signer: "DOC2", wantErr: "is not enrolled for prescriber DOC1"},
+        {name: "legacy revocation by the prescriber", revokeAs: "DOC1", wantStatus: "Revoked", wantDosage: "2 capsules"},
+        {name: "legacy revocation naming another prescriber", revokeAs: "DOC2", wantErr: "only the prescribing doctor"},
+        {name: "update by another issuing identity", issuedBy: "x509::CN=dr-phiri", signer: "DOC1", wantErr: "only the prescribing doctor"},
+        {name: "revocation by another issuing identity", issuedBy: "x509::CN=dr-phiri", revokeAs: "DOC1", wantErr: "only the prescribing doctor"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg", "500mg"}, DosageForms: []string{"capsule"}})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "250mg", DosageForm: "capsule",
+                Dosage: "2 capsules", Status: "Active", CreatedBy: "DOC1", IssuedBy: tt.issuedBy,
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.trustSigners("Org1MSP", ca)
+
+            var err error
+            if tt.revokeAs != "" {
+                err = ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+                    return contract.RevokePrescriptionJSON(ctx, `{"patientId":"P1","prescriptionId":"RX1","doctorId":"`+tt.revokeAs+`"}`)
+                })
+            } else {
+                err = ledger.submit(doctor("dr-banda"), updatePrescription(t, contract, ca.prescriber(tt.signer),
+                    `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"500mg","DosageForm":"capsule","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`))
+            }
+            prescription := ledger.prescription("P1", "RX1")
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, "Active", prescription.Status)
+                require.Equal(t, "2 capsules", prescription.Dosage)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.wantStatus, prescription.Status)
+            require.Equal(t, tt.wantDosage, prescription.Dosage)
+            require.Equal(t, tt.issuedBy, prescription.IssuedBy)
+        })
+    }
+}
+
+func TestAccessWindowsUseTransactionTime(t *testing.T) {
+    clinician := doctor("dr-banda")
+    ledger := newTestLedger(t)
+    ledger.clock = time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+    ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{}})
+    ledger.putComposite(consentObjectType, []string{"P1", "C1"}, Consent{
+        ConsentId: "C1", PatientId: "P1", GranteeType: GranteeFacility, GranteeId: "MZH", Scopes: []string{ScopeRead},
+        StartDate: "2024-05-01T08:00:00Z", ExpiryDate: "2024-05-01T09:00:00Z", Status: "Active",
+    })
+    contract := &SmartContract{}
+
+    ledger.mustSubmit(clinician, func(ctx contractapi.TransactionContextInterface) error {
+        _, err := contract.BreakGlassRead(ctx, "P1", "Unconscious patient in casualty")
+        return err
+    })
+    var record BreakGlassRecord
+    for key, value := range ledger.state {
+        if strings.HasPrefix(key, "\x00"+breakGlassObjectType) {
+            require.NoError(t, json.Unmarshal(value, &record))
+        }
+    }
+    require.Equal(t, "2024-05-01T08:00:00Z", record.AccessedAt)
+    require.Equal(t, "2024-05-01T12:00:00Z", record.ExpiresAt)
+
+    readAt := func(caller *testIdentity, at time.Time) error {
+        ledger.clock = at
+        ctx, _ := ledger.context(caller)
+        return contract.requireConsent(ctx, "P1", ScopeRead)
+    }
+    require.NoError(t, readAt(clinician, time.Date(2024, 5, 1, 11, 59, 59, 0, time.UTC)))
+    require.ErrorIs(t, readAt(clinician, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)), ErrConsentDenied)
+
+    facilityClinician := newIdentity("dr-phiri", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH"})
+    require.ErrorIs(t, readAt(facilityClinician, time.Date(2024, 5, 1, 7, 59, 59, 0, time.UTC)), ErrConsentDenied)
+    require.NoError(t, readAt(facilityClinician, time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)))
+    require.ErrorIs(t, readAt(facilityClinician, time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)), ErrConsentDenied)
+}
@@ -0,0 +1,295 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const controlledRegisterObjectType = "cdregister"
+
+// Controlled drugs register entry types
+const (
+    RegisterReceived   = "Received"
+    RegisterPrescribed = "Prescribed"
+    RegisterDispensed  = "Dispensed"
+)
+
+// ControlledDrug is a narcotic or psychotropic medicine with its schedule and per-prescription limit
+type ControlledDrug struct {
+    MedicationCode string `json:"MedicationCode,omitempty"` // formulary code; matched before the name
+    MedicationName string `json:"MedicationName"`
+    Schedule       string `json:"Schedule"`       // controlled drug schedule, e.g. "Schedule II"
+    MaxQuantity    int    `json:"MaxQuantity"`    // largest quantity a single prescription may carry
+    Unit           string `json:"Unit,omitempty"` // e.g. tablets, ml
+}
+
+// ControlledDrugList is the configurable controlled drug schedule held on the ledger
+type ControlledDrugList struct {
+    Drugs     []ControlledDrug `json:"Drugs"`
+    UpdatedBy string           `json:"UpdatedBy,omitempty"`
+    UpdatedAt string           `json:"UpdatedAt,omitempty"`
+    TxID      string           `json:"TxID,omitempty"`
+}
+
+// RegisterEntry is one line of a facility's controlled drugs register. Entries are kept per formulary product,
+// so that prescribing, stock and dispensing entries for the same product share one running balance.
+type RegisterEntry struct {
+    FacilityId     string `json:"FacilityId"`
+    MedicationCode string `json:"MedicationCode"`
+    MedicationName string `json:"MedicationName"`
+    Schedule       string `json:"Schedule"`
+    EntryType      string `json:"EntryType"` // Received, Prescribed, Dispensed
+    QuantityIn     int    `json:"QuantityIn"`
+    QuantityOut    int    `json:"QuantityOut"`
+    PatientId      string `json:"PatientId,omitempty"`
+    PrescriptionId string `json:"PrescriptionId,omitempty"`
+    Reference      string `json:"Reference,omitempty"` // supplier invoice or delivery note for receipts
+    PerformedBy    string `json:"PerformedBy"`
+    Timestamp      string `json:"Timestamp"`
+    TxID           string `json:"TxID"`
+    Balance        int    `json:"Balance"` // running balance, filled in when the register is queried
+}
+
+// GetControlledDrugs - returns the controlled drug schedule
+func (s *SmartContract) GetControlledDrugs(ctx contractapi.TransactionContextInterface) (*ControlledDrugList, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"controlled-drugs"})
+    if err != nil {
+        return nil, err
+    }
+    listJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if listJSON == nil {
+        return &ControlledDrugList{Drugs: []ControlledDrug{}}, nil
+    }
+
+    var list ControlledDrugList
+    if err := json.Unmarshal(listJSON, &list); err != nil {
+        return nil, err
+    }
+    return &list, nil
+}
+
+// SetControlledDrugs - replaces the controlled drug schedule; admins only
+func (s *SmartContract) SetControlledDrugs(ctx contractapi.TransactionContextInterface, listJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin {
+        return fmt.Errorf("only admins can change the controlled drug schedule")
+    }
+
+    var list ControlledDrugList
+    if err := json.Unmarshal([]byte(listJSON), &list); err != nil {
+        return fmt.Errorf("failed to parse controlled drug list JSON: %v", err)
+    }
+    for _, drug := range list.Drugs {
+        if drug.MedicationName == "" || drug.Schedule == "" {
+            return fmt.Errorf("medicationName and schedule are required for every controlled drug")
+        }
+        if drug.MaxQuantity <= 0 {
+            return fmt.Errorf("maxQuantity for %s must be greater than zero", drug.MedicationName)
+        }
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    list.UpdatedBy = callerId
+    list.UpdatedAt = now.Format(time.RFC3339)
+    list.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"controlled-drugs"})
+    if err != nil {
+        return err
+    }
+    listBytes, err := json.Marshal(list)
+    if err != nil {
+        return err
+    }
+    return s.putConfig(ctx, key, listBytes)
+}
+
+// GetControlledDrugsRegister - returns a facility's controlled drugs register with running balances per formulary product.
+// An empty medicationCode returns every controlled medication. Regulators can inspect any facility;
+// pharmacy staff only their own.
+func (s *SmartContract) GetControlledDrugsRegister(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string) ([]*RegisterEntry, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    switch {
+    case role == RoleRegulator:
+    case isDispenserRole(role):
+        callerFacility, err := getCallerFacility(ctx)
+        if err != nil {
+            return nil, err
+        }
+        if callerFacility != facilityId {
+            return nil, fmt.Errorf("pharmacy staff can only view their own facility's register")
+        }
+    default:
+        return nil, fmt.Errorf("only regulators and pharmacy staff can view the controlled drugs register")
+    }
+
+    attributes := []string{facilityId}
+    if medicationCode != "" {
+        attributes = append(attributes, medicationCode)
+    }
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(controlledRegisterObjectType, attributes)
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    entries := []*RegisterEntry{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var entry RegisterEntry
+        if err := json.Unmarshal(queryResponse.Value, &entry); err != nil {
+            return nil, err
+        }
+        entries = append(entries, &entry)
+    }
+
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].Timestamp < entries[j].Timestamp
+    })
+
+    balances := map[string]int{}
+    for _, entry := range entries {
+        balances[entry.MedicationCode] += entry.QuantityIn - entry.QuantityOut
+        entry.Balance = balances[entry.MedicationCode]
+    }
+
+    return entries, nil
+}
+
+// applyControlledDrugRules enforces quantity limits and no refills on a controlled drug prescription
+// and records the issue in the prescriber's register
+func (s *SmartContract) applyControlledDrugRules(ctx contractapi.TransactionContextInterface, patientId string, prescription *Prescription) error {
+    drug, err := s.findControlledDrug(ctx, prescription.MedicationCode, prescription.MedicationName)
+    if err != nil {
+        return err
+    }
+    if drug == nil {
+        prescription.ControlledSchedule = ""
+        return nil
+    }
+
+    if prescription.Quantity <= 0 {
+        return fmt.Errorf("a quantity is required for controlled drug %s", drug.MedicationName)
+    }
+    if prescription.Quantity > drug.MaxQuantity {
+        return fmt.Errorf("quantity %d of %s exceeds the maximum of %d %s per prescription", prescription.Quantity, drug.MedicationName, drug.MaxQuantity, drug.Unit)
+    }
+    if prescription.Refills > 0 {
+        return fmt.Errorf("controlled drug %s cannot be prescribed with refills", drug.MedicationName)
+    }
+    prescription.ControlledSchedule = drug.Schedule
+
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+    return s.writeRegisterEntry(ctx, &RegisterEntry{
+        FacilityId:     facilityId,
+        MedicationCode: prescription.MedicationCode,
+        MedicationName: prescription.MedicationName,
+        Schedule:       drug.Schedule,
+        EntryType:      RegisterPrescribed,
+        PatientId:      patientId,
+        PrescriptionId: prescription.PrescriptionId,
+    })
+}
+
+// recordControlledDispense checks the single-dispense rule and records the dispense of the product taken from
+// stock in the pharmacy's register
+func (s *SmartContract) recordControlledDispense(ctx contractapi.TransactionContextInterface, facilityId string, patientId string, prescription *Prescription, product *FormularyEntry, quantity int) error {
+    if quantity != prescription.Quantity {
+        return fmt.Errorf("controlled drug %s must be dispensed in full in a single dispense (%d prescribed, %d requested)", prescription.MedicationName, prescription.Quantity, quantity)
+    }
+
+    return s.writeRegisterEntry(ctx, &RegisterEntry{
+        FacilityId:     facilityId,
+        MedicationCode: product.Code,
+        MedicationName: product.GenericName,
+        Schedule:       prescription.ControlledSchedule,
+        EntryType:      RegisterDispensed,
+        QuantityOut:    quantity,
+        PatientId:      patientId,
+        PrescriptionId: prescription.PrescriptionId,
+    })
+}
+
+// writeRegisterEntry stamps and stores a controlled drugs register entry
+func (s *SmartContract) writeRegisterEntry(ctx contractapi.TransactionContextInterface, entry *RegisterEntry) error {
+    performedBy, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    entry.PerformedBy = performedBy
+    entry.Timestamp = now.Format(time.RFC3339)
+    entry.TxID = ctx.GetStub().GetTxID()
+    entry.Balance = 0
+
+    key, err := ctx.GetStub().CreateCompositeKey(controlledRegisterObjectType, []string{
+        entry.FacilityId, entry.MedicationCode, entry.TxID, entry.PrescriptionId,
+    })
+    if err != nil {
+        return err
+    }
+    entryJSON, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, entryJSON)
+}
+
+// findControlledDrug returns the schedule entry for the medication, or nil if it is not controlled
+func (s *SmartContract) findControlledDrug(ctx contractapi.TransactionContextInterface, medicationCode string, medicationName string) (*ControlledDrug, error) {
+    list, err := s.GetControlledDrugs(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for i := range list.Drugs {
+        if matchesMedication(list.Drugs[i].MedicationCode, list.Drugs[i].MedicationName, medicationCode, medicationName) {
+            return &list.Drugs[i], nil
+        }
+    }
+    return nil, nil
+}
+
+// matchesMedication compares a configured drug with a prescribed one by formulary code when both have one,
+// otherwise by name
+func matchesMedication(configuredCode string, configuredName string, medicationCode string, medicationName string) bool {
+    if configuredCode != "" && medicationCode != "" {
+        return configuredCode == medicationCode
+    }
+    return normalizeMedicationKey(configuredName) == normalizeMedicationKey(medicationName)
+}
+
+// normalizeMedicationKey gives a case- and whitespace-insensitive key for a medication name
+func normalizeMedicationKey(medicationName string) string {
+    return strings.ToLower(strings.TrimSpace(medicationName))
+}
@@ -0,0 +1,182 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestControlledDrugIsDispensedOnce(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ca := newTestCA(t, "ca.org1")
+    signer := ca.prescriber("DOC1")
+    dispenser := pharmacist("ph-mwale")
+    contract := &SmartContract{}
+    dispense := func(quantity string) func(ctx contractapi.TransactionContextInterface) error {
+        return func(ctx contractapi.TransactionContextInterface) error {
+            return contract.DispensePrescription(ctx, `{"patientId":"P1","prescriptionId":"RX1","pharmacistId":"PH1","batchNumber":"B1","quantity":`+quantity+`}`)
+        }
+    }
+
+    tests := []struct {
+        name    string
+        refused []func(ctx contractapi.TransactionContextInterface) error // run by the prescriber before the second dispense, and refused
+        wantErr string
+    }{
+        {name: "second dispense", wantErr: "can only dispense active prescriptions"},
+        {
+            name:    "update cannot reactivate",
+            refused: []func(ctx contractapi.TransactionContextInterface) error{updatePrescription(t, contract, signer, `{"PrescriptionId":"RX1","MedicationCode":"N02AA01","Status":"Active","Dosage":"10mg at night","Quantity":10,"Strength":"10mg","ExpiryDate":"2999-01-01"}`)},
+            wantErr: "can only dispense active prescriptions",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "N02AA01", AtcCode: "N02AA01", GenericName: "Morphine", Strengths: []string{"10mg"}, DosageForms: []string{"tablet"}})
+            ledger.putStock(StockItem{FacilityId: "KCH-PHARM", MedicationCode: "N02AA01", MedicationName: "Morphine", BatchNumber: "B1", BatchExpiry: "2999-01-01", Quantity: 100})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationCode: "N02AA01", MedicationName: "Morphine", Strength: "10mg",
+                Status: "Active", CreatedBy: "DOC1", IssuedBy: prescriber.id, Quantity: 10, ControlledSchedule: "Schedule 2",
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeDispense)
+            ledger.trustSigners("Org1MSP", ca)
+
+            require.ErrorContains(t, ledger.submit(dispenser, dispense("4")), "in a single dispense")
+            ledger.mustSubmit(dispenser, dispense("10"))
+            dispensed := ledger.prescription("P1", "RX1")
+            require.Equal(t, "Dispensed", dispensed.Status)
+            require.Equal(t, 90, ledger.stock("KCH-PHARM", "N02AA01", "B1").Quantity)
+
+            for _, step := range tt.refused {
+                require.ErrorContains(t, ledger.submit(prescriber, step), "can only update active or pending prescriptions")
+            }
+            updated := ledger.prescription("P1", "RX1")
+            require.Equal(t, "Dispensed", updated.Status)
+            require.Equal(t, "PH1", updated.DispensingPharmacist)
+            require.Equal(t, dispensed.DispensingTimestamp, updated.DispensingTimestamp)
+            require.Equal(t, 10, updated.DispensedQuantity)
+
+            require.ErrorContains(t, ledger.submit(dispenser, dispense("10")), tt.wantErr)
+            require.Equal(t, 90, ledger.stock("KCH-PHARM", "N02AA01", "B1").Quantity)
+        })
+    }
+}
+
+func TestUpdatePrescriptionRevalidatesPresentation(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ca := newTestCA(t, "ca.org1")
+    signer := ca.prescriber("DOC1")
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity // submits the update; the issuing prescriber if nil
+        update  string
+        wantErr string
+    }{
+        {name: "listed strength and form", update: `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"500mg","DosageForm":"capsule","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`},
+        {name: "unlisted strength", update: `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"5g","DosageForm":"capsule","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`, wantErr: "strength 5g is not listed"},
+        {name: "unlisted dosage form", update: `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"500mg","DosageForm":"injection","Dosage":"1 vial","ExpiryDate":"2999-01-01"}`, wantErr: "dosage form injection is not listed"},
+        {name: "status in the payload is ignored", update: `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"250mg","Status":"Revoked","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`},
+        {name: "another doctor", caller: doctor("dr-phiri"), update: `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"500mg","DosageForm":"capsule","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`, wantErr: "only the prescribing doctor can update"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg", "500mg"}, DosageForms: []string{"capsule"}})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "250mg", DosageForm: "capsule",
+                Status: "Active", CreatedBy: "DOC1", IssuedBy: prescriber.id,
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.trustSigners("Org1MSP", ca)
+
+            caller := prescriber
+            if tt.caller != nil {
+                caller = tt.caller
+            }
+            err := ledger.submit(caller, updatePrescription(t, contract, signer, tt.update))
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+        })
+    }
+}
+
+// updatePrescription is an UpdatePrescription transaction on patient P1, signed for prescriber DOC1
+func updatePrescription(t *testing.T, contract *SmartContract, signer *testSigner, prescriptionJSON string) func(ctx contractapi.TransactionContextInterface) error {
+    var prescription Prescription
+    require.NoError(t, json.Unmarshal([]byte(prescriptionJSON), &prescription))
+    prescription.CreatedBy = "DOC1"
+    signer.sign(t, "P1", &prescription)
+    signedJSON, err := json.Marshal(prescription)
+    require.NoError(t, err)
+    return func(ctx contractapi.TransactionContextInterface) error {
+        return contract.UpdatePrescription(ctx, "P1", string(signedJSON))
+    }
+}
+
+func TestControlledRegisterIsKeptPerProduct(t *testing.T) {
+    ca := newTestCA(t, "ca.org1")
+    dispenser := pharmacist("ph-mwale")
+    contract := &SmartContract{}
+
+    ledger := newTestLedger(t)
+    ledger.seedFormulary(FormularyEntry{Code: "MORPH10", AtcCode: "N02AA01", GenericName: "Morphine", Strengths: []string{"10mg"}, DosageForms: []string{"tablet"}})
+    // The controlled list names the drug differently from the formulary
+    ledger.putComposite(configObjectType, []string{"controlled-drugs"}, ControlledDrugList{Drugs: []ControlledDrug{
+        {MedicationCode: "MORPH10", MedicationName: "Morphine sulphate", Schedule: "Schedule 2", MaxQuantity: 30, Unit: "tablets"},
+    }})
+    ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeDispense)
+    ledger.trustSigners("Org1MSP", ca)
+
+    ledger.mustSubmit(dispenser, func(ctx contractapi.TransactionContextInterface) error {
+        _, err := contract.ReceiveStock(ctx, `{"medicationCode":"MORPH10","batchNumber":"B1","batchExpiry":"2999-01-01","quantity":100,"reference":"CMST-1"}`)
+        return err
+    })
+
+    prescription := Prescription{
+        PrescriptionId: "RX1", MedicationCode: "MORPH10", Strength: "10mg", DosageForm: "tablet",
+        Dosage: "10mg at night", Quantity: 10, ExpiryDate: "2999-01-01", CreatedBy: "DOC1",
+    }
+    ca.prescriber("DOC1").sign(t, "P1", &prescription)
+    assetJSON, err := json.Marshal(Asset{PatientId: "P1", PatientName: "Jane Banda", DoctorId: "DOC1", Prescriptions: []Prescription{prescription}})
+    require.NoError(t, err)
+    ledger.mustSubmit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.CreateAsset(ctx, string(assetJSON))
+    })
+    ledger.mustSubmit(dispenser, func(ctx contractapi.TransactionContextInterface) error {
+        return contract.DispensePrescription(ctx, `{"patientId":"P1","prescriptionId":"RX1","pharmacistId":"PH1","batchNumber":"B1","quantity":10}`)
+    })
+
+    ctx, _ := ledger.context(regulator("reg-phiri"))
+    prescribed, err := contract.GetControlledDrugsRegister(ctx, "KCH", "MORPH10")
+    require.NoError(t, err)
+    require.Len(t, prescribed, 1)
+    require.Equal(t, RegisterPrescribed, prescribed[0].EntryType)
+    require.Equal(t, "MORPH10", prescribed[0].MedicationCode)
+
+    pharmacy, err := contract.GetControlledDrugsRegister(ctx, "KCH-PHARM", "MORPH10")
+    require.NoError(t, err)
+    require.Len(t, pharmacy, 2)
+    require.Equal(t, RegisterReceived, pharmacy[0].EntryType)
+    require.Equal(t, 100, pharmacy[0].Balance)
+    require.Equal(t, RegisterDispensed, pharmacy[1].EntryType)
+    require.Equal(t, 90, pharmacy[1].Balance)
+    for _, entry := range pharmacy {
+        require.Equal(t, "MORPH10", entry.MedicationCode)
+    }
+
+    all, err := contract.GetControlledDrugsRegister(ctx, "KCH-PHARM", "")
+    require.NoError(t, err)
+    require.Len(t, all, 2)
+}
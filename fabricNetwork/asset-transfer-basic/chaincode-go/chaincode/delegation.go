@@ -0,0 +1,347 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const delegationObjectType = "delegation"
+
+// AllDrugClasses in a delegation allows the delegate to prescribe any drug class
+const AllDrugClasses = "*"
+
+// Delegation lets a supervised cadre (clinical officer, nurse prescriber) prescribe under a doctor
+type Delegation struct {
+    DelegationId       string   `json:"DelegationId"`
+    DelegatorId        string   `json:"DelegatorId"`        // client identity of the supervising doctor
+    DelegateId         string   `json:"DelegateId"`         // client identity of the delegate
+    AllowedDrugClasses []string `json:"AllowedDrugClasses"` // drug classes the delegate may prescribe, or "*"
+    StartDate          string   `json:"StartDate"`
+    ExpiryDate         string   `json:"ExpiryDate"`
+    Status             string   `json:"Status"` // Active, Revoked
+    CreatedAt          string   `json:"CreatedAt"`
+    RevokedAt          string   `json:"RevokedAt,omitempty"`
+    TxID               string   `json:"TxID"`
+}
+
+// CreateDelegation - allows a doctor to authorize a delegate to prescribe under their supervision
+func (s *SmartContract) CreateDelegation(ctx contractapi.TransactionContextInterface, delegationJSON string) (*Delegation, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleDoctor {
+        return nil, fmt.Errorf("only doctors can delegate prescribing")
+    }
+
+    var delegation Delegation
+    if err := json.Unmarshal([]byte(delegationJSON), &delegation); err != nil {
+        return nil, fmt.Errorf("failed to parse delegation JSON: %v", err)
+    }
+    if delegation.DelegateId == "" || delegation.ExpiryDate == "" {
+        return nil, fmt.Errorf("delegateId and expiryDate are required")
+    }
+    if len(delegation.AllowedDrugClasses) == 0 {
+        return nil, fmt.Errorf("at least one allowed drug class is required")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if delegation.StartDate == "" {
+        delegation.StartDate = now.Format(time.RFC3339)
+    }
+    start, err := parseDate(delegation.StartDate)
+    if err != nil {
+        return nil, fmt.Errorf("invalid start date: %v", err)
+    }
+    expiry, err := parseDate(delegation.ExpiryDate)
+    if err != nil {
+        return nil, fmt.Errorf("invalid expiry date: %v", err)
+    }
+    if !expiry.After(start) {
+        return nil, fmt.Errorf("expiry date must be after start date")
+    }
+
+    delegatorId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    if delegatorId == delegation.DelegateId {
+        return nil, fmt.Errorf("a doctor cannot delegate to themselves")
+    }
+
+    if delegation.DelegationId == "" {
+        delegation.DelegationId = ctx.GetStub().GetTxID()
+    }
+    key, err := ctx.GetStub().CreateCompositeKey(delegationObjectType, []string{delegation.DelegateId, delegation.DelegationId})
+    if err != nil {
+        return nil, err
+    }
+    existing, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil {
+        return nil, fmt.Errorf("delegation %s already exists", delegation.DelegationId)
+    }
+
+    delegation.DelegatorId = delegatorId
+    delegation.Status = "Active"
+    delegation.CreatedAt = now.Format(time.RFC3339)
+    delegation.RevokedAt = ""
+    delegation.TxID = ctx.GetStub().GetTxID()
+
+    delegationBytes, err := json.Marshal(delegation)
+    if err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().PutState(key, delegationBytes); err != nil {
+        return nil, err
+    }
+
+    return &delegation, nil
+}
+
+// RevokeDelegation - allows the supervising doctor to end a delegation early
+func (s *SmartContract) RevokeDelegation(ctx contractapi.TransactionContextInterface, delegateId string, delegationId string) error {
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(delegationObjectType, []string{delegateId, delegationId})
+    if err != nil {
+        return err
+    }
+    delegationBytes, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if delegationBytes == nil {
+        return fmt.Errorf("delegation %s does not exist", delegationId)
+    }
+
+    var delegation Delegation
+    if err := json.Unmarshal(delegationBytes, &delegation); err != nil {
+        return err
+    }
+    if delegation.DelegatorId != callerId {
+        return fmt.Errorf("only the supervising doctor can revoke this delegation")
+    }
+    if delegation.Status != "Active" {
+        return fmt.Errorf("delegation %s is not active", delegationId)
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    delegation.Status = "Revoked"
+    delegation.RevokedAt = now.Format(time.RFC3339)
+    delegation.TxID = ctx.GetStub().GetTxID()
+
+    delegationBytes, err = json.Marshal(delegation)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, delegationBytes)
+}
+
+// GetMyDelegations - lists delegations the caller has been given
+func (s *SmartContract) GetMyDelegations(ctx contractapi.TransactionContextInterface) ([]*Delegation, error) {
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    return s.listDelegations(ctx, callerId)
+}
+
+// GetPendingCountersignatures - lists delegated prescriptions awaiting the caller's countersignature
+func (s *SmartContract) GetPendingCountersignatures(ctx contractapi.TransactionContextInterface) ([]map[string]interface{}, error) {
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    pending := []map[string]interface{}{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            continue
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            continue
+        }
+
+        for _, prescription := range asset.Prescriptions {
+            if prescription.SupervisorId != callerId || prescription.CountersignedAt != "" {
+                continue
+            }
+            pending = append(pending, map[string]interface{}{
+                "PrescriptionId": prescription.PrescriptionId,
+                "PatientId":      asset.PatientId,
+                "MedicationName": prescription.MedicationName,
+                "DrugClass":      prescription.DrugClass,
+                "Dosage":         prescription.Dosage,
+                "Instructions":   prescription.Instructions,
+                "Status":         prescription.Status,
+                "DelegateId":     prescription.DelegateId,
+                "Timestamp":      prescription.Timestamp,
+            })
+        }
+    }
+
+    return pending, nil
+}
+
+// CountersignPrescription - allows the supervising doctor to countersign a delegated prescription while it is
+// active or pending approval
+func (s *SmartContract) CountersignPrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string, note string) error {
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    if err := s.requireConsent(ctx, patientId, ScopePrescribe); err != nil {
+        return err
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    found := false
+    for i := range asset.Prescriptions {
+        if asset.Prescriptions[i].PrescriptionId == prescriptionId {
+            if asset.Prescriptions[i].SupervisorId == "" {
+                return fmt.Errorf("prescription %s was not issued under delegation", prescriptionId)
+            }
+            if asset.Prescriptions[i].SupervisorId != callerId {
+                return fmt.Errorf("only the supervising doctor can countersign this prescription")
+            }
+            if asset.Prescriptions[i].CountersignedAt != "" {
+                return fmt.Errorf("prescription %s is already countersigned", prescriptionId)
+            }
+            // Dispensed, revoked, rejected and expired prescriptions are final
+            if status := asset.Prescriptions[i].Status; status != "Active" && status != StatusPendingApproval {
+                return fmt.Errorf("can only countersign active or pending prescriptions, prescription %s is %s", prescriptionId, status)
+            }
+
+            asset.Prescriptions[i].CountersignedBy = callerId
+            asset.Prescriptions[i].CountersignedAt = now.Format(time.RFC3339)
+            asset.Prescriptions[i].CountersignNote = note
+            found = true
+            break
+        }
+    }
+
+    if !found {
+        return fmt.Errorf("prescription %s not found", prescriptionId)
+    }
+
+    asset.LastUpdated = now.Format(time.RFC3339)
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(patientId, assetJSON)
+}
+
+// applyDelegation checks that a delegate caller holds an active delegation covering the prescription's
+// drug class, and records the delegate and supervising doctor on it
+func (s *SmartContract) applyDelegation(ctx contractapi.TransactionContextInterface, prescription *Prescription) error {
+    delegateId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    if prescription.DrugClass == "" {
+        return fmt.Errorf("drug class is required for delegated prescription %s", prescription.PrescriptionId)
+    }
+
+    delegations, err := s.listDelegations(ctx, delegateId)
+    if err != nil {
+        return err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    for _, delegation := range delegations {
+        if !delegation.isActiveAt(now) || !delegation.allows(prescription.DrugClass) {
+            continue
+        }
+        prescription.DelegateId = delegateId
+        prescription.SupervisorId = delegation.DelegatorId
+        return nil
+    }
+
+    return fmt.Errorf("no active delegation allows prescribing drug class '%s'", prescription.DrugClass)
+}
+
+// listDelegations reads every delegation given to a delegate
+func (s *SmartContract) listDelegations(ctx contractapi.TransactionContextInterface, delegateId string) ([]*Delegation, error) {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(delegationObjectType, []string{delegateId})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    delegations := []*Delegation{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var delegation Delegation
+        if err := json.Unmarshal(queryResponse.Value, &delegation); err != nil {
+            return nil, err
+        }
+        delegations = append(delegations, &delegation)
+    }
+
+    return delegations, nil
+}
+
+// isActiveAt reports whether the delegation is in force at the given time
+func (d *Delegation) isActiveAt(now time.Time) bool {
+    if d.Status != "Active" {
+        return false
+    }
+    start, err := parseDate(d.StartDate)
+    if err != nil || now.Before(start) {
+        return false
+    }
+    expiry, err := parseDate(d.ExpiryDate)
+    return err == nil && now.Before(expiry)
+}
+
+// allows reports whether the delegation covers the drug class
+func (d *Delegation) allows(drugClass string) bool {
+    for _, allowed := range d.AllowedDrugClasses {
+        if allowed == AllDrugClasses || strings.EqualFold(allowed, drugClass) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,63 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestCountersignRequiresConsent(t *testing.T) {
+    supervisor := newIdentity("dr-banda", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "MZH", "prescriberId": "DOC7"})
+    ledger := newTestLedger(t)
+    ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+        {PrescriptionId: "RX1", Status: "Active", DelegateId: "x509::CN=co-phiri", SupervisorId: supervisor.id},
+    }})
+    contract := &SmartContract{}
+    countersign := func(ctx contractapi.TransactionContextInterface) error {
+        return contract.CountersignPrescription(ctx, "P1", "RX1", "Reviewed")
+    }
+
+    require.ErrorIs(t, ledger.submit(supervisor, countersign), ErrConsentDenied)
+    require.Empty(t, ledger.prescription("P1", "RX1").CountersignedAt)
+
+    ledger.grantConsent("P1", GranteePractitioner, "DOC7", ScopePrescribe)
+    ledger.mustSubmit(supervisor, countersign)
+    require.Equal(t, supervisor.id, ledger.prescription("P1", "RX1").CountersignedBy)
+}
+
+func TestCountersignOnlyOpenPrescriptions(t *testing.T) {
+    supervisor := doctor("dr-banda")
+    tests := []struct {
+        status  string
+        wantErr bool
+    }{
+        {status: "Active"},
+        {status: StatusPendingApproval},
+        {status: StatusRejected, wantErr: true},
+        {status: "Revoked", wantErr: true},
+        {status: "Dispensed", wantErr: true},
+        {status: "Expired", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.status, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+                {PrescriptionId: "RX1", Status: tt.status, DelegateId: "x509::CN=co-phiri", SupervisorId: supervisor.id},
+            }})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+
+            err := ledger.submit(supervisor, func(ctx contractapi.TransactionContextInterface) error {
+                return (&SmartContract{}).CountersignPrescription(ctx, "P1", "RX1", "Reviewed")
+            })
+            if tt.wantErr {
+                require.ErrorContains(t, err, "can only countersign active or pending prescriptions")
+                require.Empty(t, ledger.prescription("P1", "RX1").CountersignedAt)
+            } else {
+                require.NoError(t, err)
+                require.Equal(t, supervisor.id, ledger.prescription("P1", "RX1").CountersignedBy)
+            }
+        })
+    }
+}
@@ -0,0 +1,277 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const doseRangeObjectType = "doserange"
+
+// Actions taken when a dose falls outside a band
+const (
+    DoseActionWarn  = "warn"
+    DoseActionBlock = "block"
+)
+
+// DoseBand holds the dose limits for one age band. Per-kg limits apply when the patient's weight is
+// recorded; absolute limits always apply. Zero means no limit.
+type DoseBand struct {
+    MinAgeMonths  int     `json:"MinAgeMonths"`
+    MaxAgeMonths  int     `json:"MaxAgeMonths,omitempty"` // exclusive; 0 means no upper bound
+    MinDailyPerKg float64 `json:"MinDailyPerKg,omitempty"`
+    MaxDailyPerKg float64 `json:"MaxDailyPerKg,omitempty"`
+    MinDaily      float64 `json:"MinDaily,omitempty"`
+    MaxDaily      float64 `json:"MaxDaily,omitempty"`
+    MaxSingle     float64 `json:"MaxSingle,omitempty"`
+    Action        string  `json:"Action"` // warn or block when the maximum is exceeded
+}
+
+// DoseRange holds the dose bands for one formulary medication
+type DoseRange struct {
+    MedicationCode string     `json:"MedicationCode"`
+    Unit           string     `json:"Unit"` // unit the limits are expressed in, e.g. mg
+    Bands          []DoseBand `json:"Bands"`
+    UpdatedBy      string     `json:"UpdatedBy,omitempty"`
+    UpdatedAt      string     `json:"UpdatedAt,omitempty"`
+}
+
+// SetDoseRange - stores the dose bands for a medication; admins and regulators only
+func (s *SmartContract) SetDoseRange(ctx contractapi.TransactionContextInterface, doseRangeJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin && role != RoleRegulator {
+        return fmt.Errorf("only admins and regulators can set dose ranges")
+    }
+
+    var doseRange DoseRange
+    if err := json.Unmarshal([]byte(doseRangeJSON), &doseRange); err != nil {
+        return fmt.Errorf("failed to parse dose range JSON: %v", err)
+    }
+    if doseRange.MedicationCode == "" || doseRange.Unit == "" || len(doseRange.Bands) == 0 {
+        return fmt.Errorf("medicationCode, unit and at least one band are required")
+    }
+    if _, err := s.GetFormularyEntry(ctx, doseRange.MedicationCode); err != nil {
+        return err
+    }
+    for i, band := range doseRange.Bands {
+        if band.Action != DoseActionWarn && band.Action != DoseActionBlock {
+            return fmt.Errorf("band %d: action must be '%s' or '%s'", i, DoseActionWarn, DoseActionBlock)
+        }
+        if band.MaxAgeMonths != 0 && band.MaxAgeMonths <= band.MinAgeMonths {
+            return fmt.Errorf("band %d: maxAgeMonths must be greater than minAgeMonths", i)
+        }
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    doseRange.UpdatedBy = callerId
+    doseRange.UpdatedAt = now.Format(time.RFC3339)
+
+    key, err := ctx.GetStub().CreateCompositeKey(doseRangeObjectType, []string{doseRange.MedicationCode})
+    if err != nil {
+        return err
+    }
+    doseRangeBytes, err := json.Marshal(doseRange)
+    if err != nil {
+        return err
+    }
+    return s.putConfig(ctx, key, doseRangeBytes)
+}
+
+// GetDoseRange - returns the dose bands for a medication, or nil if none are set
+func (s *SmartContract) GetDoseRange(ctx contractapi.TransactionContextInterface, medicationCode string) (*DoseRange, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(doseRangeObjectType, []string{medicationCode})
+    if err != nil {
+        return nil, err
+    }
+    doseRangeJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if doseRangeJSON == nil {
+        return nil, nil
+    }
+
+    var doseRange DoseRange
+    if err := json.Unmarshal(doseRangeJSON, &doseRange); err != nil {
+        return nil, err
+    }
+    return &doseRange, nil
+}
+
+// RecordPatientWeight - records the patient's current weight for weight-based dose checks
+func (s *SmartContract) RecordPatientWeight(ctx contractapi.TransactionContextInterface, patientId string, weightKg float64) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only clinicians can record a patient's weight")
+    }
+    if err := s.requireConsent(ctx, patientId, ScopePrescribe); err != nil {
+        return err
+    }
+    if weightKg <= 0 || weightKg > 500 {
+        return fmt.Errorf("weight of %.1f kg is not plausible", weightKg)
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    timestamp, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    now := timestamp.Format(time.RFC3339)
+    asset.WeightKg = weightKg
+    asset.WeightRecordedAt = now
+    asset.LastUpdated = now
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(patientId, assetJSON)
+}
+
+// checkDose validates a structured dose against the medication's dose bands for the patient's age and weight.
+// Doses over a blocking limit are rejected; other findings are recorded as warnings on the prescription.
+func (s *SmartContract) checkDose(ctx contractapi.TransactionContextInterface, asset *Asset, prescription *Prescription) error {
+    prescription.DoseWarnings = nil
+    if prescription.DoseAmount <= 0 {
+        return nil // unstructured dose, nothing to check
+    }
+    if prescription.DosesPerDay <= 0 {
+        return fmt.Errorf("dosesPerDay is required with a structured dose on prescription %s", prescription.PrescriptionId)
+    }
+
+    doseRange, err := s.GetDoseRange(ctx, prescription.MedicationCode)
+    if err != nil {
+        return err
+    }
+    if doseRange == nil {
+        return nil
+    }
+    if !strings.EqualFold(prescription.DoseUnit, doseRange.Unit) {
+        return fmt.Errorf("dose for %s must be given in %s to be checked, got '%s'", prescription.MedicationName, doseRange.Unit, prescription.DoseUnit)
+    }
+
+    ageMonths := -1
+    if asset.DateOfBirth != "" {
+        dob, err := time.Parse("2006-01-02", asset.DateOfBirth)
+        if err != nil {
+            return fmt.Errorf("invalid date of birth format: %v", err)
+        }
+        now, err := txTime(ctx)
+        if err != nil {
+            return err
+        }
+        ageMonths = monthsBetween(dob, now)
+    }
+
+    band := doseRange.bandFor(ageMonths)
+    if band == nil {
+        if ageMonths < 0 {
+            prescription.DoseWarnings = append(prescription.DoseWarnings, fmt.Sprintf("date of birth not recorded; dose of %s could not be checked against age bands", prescription.MedicationName))
+        }
+        return nil
+    }
+
+    unit := doseRange.Unit
+    daily := prescription.DoseAmount * float64(prescription.DosesPerDay)
+    patient := describePatient(ageMonths, asset.WeightKg)
+
+    maxDaily, maxBasis := band.MaxDaily, fmt.Sprintf("%g %s/day", band.MaxDaily, unit)
+    if band.MaxDailyPerKg > 0 {
+        if asset.WeightKg > 0 {
+            perKg := band.MaxDailyPerKg * asset.WeightKg
+            if maxDaily == 0 || perKg < maxDaily {
+                maxDaily = perKg
+                maxBasis = fmt.Sprintf("%g %s/kg/day x %.1f kg", band.MaxDailyPerKg, unit, asset.WeightKg)
+            }
+        } else {
+            prescription.DoseWarnings = append(prescription.DoseWarnings, fmt.Sprintf("weight not recorded; weight-based limit of %g %s/kg/day for %s was not checked", band.MaxDailyPerKg, unit, prescription.MedicationName))
+        }
+    }
+
+    violations := []string{}
+    if maxDaily > 0 && daily > maxDaily {
+        violations = append(violations, fmt.Sprintf("daily dose of %g %s exceeds the maximum of %.4g %s/day for %s (%s, %s)", daily, unit, maxDaily, unit, prescription.MedicationName, maxBasis, patient))
+    }
+    if band.MaxSingle > 0 && prescription.DoseAmount > band.MaxSingle {
+        violations = append(violations, fmt.Sprintf("single dose of %g %s exceeds the maximum of %g %s for %s (%s)", prescription.DoseAmount, unit, band.MaxSingle, unit, prescription.MedicationName, patient))
+    }
+    if len(violations) > 0 && band.Action == DoseActionBlock {
+        return fmt.Errorf("dose blocked: %s", strings.Join(violations, "; "))
+    }
+    prescription.DoseWarnings = append(prescription.DoseWarnings, violations...)
+
+    minDaily := band.MinDaily
+    if band.MinDailyPerKg > 0 && asset.WeightKg > 0 {
+        minDaily = band.MinDailyPerKg * asset.WeightKg
+    }
+    if minDaily > 0 && daily < minDaily {
+        prescription.DoseWarnings = append(prescription.DoseWarnings, fmt.Sprintf("daily dose of %g %s is below the usual minimum of %.4g %s/day for %s (%s)", daily, unit, minDaily, unit, prescription.MedicationName, patient))
+    }
+
+    return nil
+}
+
+// bandFor returns the band covering the age in months; an unknown age (-1) only matches a band covering all ages
+func (d *DoseRange) bandFor(ageMonths int) *DoseBand {
+    for i := range d.Bands {
+        band := &d.Bands[i]
+        if ageMonths < 0 {
+            if band.MinAgeMonths == 0 && band.MaxAgeMonths == 0 {
+                return band
+            }
+            continue
+        }
+        if ageMonths >= band.MinAgeMonths && (band.MaxAgeMonths == 0 || ageMonths < band.MaxAgeMonths) {
+            return band
+        }
+    }
+    return nil
+}
+
+// monthsBetween returns the number of whole months from a date of birth to now
+func monthsBetween(dob time.Time, now time.Time) int {
+    months := (now.Year()-dob.Year())*12 + int(now.Month()) - int(dob.Month())
+    if now.Day() < dob.Day() {
+        months--
+    }
+    if months < 0 {
+        return 0
+    }
+    return months
+}
+
+// describePatient summarizes the age and weight a dose limit was computed for
+func describePatient(ageMonths int, weightKg float64) string {
+    age := "age unknown"
+    if ageMonths >= 0 {
+        if ageMonths < 24 {
+            age = fmt.Sprintf("patient aged %d months", ageMonths)
+        } else {
+            age = fmt.Sprintf("patient aged %d years", ageMonths/12)
+        }
+    }
+    if weightKg > 0 {
+        return fmt.Sprintf("%s, %.1f kg", age, weightKg)
+    }
+    return age
+}
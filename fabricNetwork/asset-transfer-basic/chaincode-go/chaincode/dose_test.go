@@ -0,0 +1,71 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRecordPatientWeightRoles(t *testing.T) {
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        wantErr string
+    }{
+        {name: "doctor", caller: doctor("dr-banda")},
+        {name: "nurse prescriber", caller: newIdentity("nurse-chirwa", "Org1MSP", map[string]string{"role": RoleNursePrescriber, "facilityId": "KCH"})},
+        {name: "pharmacist", caller: pharmacist("ph-mwale"), wantErr: "only clinicians"},
+        {name: "patient", caller: patient("P1"), wantErr: "only clinicians"},
+        {name: "regulator", caller: regulator("reg-kalua"), wantErr: "only clinicians"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", WeightKg: 20})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopePrescribe, ScopeDispense)
+
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                return (&SmartContract{}).RecordPatientWeight(ctx, "P1", 22.5)
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, 20.0, ledger.asset("P1").WeightKg)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, 22.5, ledger.asset("P1").WeightKg)
+        })
+    }
+}
+
+func TestCreateAssetDateOfBirth(t *testing.T) {
+    tests := []struct {
+        name        string
+        dateOfBirth string
+        wantErr     string
+    }{
+        {name: "recorded", dateOfBirth: "2019-05-01"},
+        {name: "unknown", dateOfBirth: ""},
+        {name: "placeholder", dateOfBirth: "N/A", wantErr: "YYYY-MM-DD"},
+        {name: "other format", dateOfBirth: "01/05/2019", wantErr: "YYYY-MM-DD"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            err := ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+                return (&SmartContract{}).CreateAsset(ctx, `{"PatientId":"P1","DoctorId":"DOC1","DateOfBirth":"`+tt.dateOfBirth+`","Prescriptions":[]}`)
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Nil(t, ledger.state["P1"])
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.dateOfBirth, ledger.asset("P1").DateOfBirth)
+        })
+    }
+}
@@ -0,0 +1,162 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// Duplicate match types
+const (
+    MatchSameDrug  = "same-drug"
+    MatchSameClass = "same-class"
+)
+
+// DuplicateFinding describes an overlapping active prescription from another prescriber or facility.
+// Prescriber details are only filled in when the caller may read the patient's full record.
+type DuplicateFinding struct {
+    PrescriptionId     string `json:"PrescriptionId"`
+    MedicationName     string `json:"MedicationName"`
+    DrugClass          string `json:"DrugClass,omitempty"`
+    MatchType          string `json:"MatchType"` // same-drug or same-class
+    Status             string `json:"Status"`
+    IssuedAt           string `json:"IssuedAt"`
+    SameFacility       bool   `json:"SameFacility"`
+    Disclosed          bool   `json:"Disclosed"`
+    PrescriberId       string `json:"PrescriberId,omitempty"`
+    PrescriberFacility string `json:"PrescriberFacility,omitempty"`
+}
+
+// DetectDuplicatePrescriptions - on-demand check of whether prescribing the medication (or another drug of the
+// same class) would overlap active prescriptions written by other prescribers or at other facilities
+func (s *SmartContract) DetectDuplicatePrescriptions(ctx contractapi.TransactionContextInterface, patientId string, medicationName string, drugClass string) ([]DuplicateFinding, error) {
+    if err := s.requireConsent(ctx, patientId, ScopeRead, ScopePrescribe); err != nil {
+        return nil, err
+    }
+    if medicationName == "" && drugClass == "" {
+        return nil, fmt.Errorf("medicationName or drugClass is required")
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+    // Only a caller enrolled with its own "prescriberId" is recognised as the prescriber of existing prescriptions;
+    // through a shared client identity every overlapping prescription is reported
+    prescriberId, _, err := ctx.GetClientIdentity().GetAttributeValue("prescriberId")
+    if err != nil {
+        return nil, fmt.Errorf("failed to get prescriberId attribute: %v", err)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    candidate := &Prescription{
+        MedicationName:     medicationName,
+        DrugClass:          drugClass,
+        CreatedBy:          prescriberId,
+        PrescriberFacility: facilityId,
+    }
+    disclose := s.requireConsent(ctx, patientId, ScopeRead) == nil
+
+    return findDuplicates(asset.Prescriptions, candidate, disclose), nil
+}
+
+// flagDuplicates checks each newly issued prescription against the patient's existing and other new
+// prescriptions, stores masked warnings on it, and emits a DuplicatePrescriptionDetected event if any are found
+func (s *SmartContract) flagDuplicates(ctx contractapi.TransactionContextInterface, patientId string, existing []Prescription, issued []Prescription) error {
+    event := map[string]interface{}{
+        "patientId": patientId,
+        "findings":  map[string][]DuplicateFinding{},
+    }
+    flagged := false
+
+    for i := range issued {
+        others := append([]Prescription{}, existing...)
+        others = append(others, issued[:i]...)
+        others = append(others, issued[i+1:]...)
+
+        findings := findDuplicates(others, &issued[i], false)
+        issued[i].DuplicateWarnings = nil
+        for _, finding := range findings {
+            issued[i].DuplicateWarnings = append(issued[i].DuplicateWarnings, finding.summary())
+        }
+        if len(findings) > 0 {
+            event["findings"].(map[string][]DuplicateFinding)[issued[i].PrescriptionId] = findings
+            flagged = true
+        }
+    }
+
+    if !flagged {
+        return nil
+    }
+    eventJSON, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().SetEvent("DuplicatePrescriptionDetected", eventJSON)
+}
+
+// findDuplicates returns the active prescriptions that overlap the candidate's drug or drug class
+// and were written by a different prescriber or at a different facility. Prescribers are compared by the
+// signed prescriber ID and facilities by the one taken from the signer certificate, not by the client
+// identity that submitted them, which may be shared by a whole clinic.
+func findDuplicates(prescriptions []Prescription, candidate *Prescription, disclose bool) []DuplicateFinding {
+    findings := []DuplicateFinding{}
+    for _, other := range prescriptions {
+        if other.PrescriptionId != "" && other.PrescriptionId == candidate.PrescriptionId {
+            continue
+        }
+        if other.Status != "Active" && other.Status != StatusPendingApproval {
+            continue
+        }
+
+        matchType := ""
+        if candidate.MedicationName != "" && normalizeMedicationKey(other.MedicationName) == normalizeMedicationKey(candidate.MedicationName) {
+            matchType = MatchSameDrug
+        } else if candidate.DrugClass != "" && strings.EqualFold(other.DrugClass, candidate.DrugClass) {
+            matchType = MatchSameClass
+        }
+        if matchType == "" {
+            continue
+        }
+
+        samePrescriber := candidate.CreatedBy != "" && other.CreatedBy == candidate.CreatedBy
+        sameFacility := other.PrescriberFacility == "" || other.PrescriberFacility == candidate.PrescriberFacility
+        if samePrescriber && sameFacility {
+            continue
+        }
+
+        finding := DuplicateFinding{
+            PrescriptionId: other.PrescriptionId,
+            MedicationName: other.MedicationName,
+            DrugClass:      other.DrugClass,
+            MatchType:      matchType,
+            Status:         other.Status,
+            IssuedAt:       prescriptionIssuedAt(&other),
+            SameFacility:   sameFacility,
+            Disclosed:      disclose,
+        }
+        if disclose {
+            finding.PrescriberId = other.CreatedBy
+            finding.PrescriberFacility = other.PrescriberFacility
+        }
+        findings = append(findings, finding)
+    }
+    return findings
+}
+
+// summary describes the finding without identifying the other prescriber
+func (f DuplicateFinding) summary() string {
+    where := "another facility"
+    if f.SameFacility {
+        where = "this facility by another prescriber"
+    }
+    if f.MatchType == MatchSameClass {
+        return fmt.Sprintf("%s prescription for %s (same class %s) issued %s at %s", f.Status, f.MedicationName, f.DrugClass, f.IssuedAt, where)
+    }
+    return fmt.Sprintf("%s prescription for %s issued %s at %s", f.Status, f.MedicationName, f.IssuedAt, where)
+}
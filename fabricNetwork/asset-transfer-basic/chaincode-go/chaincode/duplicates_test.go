@@ -0,0 +1,251 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+
+    "github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+)
+
+func TestFindDuplicates(t *testing.T) {
+    candidate := &Prescription{
+        PrescriptionId: "NEW", MedicationName: "Amoxicillin", DrugClass: "J01CA",
+        CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH",
+    }
+
+    tests := []struct {
+        name      string
+        other     Prescription
+        wantMatch string
+        wantSame  bool
+    }{
+        {
+            name:      "same drug from another prescriber",
+            other:     Prescription{PrescriptionId: "RX1", MedicationName: " amoxicillin ", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "KCH"},
+            wantMatch: MatchSameDrug,
+            wantSame:  true,
+        },
+        {
+            name:      "same class at another facility",
+            other:     Prescription{PrescriptionId: "RX1", MedicationName: "Ampicillin", DrugClass: "j01ca", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+            wantMatch: MatchSameClass,
+        },
+        {
+            name:      "pending approval counts as active",
+            other:     Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: StatusPendingApproval, CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+            wantMatch: MatchSameDrug,
+        },
+        {
+            name:      "same prescriber at another facility",
+            other:     Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "ZCH"},
+            wantMatch: MatchSameDrug,
+        },
+        {
+            name:  "same prescriber and facility",
+            other: Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH"},
+        },
+        {
+            name:      "another prescriber through the same client identity",
+            other:     Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH"},
+            wantMatch: MatchSameDrug,
+            wantSame:  true,
+        },
+        {
+            name:  "legacy prescription by the same prescriber ID",
+            other: Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC1"},
+        },
+        {
+            name:  "dispensed prescription",
+            other: Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Dispensed", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+        },
+        {
+            name:  "revoked prescription",
+            other: Prescription{PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Revoked", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+        },
+        {
+            name:  "different drug and class",
+            other: Prescription{PrescriptionId: "RX1", MedicationName: "Paracetamol", DrugClass: "N02BE", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+        },
+        {
+            name:  "the candidate itself",
+            other: Prescription{PrescriptionId: "NEW", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            findings := findDuplicates([]Prescription{tt.other}, candidate, true)
+            if tt.wantMatch == "" {
+                require.Empty(t, findings)
+                return
+            }
+            require.Len(t, findings, 1)
+            require.Equal(t, tt.wantMatch, findings[0].MatchType)
+            require.Equal(t, tt.wantSame, findings[0].SameFacility)
+            require.Equal(t, tt.other.CreatedBy, findings[0].PrescriberId)
+
+            masked := findDuplicates([]Prescription{tt.other}, candidate, false)
+            require.Len(t, masked, 1)
+            require.False(t, masked[0].Disclosed)
+            require.Empty(t, masked[0].PrescriberId)
+            require.Empty(t, masked[0].PrescriberFacility)
+        })
+    }
+}
+
+func TestFindDuplicatesReportsIssueTime(t *testing.T) {
+    candidate := &Prescription{PrescriptionId: "NEW", MedicationName: "Amoxicillin", CreatedBy: "DOC1", PrescriberFacility: "KCH"}
+
+    tests := []struct {
+        name         string
+        issuedAt     string
+        timestamp    string
+        wantIssuedAt string
+    }{
+        {name: "updated since issue", issuedAt: "2024-05-01T08:00:00Z", timestamp: "2024-05-03T10:00:00Z", wantIssuedAt: "2024-05-01T08:00:00Z"},
+        {name: "legacy prescription without an issue time", timestamp: "2024-05-03T10:00:00Z", wantIssuedAt: "2024-05-03T10:00:00Z"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            other := Prescription{
+                PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", CreatedBy: "DOC2", PrescriberFacility: "ZCH",
+                IssuedAt: tt.issuedAt, Timestamp: tt.timestamp,
+            }
+            findings := findDuplicates([]Prescription{other}, candidate, false)
+            require.Len(t, findings, 1)
+            require.Equal(t, tt.wantIssuedAt, findings[0].IssuedAt)
+        })
+    }
+}
+
+func TestDetectDuplicatePrescriptionsDisclosure(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name         string
+        scopes       []string
+        wantDisclose bool
+    }{
+        {name: "read consent names the prescriber", scopes: []string{ScopeRead, ScopePrescribe}, wantDisclose: true},
+        {name: "prescribe consent only masks the prescriber", scopes: []string{ScopePrescribe}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC2", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationName: "Amoxicillin", DrugClass: "J01CA", Status: "Active",
+                CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH", Timestamp: "2025-03-01T08:00:00Z",
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", tt.scopes...)
+
+            ctx, _ := ledger.context(doctor("dr-banda"))
+            findings, err := contract.DetectDuplicatePrescriptions(ctx, "P1", "", "J01CA")
+            require.NoError(t, err)
+            require.Len(t, findings, 1)
+            require.Equal(t, MatchSameClass, findings[0].MatchType)
+            require.Equal(t, tt.wantDisclose, findings[0].Disclosed)
+            if tt.wantDisclose {
+                require.Equal(t, "DOC2", findings[0].PrescriberId)
+                require.Equal(t, "ZCH", findings[0].PrescriberFacility)
+            } else {
+                require.Empty(t, findings[0].PrescriberId)
+                require.Empty(t, findings[0].PrescriberFacility)
+            }
+        })
+    }
+}
+
+func TestFlagDuplicatesStoresMaskedWarnings(t *testing.T) {
+    ledger := newTestLedger(t)
+    contract := &SmartContract{}
+    existing := []Prescription{
+        {PrescriptionId: "RX1", MedicationName: "Amoxicillin", DrugClass: "J01CA", Status: "Active", CreatedBy: "DOC2", IssuedBy: "x509::CN=dr-phiri", PrescriberFacility: "ZCH", Timestamp: "2025-03-01T08:00:00Z"},
+        {PrescriptionId: "RX2", MedicationName: "Ampicillin", DrugClass: "J01CA", Status: "Active", CreatedBy: "DOC3", IssuedBy: "x509::CN=dr-mbewe", PrescriberFacility: "KCH", Timestamp: "2025-03-02T08:00:00Z"},
+    }
+    issued := []Prescription{
+        {PrescriptionId: "RX3", MedicationName: "Amoxicillin", DrugClass: "J01CA", Status: "Active", CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH"},
+        {PrescriptionId: "RX4", MedicationName: "Paracetamol", DrugClass: "N02BE", Status: "Active", CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH"},
+    }
+
+    ctx, _ := ledger.context(doctor("dr-banda"))
+    require.NoError(t, contract.flagDuplicates(ctx, "P1", existing, issued))
+
+    require.Equal(t, []string{
+        "Active prescription for Amoxicillin issued 2025-03-01T08:00:00Z at another facility",
+        "Active prescription for Ampicillin (same class J01CA) issued 2025-03-02T08:00:00Z at this facility by another prescriber",
+    }, issued[0].DuplicateWarnings)
+    require.Empty(t, issued[1].DuplicateWarnings)
+    for _, warning := range issued[0].DuplicateWarnings {
+        require.NotContains(t, warning, "DOC2")
+        require.NotContains(t, warning, "DOC3")
+    }
+
+    stub := ctx.GetStub().(*mocks.ChaincodeStub)
+    require.Equal(t, 1, stub.SetEventCallCount())
+    name, payload := stub.SetEventArgsForCall(0)
+    require.Equal(t, "DuplicatePrescriptionDetected", name)
+    var event struct {
+        PatientId string                        `json:"patientId"`
+        Findings  map[string][]DuplicateFinding `json:"findings"`
+    }
+    require.NoError(t, json.Unmarshal(payload, &event))
+    require.Equal(t, "P1", event.PatientId)
+    require.Len(t, event.Findings["RX3"], 2)
+    require.NotContains(t, event.Findings, "RX4")
+    for _, finding := range event.Findings["RX3"] {
+        require.False(t, finding.Disclosed)
+        require.Empty(t, finding.PrescriberId)
+    }
+}
+
+func TestFlagDuplicatesWithoutOverlapEmitsNoEvent(t *testing.T) {
+    ledger := newTestLedger(t)
+    contract := &SmartContract{}
+    issued := []Prescription{{PrescriptionId: "RX1", MedicationName: "Paracetamol", Status: "Active", CreatedBy: "DOC1", IssuedBy: "x509::CN=dr-banda", PrescriberFacility: "KCH"}}
+
+    ctx, _ := ledger.context(doctor("dr-banda"))
+    require.NoError(t, contract.flagDuplicates(ctx, "P1", nil, issued))
+    require.Empty(t, issued[0].DuplicateWarnings)
+    require.Equal(t, 0, ctx.GetStub().(*mocks.ChaincodeStub).SetEventCallCount())
+}
+
+func TestFlagDuplicatesComparesSignedPrescribers(t *testing.T) {
+    ca := newTestCA(t, "ca.org1")
+    clinic := doctor("clinic-frontdesk") // one client identity submits for every prescriber
+    contract := &SmartContract{}
+
+    ledger := newTestLedger(t)
+    ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg"}, DosageForms: []string{"capsule"}})
+    ledger.put("P1", Asset{PatientId: "P1", Prescriptions: []Prescription{}})
+    ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe, ScopeRead)
+    ledger.trustSigners("Org1MSP", ca)
+
+    issue := func(prescriptionId string, prescriberId string) {
+        prescription := Prescription{
+            PrescriptionId: prescriptionId, MedicationCode: "AMOX", Strength: "250mg", DosageForm: "capsule",
+            Dosage: "1 capsule three times a day", Quantity: 21, ExpiryDate: "2999-01-01", CreatedBy: prescriberId,
+        }
+        ca.prescriber(prescriberId).sign(t, "P1", &prescription)
+        prescriptionsJSON, err := json.Marshal([]Prescription{prescription})
+        require.NoError(t, err)
+        ledger.mustSubmit(clinic, func(ctx contractapi.TransactionContextInterface) error {
+            return contract.AddPrescriptions(ctx, "P1", prescriberId, string(prescriptionsJSON))
+        })
+    }
+    issue("RX1", "DOC1")
+    issue("RX2", "DOC1")
+    issue("RX3", "DOC2")
+
+    require.Empty(t, ledger.prescription("P1", "RX2").DuplicateWarnings)
+    warnings := ledger.prescription("P1", "RX3").DuplicateWarnings
+    require.Len(t, warnings, 2)
+    for _, warning := range warnings {
+        require.Contains(t, warning, "at this facility by another prescriber")
+    }
+    require.Equal(t, "KCH", ledger.prescription("P1", "RX3").PrescriberFacility)
+}
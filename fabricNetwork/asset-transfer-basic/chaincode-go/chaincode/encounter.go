@@ -0,0 +1,164 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// icd10Pattern matches an ICD-10 code such as J18, J18.9 or A09.0
+var icd10Pattern = regexp.MustCompile(`^[A-Z][0-9][0-9A-Z](\.[0-9A-Z]{1,4})?$`)
+
+// DiagnosisGroup lists de-identified prescriptions written for one diagnosis
+type DiagnosisGroup struct {
+    DiagnosisCode string                   `json:"DiagnosisCode"`
+    Count         int                      `json:"Count"`
+    Prescriptions []map[string]interface{} `json:"Prescriptions"`
+}
+
+// GetPrescriptionsByEncounter - returns all prescriptions written at one visit, across the patients the caller may read
+func (s *SmartContract) GetPrescriptionsByEncounter(ctx contractapi.TransactionContextInterface, encounterId string) ([]map[string]interface{}, error) {
+    if encounterId == "" {
+        return nil, fmt.Errorf("encounterId is required")
+    }
+
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    encounterPrescriptions := []map[string]interface{}{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            continue
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            continue
+        }
+
+        for _, prescription := range asset.Prescriptions {
+            if prescription.EncounterId != encounterId {
+                continue
+            }
+            // Skip patients who have not consented to the caller reading their record
+            if s.requireConsent(ctx, asset.PatientId, ScopeRead) != nil {
+                break
+            }
+            encounterPrescriptions = append(encounterPrescriptions, map[string]interface{}{
+                "PrescriptionId": prescription.PrescriptionId,
+                "PatientId":      asset.PatientId,
+                "PatientName":    asset.PatientName,
+                "MedicationCode": prescription.MedicationCode,
+                "MedicationName": prescription.MedicationName,
+                "Dosage":         prescription.Dosage,
+                "Instructions":   prescription.Instructions,
+                "DiagnosisCodes": prescription.DiagnosisCodes,
+                "Status":         prescription.Status,
+                "CreatedBy":      prescription.CreatedBy,
+                "Timestamp":      prescription.Timestamp,
+            })
+        }
+    }
+
+    return encounterPrescriptions, nil
+}
+
+// GetPrescriptionsByDiagnosis - groups prescriptions by ICD-10 diagnosis over a date range, for antimicrobial
+// stewardship and disease reporting. A code such as "J18" also matches its subcodes (J18.0, J18.9).
+// Patient identities are left out so the query can be used for reporting across all patients.
+func (s *SmartContract) GetPrescriptionsByDiagnosis(ctx contractapi.TransactionContextInterface, diagnosisCode string, startDate string, endDate string) ([]*DiagnosisGroup, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if !isPrescriberRole(role) && role != RoleRegulator {
+        return nil, fmt.Errorf("only clinicians and regulators can run diagnosis reports")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    start, end, err := parseDateRange(startDate, endDate, now)
+    if err != nil {
+        return nil, err
+    }
+    diagnosisCode = strings.ToUpper(strings.TrimSpace(diagnosisCode))
+
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    groups := map[string]*DiagnosisGroup{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            continue
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            continue
+        }
+
+        for _, prescription := range asset.Prescriptions {
+            if !withinPeriod(prescriptionIssuedAt(&prescription), start, end) {
+                continue
+            }
+            for _, code := range prescription.DiagnosisCodes {
+                if diagnosisCode != "" && code != diagnosisCode && !strings.HasPrefix(code, diagnosisCode+".") {
+                    continue
+                }
+                group, ok := groups[code]
+                if !ok {
+                    group = &DiagnosisGroup{DiagnosisCode: code, Prescriptions: []map[string]interface{}{}}
+                    groups[code] = group
+                }
+                group.Count++
+                group.Prescriptions = append(group.Prescriptions, map[string]interface{}{
+                    "PrescriptionId":     prescription.PrescriptionId,
+                    "EncounterId":        prescription.EncounterId,
+                    "MedicationCode":     prescription.MedicationCode,
+                    "MedicationName":     prescription.MedicationName,
+                    "DrugClass":          prescription.DrugClass,
+                    "Status":             prescription.Status,
+                    "PrescriberFacility": prescription.PrescriberFacility,
+                    "IssuedAt":           prescriptionIssuedAt(&prescription),
+                    "Timestamp":          prescription.Timestamp,
+                })
+            }
+        }
+    }
+
+    result := []*DiagnosisGroup{}
+    for _, group := range groups {
+        result = append(result, group)
+    }
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].DiagnosisCode < result[j].DiagnosisCode
+    })
+
+    return result, nil
+}
+
+// validateDiagnosisCodes normalizes the prescription's ICD-10 codes and rejects malformed ones
+func validateDiagnosisCodes(prescription *Prescription) error {
+    for i, code := range prescription.DiagnosisCodes {
+        code = strings.ToUpper(strings.TrimSpace(code))
+        if !icd10Pattern.MatchString(code) {
+            return fmt.Errorf("invalid ICD-10 diagnosis code '%s' on prescription %s", code, prescription.PrescriptionId)
+        }
+        prescription.DiagnosisCodes[i] = code
+    }
+    return nil
+}
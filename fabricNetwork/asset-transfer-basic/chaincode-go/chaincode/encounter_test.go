@@ -0,0 +1,39 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/require"
+)
+
+func TestPrescriptionsByDiagnosisUseIssueDate(t *testing.T) {
+    tests := []struct {
+        name  string
+        rx    Prescription
+        found bool
+    }{
+        {name: "issued in range", rx: Prescription{IssuedAt: "2024-05-10T08:00:00Z", Timestamp: "2024-05-10T08:00:00Z"}, found: true},
+        {name: "issued in range and changed later", rx: Prescription{IssuedAt: "2024-05-10T08:00:00Z", Timestamp: "2024-07-01T08:00:00Z"}, found: true},
+        {name: "issued earlier and changed in range", rx: Prescription{IssuedAt: "2024-04-10T08:00:00Z", Timestamp: "2024-05-20T08:00:00Z"}},
+        {name: "older record falls back to timestamp", rx: Prescription{Timestamp: "2024-05-20T08:00:00Z"}, found: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            rx := tt.rx
+            rx.PrescriptionId, rx.Status, rx.DiagnosisCodes = "RX1", "Active", []string{"J18.9"}
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{rx}})
+
+            ctx, _ := ledger.context(regulator("reg-kalua"))
+            groups, err := (&SmartContract{}).GetPrescriptionsByDiagnosis(ctx, "J18", "2024-05-01", "2024-05-31")
+            require.NoError(t, err)
+            if tt.found {
+                require.Len(t, groups, 1)
+                require.Equal(t, 1, groups[0].Count)
+            } else {
+                require.Empty(t, groups)
+            }
+        })
+    }
+}
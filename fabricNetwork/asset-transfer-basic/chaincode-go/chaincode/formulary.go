@@ -0,0 +1,401 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+    "unicode"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const formularyObjectType = "formulary"
+
+// minMatchScore is the lowest similarity SearchFormulary reports as a match
+const minMatchScore = 0.6
+
+// atcPattern matches a WHO ATC level 5 code: anatomical group, therapeutic subgroup, two lettered
+// subgroups and the substance, e.g. J01CA04
+var atcPattern = regexp.MustCompile(`^[A-Z][0-9]{2}[A-Z]{2}[0-9]{2}$`)
+
+// FormularyEntry is a medicine on the national formulary
+type FormularyEntry struct {
+    Code              string   `json:"Code"`                       // formulary code prescriptions refer to
+    AtcCode           string   `json:"AtcCode"`                    // WHO ATC code, e.g. J01CA04
+    GenericName       string   `json:"GenericName"`
+    BrandNames        []string `json:"BrandNames,omitempty"`
+    Strengths         []string `json:"Strengths,omitempty"`        // e.g. 250mg, 500mg
+    DosageForms       []string `json:"DosageForms,omitempty"`      // e.g. capsule, oral suspension
+    EssentialMedicine bool     `json:"EssentialMedicine"`          // on the Malawi essential medicines list
+    TherapeuticClass  string   `json:"TherapeuticClass,omitempty"` // defaults to the ATC level 4 group
+    UpdatedBy         string   `json:"UpdatedBy,omitempty"`
+    UpdatedAt         string   `json:"UpdatedAt,omitempty"`
+}
+
+// FormularyMatch is a fuzzy name lookup result
+type FormularyMatch struct {
+    Entry     *FormularyEntry `json:"Entry"`
+    Score     float64         `json:"Score"`     // 1 is an exact match
+    MatchedOn string          `json:"MatchedOn"` // the generic or brand name that matched
+}
+
+// PutFormularyEntry - adds or replaces a formulary entry; admins and regulators only
+func (s *SmartContract) PutFormularyEntry(ctx contractapi.TransactionContextInterface, entryJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin && role != RoleRegulator {
+        return fmt.Errorf("only admins and regulators can maintain the formulary")
+    }
+
+    var entry FormularyEntry
+    if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+        return fmt.Errorf("failed to parse formulary entry JSON: %v", err)
+    }
+    entry.Code = strings.TrimSpace(entry.Code)
+    entry.AtcCode = strings.ToUpper(strings.TrimSpace(entry.AtcCode))
+    if entry.Code == "" || entry.AtcCode == "" || entry.GenericName == "" {
+        return fmt.Errorf("code, atcCode and genericName are required")
+    }
+    if !atcPattern.MatchString(entry.AtcCode) {
+        return fmt.Errorf("invalid ATC code '%s', expected a level 5 code such as J01CA04", entry.AtcCode)
+    }
+    if entry.TherapeuticClass == "" {
+        entry.TherapeuticClass = entry.AtcCode[:5]
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    entry.UpdatedBy = callerId
+    entry.UpdatedAt = now.Format(time.RFC3339)
+
+    key, err := ctx.GetStub().CreateCompositeKey(formularyObjectType, []string{entry.Code})
+    if err != nil {
+        return err
+    }
+    entryBytes, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    return s.putConfig(ctx, key, entryBytes)
+}
+
+// GetFormularyEntry - returns the formulary entry for a code
+func (s *SmartContract) GetFormularyEntry(ctx contractapi.TransactionContextInterface, code string) (*FormularyEntry, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(formularyObjectType, []string{code})
+    if err != nil {
+        return nil, err
+    }
+    entryJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if entryJSON == nil {
+        return nil, fmt.Errorf("formulary code %s does not exist", code)
+    }
+
+    var entry FormularyEntry
+    if err := json.Unmarshal(entryJSON, &entry); err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
+
+// ListFormulary - returns the formulary, optionally restricted to essential medicines
+func (s *SmartContract) ListFormulary(ctx contractapi.TransactionContextInterface, essentialOnly bool) ([]*FormularyEntry, error) {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(formularyObjectType, []string{})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    entries := []*FormularyEntry{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var entry FormularyEntry
+        if err := json.Unmarshal(queryResponse.Value, &entry); err != nil {
+            return nil, err
+        }
+        if essentialOnly && !entry.EssentialMedicine {
+            continue
+        }
+        entries = append(entries, &entry)
+    }
+
+    return entries, nil
+}
+
+// SearchFormulary - fuzzy lookup of a free-text medication name against generic and brand names,
+// for mapping legacy prescriptions to formulary codes. Strengths and punctuation in the name are
+// ignored, and small spelling differences still match.
+func (s *SmartContract) SearchFormulary(ctx contractapi.TransactionContextInterface, name string) ([]FormularyMatch, error) {
+    query := normalizeDrugName(name)
+    if query == "" {
+        return nil, fmt.Errorf("a medication name is required")
+    }
+
+    entries, err := s.ListFormulary(ctx, false)
+    if err != nil {
+        return nil, err
+    }
+
+    matches := []FormularyMatch{}
+    for _, entry := range entries {
+        best := bestNameMatch(entry, query)
+        if best.Score >= minMatchScore {
+            matches = append(matches, best)
+        }
+    }
+
+    sort.SliceStable(matches, func(i, j int) bool {
+        return matches[i].Score > matches[j].Score
+    })
+
+    return matches, nil
+}
+
+// bestNameMatch scores a normalized medication name against the entry's generic and brand names
+func bestNameMatch(entry *FormularyEntry, query string) FormularyMatch {
+    best := FormularyMatch{Entry: entry}
+    for _, candidate := range append([]string{entry.GenericName}, entry.BrandNames...) {
+        score := nameSimilarity(query, normalizeDrugName(candidate))
+        if score > best.Score {
+            best.Score = score
+            best.MatchedOn = candidate
+        }
+    }
+    return best
+}
+
+// MapLegacyPrescription - attaches a formulary code to a prescription issued before codes were required. Only open
+// prescriptions can be mapped, the code must name the same medicine as the legacy free text, and the restricted and
+// controlled drug rules are applied to the mapped medicine as they are at issue.
+func (s *SmartContract) MapLegacyPrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string, code string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) && role != RoleAdmin {
+        return fmt.Errorf("only prescribers and admins can map legacy prescriptions")
+    }
+    if err := s.requireConsent(ctx, patientId, ScopePrescribe); err != nil {
+        return err
+    }
+
+    entry, err := s.GetFormularyEntry(ctx, code)
+    if err != nil {
+        return err
+    }
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    found := false
+    for i := range asset.Prescriptions {
+        if asset.Prescriptions[i].PrescriptionId == prescriptionId {
+            prescription := &asset.Prescriptions[i]
+            if prescription.MedicationCode != "" {
+                return fmt.Errorf("prescription %s already has formulary code %s", prescriptionId, prescription.MedicationCode)
+            }
+            if prescription.Status != "Active" && prescription.Status != StatusPendingApproval {
+                return fmt.Errorf("can only map active or pending prescriptions, prescription %s is %s", prescriptionId, prescription.Status)
+            }
+            if match := bestNameMatch(entry, normalizeDrugName(prescription.MedicationName)); match.Score < minMatchScore {
+                return fmt.Errorf("formulary code %s (%s) does not match the prescribed medication '%s'; use SearchFormulary to find its code", entry.Code, entry.GenericName, prescription.MedicationName)
+            }
+
+            prescription.LegacyMedicationName = prescription.MedicationName
+            prescription.MedicationCode = entry.Code
+            prescription.MedicationName = entry.GenericName
+            if prescription.DrugClass == "" {
+                prescription.DrugClass = entry.TherapeuticClass
+            }
+
+            // The mapped code may identify a restricted or controlled medicine the free text did not
+            restricted, err := s.findRestrictedDrug(ctx, prescription.MedicationCode, prescription.MedicationName)
+            if err != nil {
+                return err
+            }
+            if restricted != nil && prescription.Status == "Active" {
+                prescription.Status = StatusPendingApproval
+                prescription.ReviewedBy = ""
+                prescription.ReviewedAt = ""
+                prescription.ReviewNote = ""
+            }
+            if err := s.applyControlledDrugRules(ctx, patientId, prescription); err != nil {
+                return err
+            }
+
+            if err := stampContentHash(ctx, patientId, prescription); err != nil {
+                return err
+            }
+            found = true
+            break
+        }
+    }
+
+    if !found {
+        return fmt.Errorf("prescription %s not found", prescriptionId)
+    }
+
+    asset.LastUpdated = now.Format(time.RFC3339)
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(patientId, assetJSON)
+}
+
+// applyFormulary resolves the prescription's formulary code, replacing the free-text medication name
+// with the generic name and setting the drug class from the formulary
+func (s *SmartContract) applyFormulary(ctx contractapi.TransactionContextInterface, prescription *Prescription) error {
+    if prescription.MedicationCode == "" {
+        return fmt.Errorf("prescription %s must reference a formulary code; use SearchFormulary to find one", prescription.PrescriptionId)
+    }
+    entry, err := s.GetFormularyEntry(ctx, prescription.MedicationCode)
+    if err != nil {
+        return err
+    }
+    if err := checkFormularyPresentation(entry, prescription); err != nil {
+        return err
+    }
+
+    prescription.MedicationName = entry.GenericName
+    prescription.DrugClass = entry.TherapeuticClass
+    return nil
+}
+
+// checkFormularyPresentation checks that the prescription's strength and dosage form are listed for the entry
+func checkFormularyPresentation(entry *FormularyEntry, prescription *Prescription) error {
+    if prescription.Strength != "" && len(entry.Strengths) > 0 && !containsFold(entry.Strengths, prescription.Strength) {
+        return fmt.Errorf("strength %s is not listed for %s (available: %s)", prescription.Strength, entry.GenericName, strings.Join(entry.Strengths, ", "))
+    }
+    if prescription.DosageForm != "" && len(entry.DosageForms) > 0 && !containsFold(entry.DosageForms, prescription.DosageForm) {
+        return fmt.Errorf("dosage form %s is not listed for %s (available: %s)", prescription.DosageForm, entry.GenericName, strings.Join(entry.DosageForms, ", "))
+    }
+    return nil
+}
+
+// resolveDispensedProduct returns the formulary entry and strength actually supplied for a prescription and
+// whether it is a substitution. A substitute must share the prescribed product's ATC code, list the dispensed
+// strength, and come with a reason.
+func (s *SmartContract) resolveDispensedProduct(ctx contractapi.TransactionContextInterface, prescription *Prescription, dispensedCode string, dispensedStrength string, reason string) (*FormularyEntry, string, bool, error) {
+    prescribed, err := s.GetFormularyEntry(ctx, prescription.MedicationCode)
+    if err != nil {
+        return nil, "", false, err
+    }
+    if dispensedCode == "" {
+        dispensedCode = prescribed.Code
+    }
+    if dispensedStrength == "" {
+        dispensedStrength = prescription.Strength
+    }
+    if dispensedCode == prescribed.Code && strings.EqualFold(dispensedStrength, prescription.Strength) {
+        return prescribed, dispensedStrength, false, nil
+    }
+
+    if strings.TrimSpace(reason) == "" {
+        return nil, "", false, fmt.Errorf("a substitution reason is required to dispense a different product or strength for %s", prescribed.GenericName)
+    }
+    substitute := prescribed
+    if dispensedCode != prescribed.Code {
+        substitute, err = s.GetFormularyEntry(ctx, dispensedCode)
+        if err != nil {
+            return nil, "", false, err
+        }
+        if prescribed.AtcCode == "" || !strings.EqualFold(substitute.AtcCode, prescribed.AtcCode) {
+            return nil, "", false, fmt.Errorf("%s (ATC %s) is not therapeutically equivalent to %s (ATC %s)", substitute.GenericName, substitute.AtcCode, prescribed.GenericName, prescribed.AtcCode)
+        }
+    }
+    if dispensedStrength != "" && len(substitute.Strengths) > 0 && !containsFold(substitute.Strengths, dispensedStrength) {
+        return nil, "", false, fmt.Errorf("strength %s is not listed for %s (available: %s)", dispensedStrength, substitute.GenericName, strings.Join(substitute.Strengths, ", "))
+    }
+    return substitute, dispensedStrength, true, nil
+}
+
+// normalizeDrugName lowercases a medication name and strips strengths, units and punctuation,
+// so "Amoxycillin 500mg caps." becomes "amoxycillin caps"
+func normalizeDrugName(name string) string {
+    words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+
+    kept := []string{}
+    for _, word := range words {
+        if unicode.IsDigit(rune(word[0])) {
+            continue // strengths such as 500mg or 250
+        }
+        switch word {
+        case "mg", "g", "mcg", "ml", "iu", "tab", "tabs", "tablet", "tablets", "cap", "caps", "capsule", "capsules", "syrup", "susp", "suspension", "inj", "injection":
+            continue
+        }
+        kept = append(kept, word)
+    }
+    return strings.Join(kept, " ")
+}
+
+// nameSimilarity scores two normalized names between 0 and 1 using edit distance
+func nameSimilarity(a string, b string) float64 {
+    if a == "" || b == "" {
+        return 0
+    }
+    if a == b {
+        return 1
+    }
+    longest := len([]rune(a))
+    if l := len([]rune(b)); l > longest {
+        longest = l
+    }
+    return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a string, b string) int {
+    ra, rb := []rune(a), []rune(b)
+    previous := make([]int, len(rb)+1)
+    current := make([]int, len(rb)+1)
+    for j := range previous {
+        previous[j] = j
+    }
+    for i := 1; i <= len(ra); i++ {
+        current[0] = i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] {
+                cost = 0
+            }
+            current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+        }
+        previous, current = current, previous
+    }
+    return previous[len(rb)]
+}
+
+func containsFold(values []string, value string) bool {
+    for _, v := range values {
+        if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(value)) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,190 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestPutFormularyEntryValidatesAtcCode(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name      string
+        caller    *testIdentity
+        entry     string
+        wantErr   string
+        wantAtc   string
+        wantClass string
+    }{
+        {name: "level 5 code", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","AtcCode":"J01CA04","GenericName":"Amoxicillin"}`, wantAtc: "J01CA04", wantClass: "J01CA"},
+        {name: "normalized to upper case", caller: regulator("reg-phiri"), entry: `{"Code":"AMOX500","AtcCode":" j01ca04 ","GenericName":"Amoxicillin"}`, wantAtc: "J01CA04", wantClass: "J01CA"},
+        {name: "explicit therapeutic class", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","AtcCode":"J01CA04","GenericName":"Amoxicillin","TherapeuticClass":"penicillins"}`, wantAtc: "J01CA04", wantClass: "penicillins"},
+        {name: "level 4 code", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","AtcCode":"J01CA","GenericName":"Amoxicillin"}`, wantErr: "invalid ATC code 'J01CA'"},
+        {name: "seven characters in the wrong shape", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","AtcCode":"J01C404","GenericName":"Amoxicillin"}`, wantErr: "invalid ATC code 'J01C404'"},
+        {name: "digit for the anatomical group", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","AtcCode":"101CA04","GenericName":"Amoxicillin"}`, wantErr: "invalid ATC code"},
+        {name: "missing ATC code", caller: admin("admin-banda"), entry: `{"Code":"AMOX500","GenericName":"Amoxicillin"}`, wantErr: "code, atcCode and genericName are required"},
+        {name: "doctor", caller: doctor("dr-banda"), entry: `{"Code":"AMOX500","AtcCode":"J01CA04","GenericName":"Amoxicillin"}`, wantErr: "only admins and regulators"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                return contract.PutFormularyEntry(ctx, tt.entry)
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            ctx, _ := ledger.context(doctor("dr-banda"))
+            entry, err := contract.GetFormularyEntry(ctx, "AMOX500")
+            require.NoError(t, err)
+            require.Equal(t, tt.wantAtc, entry.AtcCode)
+            require.Equal(t, tt.wantClass, entry.TherapeuticClass)
+            require.Equal(t, tt.caller.id, entry.UpdatedBy)
+        })
+    }
+}
+
+func TestSearchFormulary(t *testing.T) {
+    ledger := newTestLedger(t)
+    ledger.seedFormulary(
+        FormularyEntry{Code: "AMOX500", AtcCode: "J01CA04", GenericName: "Amoxicillin", BrandNames: []string{"Amoxil"}},
+        FormularyEntry{Code: "AMP500", AtcCode: "J01CA01", GenericName: "Ampicillin"},
+        FormularyEntry{Code: "PARA500", AtcCode: "N02BE01", GenericName: "Paracetamol", BrandNames: []string{"Panadol"}},
+    )
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name      string
+        query     string
+        wantCodes []string // in score order
+        wantOn    string   // name the best match was found on
+        wantScore float64  // score of the best match
+        wantErr   string
+    }{
+        {name: "exact generic name", query: "Paracetamol", wantCodes: []string{"PARA500"}, wantOn: "Paracetamol", wantScore: 1},
+        {name: "brand name", query: "PANADOL", wantCodes: []string{"PARA500"}, wantOn: "Panadol", wantScore: 1},
+        {name: "strength and form are ignored", query: "Amoxicillin 500mg caps.", wantCodes: []string{"AMOX500", "AMP500"}, wantOn: "Amoxicillin", wantScore: 1},
+        {name: "misspelling", query: "amoxycilin", wantCodes: []string{"AMOX500", "AMP500"}, wantOn: "Amoxicillin", wantScore: 1 - 2.0/11},
+        {name: "no close name", query: "ibuprofen", wantCodes: []string{}},
+        {name: "only a strength", query: "500mg", wantErr: "a medication name is required"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ctx, _ := ledger.context(doctor("dr-banda"))
+            matches, err := contract.SearchFormulary(ctx, tt.query)
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            codes := []string{}
+            for _, match := range matches {
+                codes = append(codes, match.Entry.Code)
+                require.GreaterOrEqual(t, match.Score, minMatchScore)
+            }
+            require.Equal(t, tt.wantCodes, codes)
+            if len(matches) > 0 {
+                require.Equal(t, tt.wantOn, matches[0].MatchedOn)
+                require.InDelta(t, tt.wantScore, matches[0].Score, 1e-9)
+            }
+        })
+    }
+}
+
+func TestMapLegacyPrescription(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name         string
+        legacy       Prescription
+        code         string
+        restricted   []RestrictedDrug
+        controlled   []ControlledDrug
+        wantErr      string
+        wantStatus   string
+        wantSchedule string
+    }{
+        {name: "maps a misspelt name", legacy: Prescription{MedicationName: "Amoxycillin 500mg caps", Status: "Active"}, code: "AMOX500", wantStatus: "Active"},
+        {name: "maps a brand name", legacy: Prescription{MedicationName: "Panadol", Status: "Active"}, code: "PARA500", wantStatus: "Active"},
+        {name: "code for another medicine", legacy: Prescription{MedicationName: "Paracetamol", Status: "Active"}, code: "MORPH10", wantErr: "does not match the prescribed medication"},
+        {name: "dispensed prescription", legacy: Prescription{MedicationName: "Amoxicillin", Status: "Dispensed"}, code: "AMOX500", wantErr: "can only map active or pending prescriptions"},
+        {name: "revoked prescription", legacy: Prescription{MedicationName: "Amoxicillin", Status: "Revoked"}, code: "AMOX500", wantErr: "can only map active or pending prescriptions"},
+        {
+            name: "restricted medicine needs approval", legacy: Prescription{MedicationName: "Amoxicillin", Status: "Active", ReviewedBy: "dr-old"}, code: "AMOX500",
+            restricted: []RestrictedDrug{{MedicationCode: "AMOX500", MedicationName: "Amoxicillin"}}, wantStatus: StatusPendingApproval,
+        },
+        {
+            name: "controlled medicine is scheduled", legacy: Prescription{MedicationName: "Morphine 10mg", Status: "Active", Quantity: 10}, code: "MORPH10",
+            controlled: []ControlledDrug{{MedicationCode: "MORPH10", MedicationName: "Morphine", Schedule: "Schedule 2", MaxQuantity: 30, Unit: "tablets"}},
+            wantStatus: "Active", wantSchedule: "Schedule 2",
+        },
+        {
+            name: "controlled medicine with refills", legacy: Prescription{MedicationName: "Morphine", Status: "Active", Quantity: 10, Refills: 2}, code: "MORPH10",
+            controlled: []ControlledDrug{{MedicationCode: "MORPH10", MedicationName: "Morphine", Schedule: "Schedule 2", MaxQuantity: 30, Unit: "tablets"}},
+            wantErr: "cannot be prescribed with refills",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(
+                FormularyEntry{Code: "AMOX500", AtcCode: "J01CA04", GenericName: "Amoxicillin", TherapeuticClass: "J01CA"},
+                FormularyEntry{Code: "PARA500", AtcCode: "N02BE01", GenericName: "Paracetamol", BrandNames: []string{"Panadol"}},
+                FormularyEntry{Code: "MORPH10", AtcCode: "N02AA01", GenericName: "Morphine"},
+            )
+            ledger.putComposite(configObjectType, []string{"restricted-drugs"}, RestrictedDrugList{Drugs: tt.restricted})
+            ledger.putComposite(configObjectType, []string{"controlled-drugs"}, ControlledDrugList{Drugs: tt.controlled})
+            legacy := tt.legacy
+            legacy.PrescriptionId = "RX1"
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{legacy}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+
+            err := ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+                return contract.MapLegacyPrescription(ctx, "P1", "RX1", tt.code)
+            })
+            mapped := ledger.prescription("P1", "RX1")
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Empty(t, mapped.MedicationCode)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.code, mapped.MedicationCode)
+            require.Equal(t, tt.legacy.MedicationName, mapped.LegacyMedicationName)
+            require.Equal(t, tt.wantStatus, mapped.Status)
+            require.Equal(t, tt.wantSchedule, mapped.ControlledSchedule)
+            if tt.wantStatus == StatusPendingApproval {
+                require.Empty(t, mapped.ReviewedBy)
+            }
+        })
+    }
+}
+
+func TestLevenshtein(t *testing.T) {
+    tests := []struct {
+        a, b string
+        want int
+    }{
+        {"", "", 0},
+        {"", "abc", 3},
+        {"kitten", "sitting", 3},
+        {"amoxycillin", "amoxicillin", 1},
+        {"amoxicillin", "ampicillin", 2},
+        {"paracetamol", "paracetamol", 0},
+        {"ÿes", "yes", 1},
+    }
+
+    for _, tt := range tests {
+        require.Equal(t, tt.want, levenshtein(tt.a, tt.b), "levenshtein(%q, %q)", tt.a, tt.b)
+        require.Equal(t, tt.want, levenshtein(tt.b, tt.a), "levenshtein(%q, %q)", tt.b, tt.a)
+    }
+}
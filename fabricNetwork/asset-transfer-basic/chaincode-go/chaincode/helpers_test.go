@@ -0,0 +1,406 @@
+package chaincode
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/pkg/attrmgr"
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/hyperledger/fabric-protos-go-apiv2/ledger/queryresult"
+    "github.com/stretchr/testify/require"
+    "google.golang.org/protobuf/types/known/timestamppb"
+
+    "github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+)
+
+// testLedger is an in-memory world state that drives transactions through the counterfeiter mocks. As on a peer,
+// a transaction reads the committed state and its writes only become visible once it commits.
+type testLedger struct {
+    t       *testing.T
+    state   map[string][]byte
+    private map[string][]byte // private data, keyed by privateDataKey
+    history map[string][]*queryresult.KeyModification
+    clock   time.Time
+    txCount int
+}
+
+func newTestLedger(t *testing.T) *testLedger {
+    return &testLedger{
+        t:       t,
+        state:   map[string][]byte{},
+        private: map[string][]byte{},
+        history: map[string][]*queryresult.KeyModification{},
+        clock:   time.Now().Add(-time.Hour),
+    }
+}
+
+// privateDataKey identifies a key in a private data collection. Private writes are buffered with the public ones
+// under this key and committed to the private store, never to the world state.
+func privateDataKey(collection string, key string) string {
+    return "\x00private\x00" + collection + "\x00" + key
+}
+
+// testIdentity is a caller's enrollment certificate
+type testIdentity struct {
+    id    string
+    mspID string
+    attrs map[string]string
+    cert  *x509.Certificate
+}
+
+func (identity *testIdentity) GetID() (string, error) {
+    return identity.id, nil
+}
+
+func (identity *testIdentity) GetMSPID() (string, error) {
+    return identity.mspID, nil
+}
+
+func (identity *testIdentity) GetAttributeValue(name string) (string, bool, error) {
+    value, ok := identity.attrs[name]
+    return value, ok, nil
+}
+
+func (identity *testIdentity) AssertAttributeValue(name string, value string) error {
+    if identity.attrs[name] != value {
+        return fmt.Errorf("attribute %s is not %s", name, value)
+    }
+    return nil
+}
+
+func (identity *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+    return identity.cert, nil
+}
+
+// newIdentity returns a Fabric CA enrolment, which always records the enrolment ID among the attributes
+func newIdentity(name string, mspID string, attrs map[string]string) *testIdentity {
+    if _, ok := attrs["hf.EnrollmentID"]; !ok {
+        attrs["hf.EnrollmentID"] = name
+    }
+    return &testIdentity{id: "x509::CN=" + name + "::CN=ca." + strings.ToLower(mspID), mspID: mspID, attrs: attrs}
+}
+
+func doctor(name string) *testIdentity {
+    return newIdentity(name, "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "KCH"})
+}
+
+func pharmacist(name string) *testIdentity {
+    return newIdentity(name, "Org2MSP", map[string]string{"role": RolePharmacist, "facilityId": "KCH-PHARM"})
+}
+
+func patient(patientId string) *testIdentity {
+    return newIdentity(patientId, "Org3MSP", map[string]string{"role": RolePatient, "patientId": patientId})
+}
+
+func proxy(name string, patientIds string) *testIdentity {
+    return newIdentity(name, "Org3MSP", map[string]string{"role": RolePatient, "proxyFor": patientIds})
+}
+
+func regulator(name string) *testIdentity {
+    return newIdentity(name, "Org1MSP", map[string]string{"role": RoleRegulator})
+}
+
+func admin(name string) *testIdentity {
+    return newIdentity(name, "Org1MSP", map[string]string{"role": RoleAdmin})
+}
+
+// submit runs a transaction as the caller and commits its writes if it succeeds
+func (ledger *testLedger) submit(caller *testIdentity, transaction func(ctx contractapi.TransactionContextInterface) error) error {
+    ctx, writes := ledger.context(caller)
+    if err := transaction(ctx); err != nil {
+        return err
+    }
+    ledger.clock = ledger.clock.Add(time.Second)
+    for _, key := range sortedKeys(writes) {
+        if strings.HasPrefix(key, "\x00private\x00") {
+            ledger.private[key] = writes[key]
+            continue
+        }
+        ledger.state[key] = writes[key]
+        ledger.history[key] = append(ledger.history[key], &queryresult.KeyModification{
+            TxId:      ctx.GetStub().GetTxID(),
+            Value:     writes[key],
+            Timestamp: timestamppb.New(ledger.clock),
+        })
+    }
+    return nil
+}
+
+// mustSubmit runs a transaction that is expected to succeed
+func (ledger *testLedger) mustSubmit(caller *testIdentity, transaction func(ctx contractapi.TransactionContextInterface) error) {
+    ledger.t.Helper()
+    require.NoError(ledger.t, ledger.submit(caller, transaction))
+}
+
+// context builds a transaction context for the caller, returning the map its writes are buffered in
+func (ledger *testLedger) context(caller *testIdentity) (*mocks.TransactionContext, map[string][]byte) {
+    ledger.txCount++
+    txID := fmt.Sprintf("tx%04d", ledger.txCount)
+    writes := map[string][]byte{}
+
+    stub := &mocks.ChaincodeStub{}
+    stub.GetTxIDReturns(txID)
+    stub.GetTxTimestampReturns(timestamppb.New(ledger.clock), nil)
+    stub.CreateCompositeKeyStub = shim.CreateCompositeKey
+    stub.GetStateStub = func(key string) ([]byte, error) {
+        return ledger.state[key], nil
+    }
+    stub.PutStateStub = func(key string, value []byte) error {
+        writes[key] = value
+        return nil
+    }
+    stub.GetPrivateDataStub = func(collection string, key string) ([]byte, error) {
+        return ledger.private[privateDataKey(collection, key)], nil
+    }
+    stub.PutPrivateDataStub = func(collection string, key string, value []byte) error {
+        writes[privateDataKey(collection, key)] = value
+        return nil
+    }
+    stub.GetStateByRangeStub = func(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+        return ledger.iterator(func(key string) bool {
+            return !strings.HasPrefix(key, "\x00")
+        }), nil
+    }
+    stub.GetStateByPartialCompositeKeyStub = func(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+        prefix, err := shim.CreateCompositeKey(objectType, attributes)
+        if err != nil {
+            return nil, err
+        }
+        return ledger.iterator(func(key string) bool {
+            return strings.HasPrefix(key, prefix)
+        }), nil
+    }
+    stub.GetHistoryForKeyStub = func(key string) (shim.HistoryQueryIteratorInterface, error) {
+        return &testHistoryIterator{modifications: ledger.history[key]}, nil
+    }
+
+    ctx := &mocks.TransactionContext{}
+    ctx.GetStubReturns(stub)
+    ctx.GetClientIdentityReturns(caller)
+    return ctx, writes
+}
+
+// iterator returns the committed keys matching a filter, in key order
+func (ledger *testLedger) iterator(match func(string) bool) *mocks.StateQueryIterator {
+    var results []*queryresult.KV
+    for _, key := range sortedKeys(ledger.state) {
+        if match(key) {
+            results = append(results, &queryresult.KV{Key: key, Value: ledger.state[key]})
+        }
+    }
+
+    iterator := &mocks.StateQueryIterator{}
+    iterator.HasNextStub = func() bool {
+        return len(results) > 0
+    }
+    iterator.NextStub = func() (*queryresult.KV, error) {
+        next := results[0]
+        results = results[1:]
+        return next, nil
+    }
+    return iterator
+}
+
+// put stores a value in the committed state, for fixtures that would otherwise need several transactions
+func (ledger *testLedger) put(key string, value interface{}) {
+    ledger.t.Helper()
+    valueJSON, err := json.Marshal(value)
+    require.NoError(ledger.t, err)
+    ledger.state[key] = valueJSON
+}
+
+// putPrivate stores a value in a private data collection
+func (ledger *testLedger) putPrivate(collection string, key string, value interface{}) {
+    ledger.t.Helper()
+    valueJSON, err := json.Marshal(value)
+    require.NoError(ledger.t, err)
+    ledger.private[privateDataKey(collection, key)] = valueJSON
+}
+
+// putComposite stores a value under a composite key
+func (ledger *testLedger) putComposite(objectType string, attributes []string, value interface{}) {
+    ledger.t.Helper()
+    key, err := shim.CreateCompositeKey(objectType, attributes)
+    require.NoError(ledger.t, err)
+    ledger.put(key, value)
+}
+
+// asset reads a committed patient record
+func (ledger *testLedger) asset(patientId string) *Asset {
+    ledger.t.Helper()
+    var asset Asset
+    require.NoError(ledger.t, json.Unmarshal(ledger.state[patientId], &asset))
+    return &asset
+}
+
+// prescription reads a committed prescription
+func (ledger *testLedger) prescription(patientId string, prescriptionId string) *Prescription {
+    ledger.t.Helper()
+    for _, prescription := range ledger.asset(patientId).Prescriptions {
+        if prescription.PrescriptionId == prescriptionId {
+            return &prescription
+        }
+    }
+    ledger.t.Fatalf("prescription %s not found", prescriptionId)
+    return nil
+}
+
+// testHistoryIterator iterates over the recorded modifications of a key
+type testHistoryIterator struct {
+    modifications []*queryresult.KeyModification
+}
+
+func (iterator *testHistoryIterator) HasNext() bool {
+    return len(iterator.modifications) > 0
+}
+
+func (iterator *testHistoryIterator) Next() (*queryresult.KeyModification, error) {
+    next := iterator.modifications[0]
+    iterator.modifications = iterator.modifications[1:]
+    return next, nil
+}
+
+func (iterator *testHistoryIterator) Close() error {
+    return nil
+}
+
+func sortedKeys(values map[string][]byte) []string {
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// seedFormulary stores formulary entries
+func (ledger *testLedger) seedFormulary(entries ...FormularyEntry) {
+    for _, entry := range entries {
+        ledger.putComposite(formularyObjectType, []string{entry.Code}, entry)
+    }
+}
+
+// grantConsent stores an active consent for a grantee
+func (ledger *testLedger) grantConsent(patientId string, granteeType string, granteeId string, scopes ...string) {
+    ledger.putComposite(consentObjectType, []string{patientId, "C-" + granteeId}, Consent{
+        ConsentId:   "C-" + granteeId,
+        PatientId:   patientId,
+        GranteeType: granteeType,
+        GranteeId:   granteeId,
+        Scopes:      scopes,
+        StartDate:   "2000-01-01",
+        Status:      "Active",
+    })
+}
+
+// putStock stores a facility's batch of a medication
+func (ledger *testLedger) putStock(item StockItem) {
+    ledger.putComposite(stockObjectType, []string{item.FacilityId, item.MedicationCode, item.BatchNumber}, item)
+}
+
+// stock reads a committed batch, or nil if the facility holds none
+func (ledger *testLedger) stock(facilityId string, medicationCode string, batchNumber string) *StockItem {
+    ledger.t.Helper()
+    key, err := shim.CreateCompositeKey(stockObjectType, []string{facilityId, medicationCode, batchNumber})
+    require.NoError(ledger.t, err)
+    if ledger.state[key] == nil {
+        return nil
+    }
+    var item StockItem
+    require.NoError(ledger.t, json.Unmarshal(ledger.state[key], &item))
+    return &item
+}
+
+// testCA issues enrolment certificates carrying Fabric CA attributes
+type testCA struct {
+    t      *testing.T
+    cert   *x509.Certificate
+    key    *ecdsa.PrivateKey
+    pem    string
+    serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    require.NoError(t, err)
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: name},
+        NotBefore:             time.Now().Add(-24 * time.Hour),
+        NotAfter:              time.Now().Add(24 * time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    require.NoError(t, err)
+    cert, err := x509.ParseCertificate(der)
+    require.NoError(t, err)
+    return &testCA{t: t, cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), serial: 1}
+}
+
+// testSigner is an enrolled identity's certificate and private key
+type testSigner struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pem  string
+}
+
+// enrol issues a certificate valid until notAfter with the given attributes
+func (ca *testCA) enrol(name string, attrs map[string]string, notAfter time.Time) *testSigner {
+    ca.t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    require.NoError(ca.t, err)
+    attributesJSON, err := json.Marshal(attrmgr.Attributes{Attrs: attrs})
+    require.NoError(ca.t, err)
+    ca.serial++
+    template := &x509.Certificate{
+        SerialNumber:    big.NewInt(ca.serial),
+        Subject:         pkix.Name{CommonName: name},
+        NotBefore:       time.Now().Add(-24 * time.Hour),
+        NotAfter:        notAfter,
+        KeyUsage:        x509.KeyUsageDigitalSignature,
+        ExtraExtensions: []pkix.Extension{{Id: attrmgr.AttrOID, Value: attributesJSON}},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+    require.NoError(ca.t, err)
+    cert, err := x509.ParseCertificate(der)
+    require.NoError(ca.t, err)
+    return &testSigner{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// prescriber enrols a doctor at KCH whose certificate names the prescriber ID
+func (ca *testCA) prescriber(prescriberId string) *testSigner {
+    return ca.enrol(prescriberId, map[string]string{"role": RoleDoctor, "prescriberId": prescriberId, "facilityId": "KCH"}, time.Now().Add(time.Hour))
+}
+
+// sign signs a prescription's canonical content and attaches the signer certificate, as the REST server does
+func (signer *testSigner) sign(t *testing.T, patientId string, prescription *Prescription) {
+    t.Helper()
+    content, err := canonicalPrescription(patientId, prescription)
+    require.NoError(t, err)
+    digest := sha256.Sum256(content)
+    signature, err := ecdsa.SignASN1(rand.Reader, signer.key, digest[:])
+    require.NoError(t, err)
+    prescription.Signature = base64.StdEncoding.EncodeToString(signature)
+    prescription.SignerCertificate = signer.pem
+}
+
+// trustSigners registers a CA for an organization's prescriber certificates
+func (ledger *testLedger) trustSigners(mspID string, ca *testCA) {
+    ledger.putComposite(configObjectType, []string{"signer-cas", mspID}, SignerCAs{MSPID: mspID, Certificates: []string{ca.pem}})
+}
@@ -0,0 +1,106 @@
+package chaincode
+
+import (
+    "fmt"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// GetMyRecord - lets a patient read their own record
+func (s *SmartContract) GetMyRecord(ctx contractapi.TransactionContextInterface) (*Asset, error) {
+    patientId, err := s.getCallerPatientId(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return s.readAsset(ctx, patientId)
+}
+
+// GetMyActivePrescriptions - lets a patient list their prescriptions that can still be dispensed
+func (s *SmartContract) GetMyActivePrescriptions(ctx contractapi.TransactionContextInterface) ([]Prescription, error) {
+    asset, err := s.GetMyRecord(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    active := []Prescription{}
+    for _, prescription := range asset.Prescriptions {
+        if prescription.Status == "Active" {
+            active = append(active, prescription)
+        }
+    }
+
+    return active, nil
+}
+
+// GetMyDispenseHistory - lets a patient see which of their prescriptions were dispensed, by whom and when
+func (s *SmartContract) GetMyDispenseHistory(ctx contractapi.TransactionContextInterface) ([]map[string]interface{}, error) {
+    asset, err := s.GetMyRecord(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    dispensed := []map[string]interface{}{}
+    for _, prescription := range asset.Prescriptions {
+        if prescription.DispensingPharmacist == "" {
+            continue
+        }
+        dispensed = append(dispensed, map[string]interface{}{
+            "PrescriptionId":       prescription.PrescriptionId,
+            "MedicationName":       prescription.MedicationName,
+            "Dosage":               prescription.Dosage,
+            "Instructions":         prescription.Instructions,
+            "Status":               prescription.Status,
+            "CreatedBy":            prescription.CreatedBy,
+            "DispensingPharmacist": prescription.DispensingPharmacist,
+            "DispensingTimestamp":  prescription.DispensingTimestamp,
+            "DispensedBatch":       prescription.DispensedBatch,
+            "DispensedName":        prescription.DispensedName,
+            "DispensedStrength":    prescription.DispensedStrength,
+            "Substituted":          prescription.Substituted,
+            "SubstitutionReason":   prescription.SubstitutionReason,
+            "Recalled":             prescription.Recalled,
+            "RecallReason":         prescription.RecallReason,
+        })
+    }
+
+    return dispensed, nil
+}
+
+// GetMyConsents - lets a patient list the consents they have granted
+func (s *SmartContract) GetMyConsents(ctx contractapi.TransactionContextInterface) ([]*Consent, error) {
+    patientId, err := s.getCallerPatientId(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return s.listConsents(ctx, patientId)
+}
+
+// GetMyAccessLog - lets a patient see who viewed their record
+func (s *SmartContract) GetMyAccessLog(ctx contractapi.TransactionContextInterface) ([]*AccessRecord, error) {
+    patientId, err := s.getCallerPatientId(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return s.GetAccessLog(ctx, patientId)
+}
+
+// getCallerPatientId returns the patient ID of a caller holding the patient role
+func (s *SmartContract) getCallerPatientId(ctx contractapi.TransactionContextInterface) (string, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return "", err
+    }
+    if role != RolePatient {
+        return "", fmt.Errorf("only patients can access their own record")
+    }
+
+    patientId, ok, err := ctx.GetClientIdentity().GetAttributeValue("patientId")
+    if err != nil {
+        return "", fmt.Errorf("failed to get patientId attribute: %v", err)
+    }
+    if !ok || patientId == "" {
+        return "", fmt.Errorf("patientId attribute not found in certificate")
+    }
+
+    return patientId, nil
+}
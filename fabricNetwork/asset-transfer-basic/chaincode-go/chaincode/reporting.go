@@ -0,0 +1,277 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// antibioticAtcPrefix is the ATC group of antibacterials for systemic use, counted in the antibiotic share
+const antibioticAtcPrefix = "J01"
+
+// FacilityIndicators are one facility's pharmaceutical indicators for a reporting period
+type FacilityIndicators struct {
+    FacilityId              string  `json:"FacilityId"`
+    PrescriptionsIssued     int     `json:"PrescriptionsIssued"`     // issued by the facility's prescribers, less rejected ones
+    PrescriptionsDispensed  int     `json:"PrescriptionsDispensed"`  // dispensed by the facility's pharmacy
+    PrescriptionsRevoked    int     `json:"PrescriptionsRevoked"`    // issued by the facility and revoked in the period
+    AntibioticPrescriptions int     `json:"AntibioticPrescriptions"` // issued prescriptions for systemic antibacterials
+    AntibioticShare         float64 `json:"AntibioticShare"`         // percentage of issued prescriptions that are antibiotics
+    StockOuts               int     `json:"StockOuts"`               // medications whose stock on hand fell to zero
+}
+
+// stockVersion is one written version of a stock batch, read from the key history
+type stockVersion struct {
+    batchNumber string
+    quantity    int
+    at          time.Time
+    txID        string
+}
+
+// GetFacilityIndicators - computes every facility's prescribing, dispensing and stock indicators between two dates,
+// for aggregate reporting to the Ministry. Only regulators and administrators can compute them.
+func (s *SmartContract) GetFacilityIndicators(ctx contractapi.TransactionContextInterface, startDate string, endDate string) ([]*FacilityIndicators, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator && role != RoleAdmin {
+        return nil, fmt.Errorf("only regulators and administrators can compute facility indicators")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    start, end, err := parseDateRange(startDate, endDate, now)
+    if err != nil {
+        return nil, err
+    }
+
+    facilities := map[string]*FacilityIndicators{}
+    indicatorsFor := func(facilityId string) *FacilityIndicators {
+        indicators, ok := facilities[facilityId]
+        if !ok {
+            indicators = &FacilityIndicators{FacilityId: facilityId}
+            facilities[facilityId] = indicators
+        }
+        return indicators
+    }
+
+    if err := s.countPrescriptions(ctx, start, end, indicatorsFor); err != nil {
+        return nil, err
+    }
+    if err := s.countStockOuts(ctx, start, end, indicatorsFor); err != nil {
+        return nil, err
+    }
+
+    results := make([]*FacilityIndicators, 0, len(facilities))
+    for _, indicators := range facilities {
+        if indicators.PrescriptionsIssued > 0 {
+            share := float64(indicators.AntibioticPrescriptions) * 100 / float64(indicators.PrescriptionsIssued)
+            indicators.AntibioticShare = float64(int(share*10+0.5)) / 10
+        }
+        results = append(results, indicators)
+    }
+    sort.Slice(results, func(i, j int) bool {
+        return results[i].FacilityId < results[j].FacilityId
+    })
+
+    return results, nil
+}
+
+// countPrescriptions counts issued, dispensed and revoked prescriptions by facility. Prescriptions written before
+// facilities were recorded cannot be attributed and are left out.
+func (s *SmartContract) countPrescriptions(ctx contractapi.TransactionContextInterface, start time.Time, end time.Time, indicatorsFor func(string) *FacilityIndicators) error {
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return err
+    }
+    defer iterator.Close()
+
+    antibiotics := map[string]bool{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return err
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            return err
+        }
+
+        for _, prescription := range asset.Prescriptions {
+            // Records written before IssuedAt and RevokedAt existed fall back to the last change
+            issuedAt := prescriptionIssuedAt(&prescription)
+            revokedAt := prescription.RevokedAt
+            if revokedAt == "" {
+                revokedAt = prescription.Timestamp
+            }
+
+            if prescription.PrescriberFacility != "" && prescription.Status != StatusRejected && withinPeriod(issuedAt, start, end) {
+                indicators := indicatorsFor(prescription.PrescriberFacility)
+                indicators.PrescriptionsIssued++
+                antibiotic, err := s.isAntibiotic(ctx, prescription.MedicationCode, antibiotics)
+                if err != nil {
+                    return err
+                }
+                if antibiotic {
+                    indicators.AntibioticPrescriptions++
+                }
+            }
+            if prescription.DispensingFacility != "" && withinPeriod(prescription.DispensingTimestamp, start, end) {
+                indicatorsFor(prescription.DispensingFacility).PrescriptionsDispensed++
+            }
+            if prescription.PrescriberFacility != "" && prescription.Status == "Revoked" && withinPeriod(revokedAt, start, end) {
+                indicatorsFor(prescription.PrescriberFacility).PrescriptionsRevoked++
+            }
+        }
+    }
+
+    return nil
+}
+
+// isAntibiotic reports whether a formulary code is a systemic antibacterial, caching the lookups
+func (s *SmartContract) isAntibiotic(ctx contractapi.TransactionContextInterface, medicationCode string, cache map[string]bool) (bool, error) {
+    if medicationCode == "" {
+        return false, nil
+    }
+    if antibiotic, ok := cache[medicationCode]; ok {
+        return antibiotic, nil
+    }
+    entry, err := s.GetFormularyEntry(ctx, medicationCode)
+    if err != nil {
+        return false, err
+    }
+    cache[medicationCode] = strings.HasPrefix(entry.AtcCode, antibioticAtcPrefix)
+    return cache[medicationCode], nil
+}
+
+// countStockOuts replays the history of every stock batch and counts, per facility, the medications whose total
+// stock on hand fell to zero during the period
+func (s *SmartContract) countStockOuts(ctx contractapi.TransactionContextInterface, start time.Time, end time.Time, indicatorsFor func(string) *FacilityIndicators) error {
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(stockObjectType, []string{})
+    if err != nil {
+        return err
+    }
+    defer iterator.Close()
+
+    // Versions of every batch, by facility and medication
+    versions := map[string]map[string][]stockVersion{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return err
+        }
+        batchVersions, err := stockHistory(ctx, queryResponse.Key)
+        if err != nil {
+            return err
+        }
+
+        var item StockItem
+        if err := json.Unmarshal(queryResponse.Value, &item); err != nil {
+            return err
+        }
+        if versions[item.FacilityId] == nil {
+            versions[item.FacilityId] = map[string][]stockVersion{}
+        }
+        versions[item.FacilityId][item.MedicationCode] = append(versions[item.FacilityId][item.MedicationCode], batchVersions...)
+    }
+
+    for facilityId, medications := range versions {
+        for _, medicationVersions := range medications {
+            if stockedOut(medicationVersions, start, end) {
+                indicatorsFor(facilityId).StockOuts++
+            }
+        }
+    }
+
+    return nil
+}
+
+// stockHistory reads every version of a stock batch
+func stockHistory(ctx contractapi.TransactionContextInterface, key string) ([]stockVersion, error) {
+    historyIterator, err := ctx.GetStub().GetHistoryForKey(key)
+    if err != nil {
+        return nil, err
+    }
+    defer historyIterator.Close()
+
+    var history []stockVersion
+    for historyIterator.HasNext() {
+        historyData, err := historyIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+        if historyData.IsDelete || historyData.Value == nil {
+            continue
+        }
+
+        var item StockItem
+        if err := json.Unmarshal(historyData.Value, &item); err != nil {
+            return nil, err
+        }
+        history = append(history, stockVersion{
+            batchNumber: item.BatchNumber,
+            quantity:    item.Quantity,
+            at:          historyData.Timestamp.AsTime(),
+            txID:        historyData.TxId,
+        })
+    }
+
+    return history, nil
+}
+
+// stockedOut replays the versions of a medication's batches in commit order and reports whether the total fell from
+// some stock to none within the period. The total is only checked once all of a transaction's writes are applied.
+func stockedOut(versions []stockVersion, start time.Time, end time.Time) bool {
+    sort.SliceStable(versions, func(i, j int) bool {
+        if !versions[i].at.Equal(versions[j].at) {
+            return versions[i].at.Before(versions[j].at)
+        }
+        return versions[i].txID < versions[j].txID
+    })
+
+    batches := map[string]int{}
+    total, before := 0, 0
+    for i, version := range versions {
+        total += version.quantity - batches[version.batchNumber]
+        batches[version.batchNumber] = version.quantity
+
+        if i+1 < len(versions) && versions[i+1].txID == version.txID {
+            continue
+        }
+        if before > 0 && total <= 0 && !version.at.Before(start) && version.at.Before(end) {
+            return true
+        }
+        before = total
+    }
+
+    return false
+}
+
+// prescriptionIssuedAt returns when a prescription was issued. Timestamp moves with every change, so it is only
+// used for records written before IssuedAt existed.
+func prescriptionIssuedAt(prescription *Prescription) string {
+    if prescription.IssuedAt != "" {
+        return prescription.IssuedAt
+    }
+    return prescription.Timestamp
+}
+
+// withinPeriod reports whether a timestamp falls in [start, end)
+func withinPeriod(value string, start time.Time, end time.Time) bool {
+    if value == "" {
+        return false
+    }
+    t, err := parseDate(value)
+    if err != nil {
+        return false
+    }
+    return !t.Before(start) && t.Before(end)
+}
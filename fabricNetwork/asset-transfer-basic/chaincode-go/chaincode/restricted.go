@@ -0,0 +1,267 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// Statuses used by the restricted medicine approval workflow
+const (
+    StatusPendingApproval = "PendingApproval"
+    StatusRejected        = "Rejected"
+)
+
+// RestrictedDrug is a medicine that needs a second approval before it can be dispensed
+type RestrictedDrug struct {
+    MedicationCode string   `json:"MedicationCode,omitempty"` // formulary code; matched before the name
+    MedicationName string   `json:"MedicationName"`
+    Category       string   `json:"Category,omitempty"`      // e.g. reserve antibiotic, opioid, oncology
+    ApproverRoles  []string `json:"ApproverRoles,omitempty"` // roles allowed to approve, doctors if empty
+}
+
+// RestrictedDrugList is the configurable list of restricted medicines held on the ledger
+type RestrictedDrugList struct {
+    Drugs     []RestrictedDrug `json:"Drugs"`
+    UpdatedBy string           `json:"UpdatedBy,omitempty"`
+    UpdatedAt string           `json:"UpdatedAt,omitempty"`
+    TxID      string           `json:"TxID,omitempty"`
+}
+
+// GetRestrictedDrugs - returns the list of medicines that need approval before dispensing
+func (s *SmartContract) GetRestrictedDrugs(ctx contractapi.TransactionContextInterface) (*RestrictedDrugList, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"restricted-drugs"})
+    if err != nil {
+        return nil, err
+    }
+    listJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if listJSON == nil {
+        return &RestrictedDrugList{Drugs: []RestrictedDrug{}}, nil
+    }
+
+    var list RestrictedDrugList
+    if err := json.Unmarshal(listJSON, &list); err != nil {
+        return nil, err
+    }
+    return &list, nil
+}
+
+// SetRestrictedDrugs - replaces the restricted medicine list; admins only
+func (s *SmartContract) SetRestrictedDrugs(ctx contractapi.TransactionContextInterface, listJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin {
+        return fmt.Errorf("only admins can change the restricted drug list")
+    }
+
+    var list RestrictedDrugList
+    if err := json.Unmarshal([]byte(listJSON), &list); err != nil {
+        return fmt.Errorf("failed to parse restricted drug list JSON: %v", err)
+    }
+    for _, drug := range list.Drugs {
+        if drug.MedicationName == "" {
+            return fmt.Errorf("medicationName is required for every restricted drug")
+        }
+        for _, r := range drug.ApproverRoles {
+            if !containsString(knownRoles, r) {
+                return fmt.Errorf("unknown approver role '%s' for %s", r, drug.MedicationName)
+            }
+        }
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    list.UpdatedBy = callerId
+    list.UpdatedAt = now.Format(time.RFC3339)
+    list.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"restricted-drugs"})
+    if err != nil {
+        return err
+    }
+    listBytes, err := json.Marshal(list)
+    if err != nil {
+        return err
+    }
+    return s.putConfig(ctx, key, listBytes)
+}
+
+// ApprovePrescription - approves a restricted medicine prescription so it can be dispensed
+func (s *SmartContract) ApprovePrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string, note string) error {
+    return s.reviewPrescription(ctx, patientId, prescriptionId, "Active", note)
+}
+
+// RejectPrescription - rejects a restricted medicine prescription; a reason is required
+func (s *SmartContract) RejectPrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string, reason string) error {
+    if strings.TrimSpace(reason) == "" {
+        return fmt.Errorf("a reason is required to reject a prescription")
+    }
+    return s.reviewPrescription(ctx, patientId, prescriptionId, StatusRejected, reason)
+}
+
+// GetPendingApprovals - lists restricted medicine prescriptions the caller's role can approve
+func (s *SmartContract) GetPendingApprovals(ctx contractapi.TransactionContextInterface) ([]map[string]interface{}, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    pending := []map[string]interface{}{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            continue
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            continue
+        }
+
+        // Skip patients who have not consented to the caller reading their record
+        if s.requireConsent(ctx, asset.PatientId, ScopeRead, ScopePrescribe) != nil {
+            continue
+        }
+
+        for _, prescription := range asset.Prescriptions {
+            if prescription.Status != StatusPendingApproval {
+                continue
+            }
+            drug, err := s.findApprovalRule(ctx, prescription.MedicationCode, prescription.MedicationName)
+            if err != nil {
+                return nil, err
+            }
+            if !drug.canApprove(role) {
+                continue
+            }
+            pending = append(pending, map[string]interface{}{
+                "PrescriptionId": prescription.PrescriptionId,
+                "PatientId":      asset.PatientId,
+                "MedicationName": prescription.MedicationName,
+                "Dosage":         prescription.Dosage,
+                "Instructions":   prescription.Instructions,
+                "CreatedBy":      prescription.CreatedBy,
+                "Timestamp":      prescription.Timestamp,
+            })
+        }
+    }
+
+    return pending, nil
+}
+
+// reviewPrescription moves a pending restricted prescription to the given status on behalf of an approver
+func (s *SmartContract) reviewPrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string, status string, note string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if err := s.requireConsent(ctx, patientId, ScopeRead, ScopePrescribe); err != nil {
+        return err
+    }
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    timestamp, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    found := false
+    for i := range asset.Prescriptions {
+        if asset.Prescriptions[i].PrescriptionId == prescriptionId {
+            if asset.Prescriptions[i].Status != StatusPendingApproval {
+                return fmt.Errorf("prescription %s is not pending approval", prescriptionId)
+            }
+            if asset.Prescriptions[i].IssuedBy == callerId {
+                return fmt.Errorf("a prescriber cannot approve their own prescription")
+            }
+            drug, err := s.findApprovalRule(ctx, asset.Prescriptions[i].MedicationCode, asset.Prescriptions[i].MedicationName)
+            if err != nil {
+                return err
+            }
+            if !drug.canApprove(role) {
+                return fmt.Errorf("role '%s' cannot approve %s", role, drug.MedicationName)
+            }
+
+            now := timestamp.Format(time.RFC3339)
+            asset.Prescriptions[i].Status = status
+            asset.Prescriptions[i].ReviewedBy = callerId
+            asset.Prescriptions[i].ReviewedAt = now
+            asset.Prescriptions[i].ReviewNote = note
+            asset.Prescriptions[i].TxID = ctx.GetStub().GetTxID()
+            asset.Prescriptions[i].Timestamp = now
+            found = true
+            break
+        }
+    }
+
+    if !found {
+        return fmt.Errorf("prescription %s not found", prescriptionId)
+    }
+
+    asset.LastUpdated = timestamp.Format(time.RFC3339)
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(patientId, assetJSON)
+}
+
+// findRestrictedDrug returns the restricted drug entry matching the medication, or nil if it is not restricted
+func (s *SmartContract) findRestrictedDrug(ctx contractapi.TransactionContextInterface, medicationCode string, medicationName string) (*RestrictedDrug, error) {
+    list, err := s.GetRestrictedDrugs(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for i := range list.Drugs {
+        if matchesMedication(list.Drugs[i].MedicationCode, list.Drugs[i].MedicationName, medicationCode, medicationName) {
+            return &list.Drugs[i], nil
+        }
+    }
+    return nil, nil
+}
+
+// findApprovalRule returns the restricted drug entry governing approval of a pending prescription. A medicine
+// taken off the list after it was prescribed still needs approval, by doctors as for an entry without approver roles.
+func (s *SmartContract) findApprovalRule(ctx contractapi.TransactionContextInterface, medicationCode string, medicationName string) (*RestrictedDrug, error) {
+    drug, err := s.findRestrictedDrug(ctx, medicationCode, medicationName)
+    if err != nil || drug != nil {
+        return drug, err
+    }
+    return &RestrictedDrug{MedicationCode: medicationCode, MedicationName: medicationName}, nil
+}
+
+// canApprove reports whether the role may approve prescriptions for this drug
+func (d *RestrictedDrug) canApprove(role string) bool {
+    if len(d.ApproverRoles) == 0 {
+        return role == RoleDoctor
+    }
+    return containsString(d.ApproverRoles, role)
+}
@@ -0,0 +1,106 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRestrictedApprovalRoles(t *testing.T) {
+    issuer := doctor("dr-banda")
+    clinicalOfficer := newIdentity("co-phiri", "Org1MSP", map[string]string{"role": RoleClinicalOfficer, "facilityId": "KCH"})
+    meropenem := RestrictedDrug{MedicationCode: "J01DH02", MedicationName: "Meropenem"}
+    morphine := RestrictedDrug{MedicationCode: "N02AA01", MedicationName: "Morphine", ApproverRoles: []string{RolePharmacist}}
+
+    tests := []struct {
+        name    string
+        listed  []RestrictedDrug
+        rx      Prescription
+        caller  *testIdentity
+        wantErr string
+    }{
+        {name: "doctor approves by default", listed: []RestrictedDrug{meropenem}, rx: Prescription{MedicationCode: "J01DH02", MedicationName: "Meropenem"}, caller: doctor("dr-phiri")},
+        {name: "clinical officer cannot approve by default", listed: []RestrictedDrug{meropenem}, rx: Prescription{MedicationCode: "J01DH02", MedicationName: "Meropenem"}, caller: clinicalOfficer, wantErr: "cannot approve"},
+        {name: "configured approver role", listed: []RestrictedDrug{morphine}, rx: Prescription{MedicationCode: "N02AA01", MedicationName: "Morphine"}, caller: pharmacist("ph-mwale")},
+        {name: "doctor outside configured roles", listed: []RestrictedDrug{morphine}, rx: Prescription{MedicationCode: "N02AA01", MedicationName: "Morphine"}, caller: doctor("dr-phiri"), wantErr: "cannot approve"},
+        {name: "delisted drug falls back to doctors", rx: Prescription{MedicationCode: "N02AA01", MedicationName: "Morphine"}, caller: doctor("dr-phiri")},
+        {name: "delisted drug is not approvable by other roles", rx: Prescription{MedicationCode: "N02AA01", MedicationName: "Morphine"}, caller: pharmacist("ph-mwale"), wantErr: "cannot approve"},
+        {name: "prescriber cannot approve own prescription", listed: []RestrictedDrug{meropenem}, rx: Prescription{MedicationCode: "J01DH02", MedicationName: "Meropenem"}, caller: issuer, wantErr: "own prescription"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.putComposite(configObjectType, []string{"restricted-drugs"}, RestrictedDrugList{Drugs: tt.listed})
+            rx := tt.rx
+            rx.PrescriptionId, rx.Status, rx.IssuedBy = "RX1", StatusPendingApproval, issuer.id
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{rx}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopeRead, ScopePrescribe)
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeRead, ScopeDispense)
+            contract := &SmartContract{}
+
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                return contract.ApprovePrescription(ctx, "P1", "RX1", "Indicated")
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, StatusPendingApproval, ledger.prescription("P1", "RX1").Status)
+                return
+            }
+            require.NoError(t, err)
+            approved := ledger.prescription("P1", "RX1")
+            require.Equal(t, "Active", approved.Status)
+            require.Equal(t, tt.caller.id, approved.ReviewedBy)
+
+            ctx, _ := ledger.context(tt.caller)
+            pending, err := contract.GetPendingApprovals(ctx)
+            require.NoError(t, err)
+            require.Empty(t, pending)
+        })
+    }
+}
+
+func TestUpdateRestrictedPrescriptionNeedsApprovalAgain(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ca := newTestCA(t, "ca.org1")
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name       string
+        listed     []RestrictedDrug
+        wantStatus string
+    }{
+        {name: "restricted drug", listed: []RestrictedDrug{{MedicationCode: "MERO", MedicationName: "Meropenem"}}, wantStatus: StatusPendingApproval},
+        {name: "drug no longer restricted", wantStatus: "Active"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "MERO", AtcCode: "J01DH02", GenericName: "Meropenem", Strengths: []string{"500mg", "1g"}, DosageForms: []string{"injection"}})
+            ledger.putComposite(configObjectType, []string{"restricted-drugs"}, RestrictedDrugList{Drugs: tt.listed})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationCode: "MERO", MedicationName: "Meropenem", Strength: "500mg", DosageForm: "injection",
+                Status: "Active", CreatedBy: "DOC1", IssuedBy: prescriber.id,
+                ReviewedBy: "x509::CN=dr-phiri", ReviewedAt: "2025-01-01T08:00:00Z", ReviewNote: "Culture sensitive",
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.trustSigners("Org1MSP", ca)
+
+            ledger.mustSubmit(prescriber, updatePrescription(t, contract, ca.prescriber("DOC1"),
+                `{"PrescriptionId":"RX1","MedicationCode":"MERO","Strength":"1g","DosageForm":"injection","Dosage":"1g every 8 hours","ExpiryDate":"2999-01-01"}`))
+
+            updated := ledger.prescription("P1", "RX1")
+            require.Equal(t, tt.wantStatus, updated.Status)
+            require.Equal(t, "1g", updated.Strength)
+            if tt.wantStatus == StatusPendingApproval {
+                require.Empty(t, updated.ReviewedBy)
+                require.Empty(t, updated.ReviewedAt)
+                require.Empty(t, updated.ReviewNote)
+            } else {
+                require.Equal(t, "Culture sensitive", updated.ReviewNote)
+            }
+        })
+    }
+}
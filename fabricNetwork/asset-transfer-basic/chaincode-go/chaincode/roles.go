@@ -0,0 +1,214 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/pkg/statebased"
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// Roles recognised in the "role" certificate attribute
+const (
+    RoleDoctor             = "doctor"
+    RoleClinicalOfficer    = "clinical_officer"
+    RoleNursePrescriber    = "nurse_prescriber"
+    RolePharmacist         = "pharmacist"
+    RolePharmacyTechnician = "pharmacy_technician"
+    RoleRegulator          = "regulator"
+    RoleAdmin              = "admin"
+    RolePatient            = "patient"
+    RoleSupplier           = "supplier"
+)
+
+var knownRoles = []string{
+    RoleDoctor,
+    RoleClinicalOfficer,
+    RoleNursePrescriber,
+    RolePharmacist,
+    RolePharmacyTechnician,
+    RoleRegulator,
+    RoleAdmin,
+    RolePatient,
+    RoleSupplier,
+}
+
+const configObjectType = "config"
+
+// RoleMapping lists, for each MSP, the roles its members may hold, and the MSPs whose peers must
+// all endorse a change to the ledger configuration
+type RoleMapping struct {
+    MSPRoles        map[string][]string `json:"MSPRoles"`
+    ConfigEndorsers []string            `json:"ConfigEndorsers"`
+    UpdatedBy       string              `json:"UpdatedBy,omitempty"`
+    UpdatedAt       string              `json:"UpdatedAt,omitempty"`
+    TxID            string              `json:"TxID,omitempty"`
+}
+
+// defaultRoleMapping applies until an admin stores a mapping on the ledger
+func defaultRoleMapping() *RoleMapping {
+    return &RoleMapping{
+        MSPRoles: map[string][]string{
+            "Org1MSP": {RoleDoctor, RoleClinicalOfficer, RoleNursePrescriber, RoleRegulator, RoleAdmin}, // Health facilities and the regulator
+            "Org2MSP": {RolePharmacist, RolePharmacyTechnician, RoleSupplier},                          // Pharmacies and medical stores
+            "Org3MSP": {RolePatient},                                                                   // Patients
+        },
+        // The regulator and admins share Org1, so configuration changes also need the pharmacies' endorsement
+        ConfigEndorsers: []string{"Org1MSP", "Org2MSP"},
+    }
+}
+
+// GetRoleMapping - returns the MSP-to-roles mapping currently in force
+func (s *SmartContract) GetRoleMapping(ctx contractapi.TransactionContextInterface) (*RoleMapping, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"roles"})
+    if err != nil {
+        return nil, err
+    }
+    mappingJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if mappingJSON == nil {
+        return defaultRoleMapping(), nil
+    }
+
+    var mapping RoleMapping
+    if err := json.Unmarshal(mappingJSON, &mapping); err != nil {
+        return nil, err
+    }
+    // Mappings stored before config endorsers were recorded keep the default endorsers
+    if len(mapping.ConfigEndorsers) == 0 {
+        mapping.ConfigEndorsers = defaultRoleMapping().ConfigEndorsers
+    }
+    return &mapping, nil
+}
+
+// SetRoleMapping - replaces the MSP-to-roles mapping, so new organizations and cadres can be
+// admitted without a chaincode upgrade. Only admins may call it, the new mapping must keep
+// at least one MSP able to hold the admin role, and at least two MSPs must endorse configuration changes.
+func (s *SmartContract) SetRoleMapping(ctx contractapi.TransactionContextInterface, mappingJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin {
+        return fmt.Errorf("only admins can change the role mapping")
+    }
+
+    var mapping RoleMapping
+    if err := json.Unmarshal([]byte(mappingJSON), &mapping); err != nil {
+        return fmt.Errorf("failed to parse role mapping JSON: %v", err)
+    }
+    if len(mapping.MSPRoles) == 0 {
+        return fmt.Errorf("role mapping must list at least one MSP")
+    }
+
+    hasAdmin := false
+    for mspID, roles := range mapping.MSPRoles {
+        if mspID == "" {
+            return fmt.Errorf("MSP ID cannot be empty")
+        }
+        if len(roles) == 0 {
+            return fmt.Errorf("MSP %s must allow at least one role", mspID)
+        }
+        for _, r := range roles {
+            if !containsString(knownRoles, r) {
+                return fmt.Errorf("unknown role '%s' for MSP %s", r, mspID)
+            }
+            if r == RoleAdmin {
+                hasAdmin = true
+            }
+        }
+    }
+    if !hasAdmin {
+        return fmt.Errorf("role mapping must allow the %s role for at least one MSP", RoleAdmin)
+    }
+    endorsers := map[string]bool{}
+    for _, mspID := range mapping.ConfigEndorsers {
+        if _, ok := mapping.MSPRoles[mspID]; !ok {
+            return fmt.Errorf("config endorser %s is not in the role mapping", mspID)
+        }
+        endorsers[mspID] = true
+    }
+    if len(endorsers) < 2 {
+        return fmt.Errorf("role mapping must name at least two MSPs to endorse configuration changes")
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    mapping.UpdatedBy = callerId
+    mapping.UpdatedAt = now.Format(time.RFC3339)
+    mapping.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"roles"})
+    if err != nil {
+        return err
+    }
+    mappingBytes, err := json.Marshal(mapping)
+    if err != nil {
+        return err
+    }
+    if err := ctx.GetStub().PutState(key, mappingBytes); err != nil {
+        return err
+    }
+    if err := setConfigEndorsement(ctx, key, mapping.ConfigEndorsers); err != nil {
+        return err
+    }
+    return ctx.GetStub().SetEvent("RoleMappingUpdated", mappingBytes)
+}
+
+// putConfig writes a configuration entry (role mapping, signer CAs, drug lists, dose ranges, formulary) and
+// sets a key-level endorsement policy on it, so that later changes are only valid when the peers of every
+// config endorser in the role mapping endorse them and no single organization's admin can make them alone.
+func (s *SmartContract) putConfig(ctx contractapi.TransactionContextInterface, key string, value []byte) error {
+    mapping, err := s.GetRoleMapping(ctx)
+    if err != nil {
+        return err
+    }
+    if err := ctx.GetStub().PutState(key, value); err != nil {
+        return err
+    }
+    return setConfigEndorsement(ctx, key, mapping.ConfigEndorsers)
+}
+
+// setConfigEndorsement requires the peers of all the given MSPs to endorse changes to the key
+func setConfigEndorsement(ctx contractapi.TransactionContextInterface, key string, mspIDs []string) error {
+    endorsement, err := statebased.NewStateEP(nil)
+    if err != nil {
+        return err
+    }
+    if err := endorsement.AddOrgs(statebased.RoleTypePeer, mspIDs...); err != nil {
+        return err
+    }
+    policy, err := endorsement.Policy()
+    if err != nil {
+        return fmt.Errorf("failed to build endorsement policy: %v", err)
+    }
+    return ctx.GetStub().SetStateValidationParameter(key, policy)
+}
+
+// isPrescriberRole reports whether the role may issue prescriptions
+func isPrescriberRole(role string) bool {
+    return role == RoleDoctor || role == RoleClinicalOfficer || role == RoleNursePrescriber
+}
+
+// isDispenserRole reports whether the role may dispense prescriptions
+func isDispenserRole(role string) bool {
+    return role == RolePharmacist || role == RolePharmacyTechnician
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
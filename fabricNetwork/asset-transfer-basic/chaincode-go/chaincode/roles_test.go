@@ -0,0 +1,156 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/pkg/statebased"
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+
+    "github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+)
+
+// configEndorsers returns the MSPs whose peers must endorse changes to a key, from the transaction's
+// key-level endorsement policy
+func configEndorsers(t *testing.T, stub *mocks.ChaincodeStub, key string) []string {
+    t.Helper()
+    for i := 0; i < stub.SetStateValidationParameterCallCount(); i++ {
+        parameterKey, policy := stub.SetStateValidationParameterArgsForCall(i)
+        if parameterKey == key {
+            endorsement, err := statebased.NewStateEP(policy)
+            require.NoError(t, err)
+            return endorsement.ListOrgs()
+        }
+    }
+    t.Fatalf("no endorsement policy set on %q", key)
+    return nil
+}
+
+func TestSetRoleMapping(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name          string
+        caller        *testIdentity
+        mapping       string
+        wantErr       string
+        wantEndorsers []string
+    }{
+        {
+            name:          "two endorsers",
+            caller:        admin("admin-kumwenda"),
+            mapping:       `{"MSPRoles":{"Org1MSP":["doctor"],"Org2MSP":["pharmacist"],"Org4MSP":["regulator","admin"]},"ConfigEndorsers":["Org2MSP","Org4MSP"]}`,
+            wantEndorsers: []string{"Org2MSP", "Org4MSP"},
+        },
+        {
+            name:    "single endorser",
+            caller:  admin("admin-kumwenda"),
+            mapping: `{"MSPRoles":{"Org1MSP":["doctor","admin"],"Org2MSP":["pharmacist"]},"ConfigEndorsers":["Org1MSP","Org1MSP"]}`,
+            wantErr: "at least two MSPs",
+        },
+        {
+            name:    "no endorsers",
+            caller:  admin("admin-kumwenda"),
+            mapping: `{"MSPRoles":{"Org1MSP":["doctor","admin"],"Org2MSP":["pharmacist"]}}`,
+            wantErr: "at least two MSPs",
+        },
+        {
+            name:    "endorser outside the mapping",
+            caller:  admin("admin-kumwenda"),
+            mapping: `{"MSPRoles":{"Org1MSP":["doctor","admin"],"Org2MSP":["pharmacist"]},"ConfigEndorsers":["Org1MSP","Org9MSP"]}`,
+            wantErr: "config endorser Org9MSP is not in the role mapping",
+        },
+        {
+            name:    "no admin role",
+            caller:  admin("admin-kumwenda"),
+            mapping: `{"MSPRoles":{"Org1MSP":["doctor"],"Org2MSP":["pharmacist"]},"ConfigEndorsers":["Org1MSP","Org2MSP"]}`,
+            wantErr: "must allow the admin role",
+        },
+        {
+            name:    "regulator",
+            caller:  regulator("reg-phiri"),
+            mapping: `{"MSPRoles":{"Org1MSP":["doctor","admin"],"Org2MSP":["pharmacist"]},"ConfigEndorsers":["Org1MSP","Org2MSP"]}`,
+            wantErr: "only admins can change the role mapping",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ctx, _ := ledger.context(tt.caller)
+            err := contract.SetRoleMapping(ctx, tt.mapping)
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"roles"})
+            require.NoError(t, err)
+            require.ElementsMatch(t, tt.wantEndorsers, configEndorsers(t, ctx.GetStub().(*mocks.ChaincodeStub), key))
+        })
+    }
+}
+
+func TestConfigWritesRequireEndorsers(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name          string
+        storedMapping *RoleMapping
+        wantEndorsers []string
+    }{
+        {name: "default mapping", wantEndorsers: []string{"Org1MSP", "Org2MSP"}},
+        {
+            name: "stored mapping",
+            storedMapping: &RoleMapping{
+                MSPRoles:        map[string][]string{"Org1MSP": {RoleDoctor, RoleAdmin}, "Org2MSP": {RolePharmacist}, "Org3MSP": {RolePatient}},
+                ConfigEndorsers: []string{"Org1MSP", "Org2MSP", "Org3MSP"},
+            },
+            wantEndorsers: []string{"Org1MSP", "Org2MSP", "Org3MSP"},
+        },
+        {
+            name:          "mapping stored before config endorsers",
+            storedMapping: &RoleMapping{MSPRoles: map[string][]string{"Org1MSP": {RoleDoctor, RoleAdmin}, "Org2MSP": {RolePharmacist}}},
+            wantEndorsers: []string{"Org1MSP", "Org2MSP"},
+        },
+    }
+
+    writes := []struct {
+        name        string
+        key         []string
+        transaction func(ctx contractapi.TransactionContextInterface) error
+    }{
+        {
+            name: "restricted drugs",
+            key:  []string{"restricted-drugs"},
+            transaction: func(ctx contractapi.TransactionContextInterface) error {
+                return contract.SetRestrictedDrugs(ctx, `{"Drugs":[{"MedicationName":"Meropenem"}]}`)
+            },
+        },
+        {
+            name: "controlled drugs",
+            key:  []string{"controlled-drugs"},
+            transaction: func(ctx contractapi.TransactionContextInterface) error {
+                return contract.SetControlledDrugs(ctx, `{"Drugs":[{"MedicationName":"Morphine","Schedule":"II","MaxQuantity":30}]}`)
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        for _, write := range writes {
+            t.Run(tt.name+"/"+write.name, func(t *testing.T) {
+                ledger := newTestLedger(t)
+                if tt.storedMapping != nil {
+                    ledger.putComposite(configObjectType, []string{"roles"}, tt.storedMapping)
+                }
+                ctx, _ := ledger.context(admin("admin-kumwenda"))
+                require.NoError(t, write.transaction(ctx))
+
+                key, err := ctx.GetStub().CreateCompositeKey(configObjectType, write.key)
+                require.NoError(t, err)
+                require.ElementsMatch(t, tt.wantEndorsers, configEndorsers(t, ctx.GetStub().(*mocks.ChaincodeStub), key))
+            })
+        }
+    }
+}
@@ -0,0 +1,508 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const (
+    shipmentObjectType = "shipment"
+    custodyObjectType  = "custody"
+)
+
+// Shipment statuses
+const (
+    ShipmentInTransit                 = "InTransit"
+    ShipmentReceived                  = "Received"
+    ShipmentReceivedWithDiscrepancies = "ReceivedWithDiscrepancies"
+)
+
+// Custody event types
+const (
+    CustodyDispatched  = "Dispatched"
+    CustodyReceived    = "Received"
+    CustodyTransferred = "Transferred"
+    CustodyAdjusted    = "Adjusted"
+    CustodyDispensed   = "Dispensed"
+    CustodyQuarantined = "Quarantined"
+)
+
+// ShipmentItem is one batch in a consignment
+type ShipmentItem struct {
+    MedicationCode   string `json:"MedicationCode"`
+    MedicationName   string `json:"MedicationName"`
+    BatchNumber      string `json:"BatchNumber"`
+    Manufacturer     string `json:"Manufacturer,omitempty"`
+    BatchExpiry      string `json:"BatchExpiry"`
+    Quantity         int    `json:"Quantity"`
+    ReceivedQuantity int    `json:"ReceivedQuantity"`
+    Discrepancy      int    `json:"Discrepancy"` // shipped minus received
+    DiscrepancyNote  string `json:"DiscrepancyNote,omitempty"`
+    Quarantined      int    `json:"Quarantined,omitempty"` // received but expired or recalled, so kept out of stock
+    QuarantineReason string `json:"QuarantineReason,omitempty"`
+}
+
+// Shipment is a consignment from a supplier such as the central medical stores to a facility
+type Shipment struct {
+    ShipmentId     string         `json:"ShipmentId"`
+    FromFacilityId string         `json:"FromFacilityId"`
+    ToFacilityId   string         `json:"ToFacilityId"`
+    Items          []ShipmentItem `json:"Items"`
+    Status         string         `json:"Status"`
+    CreatedBy      string         `json:"CreatedBy"`
+    CreatedAt      string         `json:"CreatedAt"`
+    ReceivedBy     string         `json:"ReceivedBy,omitempty"`
+    ReceivedAt     string         `json:"ReceivedAt,omitempty"`
+    TxID           string         `json:"TxID"`
+}
+
+// ShipmentReceipt records what was counted for one batch of a shipment on arrival
+type ShipmentReceipt struct {
+    BatchNumber      string `json:"batchNumber"`
+    ReceivedQuantity int    `json:"receivedQuantity"`
+    Note             string `json:"note,omitempty"`
+}
+
+// CustodyEvent is one movement of a batch between parties
+type CustodyEvent struct {
+    BatchNumber    string `json:"BatchNumber"`
+    MedicationCode string `json:"MedicationCode"`
+    EventType      string `json:"EventType"`
+    FromFacilityId string `json:"FromFacilityId,omitempty"`
+    ToFacilityId   string `json:"ToFacilityId,omitempty"` // empty when dispensed to a patient or written off
+    Quantity       int    `json:"Quantity"`
+    Reference      string `json:"Reference,omitempty"` // shipment, prescription or adjustment reason
+    PerformedBy    string `json:"PerformedBy"`
+    Timestamp      string `json:"Timestamp"`
+    TxID           string `json:"TxID"`
+}
+
+// CreateShipment - supplier transaction that dispatches a consignment to a facility
+func (s *SmartContract) CreateShipment(ctx contractapi.TransactionContextInterface, shipmentJSON string) (*Shipment, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleSupplier {
+        return nil, fmt.Errorf("only suppliers can create shipments")
+    }
+
+    var shipment Shipment
+    if err := json.Unmarshal([]byte(shipmentJSON), &shipment); err != nil {
+        return nil, fmt.Errorf("failed to parse shipment JSON: %v", err)
+    }
+    if shipment.ShipmentId == "" || shipment.ToFacilityId == "" || len(shipment.Items) == 0 {
+        return nil, fmt.Errorf("shipmentId, toFacilityId and at least one item are required")
+    }
+    existing, err := s.getShipment(ctx, shipment.ShipmentId)
+    if err != nil {
+        return nil, err
+    }
+    if existing != nil {
+        return nil, fmt.Errorf("shipment %s already exists", shipment.ShipmentId)
+    }
+
+    fromFacilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
+    batches := map[string]bool{}
+    for i := range shipment.Items {
+        item := &shipment.Items[i]
+        if item.MedicationCode == "" || item.BatchNumber == "" || item.BatchExpiry == "" || item.Quantity <= 0 {
+            return nil, fmt.Errorf("item %d: medicationCode, batchNumber, batchExpiry and a positive quantity are required", i)
+        }
+        // Receipts refer to items by batch number alone, so batch numbers must be unique within a shipment
+        if batches[item.BatchNumber] {
+            return nil, fmt.Errorf("batch %s is listed more than once", item.BatchNumber)
+        }
+        batches[item.BatchNumber] = true
+        if _, err := parseDate(item.BatchExpiry); err != nil {
+            return nil, fmt.Errorf("item %d: invalid batch expiry date: %v", i, err)
+        }
+        recall, err := s.getRecall(ctx, item.MedicationCode, item.BatchNumber)
+        if err != nil {
+            return nil, err
+        }
+        if recall != nil {
+            return nil, fmt.Errorf("batch %s was recalled on %s and cannot be shipped", item.BatchNumber, recall.RecalledAt)
+        }
+        entry, err := s.GetFormularyEntry(ctx, item.MedicationCode)
+        if err != nil {
+            return nil, err
+        }
+        item.MedicationName = entry.GenericName
+        item.ReceivedQuantity = 0
+        item.Discrepancy = 0
+        item.DiscrepancyNote = ""
+
+        if err := s.recordCustody(ctx, &CustodyEvent{
+            BatchNumber:    item.BatchNumber,
+            MedicationCode: item.MedicationCode,
+            EventType:      CustodyDispatched,
+            FromFacilityId: fromFacilityId,
+            ToFacilityId:   shipment.ToFacilityId,
+            Quantity:       item.Quantity,
+            Reference:      shipment.ShipmentId,
+        }); err != nil {
+            return nil, err
+        }
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    shipment.FromFacilityId = fromFacilityId
+    shipment.Status = ShipmentInTransit
+    shipment.CreatedBy = callerId
+    shipment.CreatedAt = now.Format(time.RFC3339)
+    shipment.ReceivedBy = ""
+    shipment.ReceivedAt = ""
+    shipment.TxID = ctx.GetStub().GetTxID()
+
+    if err := s.putShipment(ctx, &shipment); err != nil {
+        return nil, err
+    }
+    return &shipment, nil
+}
+
+// ReceiveShipment - pharmacy transaction that books a shipment into stock. receiptsJSON lists the counted
+// quantity per batch; batches left out, or an empty list, are taken as received in full. Differences from the
+// shipped quantity are recorded as discrepancies and only the counted quantity is added to stock. Batches that
+// expired or were recalled in transit are quarantined instead of stocked, and the shipment is still received.
+func (s *SmartContract) ReceiveShipment(ctx contractapi.TransactionContextInterface, shipmentId string, receiptsJSON string) (*Shipment, error) {
+    if err := s.requireDispenser(ctx); err != nil {
+        return nil, err
+    }
+
+    var receipts []ShipmentReceipt
+    if strings.TrimSpace(receiptsJSON) != "" {
+        if err := json.Unmarshal([]byte(receiptsJSON), &receipts); err != nil {
+            return nil, fmt.Errorf("failed to parse shipment receipt JSON: %v", err)
+        }
+    }
+
+    shipment, err := s.getShipment(ctx, shipmentId)
+    if err != nil {
+        return nil, err
+    }
+    if shipment == nil {
+        return nil, fmt.Errorf("shipment %s not found", shipmentId)
+    }
+    if shipment.Status != ShipmentInTransit {
+        return nil, fmt.Errorf("shipment %s was already received on %s", shipmentId, shipment.ReceivedAt)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if facilityId != shipment.ToFacilityId {
+        return nil, fmt.Errorf("shipment %s is addressed to %s", shipmentId, shipment.ToFacilityId)
+    }
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
+    counted := map[string]ShipmentReceipt{}
+    for _, receipt := range receipts {
+        counted[receipt.BatchNumber] = receipt
+    }
+
+    changes := []StockChange{}
+    updated := []*StockItem{}
+    shipment.Status = ShipmentReceived
+    for i := range shipment.Items {
+        item := &shipment.Items[i]
+        item.ReceivedQuantity = item.Quantity
+        if receipt, ok := counted[item.BatchNumber]; ok {
+            if receipt.ReceivedQuantity < 0 {
+                return nil, fmt.Errorf("received quantity for batch %s cannot be negative", item.BatchNumber)
+            }
+            item.ReceivedQuantity = receipt.ReceivedQuantity
+            item.DiscrepancyNote = receipt.Note
+            delete(counted, item.BatchNumber)
+        }
+        item.Discrepancy = item.Quantity - item.ReceivedQuantity
+        if item.Discrepancy != 0 {
+            if strings.TrimSpace(item.DiscrepancyNote) == "" {
+                return nil, fmt.Errorf("a note is required for the discrepancy on batch %s", item.BatchNumber)
+            }
+            shipment.Status = ShipmentReceivedWithDiscrepancies
+        }
+        if item.ReceivedQuantity == 0 {
+            continue
+        }
+
+        if err := s.recordCustody(ctx, &CustodyEvent{
+            BatchNumber:    item.BatchNumber,
+            MedicationCode: item.MedicationCode,
+            EventType:      CustodyReceived,
+            FromFacilityId: shipment.FromFacilityId,
+            ToFacilityId:   facilityId,
+            Quantity:       item.ReceivedQuantity,
+            Reference:      shipmentId,
+        }); err != nil {
+            return nil, err
+        }
+
+        // A batch that expired or was recalled in transit is booked in but quarantined rather than stocked
+        reason, err := s.quarantineReason(ctx, item)
+        if err != nil {
+            return nil, err
+        }
+        if reason != "" {
+            item.Quarantined = item.ReceivedQuantity
+            item.QuarantineReason = reason
+            shipment.Status = ShipmentReceivedWithDiscrepancies
+            if err := s.recordCustody(ctx, &CustodyEvent{
+                BatchNumber:    item.BatchNumber,
+                MedicationCode: item.MedicationCode,
+                EventType:      CustodyQuarantined,
+                FromFacilityId: facilityId,
+                Quantity:       item.ReceivedQuantity,
+                Reference:      reason,
+            }); err != nil {
+                return nil, err
+            }
+            continue
+        }
+
+        stocked, err := s.receiveStock(ctx, facilityId, StockReceipt{
+            MedicationCode: item.MedicationCode,
+            BatchNumber:    item.BatchNumber,
+            Manufacturer:   item.Manufacturer,
+            BatchExpiry:    item.BatchExpiry,
+            Quantity:       item.ReceivedQuantity,
+            Reference:      shipmentId,
+        })
+        if err != nil {
+            return nil, err
+        }
+        changes = append(changes, stockChange(stocked, item.ReceivedQuantity, "Received"))
+        updated = append(updated, stocked)
+    }
+    for _, receipt := range receipts {
+        if _, unmatched := counted[receipt.BatchNumber]; unmatched {
+            return nil, fmt.Errorf("batch %s is not part of shipment %s", receipt.BatchNumber, shipmentId)
+        }
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    shipment.ReceivedBy = callerId
+    shipment.ReceivedAt = now.Format(time.RFC3339)
+    shipment.TxID = ctx.GetStub().GetTxID()
+    if err := s.putShipment(ctx, shipment); err != nil {
+        return nil, err
+    }
+    if len(changes) > 0 {
+        if err := s.emitStockEvent(ctx, "StockChanged", "", changes, updated); err != nil {
+            return nil, err
+        }
+    }
+    return shipment, nil
+}
+
+// quarantineReason returns why a received batch cannot be put into stock, or "" if it can
+func (s *SmartContract) quarantineReason(ctx contractapi.TransactionContextInterface, item *ShipmentItem) (string, error) {
+    expiry, err := parseDate(item.BatchExpiry)
+    if err != nil {
+        return "", fmt.Errorf("invalid expiry date for batch %s: %v", item.BatchNumber, err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return "", err
+    }
+    if now.After(expiry.AddDate(0, 0, 1)) {
+        return fmt.Sprintf("batch expired on %s", item.BatchExpiry), nil
+    }
+    recall, err := s.getRecall(ctx, item.MedicationCode, item.BatchNumber)
+    if err != nil {
+        return "", err
+    }
+    if recall != nil {
+        return fmt.Sprintf("batch recalled on %s: %s", recall.RecalledAt, recall.Reason), nil
+    }
+    return "", nil
+}
+
+// GetShipment - returns a shipment to its supplier, its destination facility or a regulator
+func (s *SmartContract) GetShipment(ctx contractapi.TransactionContextInterface, shipmentId string) (*Shipment, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    shipment, err := s.getShipment(ctx, shipmentId)
+    if err != nil {
+        return nil, err
+    }
+    if shipment == nil {
+        return nil, fmt.Errorf("shipment %s not found", shipmentId)
+    }
+    if role == RoleRegulator {
+        return shipment, nil
+    }
+
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if (role == RoleSupplier && facilityId == shipment.FromFacilityId) || (isDispenserRole(role) && facilityId == shipment.ToFacilityId) {
+        return shipment, nil
+    }
+    return nil, fmt.Errorf("shipment %s is not visible to the caller", shipmentId)
+}
+
+// GetIncomingShipments - lists the shipments still in transit to the caller's facility
+func (s *SmartContract) GetIncomingShipments(ctx contractapi.TransactionContextInterface) ([]*Shipment, error) {
+    if err := s.requireDispenser(ctx); err != nil {
+        return nil, err
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(shipmentObjectType, []string{})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    incoming := []*Shipment{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var shipment Shipment
+        if err := json.Unmarshal(queryResponse.Value, &shipment); err != nil {
+            return nil, err
+        }
+        if shipment.ToFacilityId == facilityId && shipment.Status == ShipmentInTransit {
+            incoming = append(incoming, &shipment)
+        }
+    }
+
+    return incoming, nil
+}
+
+// GetBatchCustodyHistory - returns every recorded movement of a batch, oldest first, for counterfeit and
+// diversion investigations. Regulators see the whole chain; suppliers and pharmacy staff see the movements
+// that involve their own facility.
+func (s *SmartContract) GetBatchCustodyHistory(ctx contractapi.TransactionContextInterface, batchNumber string) ([]CustodyEvent, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator && role != RoleSupplier && !isDispenserRole(role) {
+        return nil, fmt.Errorf("only regulators, suppliers and pharmacy staff can view custody history")
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(custodyObjectType, []string{batchNumber})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    events := []CustodyEvent{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var event CustodyEvent
+        if err := json.Unmarshal(queryResponse.Value, &event); err != nil {
+            return nil, err
+        }
+        if role != RoleRegulator && event.FromFacilityId != facilityId && event.ToFacilityId != facilityId {
+            continue
+        }
+        events = append(events, event)
+    }
+
+    // Keys are ordered by transaction ID, so put the events back in time order
+    sort.SliceStable(events, func(i, j int) bool {
+        return events[i].Timestamp < events[j].Timestamp
+    })
+    return events, nil
+}
+
+// recordCustody stamps and stores a custody event for a batch
+func (s *SmartContract) recordCustody(ctx contractapi.TransactionContextInterface, event *CustodyEvent) error {
+    performedBy, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    event.PerformedBy = performedBy
+    event.Timestamp = now.Format(time.RFC3339)
+    event.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(custodyObjectType, []string{
+        event.BatchNumber, event.TxID, event.EventType, event.FromFacilityId, event.ToFacilityId, event.Reference,
+    })
+    if err != nil {
+        return err
+    }
+    eventJSON, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, eventJSON)
+}
+
+func (s *SmartContract) getShipment(ctx contractapi.TransactionContextInterface, shipmentId string) (*Shipment, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(shipmentObjectType, []string{shipmentId})
+    if err != nil {
+        return nil, err
+    }
+    shipmentJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if shipmentJSON == nil {
+        return nil, nil
+    }
+
+    var shipment Shipment
+    if err := json.Unmarshal(shipmentJSON, &shipment); err != nil {
+        return nil, err
+    }
+    return &shipment, nil
+}
+
+func (s *SmartContract) putShipment(ctx contractapi.TransactionContextInterface, shipment *Shipment) error {
+    key, err := ctx.GetStub().CreateCompositeKey(shipmentObjectType, []string{shipment.ShipmentId})
+    if err != nil {
+        return err
+    }
+    shipmentJSON, err := json.Marshal(shipment)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, shipmentJSON)
+}
@@ -0,0 +1,64 @@
+package chaincode
+
+import (
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestReceiveShipmentQuarantinesUnusableBatches(t *testing.T) {
+    tests := []struct {
+        name           string
+        item           ShipmentItem
+        receipts       string
+        wantStatus     string
+        wantStocked    int
+        wantQuarantine string
+        wantErr        string
+    }{
+        {name: "received in full", item: ShipmentItem{BatchNumber: "B1", BatchExpiry: "2999-01-01", Quantity: 50}, wantStatus: ShipmentReceived, wantStocked: 50},
+        {name: "short delivery", item: ShipmentItem{BatchNumber: "B1", BatchExpiry: "2999-01-01", Quantity: 50}, receipts: `[{"batchNumber":"B1","receivedQuantity":45,"note":"5 packs damaged"}]`, wantStatus: ShipmentReceivedWithDiscrepancies, wantStocked: 45},
+        {name: "short delivery without a note", item: ShipmentItem{BatchNumber: "B1", BatchExpiry: "2999-01-01", Quantity: 50}, receipts: `[{"batchNumber":"B1","receivedQuantity":45}]`, wantErr: "a note is required"},
+        {name: "expired in transit", item: ShipmentItem{BatchNumber: "B1", BatchExpiry: "2001-01-01", Quantity: 50}, wantStatus: ShipmentReceivedWithDiscrepancies, wantQuarantine: "expired on 2001-01-01"},
+        {name: "recalled in transit", item: ShipmentItem{BatchNumber: "RB", BatchExpiry: "2999-01-01", Quantity: 50}, wantStatus: ShipmentReceivedWithDiscrepancies, wantQuarantine: "contamination"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin"}, FormularyEntry{Code: "ORS", GenericName: "Oral rehydration salts"})
+            ledger.putComposite(recallObjectType, []string{"AMOX", "RB"}, Recall{MedicationCode: "AMOX", BatchNumber: "RB", Reason: "contamination", RecalledAt: "2024-05-01T00:00:00Z"})
+            item := tt.item
+            item.MedicationCode, item.MedicationName = "AMOX", "Amoxicillin"
+            ledger.putComposite(shipmentObjectType, []string{"SH1"}, Shipment{
+                ShipmentId: "SH1", FromFacilityId: "CMST", ToFacilityId: "KCH-PHARM", Status: ShipmentInTransit,
+                Items: []ShipmentItem{item, {MedicationCode: "ORS", MedicationName: "Oral rehydration salts", BatchNumber: "O1", BatchExpiry: "2999-01-01", Quantity: 20}},
+            })
+
+            var received *Shipment
+            err := ledger.submit(pharmacist("ph-mwale"), func(ctx contractapi.TransactionContextInterface) error {
+                var err error
+                received, err = (&SmartContract{}).ReceiveShipment(ctx, "SH1", tt.receipts)
+                return err
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.wantStatus, received.Status)
+            require.Equal(t, 20, ledger.stock("KCH-PHARM", "ORS", "O1").Quantity)
+
+            line := received.Items[0]
+            if tt.wantQuarantine != "" {
+                require.Contains(t, line.QuarantineReason, tt.wantQuarantine)
+                require.Equal(t, line.ReceivedQuantity, line.Quarantined)
+                require.Nil(t, ledger.stock("KCH-PHARM", "AMOX", item.BatchNumber))
+                return
+            }
+            require.Zero(t, line.Quarantined)
+            require.Equal(t, tt.wantStocked, ledger.stock("KCH-PHARM", "AMOX", item.BatchNumber).Quantity)
+        })
+    }
+}
@@ -0,0 +1,441 @@
+package chaincode
+
+import (
+    "crypto/ecdsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/pkg/attrmgr"
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// SignerCAs are the certificate authorities of an organization whose enrolled prescribers may sign
+// prescriptions. Signer certificates must chain to one of them.
+type SignerCAs struct {
+    MSPID        string   `json:"MSPID"`
+    Certificates []string `json:"Certificates"` // PEM root and intermediate CA certificates
+    UpdatedBy    string   `json:"UpdatedBy,omitempty"`
+    UpdatedAt    string   `json:"UpdatedAt,omitempty"`
+    TxID         string   `json:"TxID,omitempty"`
+}
+
+// PrescriptionContent is the canonical form of a prescription that the prescriber signs. Fields are marshalled
+// in declaration order, so clients must build exactly this structure; values the chaincode derives (medication
+// name, drug class, encounter default) are left out.
+type PrescriptionContent struct {
+    PrescriptionId string   `json:"prescriptionId"`
+    PatientId      string   `json:"patientId"`
+    PrescriberId   string   `json:"prescriberId"`
+    MedicationCode string   `json:"medicationCode"`
+    Strength       string   `json:"strength"`
+    DosageForm     string   `json:"dosageForm"`
+    Dosage         string   `json:"dosage"`
+    DoseAmount     float64  `json:"doseAmount"`
+    DoseUnit       string   `json:"doseUnit"`
+    DosesPerDay    int      `json:"dosesPerDay"`
+    Instructions   string   `json:"instructions"`
+    Quantity       int      `json:"quantity"`
+    Refills        int      `json:"refills"`
+    DiagnosisCodes []string `json:"diagnosisCodes"`
+    ExpiryDate     string   `json:"expiryDate"`
+}
+
+// SignatureVerification is the result of checking a prescription's signature
+type SignatureVerification struct {
+    PrescriptionId        string `json:"PrescriptionId"`
+    Signed                bool   `json:"Signed"`
+    Valid                 bool   `json:"Valid"`
+    SignerSubject         string `json:"SignerSubject,omitempty"`
+    SignerCertFingerprint string `json:"SignerCertFingerprint,omitempty"`
+    Reason                string `json:"Reason,omitempty"`
+}
+
+// VerifyPrescriptionSignature - checks a prescription's stored signature against its current content and the
+// signer certificate recorded at issuance
+func (s *SmartContract) VerifyPrescriptionSignature(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string) (*SignatureVerification, error) {
+    if err := s.requireConsent(ctx, patientId, ScopeRead, ScopeDispense); err != nil {
+        return nil, err
+    }
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+
+    for i := range asset.Prescriptions {
+        prescription := &asset.Prescriptions[i]
+        if prescription.PrescriptionId != prescriptionId {
+            continue
+        }
+
+        result := &SignatureVerification{PrescriptionId: prescriptionId}
+        if prescription.Signature == "" {
+            result.Reason = "prescription is not signed"
+            return result, nil
+        }
+        result.Signed = true
+        result.SignerCertFingerprint = prescription.SignerCertFingerprint
+
+        block, _ := pem.Decode([]byte(prescription.SignerCertificate))
+        if block == nil {
+            result.Reason = "stored signer certificate is not valid PEM"
+            return result, nil
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            result.Reason = fmt.Sprintf("stored signer certificate cannot be parsed: %v", err)
+            return result, nil
+        }
+        result.SignerSubject = cert.Subject.String()
+        if certFingerprint(cert) != prescription.SignerCertFingerprint {
+            result.Reason = "signer certificate does not match the recorded fingerprint"
+            return result, nil
+        }
+        if err := checkPrescriptionSignature(patientId, prescription, cert); err != nil {
+            result.Reason = err.Error()
+            return result, nil
+        }
+        result.Valid = true
+        return result, nil
+    }
+
+    return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+}
+
+// SetSignerCAs - registers the CA certificates an organization enrols its prescribers with; admins only
+func (s *SmartContract) SetSignerCAs(ctx contractapi.TransactionContextInterface, mspId string, certificatesPEM string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin {
+        return fmt.Errorf("only admins can register signer CAs")
+    }
+    if mspId == "" {
+        return fmt.Errorf("mspId is required")
+    }
+
+    cas := SignerCAs{MSPID: mspId, Certificates: []string{}}
+    rest := []byte(certificatesPEM)
+    for {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            break
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return fmt.Errorf("failed to parse CA certificate: %v", err)
+        }
+        if !cert.IsCA {
+            return fmt.Errorf("certificate %s is not a CA certificate", cert.Subject)
+        }
+        cas.Certificates = append(cas.Certificates, string(pem.EncodeToMemory(block)))
+    }
+    if len(cas.Certificates) == 0 {
+        return fmt.Errorf("at least one PEM CA certificate is required")
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    cas.UpdatedBy = callerId
+    cas.UpdatedAt = now.Format(time.RFC3339)
+    cas.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"signer-cas", mspId})
+    if err != nil {
+        return err
+    }
+    casJSON, err := json.Marshal(cas)
+    if err != nil {
+        return err
+    }
+    return s.putConfig(ctx, key, casJSON)
+}
+
+// GetSignerCAs - returns the CA certificates registered for an organization, or nil if there are none
+func (s *SmartContract) GetSignerCAs(ctx contractapi.TransactionContextInterface, mspId string) (*SignerCAs, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"signer-cas", mspId})
+    if err != nil {
+        return nil, err
+    }
+    casJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if casJSON == nil {
+        return nil, nil
+    }
+
+    var cas SignerCAs
+    if err := json.Unmarshal(casJSON, &cas); err != nil {
+        return nil, err
+    }
+    return &cas, nil
+}
+
+// applySignature verifies the prescriber's signature on a new or updated prescription and records the signer.
+// Every prescription must be signed. The signer certificate travels with the prescription and must be issued by
+// a CA registered for the submitting organization to a prescriber whose prescriberId attribute names the
+// prescription's prescriber, so a shared gateway identity cannot sign on a prescriber's behalf.
+func (s *SmartContract) applySignature(ctx contractapi.TransactionContextInterface, patientId string, prescription *Prescription) error {
+    prescription.SignerCertFingerprint = ""
+    if prescription.Signature == "" || prescription.SignerCertificate == "" {
+        return fmt.Errorf("prescription %s must be signed by its prescriber and carry the signer certificate", prescription.PrescriptionId)
+    }
+    if prescription.ExpiryDate == "" {
+        return fmt.Errorf("signed prescription %s must carry an expiry date", prescription.PrescriptionId)
+    }
+
+    block, _ := pem.Decode([]byte(prescription.SignerCertificate))
+    if block == nil {
+        return fmt.Errorf("signer certificate on prescription %s is not valid PEM", prescription.PrescriptionId)
+    }
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil {
+        return fmt.Errorf("failed to parse signer certificate on prescription %s: %v", prescription.PrescriptionId, err)
+    }
+    if err := s.checkSignerCertificate(ctx, cert, prescription.CreatedBy); err != nil {
+        return fmt.Errorf("signer of prescription %s is not trusted: %v", prescription.PrescriptionId, err)
+    }
+    if err := checkPrescriptionSignature(patientId, prescription, cert); err != nil {
+        return fmt.Errorf("signature on prescription %s is invalid: %v", prescription.PrescriptionId, err)
+    }
+
+    facilityId, err := signerFacility(ctx, cert)
+    if err != nil {
+        return err
+    }
+
+    prescription.SignerCertFingerprint = certFingerprint(cert)
+    prescription.SignerCertificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+    prescription.PrescriberFacility = facilityId
+    return nil
+}
+
+// signerFacility returns the "facilityId" attribute of a verified signer certificate, falling back to the MSP ID
+// whose CA issued it. Unlike the submitting client's facility, it identifies where the signing prescriber works
+// even when several prescribers share one client identity.
+func signerFacility(ctx contractapi.TransactionContextInterface, cert *x509.Certificate) (string, error) {
+    attributes, err := attrmgr.New().GetAttributesFromCert(cert)
+    if err != nil {
+        return "", err
+    }
+    facilityId, ok, err := attributes.Value("facilityId")
+    if err != nil {
+        return "", err
+    }
+    if ok && facilityId != "" {
+        return facilityId, nil
+    }
+
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return "", fmt.Errorf("failed to get MSP ID: %v", err)
+    }
+    return mspID, nil
+}
+
+// checkSignerCertificate checks that a signer certificate chains to a CA registered for the submitting
+// organization and was enrolled for the named prescriber with a prescriber role. Validity is checked at the
+// transaction time, so every endorsing peer reaches the same result whatever its clock says.
+func (s *SmartContract) checkSignerCertificate(ctx contractapi.TransactionContextInterface, cert *x509.Certificate, prescriberId string) error {
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return fmt.Errorf("failed to get MSP ID: %v", err)
+    }
+    cas, err := s.GetSignerCAs(ctx, mspID)
+    if err != nil {
+        return err
+    }
+    if cas == nil {
+        return fmt.Errorf("no signer CAs are registered for %s", mspID)
+    }
+
+    roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+    for _, caPEM := range cas.Certificates {
+        block, _ := pem.Decode([]byte(caPEM))
+        if block == nil {
+            continue
+        }
+        ca, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            continue
+        }
+        if ca.Subject.String() == ca.Issuer.String() {
+            roots.AddCert(ca)
+        } else {
+            intermediates.AddCert(ca)
+        }
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    if _, err := cert.Verify(x509.VerifyOptions{
+        Roots:         roots,
+        Intermediates: intermediates,
+        CurrentTime:   now,
+        KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+    }); err != nil {
+        return fmt.Errorf("certificate %s is not issued by %s: %v", cert.Subject, mspID, err)
+    }
+
+    attributes, err := attrmgr.New().GetAttributesFromCert(cert)
+    if err != nil {
+        return err
+    }
+    role, _, err := attributes.Value("role")
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("certificate %s does not hold a prescriber role", cert.Subject)
+    }
+    signerId, _, err := attributes.Value("prescriberId")
+    if err != nil {
+        return err
+    }
+    if signerId == "" || signerId != prescriberId {
+        return fmt.Errorf("certificate %s is not enrolled for prescriber %s", cert.Subject, prescriberId)
+    }
+    return nil
+}
+
+// checkPrescriptionSignature verifies the ECDSA signature over the SHA-256 digest of the canonical content
+func checkPrescriptionSignature(patientId string, prescription *Prescription, cert *x509.Certificate) error {
+    publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+    if !ok {
+        return fmt.Errorf("signer certificate does not hold an ECDSA key")
+    }
+    signature, err := base64.StdEncoding.DecodeString(prescription.Signature)
+    if err != nil {
+        return fmt.Errorf("signature is not valid base64: %v", err)
+    }
+    content, err := canonicalPrescription(patientId, prescription)
+    if err != nil {
+        return err
+    }
+    digest := sha256.Sum256(content)
+    if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+        return fmt.Errorf("signature does not match the prescription content")
+    }
+    return nil
+}
+
+// canonicalPrescription returns the bytes a prescriber signs for a prescription
+func canonicalPrescription(patientId string, prescription *Prescription) ([]byte, error) {
+    diagnosisCodes := prescription.DiagnosisCodes
+    if diagnosisCodes == nil {
+        diagnosisCodes = []string{}
+    }
+    return json.Marshal(PrescriptionContent{
+        PrescriptionId: prescription.PrescriptionId,
+        PatientId:      patientId,
+        PrescriberId:   prescription.CreatedBy,
+        MedicationCode: prescription.MedicationCode,
+        Strength:       prescription.Strength,
+        DosageForm:     prescription.DosageForm,
+        Dosage:         prescription.Dosage,
+        DoseAmount:     prescription.DoseAmount,
+        DoseUnit:       prescription.DoseUnit,
+        DosesPerDay:    prescription.DosesPerDay,
+        Instructions:   prescription.Instructions,
+        Quantity:       prescription.Quantity,
+        Refills:        prescription.Refills,
+        DiagnosisCodes: diagnosisCodes,
+        ExpiryDate:     prescription.ExpiryDate,
+    })
+}
+
+// certFingerprint is the hex SHA-256 of a certificate's DER encoding
+func certFingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return hex.EncodeToString(sum[:])
+}
+
+// PrescriptionProof lets a verifier check a printed prescription against the ledger. The stored hash is
+// recomputed from the current content; ContentTxID identifies the transaction whose block holds the content.
+type PrescriptionProof struct {
+    PrescriptionId string `json:"PrescriptionId"`
+    PatientId      string `json:"PatientId"`
+    Content        string `json:"Content"` // canonical content the hash is computed over
+    ContentHash    string `json:"ContentHash"`
+    ComputedHash   string `json:"ComputedHash"`
+    Matches        bool   `json:"Matches"`
+    ContentTxID    string `json:"ContentTxID"`
+    Status         string `json:"Status"`
+}
+
+// GetPrescriptionProof - returns the canonical content, stored content hash and committing transaction of a prescription
+func (s *SmartContract) GetPrescriptionProof(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string) (*PrescriptionProof, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator {
+        if err := s.requireConsent(ctx, patientId, ScopeRead, ScopeDispense); err != nil {
+            return nil, err
+        }
+    }
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+
+    for i := range asset.Prescriptions {
+        prescription := &asset.Prescriptions[i]
+        if prescription.PrescriptionId != prescriptionId {
+            continue
+        }
+        if prescription.ContentHash == "" {
+            return nil, fmt.Errorf("prescription %s was issued before content hashing and has no proof", prescriptionId)
+        }
+
+        content, err := canonicalPrescription(patientId, prescription)
+        if err != nil {
+            return nil, err
+        }
+        computed := contentHash(content)
+        return &PrescriptionProof{
+            PrescriptionId: prescriptionId,
+            PatientId:      patientId,
+            Content:        string(content),
+            ContentHash:    prescription.ContentHash,
+            ComputedHash:   computed,
+            Matches:        computed == prescription.ContentHash,
+            ContentTxID:    prescription.ContentTxID,
+            Status:         prescription.Status,
+        }, nil
+    }
+
+    return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+}
+
+// stampContentHash records the hash of the prescription's canonical content and the transaction writing it
+func stampContentHash(ctx contractapi.TransactionContextInterface, patientId string, prescription *Prescription) error {
+    content, err := canonicalPrescription(patientId, prescription)
+    if err != nil {
+        return err
+    }
+    prescription.ContentHash = contentHash(content)
+    prescription.ContentTxID = ctx.GetStub().GetTxID()
+    return nil
+}
+
+// contentHash is the hex SHA-256 of canonical prescription content
+func contentHash(content []byte) string {
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestPrescriptionSignatureVerification(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    contract := &SmartContract{}
+    ca := newTestCA(t, "ca.org1")
+    otherCA := newTestCA(t, "ca.elsewhere")
+
+    tests := []struct {
+        name      string
+        untrusted bool // no signer CA is registered for Org1MSP
+        sign      func(t *testing.T, prescription *Prescription)
+        wantErr   string
+    }{
+        {name: "signed by the prescriber", sign: func(t *testing.T, prescription *Prescription) {
+            ca.prescriber("DOC1").sign(t, "P1", prescription)
+        }},
+        {name: "unsigned", sign: func(t *testing.T, prescription *Prescription) {}, wantErr: "must be signed by its prescriber"},
+        {name: "unregistered CA", sign: func(t *testing.T, prescription *Prescription) {
+            otherCA.prescriber("DOC1").sign(t, "P1", prescription)
+        }, wantErr: "is not issued by Org1MSP"},
+        {name: "no CAs registered", untrusted: true, sign: func(t *testing.T, prescription *Prescription) {
+            ca.prescriber("DOC1").sign(t, "P1", prescription)
+        }, wantErr: "no signer CAs are registered for Org1MSP"},
+        {name: "another prescriber's certificate", sign: func(t *testing.T, prescription *Prescription) {
+            ca.prescriber("DOC2").sign(t, "P1", prescription)
+        }, wantErr: "is not enrolled for prescriber DOC1"},
+        {name: "non-prescriber role", sign: func(t *testing.T, prescription *Prescription) {
+            ca.enrol("ph-mwale", map[string]string{"role": RolePharmacist, "prescriberId": "DOC1"}, time.Now().Add(time.Hour)).sign(t, "P1", prescription)
+        }, wantErr: "does not hold a prescriber role"},
+        {name: "content changed after signing", sign: func(t *testing.T, prescription *Prescription) {
+            ca.prescriber("DOC1").sign(t, "P1", prescription)
+            prescription.Quantity = 60
+        }, wantErr: "signature on prescription RX1 is invalid"},
+        {name: "expired certificate", sign: func(t *testing.T, prescription *Prescription) {
+            ca.enrol("DOC1", map[string]string{"role": RoleDoctor, "prescriberId": "DOC1"}, time.Now().Add(-2*time.Hour)).sign(t, "P1", prescription)
+        }, wantErr: "is not issued by Org1MSP"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg"}, DosageForms: []string{"capsule"}})
+            ledger.put("P1", Asset{PatientId: "P1", Prescriptions: []Prescription{}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe, ScopeRead)
+            if !tt.untrusted {
+                ledger.trustSigners("Org1MSP", ca)
+            }
+
+            prescription := Prescription{
+                PrescriptionId: "RX1", MedicationCode: "AMOX", Strength: "250mg", DosageForm: "capsule",
+                Dosage: "1 capsule three times a day", Quantity: 21, ExpiryDate: "2999-01-01", CreatedBy: "DOC1",
+            }
+            tt.sign(t, &prescription)
+            prescriptionsJSON, err := json.Marshal([]Prescription{prescription})
+            require.NoError(t, err)
+
+            err = ledger.submit(prescriber, func(ctx contractapi.TransactionContextInterface) error {
+                return contract.AddPrescriptions(ctx, "P1", "DOC1", string(prescriptionsJSON))
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+
+            var verification *SignatureVerification
+            ledger.mustSubmit(prescriber, func(ctx contractapi.TransactionContextInterface) error {
+                verification, err = contract.VerifyPrescriptionSignature(ctx, "P1", "RX1")
+                return err
+            })
+            require.True(t, verification.Signed)
+            require.True(t, verification.Valid, verification.Reason)
+            require.NotEmpty(t, ledger.prescription("P1", "RX1").SignerCertFingerprint)
+        })
+    }
+}
+
+func TestSignerCertificateCheckedAtTransactionTime(t *testing.T) {
+    contract := &SmartContract{}
+    ca := newTestCA(t, "ca.org1")
+
+    tests := []struct {
+        name     string
+        notAfter time.Duration // certificate expiry relative to the transaction time
+        wantErr  string
+    }{
+        {name: "valid at the transaction time", notAfter: time.Minute},
+        {name: "valid at the transaction time but expired since", notAfter: 59 * time.Minute},
+        {name: "expired before the transaction", notAfter: -time.Minute, wantErr: "certificate has expired"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin"})
+            ledger.put("P1", Asset{PatientId: "P1", Prescriptions: []Prescription{}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.trustSigners("Org1MSP", ca)
+
+            // The ledger clock runs an hour behind the wall clock, so a certificate can be valid at the
+            // transaction time and expired by the time a peer endorses
+            prescription := Prescription{PrescriptionId: "RX1", MedicationCode: "AMOX", Quantity: 21, ExpiryDate: "2999-01-01", CreatedBy: "DOC1"}
+            ca.enrol("DOC1", map[string]string{"role": RoleDoctor, "prescriberId": "DOC1"}, ledger.clock.Add(tt.notAfter)).sign(t, "P1", &prescription)
+            prescriptionsJSON, err := json.Marshal([]Prescription{prescription})
+            require.NoError(t, err)
+
+            err = ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+                return contract.AddPrescriptions(ctx, "P1", "DOC1", string(prescriptionsJSON))
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+        })
+    }
+}
+
+func TestUpdatePrescriptionKeepsFinalContent(t *testing.T) {
+    prescriber := doctor("dr-banda")
+    ca := newTestCA(t, "ca.org1")
+    contract := &SmartContract{}
+
+    tests := []struct {
+        status  string
+        wantErr string
+    }{
+        {status: "Active"},
+        {status: StatusPendingApproval},
+        {status: "Dispensed", wantErr: "prescription RX1 is Dispensed"},
+        {status: "Revoked", wantErr: "prescription RX1 is Revoked"},
+        {status: StatusRejected, wantErr: "prescription RX1 is Rejected"},
+        {status: "Expired", wantErr: "prescription RX1 is Expired"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.status, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg", "500mg"}, DosageForms: []string{"capsule"}})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "250mg", DosageForm: "capsule",
+                Status: tt.status, CreatedBy: "DOC1", IssuedBy: prescriber.id, ContentHash: "original",
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+            ledger.trustSigners("Org1MSP", ca)
+
+            err := ledger.submit(prescriber, updatePrescription(t, contract, ca.prescriber("DOC1"),
+                `{"PrescriptionId":"RX1","MedicationCode":"AMOX","Strength":"500mg","DosageForm":"capsule","Dosage":"1 capsule","ExpiryDate":"2999-01-01"}`))
+            updated := ledger.prescription("P1", "RX1")
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, "250mg", updated.Strength)
+                require.Equal(t, "original", updated.ContentHash)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, "500mg", updated.Strength)
+            require.NotEqual(t, "original", updated.ContentHash)
+            require.Equal(t, tt.status, updated.Status)
+        })
+    }
+}
@@ -16,7 +16,9 @@ type Asset struct {
     DoctorId      string         `json:"DoctorId"`      // ID of prescribing doctor
     PatientName   string         `json:"PatientName"`   // Name of the patient
     PatientId     string         `json:"PatientId"`     // Unique identifier for the patient
-    DateOfBirth   string         `json:"DateOfBirth,omitempty"` // Patient's DOB (optional)
+    DateOfBirth   string         `json:"DateOfBirth,omitempty"` // Patient's DOB (optional), used for dose checks
+    WeightKg      float64        `json:"WeightKg,omitempty"`    // Last recorded weight, used for dose checks
+    WeightRecordedAt string      `json:"WeightRecordedAt,omitempty"`
     Prescriptions []Prescription `json:"Prescriptions"` // Array of prescriptions
     LastUpdated   string         `json:"LastUpdated"`   // Timestamp of last modification
 }
@@ -24,16 +26,61 @@ type Asset struct {
 // Prescription structure
 type Prescription struct {
     PrescriptionId      string `json:"PrescriptionId"`
-    MedicationName      string `json:"MedicationName"`
+    MedicationCode      string `json:"MedicationCode,omitempty"` // Formulary code, required for new prescriptions
+    MedicationName      string `json:"MedicationName"`           // Generic name from the formulary
+    Strength            string `json:"Strength,omitempty"`
+    DosageForm          string `json:"DosageForm,omitempty"`
     Dosage              string `json:"Dosage"`
     Instructions        string `json:"Instructions"`
-    Status              string `json:"Status"`    // Active, Filled, Revoked, Expired
+    Status              string `json:"Status"`    // Active, PendingApproval, Rejected, Dispensed, Revoked, Expired
     CreatedBy           string `json:"CreatedBy"` // DoctorId who created it
     TxID                string `json:"TxID"`
     Timestamp           string `json:"Timestamp"`
+    IssuedAt            string `json:"IssuedAt,omitempty"`  // When it was issued; Timestamp moves with every change
+    RevokedAt           string `json:"RevokedAt,omitempty"`
     ExpiryDate          string `json:"ExpiryDate,omitempty"`
     DispensingPharmacist string `json:"dispensingPharmacist,omitempty"` // ID of pharmacist who dispensed
     DispensingTimestamp  string `json:"dispensingTimestamp,omitempty"`  // When it was dispensed
+    DrugClass            string `json:"DrugClass,omitempty"`            // Therapeutic class, used to scope delegated prescribing
+    DelegateId           string `json:"DelegateId,omitempty"`           // Clinical officer or nurse who prescribed under delegation
+    SupervisorId         string `json:"SupervisorId,omitempty"`         // Supervising doctor for a delegated prescription
+    CountersignedBy      string `json:"CountersignedBy,omitempty"`
+    CountersignedAt      string `json:"CountersignedAt,omitempty"`
+    CountersignNote      string `json:"CountersignNote,omitempty"`
+    IssuedBy             string `json:"IssuedBy,omitempty"`             // Client identity that submitted the prescription
+    ReviewedBy           string `json:"ReviewedBy,omitempty"`           // Approver of a restricted medicine prescription
+    ReviewedAt           string `json:"ReviewedAt,omitempty"`
+    ReviewNote           string `json:"ReviewNote,omitempty"`
+    Quantity             int    `json:"Quantity,omitempty"`             // Total quantity to supply, required for controlled drugs
+    Refills              int    `json:"Refills,omitempty"`
+    ControlledSchedule   string `json:"ControlledSchedule,omitempty"`   // Set when the medication is a controlled drug
+    DispensedQuantity    int    `json:"DispensedQuantity,omitempty"`
+    DispensingFacility   string `json:"DispensingFacility,omitempty"`
+    PrescriberFacility   string `json:"PrescriberFacility,omitempty"`   // Facility of the issuing prescriber, from the signer certificate
+    DuplicateWarnings    []string `json:"DuplicateWarnings,omitempty"` // Overlapping prescriptions found at issuance
+    LegacyMedicationName string `json:"LegacyMedicationName,omitempty"` // Free-text name before mapping to the formulary
+    EncounterId          string   `json:"EncounterId,omitempty"`        // Visit at which it was written; defaults to the issuing transaction
+    DiagnosisCodes       []string `json:"DiagnosisCodes,omitempty"`     // ICD-10 indications
+    DoseAmount           float64  `json:"DoseAmount,omitempty"`         // Structured dose per administration
+    DoseUnit             string   `json:"DoseUnit,omitempty"`
+    DosesPerDay          int      `json:"DosesPerDay,omitempty"`
+    DoseWarnings         []string `json:"DoseWarnings,omitempty"`       // Dose range findings at issuance
+    DispensedBatch       string   `json:"DispensedBatch,omitempty"`     // Batch/lot the dispensed stock came from
+    BatchManufacturer    string   `json:"BatchManufacturer,omitempty"`
+    BatchExpiry          string   `json:"BatchExpiry,omitempty"`
+    Recalled             bool     `json:"Recalled,omitempty"`           // Set when the dispensed batch is recalled
+    RecallReason         string   `json:"RecallReason,omitempty"`
+    RecalledAt           string   `json:"RecalledAt,omitempty"`
+    DispensedCode        string   `json:"DispensedCode,omitempty"`      // Formulary code of the product actually supplied
+    DispensedName        string   `json:"DispensedName,omitempty"`
+    DispensedStrength    string   `json:"DispensedStrength,omitempty"`
+    Substituted          bool     `json:"Substituted,omitempty"`        // Set when an equivalent product was supplied instead
+    SubstitutionReason   string   `json:"SubstitutionReason,omitempty"`
+    Signature             string  `json:"Signature,omitempty"`             // Prescriber's base64 ECDSA signature over the canonical content
+    SignerCertFingerprint string  `json:"SignerCertFingerprint,omitempty"` // Hex SHA-256 of the signer certificate
+    SignerCertificate     string  `json:"SignerCertificate,omitempty"`     // PEM signer certificate, for offline verification
+    ContentHash           string  `json:"ContentHash,omitempty"`           // Hex SHA-256 of the canonical content
+    ContentTxID           string  `json:"ContentTxID,omitempty"`           // Transaction that last wrote the content
 }
 
 // IssuePrescription - this function allows a doctor to issue a new prescription for a patient
@@ -50,20 +97,47 @@ func (s *SmartContract) CreateAsset(ctx contractapi.TransactionContextInterface,
     if asset.PatientId == "" || asset.DoctorId == "" {
         return fmt.Errorf("patientId and doctorId are required")
     }
+    // Age-banded dose checks read the date of birth; an unknown one is left empty, never a placeholder
+    if asset.DateOfBirth != "" {
+        if _, err := time.Parse("2006-01-02", asset.DateOfBirth); err != nil {
+            return fmt.Errorf("dateOfBirth must be a YYYY-MM-DD date, or omitted when unknown: %v", err)
+        }
+    }
 
+    // Existing records are never overwritten; their prescriptions are added under consent
+    existing, err := ctx.GetStub().GetState(asset.PatientId)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil {
+        return fmt.Errorf("patient %s already has a record; add prescriptions with AddPrescriptions", asset.PatientId)
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only prescribers can issue prescriptions")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
     // Add metadata
-    asset.LastUpdated = time.Now().Format(time.RFC3339)
+    asset.LastUpdated = now.Format(time.RFC3339)
     for i := range asset.Prescriptions {
-        asset.Prescriptions[i].TxID = ctx.GetStub().GetTxID()
-        asset.Prescriptions[i].Timestamp = asset.LastUpdated
-        asset.Prescriptions[i].Status = "Active"
-        asset.Prescriptions[i].CreatedBy = asset.DoctorId
-
-        if asset.Prescriptions[i].ExpiryDate == "" {
-            asset.Prescriptions[i].ExpiryDate = time.Now().AddDate(0, 1, 0).Format("2006-01-02") // 1 month from now
+        if err := s.prepareNewPrescription(ctx, role, &asset, &asset.Prescriptions[i]); err != nil {
+            return err
         }
     }
 
+    // Flag overlapping prescriptions from other prescribers or facilities
+    if err := s.flagDuplicates(ctx, asset.PatientId, nil, asset.Prescriptions); err != nil {
+        return err
+    }
+
     assetJSONBytes, err := json.Marshal(asset)
     if err != nil {
         return err
@@ -72,8 +146,224 @@ func (s *SmartContract) CreateAsset(ctx contractapi.TransactionContextInterface,
     return ctx.GetStub().PutState(asset.PatientId, assetJSONBytes)
 }
 
+// AddPrescriptions - issues new prescriptions to an existing patient record, keeping the prescriptions already on it.
+// The caller needs the patient's prescribe consent.
+func (s *SmartContract) AddPrescriptions(ctx contractapi.TransactionContextInterface, patientId string, doctorId string, prescriptionsJSON string) error {
+    var prescriptions []Prescription
+    if err := json.Unmarshal([]byte(prescriptionsJSON), &prescriptions); err != nil {
+        return fmt.Errorf("failed to parse prescriptions JSON: %v", err)
+    }
+    if doctorId == "" || len(prescriptions) == 0 {
+        return fmt.Errorf("doctorId and at least one prescription are required")
+    }
+
+    if err := s.requireConsent(ctx, patientId, ScopePrescribe); err != nil {
+        return err
+    }
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return err
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only prescribers can issue prescriptions")
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    asset.DoctorId = doctorId
+    asset.LastUpdated = now.Format(time.RFC3339)
+    for i := range prescriptions {
+        for _, existing := range asset.Prescriptions {
+            if existing.PrescriptionId == prescriptions[i].PrescriptionId {
+                return fmt.Errorf("prescription %s already exists", prescriptions[i].PrescriptionId)
+            }
+        }
+        if err := s.prepareNewPrescription(ctx, role, asset, &prescriptions[i]); err != nil {
+            return err
+        }
+    }
+
+    if err := s.flagDuplicates(ctx, patientId, asset.Prescriptions, prescriptions); err != nil {
+        return err
+    }
+    asset.Prescriptions = append(asset.Prescriptions, prescriptions...)
+
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(patientId, assetJSON)
+}
+
+// CreatePatient - registers a new patient record without prescriptions. Like CreateAsset it never
+// overwrites an existing record.
+func (s *SmartContract) CreatePatient(ctx contractapi.TransactionContextInterface, patientJSON string) error {
+    var asset Asset
+    if err := json.Unmarshal([]byte(patientJSON), &asset); err != nil {
+        return fmt.Errorf("failed to parse patient JSON: %v", err)
+    }
+    if asset.PatientId == "" || asset.DoctorId == "" {
+        return fmt.Errorf("patientId and doctorId are required")
+    }
+    if len(asset.Prescriptions) > 0 {
+        return fmt.Errorf("prescriptions must be issued with AddPrescriptions")
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only prescribers can register patients")
+    }
+
+    existing, err := ctx.GetStub().GetState(asset.PatientId)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil {
+        return fmt.Errorf("asset %s already exists", asset.PatientId)
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    asset.Prescriptions = []Prescription{}
+    asset.LastUpdated = now.Format(time.RFC3339)
+    assetJSON, err := json.Marshal(asset)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(asset.PatientId, assetJSON)
+}
+
+// CreatePatientIfAbsent - creates a patient's record with its first prescriptions, as CreateAsset does, when the
+// ledger has no record for the patient, and returns whether it did. An existing record is left untouched, so
+// callers add prescriptions to it with AddPrescriptions under the patient's consent.
+func (s *SmartContract) CreatePatientIfAbsent(ctx contractapi.TransactionContextInterface, assetJSON string) (bool, error) {
+    var asset Asset
+    if err := json.Unmarshal([]byte(assetJSON), &asset); err != nil {
+        return false, fmt.Errorf("failed to parse asset JSON: %v", err)
+    }
+    if asset.PatientId == "" {
+        return false, fmt.Errorf("patientId is required")
+    }
+
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return false, err
+    }
+    if !isPrescriberRole(role) {
+        return false, fmt.Errorf("only prescribers can register patients")
+    }
+
+    existing, err := ctx.GetStub().GetState(asset.PatientId)
+    if err != nil {
+        return false, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil {
+        return false, nil
+    }
+    if err := s.CreateAsset(ctx, assetJSON); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// prepareNewPrescription validates a prescription being issued and fills in its metadata
+func (s *SmartContract) prepareNewPrescription(ctx contractapi.TransactionContextInterface, role string, asset *Asset, prescription *Prescription) error {
+    prescription.TxID = ctx.GetStub().GetTxID()
+    prescription.Timestamp = asset.LastUpdated
+    prescription.IssuedAt = asset.LastUpdated
+    prescription.RevokedAt = ""
+    prescription.Status = "Active"
+    prescription.CreatedBy = asset.DoctorId
+    prescription.DelegateId = ""
+    prescription.SupervisorId = ""
+    prescription.CountersignedBy = ""
+    prescription.CountersignedAt = ""
+    prescription.CountersignNote = ""
+    prescription.ReviewedBy = ""
+    prescription.ReviewedAt = ""
+    prescription.ReviewNote = ""
+    prescription.LegacyMedicationName = ""
+
+    if prescription.PrescriptionId == "" {
+        return fmt.Errorf("prescriptionId is required")
+    }
+    if err := indexPrescription(ctx, asset.PatientId, prescription.PrescriptionId); err != nil {
+        return err
+    }
+
+    // Every new prescription must reference the formulary
+    if err := s.applyFormulary(ctx, prescription); err != nil {
+        return err
+    }
+
+    issuerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    prescription.IssuedBy = issuerId
+
+    if err := s.checkDose(ctx, asset, prescription); err != nil {
+        return err
+    }
+
+    if prescription.EncounterId == "" {
+        prescription.EncounterId = ctx.GetStub().GetTxID()
+    }
+    if err := validateDiagnosisCodes(prescription); err != nil {
+        return err
+    }
+
+    // Clinical officers and nurses prescribe under a supervising doctor's delegation
+    if role != RoleDoctor {
+        if err := s.applyDelegation(ctx, prescription); err != nil {
+            return err
+        }
+    }
+
+    // Restricted medicines wait for a second approval before they can be dispensed
+    restricted, err := s.findRestrictedDrug(ctx, prescription.MedicationCode, prescription.MedicationName)
+    if err != nil {
+        return err
+    }
+    if restricted != nil {
+        prescription.Status = StatusPendingApproval
+    }
+
+    if err := s.applyControlledDrugRules(ctx, asset.PatientId, prescription); err != nil {
+        return err
+    }
+
+    if err := s.applySignature(ctx, asset.PatientId, prescription); err != nil {
+        return err
+    }
+
+    return stampContentHash(ctx, asset.PatientId, prescription)
+}
+
 // ReadAsset - returns world state information for an asset, patientId as key
+// Only the patient or their proxy can read it this way; clinicians use AccessPatientRecord, which audits the read.
 func (s *SmartContract) ReadAsset(ctx contractapi.TransactionContextInterface, patientId string) (*Asset, error) {
+    if _, err := s.requirePatientOrProxy(ctx, patientId); err != nil {
+        return nil, fmt.Errorf("%v; clinicians read records with AccessPatientRecord", err)
+    }
+    return s.readAsset(ctx, patientId)
+}
+
+// readAsset loads an asset from world state without any consent check, for use by
+// transactions that enforce their own scope
+func (s *SmartContract) readAsset(ctx contractapi.TransactionContextInterface, patientId string) (*Asset, error) {
     assetJSON, err := ctx.GetStub().GetState(patientId)
     if err != nil {
         return nil, fmt.Errorf("failed to read from world state: %v", err)
@@ -91,11 +381,34 @@ func (s *SmartContract) ReadAsset(ctx contractapi.TransactionContextInterface, p
     return &asset, nil
 }
 
+// issuedByCaller reports whether the caller is the identity that issued a prescription. Legacy prescriptions
+// recorded before the issuing identity was kept have no IssuedBy; they are matched on the prescriber ID alone,
+// which an update proves with the prescriber's signature and a revocation with the doctorId it names.
+func issuedByCaller(prescription *Prescription, callerId string) bool {
+    return prescription.IssuedBy == "" || prescription.IssuedBy == callerId
+}
+
 // UpdatePrescription  - may be used to update prescription details, incase of a change in dosage or instructions
-// Prescriptions are immutable, but we can update the status or other non-immutable fields
+// The medication, status and dispensing record are kept; status only changes by dispensing, revoking or review,
+// except that an updated restricted medicine prescription goes back to pending approval
 func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionJSON string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only prescribers can update prescriptions")
+    }
+    if err := s.requireConsent(ctx, patientId, ScopePrescribe); err != nil {
+        return err
+    }
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
     // Get existing asset
-    asset, err := s.ReadAsset(ctx, patientId)
+    asset, err := s.readAsset(ctx, patientId)
     if err != nil {
         return err
     }
@@ -107,14 +420,101 @@ func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInt
         return fmt.Errorf("failed to parse prescription JSON: %v", err)
     }
 
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
     // Find and update prescription
     found := false
     for i := range asset.Prescriptions {
         if asset.Prescriptions[i].PrescriptionId == newPrescription.PrescriptionId {
-            // Preserve immutable fields
+            // Only the identity that issued the prescription can change it
+            if !issuedByCaller(&asset.Prescriptions[i], callerId) {
+                return fmt.Errorf("only the prescribing doctor can update this prescription")
+            }
+            // Dispensed, revoked, rejected and expired prescriptions are final
+            if status := asset.Prescriptions[i].Status; status != "Active" && status != StatusPendingApproval {
+                return fmt.Errorf("can only update active or pending prescriptions, prescription %s is %s", newPrescription.PrescriptionId, status)
+            }
+            // Preserve immutable fields; a different medication needs a new prescription
             newPrescription.CreatedBy = asset.Prescriptions[i].CreatedBy
+            newPrescription.MedicationCode = asset.Prescriptions[i].MedicationCode
+            newPrescription.MedicationName = asset.Prescriptions[i].MedicationName
+            newPrescription.DrugClass = asset.Prescriptions[i].DrugClass
+            newPrescription.LegacyMedicationName = asset.Prescriptions[i].LegacyMedicationName
+            newPrescription.EncounterId = asset.Prescriptions[i].EncounterId
+            newPrescription.Status = asset.Prescriptions[i].Status
+            if newPrescription.MedicationCode != "" {
+                entry, err := s.GetFormularyEntry(ctx, newPrescription.MedicationCode)
+                if err != nil {
+                    return err
+                }
+                if err := checkFormularyPresentation(entry, &newPrescription); err != nil {
+                    return err
+                }
+            }
+            if err := validateDiagnosisCodes(&newPrescription); err != nil {
+                return err
+            }
+            if err := s.checkDose(ctx, asset, &newPrescription); err != nil {
+                return err
+            }
+            // The update must carry the prescriber's signature over the new content
+            if err := s.applySignature(ctx, patientId, &newPrescription); err != nil {
+                return err
+            }
+            newPrescription.DelegateId = asset.Prescriptions[i].DelegateId
+            newPrescription.SupervisorId = asset.Prescriptions[i].SupervisorId
+            newPrescription.CountersignedBy = asset.Prescriptions[i].CountersignedBy
+            newPrescription.CountersignedAt = asset.Prescriptions[i].CountersignedAt
+            newPrescription.CountersignNote = asset.Prescriptions[i].CountersignNote
+            newPrescription.IssuedBy = asset.Prescriptions[i].IssuedBy
+            newPrescription.IssuedAt = asset.Prescriptions[i].IssuedAt
+            newPrescription.RevokedAt = asset.Prescriptions[i].RevokedAt
+            newPrescription.ReviewedBy = asset.Prescriptions[i].ReviewedBy
+            newPrescription.ReviewedAt = asset.Prescriptions[i].ReviewedAt
+            newPrescription.ReviewNote = asset.Prescriptions[i].ReviewNote
+            newPrescription.ControlledSchedule = asset.Prescriptions[i].ControlledSchedule
+            newPrescription.DispensingPharmacist = asset.Prescriptions[i].DispensingPharmacist
+            newPrescription.DispensingTimestamp = asset.Prescriptions[i].DispensingTimestamp
+            newPrescription.DispensedQuantity = asset.Prescriptions[i].DispensedQuantity
+            newPrescription.DispensingFacility = asset.Prescriptions[i].DispensingFacility
+            newPrescription.DispensedBatch = asset.Prescriptions[i].DispensedBatch
+            newPrescription.BatchManufacturer = asset.Prescriptions[i].BatchManufacturer
+            newPrescription.BatchExpiry = asset.Prescriptions[i].BatchExpiry
+            newPrescription.Recalled = asset.Prescriptions[i].Recalled
+            newPrescription.RecallReason = asset.Prescriptions[i].RecallReason
+            newPrescription.RecalledAt = asset.Prescriptions[i].RecalledAt
+            newPrescription.DispensedCode = asset.Prescriptions[i].DispensedCode
+            newPrescription.DispensedName = asset.Prescriptions[i].DispensedName
+            newPrescription.DispensedStrength = asset.Prescriptions[i].DispensedStrength
+            newPrescription.Substituted = asset.Prescriptions[i].Substituted
+            newPrescription.SubstitutionReason = asset.Prescriptions[i].SubstitutionReason
+            newPrescription.PrescriberFacility = asset.Prescriptions[i].PrescriberFacility
+            newPrescription.DuplicateWarnings = asset.Prescriptions[i].DuplicateWarnings
+
+            // A changed restricted medicine prescription must be approved again before it is dispensed
+            restricted, err := s.findRestrictedDrug(ctx, newPrescription.MedicationCode, newPrescription.MedicationName)
+            if err != nil {
+                return err
+            }
+            if restricted != nil {
+                newPrescription.Status = StatusPendingApproval
+                newPrescription.ReviewedBy = ""
+                newPrescription.ReviewedAt = ""
+                newPrescription.ReviewNote = ""
+            }
+
+            // Controlled drug quantities are fixed once issued
+            if newPrescription.ControlledSchedule != "" && (newPrescription.Quantity != asset.Prescriptions[i].Quantity || newPrescription.Refills != asset.Prescriptions[i].Refills) {
+                return fmt.Errorf("quantity and refills of controlled drug prescription %s cannot be changed", newPrescription.PrescriptionId)
+            }
+
             newPrescription.TxID = ctx.GetStub().GetTxID()
-            newPrescription.Timestamp = time.Now().Format(time.RFC3339)
+            newPrescription.Timestamp = now.Format(time.RFC3339)
+            if err := stampContentHash(ctx, patientId, &newPrescription); err != nil {
+                return err
+            }
             asset.Prescriptions[i] = newPrescription
             found = true
             break
@@ -125,7 +525,7 @@ func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInt
         return fmt.Errorf("prescription %s not found", newPrescription.PrescriptionId)
     }
 
-    asset.LastUpdated = time.Now().Format(time.RFC3339)
+    asset.LastUpdated = now.Format(time.RFC3339)
     assetJSON, err := json.Marshal(asset)
     if err != nil {
         return err
@@ -139,10 +539,17 @@ func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInt
 func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextInterface, dispensationJSON string) error {
     // Parse the dispensation JSON
     var dispensation struct {
-        PatientId       string `json:"patientId"`
-        PrescriptionId string `json:"prescriptionId"`
-        PharmacistId   string `json:"pharmacistId"`
-        Note           string `json:"note,omitempty"`
+        PatientId          string `json:"patientId"`
+        PrescriptionId     string `json:"prescriptionId"`
+        PharmacistId       string `json:"pharmacistId"`
+        Note               string `json:"note,omitempty"`
+        Quantity           int    `json:"quantity,omitempty"` // defaults to the prescribed quantity
+        BatchNumber        string `json:"batchNumber"`
+        Manufacturer       string `json:"manufacturer,omitempty"`       // must match the stock record when given
+        BatchExpiry        string `json:"batchExpiry,omitempty"`        // must match the stock record when given
+        DispensedCode      string `json:"dispensedCode,omitempty"`      // defaults to the prescribed code
+        DispensedStrength  string `json:"dispensedStrength,omitempty"`  // defaults to the prescribed strength
+        SubstitutionReason string `json:"substitutionReason,omitempty"` // required when substituting
     }
     
     err := json.Unmarshal([]byte(dispensationJSON), &dispensation)
@@ -154,13 +561,33 @@ func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextI
     if dispensation.PatientId == "" || dispensation.PrescriptionId == "" || dispensation.PharmacistId == "" {
         return fmt.Errorf("patientId, prescriptionId, and pharmacistId are required")
     }
+    if dispensation.BatchNumber == "" {
+        return fmt.Errorf("batchNumber is required to dispense")
+    }
+
+    // Only pharmacy staff take stock off the shelf
+    if err := s.requireDispenser(ctx); err != nil {
+        return err
+    }
+    if err := s.requireConsent(ctx, dispensation.PatientId, ScopeDispense); err != nil {
+        return err
+    }
+
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
 
     // Get the asset
-    asset, err := s.ReadAsset(ctx, dispensation.PatientId)
+    asset, err := s.readAsset(ctx, dispensation.PatientId)
     if err != nil {
         return err
     }
 
+    timestamp, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
     // Find and update prescription
     found := false
     for i := range asset.Prescriptions {
@@ -169,17 +596,101 @@ func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextI
             if asset.Prescriptions[i].Status == "Revoked" {
                 return fmt.Errorf("cannot dispense a revoked prescription")
             }
+            if asset.Prescriptions[i].Status == StatusPendingApproval {
+                return fmt.Errorf("prescription %s is a restricted medicine awaiting approval", dispensation.PrescriptionId)
+            }
+            if asset.Prescriptions[i].Status == StatusRejected {
+                return fmt.Errorf("cannot dispense a rejected prescription")
+            }
             if asset.Prescriptions[i].Status != "Active" {
                 return fmt.Errorf("can only dispense active prescriptions")
             }
             
+            quantity := dispensation.Quantity
+            if quantity == 0 {
+                quantity = asset.Prescriptions[i].Quantity
+            }
+            if quantity == 0 {
+                return fmt.Errorf("a quantity is required to dispense prescription %s from stock", dispensation.PrescriptionId)
+            }
+            if quantity < 0 || (asset.Prescriptions[i].Quantity > 0 && quantity > asset.Prescriptions[i].Quantity) {
+                return fmt.Errorf("invalid dispense quantity %d for prescription %s", quantity, dispensation.PrescriptionId)
+            }
+            if asset.Prescriptions[i].MedicationCode == "" {
+                return fmt.Errorf("prescription %s has no formulary code and cannot be dispensed from stock; map it with MapLegacyPrescription first", dispensation.PrescriptionId)
+            }
+
+            // A substitute must be therapeutically equivalent to the prescribed product
+            product, strength, substituted, err := s.resolveDispensedProduct(ctx, &asset.Prescriptions[i], dispensation.DispensedCode, dispensation.DispensedStrength, dispensation.SubstitutionReason)
+            if err != nil {
+                return err
+            }
+
+            // Batch details come from the facility's stock record for the batch, never from the request
+            stockItem, err := s.getStockItem(ctx, facilityId, product.Code, dispensation.BatchNumber)
+            if err != nil {
+                return err
+            }
+            if stockItem == nil {
+                return fmt.Errorf("no stock of %s batch %s at %s", product.Code, dispensation.BatchNumber, facilityId)
+            }
+            if dispensation.BatchExpiry != "" && dispensation.BatchExpiry != stockItem.BatchExpiry {
+                return fmt.Errorf("batch %s expires on %s according to the stock record, not %s", dispensation.BatchNumber, stockItem.BatchExpiry, dispensation.BatchExpiry)
+            }
+            if dispensation.Manufacturer != "" && dispensation.Manufacturer != stockItem.Manufacturer {
+                return fmt.Errorf("batch %s was made by %s according to the stock record, not %s", dispensation.BatchNumber, stockItem.Manufacturer, dispensation.Manufacturer)
+            }
+
+            // Expired or recalled stock cannot be handed over
+            if err := s.validateDispenseBatch(ctx, stockItem); err != nil {
+                return err
+            }
+            stockItem, err = s.decrementStock(ctx, facilityId, product.Code, dispensation.BatchNumber, quantity)
+            if err != nil {
+                return err
+            }
+            if err := s.recordCustody(ctx, &CustodyEvent{
+                BatchNumber:    dispensation.BatchNumber,
+                MedicationCode: product.Code,
+                EventType:      CustodyDispensed,
+                FromFacilityId: facilityId,
+                Quantity:       quantity,
+                Reference:      dispensation.PrescriptionId,
+            }); err != nil {
+                return err
+            }
+            if asset.Prescriptions[i].ControlledSchedule != "" {
+                if err := s.recordControlledDispense(ctx, facilityId, dispensation.PatientId, &asset.Prescriptions[i], product, quantity); err != nil {
+                    return err
+                }
+            }
+
             // Update prescription status and pharmacist info
-            now := time.Now().Format(time.RFC3339)
+            now := timestamp.Format(time.RFC3339)
             asset.Prescriptions[i].Status = "Dispensed"
             asset.Prescriptions[i].TxID = ctx.GetStub().GetTxID()
             asset.Prescriptions[i].Timestamp = now
             asset.Prescriptions[i].DispensingPharmacist = dispensation.PharmacistId
             asset.Prescriptions[i].DispensingTimestamp = now
+            asset.Prescriptions[i].DispensedQuantity = quantity
+            asset.Prescriptions[i].DispensingFacility = facilityId
+            asset.Prescriptions[i].DispensedBatch = stockItem.BatchNumber
+            asset.Prescriptions[i].BatchManufacturer = stockItem.Manufacturer
+            asset.Prescriptions[i].BatchExpiry = stockItem.BatchExpiry
+            asset.Prescriptions[i].DispensedCode = product.Code
+            asset.Prescriptions[i].DispensedName = product.GenericName
+            asset.Prescriptions[i].DispensedStrength = strength
+            asset.Prescriptions[i].Substituted = substituted
+            asset.Prescriptions[i].SubstitutionReason = ""
+            if substituted {
+                asset.Prescriptions[i].SubstitutionReason = dispensation.SubstitutionReason
+            }
+            if err := s.indexBatchDispense(ctx, dispensation.PatientId, &asset.Prescriptions[i]); err != nil {
+                return err
+            }
+            if err := s.emitStockEvent(ctx, "PrescriptionDispensed", dispensation.PrescriptionId, []StockChange{stockChange(stockItem, -quantity, "Dispensed")}, []*StockItem{stockItem}); err != nil {
+                return err
+            }
             found = true
             break
         }
@@ -190,7 +701,7 @@ func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextI
     }
 
     // Update asset and save to state
-    asset.LastUpdated = time.Now().Format(time.RFC3339)
+    asset.LastUpdated = timestamp.Format(time.RFC3339)
     assetJSON, err := json.Marshal(asset)
     if err != nil {
         return err
@@ -201,6 +712,10 @@ func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextI
 
 // GetAssetHistory - obtain the history of a specific asset(patientId) from the ledger 
 func (s *SmartContract) GetAssetHistory(ctx contractapi.TransactionContextInterface, patientId string) ([]map[string]interface{}, error) {
+    if err := s.auditRead(ctx, patientId, "Record history"); err != nil {
+        return nil, err
+    }
+
     historyIterator, err := ctx.GetStub().GetHistoryForKey(patientId)
     if err != nil {
         return nil, err
@@ -235,7 +750,10 @@ func (s *SmartContract) GetAssetHistory(ctx contractapi.TransactionContextInterf
         for _, prescription := range asset.Prescriptions {
             prescriptionRecord := map[string]interface{}{
                 "prescriptionId": prescription.PrescriptionId,
+                "medicationCode": prescription.MedicationCode,
                 "medicationName": prescription.MedicationName,
+                "encounterId":   prescription.EncounterId,
+                "diagnosisCodes": prescription.DiagnosisCodes,
                 "dosage":        prescription.Dosage,
                 "instructions":  prescription.Instructions,
                 "status":       prescription.Status,
@@ -243,6 +761,20 @@ func (s *SmartContract) GetAssetHistory(ctx contractapi.TransactionContextInterf
                 "timestamp":    prescription.Timestamp,
                 "expiryDate":   prescription.ExpiryDate,
             }
+            if prescription.DispensedCode != "" {
+                prescriptionRecord["strength"] = prescription.Strength
+                prescriptionRecord["dispensedCode"] = prescription.DispensedCode
+                prescriptionRecord["dispensedName"] = prescription.DispensedName
+                prescriptionRecord["dispensedStrength"] = prescription.DispensedStrength
+                prescriptionRecord["substituted"] = prescription.Substituted
+                prescriptionRecord["substitutionReason"] = prescription.SubstitutionReason
+            }
+            if prescription.SupervisorId != "" {
+                prescriptionRecord["delegateId"] = prescription.DelegateId
+                prescriptionRecord["supervisorId"] = prescription.SupervisorId
+                prescriptionRecord["countersignedBy"] = prescription.CountersignedBy
+                prescriptionRecord["countersignedAt"] = prescription.CountersignedAt
+            }
             record["prescriptions"] = append(record["prescriptions"].([]map[string]interface{}), prescriptionRecord)
         }
 
@@ -255,7 +787,10 @@ func (s *SmartContract) GetAssetHistory(ctx contractapi.TransactionContextInterf
 // GetPrescriptionsByStatus - obtain prescriptions by status
 // This function allows filtering prescriptions based on their status (e.g., Active, Dispensed, Revoked, Expired)
 func (s *SmartContract) GetPrescriptionsByStatus(ctx contractapi.TransactionContextInterface, patientId string, status string) ([]Prescription, error) {
-    asset, err := s.ReadAsset(ctx, patientId)
+    if err := s.auditRead(ctx, patientId, "Prescriptions by status"); err != nil {
+        return nil, err
+    }
+    asset, err := s.readAsset(ctx, patientId)
     if err != nil {
         return nil, err
     }
@@ -292,12 +827,31 @@ func (s *SmartContract) RevokePrescriptionJSON(ctx contractapi.TransactionContex
         return fmt.Errorf("patientId, prescriptionId, and doctorId are required")
     }
 
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) {
+        return fmt.Errorf("only prescribers can revoke prescriptions")
+    }
+    if err := s.requireConsent(ctx, revocation.PatientId, ScopePrescribe); err != nil {
+        return err
+    }
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+
     // Get the asset
-    asset, err := s.ReadAsset(ctx, revocation.PatientId)
+    asset, err := s.readAsset(ctx, revocation.PatientId)
     if err != nil {
         return err
     }
 
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
     // Find and update prescription
     found := false
     for i := range asset.Prescriptions {
@@ -306,6 +860,10 @@ func (s *SmartContract) RevokePrescriptionJSON(ctx contractapi.TransactionContex
             if asset.Prescriptions[i].CreatedBy != revocation.DoctorId {
                 return fmt.Errorf("only the prescribing doctor can revoke this prescription")
             }
+            // DoctorId is supplied by the caller, so the caller must also be the identity that issued it
+            if !issuedByCaller(&asset.Prescriptions[i], callerId) {
+                return fmt.Errorf("only the prescribing doctor can revoke this prescription")
+            }
             
             if asset.Prescriptions[i].Status != "Active" {
                 return fmt.Errorf("can only revoke active prescriptions")
@@ -313,7 +871,8 @@ func (s *SmartContract) RevokePrescriptionJSON(ctx contractapi.TransactionContex
             
             asset.Prescriptions[i].Status = "Revoked"
             asset.Prescriptions[i].TxID = ctx.GetStub().GetTxID()
-            asset.Prescriptions[i].Timestamp = time.Now().Format(time.RFC3339)
+            asset.Prescriptions[i].Timestamp = now.Format(time.RFC3339)
+            asset.Prescriptions[i].RevokedAt = asset.Prescriptions[i].Timestamp
             found = true
             break
         }
@@ -323,7 +882,7 @@ func (s *SmartContract) RevokePrescriptionJSON(ctx contractapi.TransactionContex
         return fmt.Errorf("prescription not found")
     }
 
-    asset.LastUpdated = time.Now().Format(time.RFC3339)
+    asset.LastUpdated = now.Format(time.RFC3339)
     assetJSON, err := json.Marshal(asset)
     if err != nil {
         return err
@@ -332,7 +891,8 @@ func (s *SmartContract) RevokePrescriptionJSON(ctx contractapi.TransactionContex
     return ctx.GetStub().PutState(revocation.PatientId, assetJSON)
 }
 
-// GetUserRole retrieves the user's role from their certificate attributes
+// GetUserRole retrieves the user's role from their certificate attributes and checks that
+// their organization may hold it
 func (s *SmartContract) GetUserRole(ctx contractapi.TransactionContextInterface) (string, error) {
     // Get the MSP ID and certificate
     mspID, err := ctx.GetClientIdentity().GetMSPID()
@@ -349,19 +909,18 @@ func (s *SmartContract) GetUserRole(ctx contractapi.TransactionContextInterface)
         return "", fmt.Errorf("role attribute not found in certificate")
     }
 
-    // Validate role based on MSP
-    switch mspID {
-    case "Org1MSP": // Doctor's organization
-        if role != "doctor" {
-            return "", fmt.Errorf("invalid role '%s' for organization %s", role, mspID)
-        }
-    case "Org2MSP": // Pharmacist's organization
-        if role != "pharmacist" {
-            return "", fmt.Errorf("invalid role '%s' for organization %s", role, mspID)
-        }
-    default:
+    // Validate role against the MSP-to-roles mapping held on the ledger
+    mapping, err := s.GetRoleMapping(ctx)
+    if err != nil {
+        return "", err
+    }
+    allowedRoles, known := mapping.MSPRoles[mspID]
+    if !known {
         return "", fmt.Errorf("unknown MSP ID: %s", mspID)
     }
+    if !containsString(allowedRoles, role) {
+        return "", fmt.Errorf("invalid role '%s' for organization %s", role, mspID)
+    }
 
     return role, nil
 }
@@ -378,12 +937,15 @@ func (s *SmartContract) GetPrescriptionsByPatient(ctx contractapi.TransactionCon
     if err != nil {
         return nil, err
     }
-    if role != "doctor" {
-        return nil, fmt.Errorf("only doctors can access patient prescriptions")
+    if !isPrescriberRole(role) {
+        return nil, fmt.Errorf("only prescribers can access patient prescriptions")
     }
 
     // Get the asset
-    asset, err := s.ReadAsset(ctx, patientId)
+    if err := s.auditRead(ctx, patientId, "Own prescriptions"); err != nil {
+        return nil, err
+    }
+    asset, err := s.readAsset(ctx, patientId)
     if err != nil {
         return nil, err
     }
@@ -400,24 +962,39 @@ func (s *SmartContract) GetPrescriptionsByPatient(ctx contractapi.TransactionCon
     return asset, nil
 }
 
-// CheckPrescriptionExpiry - checks if a prescription has expired
+// CheckPrescriptionExpiry - marks an active prescription Expired once it is past its expiry date.
+// Only prescribers and pharmacy staff can record the change.
 func (s *SmartContract) CheckPrescriptionExpiry(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string) error {
-    asset, err := s.ReadAsset(ctx, patientId)
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isPrescriberRole(role) && !isDispenserRole(role) {
+        return fmt.Errorf("only prescribers and pharmacy staff can expire prescriptions")
+    }
+    if err := s.requireConsent(ctx, patientId, ScopeRead); err != nil {
+        return err
+    }
+    asset, err := s.readAsset(ctx, patientId)
     if err != nil {
         return err
     }
 
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
     for i := range asset.Prescriptions {
         if asset.Prescriptions[i].PrescriptionId == prescriptionId {
-            expiryDate, err := time.Parse("2006-01-02", asset.Prescriptions[i].ExpiryDate)
+            expired, err := prescriptionExpired(&asset.Prescriptions[i], now)
             if err != nil {
-                return fmt.Errorf("invalid expiry date format: %v", err)
+                return err
             }
 
-            if time.Now().After(expiryDate) {
+            if expired {
                 asset.Prescriptions[i].Status = "Expired"
                 asset.Prescriptions[i].TxID = ctx.GetStub().GetTxID()
-                asset.Prescriptions[i].Timestamp = time.Now().Format(time.RFC3339)
+                asset.Prescriptions[i].Timestamp = now.Format(time.RFC3339)
 
                 assetJSON, err := json.Marshal(asset)
                 if err != nil {
@@ -432,8 +1009,17 @@ func (s *SmartContract) CheckPrescriptionExpiry(ctx contractapi.TransactionConte
     return fmt.Errorf("prescription not found")
 }
 
-// GetPrescriptionAnalytics - get analytics for prescriptions by doctor/pharmacist
+// GetPrescriptionAnalytics - get analytics for prescriptions across all patients.
+// Only regulators and administrators can compute them.
 func (s *SmartContract) GetPrescriptionAnalytics(ctx contractapi.TransactionContextInterface, startDate string, endDate string) (map[string]interface{}, error) {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if role != RoleRegulator && role != RoleAdmin {
+        return nil, fmt.Errorf("only regulators and administrators can compute prescription analytics")
+    }
+
     iterator, err := ctx.GetStub().GetStateByRange("", "")
     if err != nil {
         return nil, err
@@ -487,7 +1073,11 @@ func (s *SmartContract) GetPrescriptionAnalytics(ctx contractapi.TransactionCont
 
 // CheckMedicationInteractions - checks for potential interactions between medications
 func (s *SmartContract) CheckMedicationInteractions(ctx contractapi.TransactionContextInterface, patientId string, newMedication string) ([]string, error) {
-    asset, err := s.ReadAsset(ctx, patientId)
+    if err := s.requireConsent(ctx, patientId, ScopeRead, ScopePrescribe); err != nil {
+        return nil, err
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
     if err != nil {
         return nil, err
     }
@@ -557,6 +1147,11 @@ func (s *SmartContract) GetPrescriptionsByDoctor(ctx contractapi.TransactionCont
             continue
         }
 
+        // Skip patients who have not consented to the caller reading their record
+        if s.requireConsent(ctx, asset.PatientId, ScopeRead) != nil {
+            continue
+        }
+
         for _, prescription := range asset.Prescriptions {
             if prescription.CreatedBy == doctorId {
                 prescriptionData := map[string]interface{}{
@@ -601,6 +1196,11 @@ func (s *SmartContract) GetDispenseHistory(ctx contractapi.TransactionContextInt
             continue
         }
 
+        // Skip patients who have not consented to the caller reading their record
+        if s.requireConsent(ctx, asset.PatientId, ScopeRead, ScopeDispense) != nil {
+            continue
+        }
+
         for _, prescription := range asset.Prescriptions {
             if prescription.DispensingPharmacist == pharmacistId {
                 prescriptionData := map[string]interface{}{
@@ -613,6 +1213,13 @@ func (s *SmartContract) GetDispenseHistory(ctx contractapi.TransactionContextInt
                     "Status":              prescription.Status,
                     "CreatedBy":           prescription.CreatedBy,
                     "DispensingTimestamp": prescription.DispensingTimestamp,
+                    "DispensedBatch":      prescription.DispensedBatch,
+                    "DispensedCode":       prescription.DispensedCode,
+                    "DispensedName":       prescription.DispensedName,
+                    "DispensedStrength":   prescription.DispensedStrength,
+                    "Substituted":         prescription.Substituted,
+                    "SubstitutionReason":  prescription.SubstitutionReason,
+                    "Recalled":            prescription.Recalled,
                     "TxID":                prescription.TxID,
                 }
                 
@@ -0,0 +1,194 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestCreatePatientIfAbsent(t *testing.T) {
+    contract := &SmartContract{}
+    ca := newTestCA(t, "ca.org1")
+
+    tests := []struct {
+        name        string
+        caller      *testIdentity
+        existing    bool
+        wantCreated bool
+        wantErr     string
+    }{
+        {name: "new patient", caller: doctor("dr-banda"), wantCreated: true},
+        {name: "existing patient is left untouched", caller: doctor("dr-banda"), existing: true},
+        {name: "non-prescriber", caller: pharmacist("ph-mwale"), wantErr: "only prescribers can register patients"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"250mg"}, DosageForms: []string{"capsule"}})
+            ledger.trustSigners("Org1MSP", ca)
+            if tt.existing {
+                ledger.put("P1", Asset{PatientId: "P1", PatientName: "Existing", DoctorId: "DOC0", Prescriptions: []Prescription{}})
+            }
+
+            prescription := Prescription{
+                PrescriptionId: "RX1", MedicationCode: "AMOX", Strength: "250mg", DosageForm: "capsule",
+                Dosage: "1 capsule", Quantity: 21, ExpiryDate: "2999-01-01", CreatedBy: "DOC1",
+            }
+            ca.prescriber("DOC1").sign(t, "P1", &prescription)
+            assetJSON, err := json.Marshal(Asset{PatientId: "P1", PatientName: "Jane Banda", DoctorId: "DOC1", Prescriptions: []Prescription{prescription}})
+            require.NoError(t, err)
+
+            var created bool
+            err = ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                created, err = contract.CreatePatientIfAbsent(ctx, string(assetJSON))
+                return err
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Nil(t, ledger.state["P1"])
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.wantCreated, created)
+
+            record := ledger.asset("P1")
+            if tt.wantCreated {
+                require.Equal(t, "Jane Banda", record.PatientName)
+                require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+            } else {
+                require.Equal(t, "Existing", record.PatientName)
+                require.Empty(t, record.Prescriptions)
+            }
+        })
+    }
+}
+
+func TestAddPrescriptionsChecksConsentFirst(t *testing.T) {
+    ledger := newTestLedger(t)
+    contract := &SmartContract{}
+
+    // Without consent the caller cannot learn whether the patient has a record
+    err := ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.AddPrescriptions(ctx, "P404", "DOC1", `[{"PrescriptionId":"RX1"}]`)
+    })
+    require.ErrorIs(t, err, ErrConsentDenied)
+}
+
+func TestCreateAssetRejectsExistingRecord(t *testing.T) {
+    ledger := newTestLedger(t)
+    contract := &SmartContract{}
+    ledger.put("P1", Asset{PatientId: "P1", PatientName: "Existing", DoctorId: "DOC0", Prescriptions: []Prescription{}})
+    ledger.grantConsent("P1", GranteeFacility, "KCH", ScopePrescribe)
+
+    err := ledger.submit(doctor("dr-banda"), func(ctx contractapi.TransactionContextInterface) error {
+        return contract.CreateAsset(ctx, `{"PatientId":"P1","PatientName":"Replaced","DoctorId":"DOC1","Prescriptions":[]}`)
+    })
+    require.ErrorContains(t, err, "add prescriptions with AddPrescriptions")
+    require.Equal(t, "Existing", ledger.asset("P1").PatientName)
+}
+
+func TestGetPrescriptionAnalyticsRoles(t *testing.T) {
+    contract := &SmartContract{}
+
+    tests := []struct {
+        name    string
+        caller  *testIdentity
+        wantErr bool
+    }{
+        {name: "regulator", caller: regulator("reg-phiri")},
+        {name: "admin", caller: admin("admin-kumwenda")},
+        {name: "doctor", caller: doctor("dr-banda"), wantErr: true},
+        {name: "pharmacist", caller: pharmacist("ph-mwale"), wantErr: true},
+        {name: "patient", caller: patient("P1"), wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+                {PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active"},
+                {PrescriptionId: "RX2", MedicationName: "Amoxicillin", Status: "Dispensed"},
+            }})
+
+            var analytics map[string]interface{}
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                var err error
+                analytics, err = contract.GetPrescriptionAnalytics(ctx, "", "")
+                return err
+            })
+            if tt.wantErr {
+                require.ErrorContains(t, err, "only regulators and administrators")
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, 2, analytics["totalPrescriptions"])
+            require.Equal(t, 1, analytics["dispensedCount"])
+        })
+    }
+}
+
+func TestCheckPrescriptionExpiry(t *testing.T) {
+    contract := &SmartContract{}
+    key := []byte("server-secret")
+
+    tests := []struct {
+        name       string
+        caller     *testIdentity
+        status     string
+        at         time.Time
+        wantStatus string
+        wantErr    string
+    }{
+        {name: "prescriber after the expiry date", caller: doctor("dr-banda"), status: "Active", at: time.Date(2024, 5, 2, 0, 0, 1, 0, time.UTC), wantStatus: "Expired"},
+        {name: "pharmacist after the expiry date", caller: pharmacist("ph-mwale"), status: "Active", at: time.Date(2024, 5, 2, 0, 0, 1, 0, time.UTC), wantStatus: "Expired"},
+        {name: "during the expiry date", caller: doctor("dr-banda"), status: "Active", at: time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC), wantStatus: "Active"},
+        {name: "before the expiry date", caller: doctor("dr-banda"), status: "Active", at: time.Date(2024, 4, 30, 12, 0, 0, 0, time.UTC), wantStatus: "Active"},
+        {name: "dispensed prescription", caller: doctor("dr-banda"), status: "Dispensed", at: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), wantStatus: "Dispensed"},
+        {
+            name: "patient", caller: patient("P1"), status: "Active", at: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+            wantErr: "only prescribers and pharmacy staff",
+        },
+        {
+            name: "regulator", caller: regulator("reg-kalua"), status: "Active", at: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+            wantErr: "only prescribers and pharmacy staff",
+        },
+        {
+            name: "clinician without consent", caller: newIdentity("dr-tembo", "Org1MSP", map[string]string{"role": RoleDoctor, "facilityId": "ZCH"}),
+            status: "Active", at: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), wantErr: "consent denied",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.clock = tt.at
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: tt.status, ExpiryDate: "2024-05-01", ContentHash: "abc",
+            }}})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopeRead)
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeRead)
+            ledger.putPrivate(patientHashKeyCollection, patientHashKeyId, PatientHashKey{Key: key})
+
+            // The public status check applies the same expiry rule at the same time
+            ctx, _ := ledger.context(pharmacist("ph-mwale"))
+            reported, err := contract.GetPrescriptionStatus(ctx, "RX1", hashPatientId(key, "P1"), "abc")
+            require.NoError(t, err)
+
+            err = ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                return contract.CheckPrescriptionExpiry(ctx, "P1", "RX1")
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, tt.status, ledger.prescription("P1", "RX1").Status)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, tt.wantStatus, ledger.prescription("P1", "RX1").Status)
+            require.Equal(t, tt.wantStatus, reported.Status)
+        })
+    }
+}
@@ -0,0 +1,228 @@
+package chaincode
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const prescriptionIndexObjectType = "rx"
+
+// patientHashKeyTransient is the transient data field SetPatientHashKey reads the patient hash key from
+const patientHashKeyTransient = "patientHashKey"
+
+// patientHashKeyCollection is the private data collection the patient hash key is kept in. Only the verifying
+// organization is a member (see collections_config.json), so the key never appears in a block; other peers only
+// see its hash.
+const patientHashKeyCollection = "patientHashKeyCollection"
+
+// patientHashKeyId is the key the patient hash key is stored under in its collection
+const patientHashKeyId = "patient-hash-key"
+
+// PatientHashKey is the key patient hashes in prescription tokens are keyed with. It is the same secret the
+// issuing server holds, registered once by an admin.
+type PatientHashKey struct {
+    Key       []byte `json:"Key"`
+    UpdatedBy string `json:"UpdatedBy,omitempty"`
+    UpdatedAt string `json:"UpdatedAt,omitempty"`
+}
+
+// PrescriptionStatus is the public status of a prescription presented on paper or as a QR code
+type PrescriptionStatus struct {
+    PrescriptionId string `json:"PrescriptionId"`
+    Status         string `json:"Status"` // Active, PendingApproval, Rejected, Dispensed, Revoked or Expired
+    MedicationName string `json:"MedicationName"`
+    Strength       string `json:"Strength,omitempty"`
+    ExpiryDate     string `json:"ExpiryDate,omitempty"`
+    DispensedAt    string `json:"DispensedAt,omitempty"`
+    ContentMatches bool   `json:"ContentMatches"` // false when the presented content hash is not the current one
+}
+
+// SetPatientHashKey - registers the key patient hashes are keyed with; admins of the verifying organization only.
+// The key is passed as the transient data field patientHashKey and stored in patientHashKeyCollection, so neither
+// the transaction's arguments nor its public write set contain it.
+func (s *SmartContract) SetPatientHashKey(ctx contractapi.TransactionContextInterface) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role != RoleAdmin {
+        return fmt.Errorf("only admins can set the patient hash key")
+    }
+
+    transient, err := ctx.GetStub().GetTransient()
+    if err != nil {
+        return fmt.Errorf("failed to read transient data: %v", err)
+    }
+    key := transient[patientHashKeyTransient]
+    if len(key) == 0 {
+        return fmt.Errorf("the patient hash key must be passed as transient data field %s", patientHashKeyTransient)
+    }
+
+    callerId, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return fmt.Errorf("failed to get caller identity: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    hashKey := PatientHashKey{Key: key, UpdatedBy: callerId, UpdatedAt: now.Format(time.RFC3339)}
+
+    hashKeyBytes, err := json.Marshal(hashKey)
+    if err != nil {
+        return err
+    }
+    if err := ctx.GetStub().PutPrivateData(patientHashKeyCollection, patientHashKeyId, hashKeyBytes); err != nil {
+        return fmt.Errorf("failed to store the patient hash key: %v", err)
+    }
+    return nil
+}
+
+// getPatientHashKey returns the registered patient hash key. It can only be read on the peers of the verifying
+// organization.
+func (s *SmartContract) getPatientHashKey(ctx contractapi.TransactionContextInterface) ([]byte, error) {
+    hashKeyJSON, err := ctx.GetStub().GetPrivateData(patientHashKeyCollection, patientHashKeyId)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read the patient hash key: %v", err)
+    }
+    if hashKeyJSON == nil {
+        return nil, fmt.Errorf("no patient hash key is registered; an admin must set it with SetPatientHashKey")
+    }
+
+    var hashKey PatientHashKey
+    if err := json.Unmarshal(hashKeyJSON, &hashKey); err != nil {
+        return nil, err
+    }
+    return hashKey.Key, nil
+}
+
+// GetPrescriptionStatus - returns the current status of a prescription to whoever holds its token. The caller must
+// present the patient hash and content hash from the token, so the prescription ID alone reveals nothing. The patient
+// hash is an HMAC keyed with the secret registered with SetPatientHashKey, never a key the caller supplies, so it
+// cannot be recomputed from a guessed patient ID.
+func (s *SmartContract) GetPrescriptionStatus(ctx contractapi.TransactionContextInterface, prescriptionId string, patientHash string, contentHash string) (*PrescriptionStatus, error) {
+    key, err := s.getPatientHashKey(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    patientId, err := s.findPrescriptionPatient(ctx, prescriptionId)
+    if err != nil {
+        return nil, err
+    }
+    if patientId == "" || !hmac.Equal([]byte(hashPatientId(key, patientId)), []byte(patientHash)) {
+        return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+    }
+
+    asset, err := s.readAsset(ctx, patientId)
+    if err != nil {
+        return nil, err
+    }
+    for _, prescription := range asset.Prescriptions {
+        if prescription.PrescriptionId != prescriptionId {
+            continue
+        }
+
+        now, err := txTime(ctx)
+        if err != nil {
+            return nil, err
+        }
+        status := prescription.Status
+        if expired, err := prescriptionExpired(&prescription, now); err == nil && expired {
+            status = "Expired"
+        }
+        return &PrescriptionStatus{
+            PrescriptionId: prescriptionId,
+            Status:         status,
+            MedicationName: prescription.MedicationName,
+            Strength:       prescription.Strength,
+            ExpiryDate:     prescription.ExpiryDate,
+            DispensedAt:    prescription.DispensingTimestamp,
+            ContentMatches: prescription.ContentHash != "" && prescription.ContentHash == contentHash,
+        }, nil
+    }
+
+    return nil, fmt.Errorf("prescription %s not found", prescriptionId)
+}
+
+// prescriptionExpired reports whether an active prescription is past its expiry date. The prescription can
+// be dispensed throughout its expiry date, so it expires when that day ends.
+func prescriptionExpired(prescription *Prescription, now time.Time) (bool, error) {
+    if prescription.Status != "Active" || prescription.ExpiryDate == "" {
+        return false, nil
+    }
+    expiry, err := time.Parse("2006-01-02", prescription.ExpiryDate)
+    if err != nil {
+        return false, fmt.Errorf("invalid expiry date format: %v", err)
+    }
+    return now.After(expiry.AddDate(0, 0, 1)), nil
+}
+
+// indexPrescription maps a prescription ID to its patient, rejecting IDs already used for another patient
+func indexPrescription(ctx contractapi.TransactionContextInterface, patientId string, prescriptionId string) error {
+    key, err := ctx.GetStub().CreateCompositeKey(prescriptionIndexObjectType, []string{prescriptionId})
+    if err != nil {
+        return err
+    }
+    existing, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if existing != nil && string(existing) != patientId {
+        return fmt.Errorf("prescription ID %s is already in use", prescriptionId)
+    }
+    return ctx.GetStub().PutState(key, []byte(patientId))
+}
+
+// findPrescriptionPatient returns the patient a prescription belongs to, or "" if it is unknown. Prescriptions
+// issued before the index existed are found by scanning the patient records.
+func (s *SmartContract) findPrescriptionPatient(ctx contractapi.TransactionContextInterface, prescriptionId string) (string, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(prescriptionIndexObjectType, []string{prescriptionId})
+    if err != nil {
+        return "", err
+    }
+    patientId, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return "", fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if patientId != nil {
+        return string(patientId), nil
+    }
+
+    iterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return "", err
+    }
+    defer iterator.Close()
+
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            continue
+        }
+
+        var asset Asset
+        if err := json.Unmarshal(queryResponse.Value, &asset); err != nil {
+            continue
+        }
+        for _, prescription := range asset.Prescriptions {
+            if prescription.PrescriptionId == prescriptionId {
+                return asset.PatientId, nil
+            }
+        }
+    }
+    return "", nil
+}
+
+// hashPatientId is the hex HMAC-SHA256 of a patient ID under the given key, used in tokens in place of the ID itself
+func hashPatientId(key []byte, patientId string) string {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(patientId))
+    return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package chaincode
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+    "github.com/stretchr/testify/require"
+)
+
+func TestPrescriptionStatusNeedsKeyedPatientHash(t *testing.T) {
+    contract := &SmartContract{}
+    key := []byte("server-secret")
+    unkeyed := sha256.Sum256([]byte("P1"))
+
+    tests := []struct {
+        name        string
+        registered  []byte // key registered on the ledger
+        transient   []byte // key the caller passes
+        patientHash string
+        wantErr     string
+    }{
+        {name: "keyed hash", registered: key, patientHash: hashPatientId(key, "P1")},
+        {name: "unkeyed SHA-256", registered: key, patientHash: hex.EncodeToString(unkeyed[:]), wantErr: "prescription RX1 not found"},
+        {name: "hash under another key", registered: key, patientHash: hashPatientId([]byte("guess"), "P1"), wantErr: "prescription RX1 not found"},
+        {name: "caller cannot supply the key", registered: key, transient: []byte("guess"), patientHash: hashPatientId([]byte("guess"), "P1"), wantErr: "prescription RX1 not found"},
+        {name: "no key registered", transient: key, patientHash: hashPatientId(key, "P1"), wantErr: "no patient hash key is registered"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.put("P1", Asset{PatientId: "P1", Prescriptions: []Prescription{{
+                PrescriptionId: "RX1", MedicationName: "Amoxicillin", Status: "Active", ContentHash: "abc",
+            }}})
+            if tt.registered != nil {
+                ledger.putPrivate(patientHashKeyCollection, patientHashKeyId, PatientHashKey{Key: tt.registered})
+            }
+
+            var status *PrescriptionStatus
+            err := ledger.submit(pharmacist("ph-mwale"), func(ctx contractapi.TransactionContextInterface) error {
+                ctx.GetStub().(*mocks.ChaincodeStub).GetTransientReturns(map[string][]byte{patientHashKeyTransient: tt.transient}, nil)
+                var err error
+                status, err = contract.GetPrescriptionStatus(ctx, "RX1", tt.patientHash, "abc")
+                return err
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                return
+            }
+            require.NoError(t, err)
+            require.Equal(t, "Active", status.Status)
+            require.True(t, status.ContentMatches)
+        })
+    }
+}
+
+func TestSetPatientHashKey(t *testing.T) {
+    contract := &SmartContract{}
+    setKey := func(ledger *testLedger, caller *testIdentity, key []byte) error {
+        return ledger.submit(caller, func(ctx contractapi.TransactionContextInterface) error {
+            ctx.GetStub().(*mocks.ChaincodeStub).GetTransientReturns(map[string][]byte{patientHashKeyTransient: key}, nil)
+            return contract.SetPatientHashKey(ctx)
+        })
+    }
+
+    ledger := newTestLedger(t)
+    require.ErrorContains(t, setKey(ledger, doctor("dr-banda"), []byte("guess")), "only admins")
+    require.ErrorContains(t, setKey(ledger, admin("admin-banda"), nil), "must be passed as transient data")
+    require.NoError(t, setKey(ledger, admin("admin-banda"), []byte("server-secret")))
+
+    // The key is only kept in the private collection, never in the public world state
+    for key, value := range ledger.state {
+        require.NotContains(t, string(value), base64.StdEncoding.EncodeToString([]byte("server-secret")), "key %q", key)
+    }
+
+    ctx, _ := ledger.context(pharmacist("ph-mwale"))
+    key, err := contract.getPatientHashKey(ctx)
+    require.NoError(t, err)
+    require.Equal(t, []byte("server-secret"), key)
+}
@@ -0,0 +1,588 @@
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const (
+    stockObjectType   = "stock"
+    reorderObjectType = "reorder"
+)
+
+// Controlled drugs register entry types for stock movements other than dispensing
+const (
+    RegisterAdjusted       = "Adjusted"
+    RegisterTransferredOut = "TransferredOut"
+    RegisterTransferredIn  = "TransferredIn"
+)
+
+// StockItem is the quantity of one batch of a medication held at a facility
+type StockItem struct {
+    FacilityId     string `json:"FacilityId"`
+    MedicationCode string `json:"MedicationCode"`
+    MedicationName string `json:"MedicationName"`
+    BatchNumber    string `json:"BatchNumber"`
+    Manufacturer   string `json:"Manufacturer,omitempty"`
+    BatchExpiry    string `json:"BatchExpiry"`
+    Quantity       int    `json:"Quantity"`
+    UpdatedAt      string `json:"UpdatedAt"`
+    TxID           string `json:"TxID"`
+}
+
+// ReorderLevel is the stock level at or below which a facility should reorder a medication
+type ReorderLevel struct {
+    FacilityId     string `json:"FacilityId"`
+    MedicationCode string `json:"MedicationCode"`
+    Level          int    `json:"Level"`
+}
+
+// LowStockItem is a medication at or below its reorder level
+type LowStockItem struct {
+    FacilityId     string `json:"FacilityId"`
+    MedicationCode string `json:"MedicationCode"`
+    MedicationName string `json:"MedicationName"`
+    Quantity       int    `json:"Quantity"` // usable (unexpired) quantity across batches
+    ReorderLevel   int    `json:"ReorderLevel"`
+}
+
+// StockChange is one change to a batch's quantity, with the facility's resulting total for the medication
+type StockChange struct {
+    FacilityId     string `json:"FacilityId"`
+    MedicationCode string `json:"MedicationCode"`
+    MedicationName string `json:"MedicationName"`
+    BatchNumber    string `json:"BatchNumber"`
+    Change         int    `json:"Change"`        // positive for stock in, negative for stock out
+    FacilityStock  int    `json:"FacilityStock"` // quantity on hand across all batches after the change
+    Reason         string `json:"Reason"`
+}
+
+// StockEvent is the payload of the StockChanged and PrescriptionDispensed chaincode events
+type StockEvent struct {
+    PrescriptionId string        `json:"PrescriptionId,omitempty"`
+    Changes        []StockChange `json:"Changes"`
+    Timestamp      string        `json:"Timestamp"`
+    TxID           string        `json:"TxID"`
+}
+
+// StockReceipt is the input to ReceiveStock
+type StockReceipt struct {
+    MedicationCode string `json:"medicationCode"`
+    BatchNumber    string `json:"batchNumber"`
+    Manufacturer   string `json:"manufacturer,omitempty"`
+    BatchExpiry    string `json:"batchExpiry"`
+    Quantity       int    `json:"quantity"`
+    Reference      string `json:"reference,omitempty"` // delivery note or invoice
+}
+
+// ReceiveStock - records stock received into the caller's facility
+func (s *SmartContract) ReceiveStock(ctx contractapi.TransactionContextInterface, receiptJSON string) (*StockItem, error) {
+    if err := s.requireDispenser(ctx); err != nil {
+        return nil, err
+    }
+
+    var receipt StockReceipt
+    if err := json.Unmarshal([]byte(receiptJSON), &receipt); err != nil {
+        return nil, fmt.Errorf("failed to parse stock receipt JSON: %v", err)
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    item, err := s.receiveStock(ctx, facilityId, receipt)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.recordCustody(ctx, &CustodyEvent{
+        BatchNumber:    item.BatchNumber,
+        MedicationCode: item.MedicationCode,
+        EventType:      CustodyReceived,
+        ToFacilityId:   facilityId,
+        Quantity:       receipt.Quantity,
+        Reference:      receipt.Reference,
+    }); err != nil {
+        return nil, err
+    }
+
+    if err := s.emitStockEvent(ctx, "StockChanged", "", []StockChange{stockChange(item, receipt.Quantity, "Received")}, []*StockItem{item}); err != nil {
+        return nil, err
+    }
+    return item, nil
+}
+
+// AdjustStock - corrects a batch's quantity at the caller's facility (breakage, expiry write-off, stock count);
+// a reason is required
+func (s *SmartContract) AdjustStock(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string, delta int, reason string) (*StockItem, error) {
+    if err := s.requireDispenser(ctx); err != nil {
+        return nil, err
+    }
+    if delta == 0 {
+        return nil, fmt.Errorf("adjustment cannot be zero")
+    }
+    if strings.TrimSpace(reason) == "" {
+        return nil, fmt.Errorf("a reason is required to adjust stock")
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    item, err := s.getStockItem(ctx, facilityId, medicationCode, batchNumber)
+    if err != nil {
+        return nil, err
+    }
+    if item == nil {
+        return nil, fmt.Errorf("no stock of %s batch %s at %s", medicationCode, batchNumber, facilityId)
+    }
+    if item.Quantity+delta < 0 {
+        return nil, fmt.Errorf("adjustment of %d would leave negative stock (%d on hand)", delta, item.Quantity)
+    }
+    item.Quantity += delta
+    if err := s.putStockItem(ctx, item); err != nil {
+        return nil, err
+    }
+
+    entry := &RegisterEntry{EntryType: RegisterAdjusted, Reference: reason}
+    custody := &CustodyEvent{BatchNumber: batchNumber, MedicationCode: item.MedicationCode, EventType: CustodyAdjusted, Reference: reason}
+    if delta > 0 {
+        entry.QuantityIn = delta
+        custody.ToFacilityId = facilityId
+        custody.Quantity = delta
+    } else {
+        entry.QuantityOut = -delta
+        custody.FromFacilityId = facilityId
+        custody.Quantity = -delta
+    }
+    if err := s.recordCustody(ctx, custody); err != nil {
+        return nil, err
+    }
+    if err := s.recordControlledStockMovement(ctx, facilityId, item.MedicationCode, entry); err != nil {
+        return nil, err
+    }
+    if err := s.emitStockEvent(ctx, "StockChanged", "", []StockChange{stockChange(item, delta, reason)}, []*StockItem{item}); err != nil {
+        return nil, err
+    }
+
+    return item, nil
+}
+
+// TransferStock - moves a quantity of a batch from the caller's facility to another facility
+func (s *SmartContract) TransferStock(ctx contractapi.TransactionContextInterface, medicationCode string, batchNumber string, quantity int, toFacilityId string) error {
+    if err := s.requireDispenser(ctx); err != nil {
+        return err
+    }
+    if quantity <= 0 {
+        return fmt.Errorf("quantity must be greater than zero")
+    }
+    fromFacilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+    if toFacilityId == "" || toFacilityId == fromFacilityId {
+        return fmt.Errorf("a different destination facility is required")
+    }
+
+    source, err := s.decrementStock(ctx, fromFacilityId, medicationCode, batchNumber, quantity)
+    if err != nil {
+        return err
+    }
+
+    destination, err := s.getStockItem(ctx, toFacilityId, medicationCode, batchNumber)
+    if err != nil {
+        return err
+    }
+    if destination == nil {
+        destination = &StockItem{
+            FacilityId:     toFacilityId,
+            MedicationCode: source.MedicationCode,
+            MedicationName: source.MedicationName,
+            BatchNumber:    source.BatchNumber,
+            Manufacturer:   source.Manufacturer,
+            BatchExpiry:    source.BatchExpiry,
+        }
+    }
+    destination.Quantity += quantity
+    if err := s.putStockItem(ctx, destination); err != nil {
+        return err
+    }
+
+    if err := s.recordCustody(ctx, &CustodyEvent{
+        BatchNumber:    batchNumber,
+        MedicationCode: medicationCode,
+        EventType:      CustodyTransferred,
+        FromFacilityId: fromFacilityId,
+        ToFacilityId:   toFacilityId,
+        Quantity:       quantity,
+    }); err != nil {
+        return err
+    }
+    if err := s.recordControlledStockMovement(ctx, fromFacilityId, medicationCode, &RegisterEntry{EntryType: RegisterTransferredOut, QuantityOut: quantity, Reference: toFacilityId}); err != nil {
+        return err
+    }
+    if err := s.recordControlledStockMovement(ctx, toFacilityId, medicationCode, &RegisterEntry{EntryType: RegisterTransferredIn, QuantityIn: quantity, Reference: fromFacilityId}); err != nil {
+        return err
+    }
+
+    changes := []StockChange{
+        stockChange(source, -quantity, "TransferredOut"),
+        stockChange(destination, quantity, "TransferredIn"),
+    }
+    return s.emitStockEvent(ctx, "StockChanged", "", changes, []*StockItem{source, destination})
+}
+
+// SetReorderLevel - sets the reorder threshold for a medication at the caller's facility
+func (s *SmartContract) SetReorderLevel(ctx contractapi.TransactionContextInterface, medicationCode string, level int) error {
+    if err := s.requireDispenser(ctx); err != nil {
+        return err
+    }
+    if level < 0 {
+        return fmt.Errorf("reorder level cannot be negative")
+    }
+    if _, err := s.GetFormularyEntry(ctx, medicationCode); err != nil {
+        return err
+    }
+    facilityId, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(reorderObjectType, []string{facilityId, medicationCode})
+    if err != nil {
+        return err
+    }
+    levelJSON, err := json.Marshal(ReorderLevel{FacilityId: facilityId, MedicationCode: medicationCode, Level: level})
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, levelJSON)
+}
+
+// GetStock - lists a facility's stock, optionally for one medication. Regulators can view any facility,
+// pharmacy staff only their own.
+func (s *SmartContract) GetStock(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string) ([]*StockItem, error) {
+    if err := s.requireStockViewer(ctx, facilityId); err != nil {
+        return nil, err
+    }
+    return s.listStock(ctx, facilityId, medicationCode)
+}
+
+// GetLowStock - lists medications at a facility whose unexpired stock is at or below the reorder level
+func (s *SmartContract) GetLowStock(ctx contractapi.TransactionContextInterface, facilityId string) ([]*LowStockItem, error) {
+    if err := s.requireStockViewer(ctx, facilityId); err != nil {
+        return nil, err
+    }
+
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(reorderObjectType, []string{facilityId})
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    low := []*LowStockItem{}
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var level ReorderLevel
+        if err := json.Unmarshal(queryResponse.Value, &level); err != nil {
+            return nil, err
+        }
+
+        items, err := s.listStock(ctx, facilityId, level.MedicationCode)
+        if err != nil {
+            return nil, err
+        }
+        usable := 0
+        name := ""
+        for _, item := range items {
+            name = item.MedicationName
+            if expiry, err := parseDate(item.BatchExpiry); err == nil && now.After(expiry.AddDate(0, 0, 1)) {
+                continue
+            }
+            usable += item.Quantity
+        }
+        if usable > level.Level {
+            continue
+        }
+        if name == "" {
+            if entry, err := s.GetFormularyEntry(ctx, level.MedicationCode); err == nil {
+                name = entry.GenericName
+            }
+        }
+        low = append(low, &LowStockItem{
+            FacilityId:     facilityId,
+            MedicationCode: level.MedicationCode,
+            MedicationName: name,
+            Quantity:       usable,
+            ReorderLevel:   level.Level,
+        })
+    }
+
+    sort.Slice(low, func(i, j int) bool {
+        return low[i].MedicationCode < low[j].MedicationCode
+    })
+
+    return low, nil
+}
+
+// receiveStock adds received stock to a facility's batch and records controlled drug receipts
+func (s *SmartContract) receiveStock(ctx contractapi.TransactionContextInterface, facilityId string, receipt StockReceipt) (*StockItem, error) {
+    if receipt.MedicationCode == "" || receipt.BatchNumber == "" || receipt.BatchExpiry == "" {
+        return nil, fmt.Errorf("medicationCode, batchNumber and batchExpiry are required")
+    }
+    if receipt.Quantity <= 0 {
+        return nil, fmt.Errorf("quantity must be greater than zero")
+    }
+    expiry, err := parseDate(receipt.BatchExpiry)
+    if err != nil {
+        return nil, fmt.Errorf("invalid batch expiry date: %v", err)
+    }
+    now, err := txTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if now.After(expiry.AddDate(0, 0, 1)) {
+        return nil, fmt.Errorf("batch %s expired on %s and cannot be received", receipt.BatchNumber, receipt.BatchExpiry)
+    }
+    entry, err := s.GetFormularyEntry(ctx, receipt.MedicationCode)
+    if err != nil {
+        return nil, err
+    }
+
+    item, err := s.getStockItem(ctx, facilityId, receipt.MedicationCode, receipt.BatchNumber)
+    if err != nil {
+        return nil, err
+    }
+    if item == nil {
+        item = &StockItem{
+            FacilityId:     facilityId,
+            MedicationCode: receipt.MedicationCode,
+            MedicationName: entry.GenericName,
+            BatchNumber:    receipt.BatchNumber,
+            Manufacturer:   receipt.Manufacturer,
+            BatchExpiry:    receipt.BatchExpiry,
+        }
+    } else if item.BatchExpiry != receipt.BatchExpiry {
+        return nil, fmt.Errorf("batch %s is already held with expiry %s, not %s", receipt.BatchNumber, item.BatchExpiry, receipt.BatchExpiry)
+    }
+    item.Quantity += receipt.Quantity
+    if err := s.putStockItem(ctx, item); err != nil {
+        return nil, err
+    }
+
+    if err := s.recordControlledStockMovement(ctx, facilityId, receipt.MedicationCode, &RegisterEntry{EntryType: RegisterReceived, QuantityIn: receipt.Quantity, Reference: receipt.Reference}); err != nil {
+        return nil, err
+    }
+
+    return item, nil
+}
+
+// decrementStock takes a quantity out of a facility's batch, refusing to go below zero
+func (s *SmartContract) decrementStock(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string, batchNumber string, quantity int) (*StockItem, error) {
+    item, err := s.getStockItem(ctx, facilityId, medicationCode, batchNumber)
+    if err != nil {
+        return nil, err
+    }
+    if item == nil {
+        return nil, fmt.Errorf("no stock of %s batch %s at %s", medicationCode, batchNumber, facilityId)
+    }
+    if item.Quantity < quantity {
+        return nil, fmt.Errorf("insufficient stock of %s batch %s at %s: %d available, %d requested", item.MedicationName, batchNumber, facilityId, item.Quantity, quantity)
+    }
+
+    item.Quantity -= quantity
+    if err := s.putStockItem(ctx, item); err != nil {
+        return nil, err
+    }
+    return item, nil
+}
+
+// emitStockEvent sets a stock event for the transaction. The world state read by listStock does not include this
+// transaction's writes, so the batches it updated are passed in to compute the facility totals.
+func (s *SmartContract) emitStockEvent(ctx contractapi.TransactionContextInterface, eventName string, prescriptionId string, changes []StockChange, updated []*StockItem) error {
+    for i := range changes {
+        items, err := s.listStock(ctx, changes[i].FacilityId, changes[i].MedicationCode)
+        if err != nil {
+            return err
+        }
+
+        batches := map[string]int{}
+        for _, item := range items {
+            batches[item.BatchNumber] = item.Quantity
+        }
+        for _, item := range updated {
+            if item.FacilityId == changes[i].FacilityId && item.MedicationCode == changes[i].MedicationCode {
+                batches[item.BatchNumber] = item.Quantity
+            }
+        }
+        total := 0
+        for _, quantity := range batches {
+            total += quantity
+        }
+        changes[i].FacilityStock = total
+    }
+
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    eventJSON, err := json.Marshal(StockEvent{
+        PrescriptionId: prescriptionId,
+        Changes:        changes,
+        Timestamp:      now.Format(time.RFC3339),
+        TxID:           ctx.GetStub().GetTxID(),
+    })
+    if err != nil {
+        return err
+    }
+    if err := ctx.GetStub().SetEvent(eventName, eventJSON); err != nil {
+        return fmt.Errorf("failed to set event: %v", err)
+    }
+    return nil
+}
+
+// stockChange describes a change to a stock item for a stock event
+func stockChange(item *StockItem, change int, reason string) StockChange {
+    return StockChange{
+        FacilityId:     item.FacilityId,
+        MedicationCode: item.MedicationCode,
+        MedicationName: item.MedicationName,
+        BatchNumber:    item.BatchNumber,
+        Change:         change,
+        Reason:         reason,
+    }
+}
+
+// recordControlledStockMovement writes a register entry when the medication is a controlled drug
+func (s *SmartContract) recordControlledStockMovement(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string, entry *RegisterEntry) error {
+    formularyEntry, err := s.GetFormularyEntry(ctx, medicationCode)
+    if err != nil {
+        return err
+    }
+    drug, err := s.findControlledDrug(ctx, formularyEntry.Code, formularyEntry.GenericName)
+    if err != nil {
+        return err
+    }
+    if drug == nil {
+        return nil
+    }
+
+    entry.FacilityId = facilityId
+    entry.MedicationCode = formularyEntry.Code
+    entry.MedicationName = formularyEntry.GenericName
+    entry.Schedule = drug.Schedule
+    return s.writeRegisterEntry(ctx, entry)
+}
+
+func (s *SmartContract) getStockItem(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string, batchNumber string) (*StockItem, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(stockObjectType, []string{facilityId, medicationCode, batchNumber})
+    if err != nil {
+        return nil, err
+    }
+    itemJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if itemJSON == nil {
+        return nil, nil
+    }
+
+    var item StockItem
+    if err := json.Unmarshal(itemJSON, &item); err != nil {
+        return nil, err
+    }
+    return &item, nil
+}
+
+func (s *SmartContract) putStockItem(ctx contractapi.TransactionContextInterface, item *StockItem) error {
+    now, err := txTime(ctx)
+    if err != nil {
+        return err
+    }
+    item.UpdatedAt = now.Format(time.RFC3339)
+    item.TxID = ctx.GetStub().GetTxID()
+
+    key, err := ctx.GetStub().CreateCompositeKey(stockObjectType, []string{item.FacilityId, item.MedicationCode, item.BatchNumber})
+    if err != nil {
+        return err
+    }
+    itemJSON, err := json.Marshal(item)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, itemJSON)
+}
+
+func (s *SmartContract) listStock(ctx contractapi.TransactionContextInterface, facilityId string, medicationCode string) ([]*StockItem, error) {
+    attributes := []string{facilityId}
+    if medicationCode != "" {
+        attributes = append(attributes, medicationCode)
+    }
+    iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(stockObjectType, attributes)
+    if err != nil {
+        return nil, err
+    }
+    defer iterator.Close()
+
+    items := []*StockItem{}
+    for iterator.HasNext() {
+        queryResponse, err := iterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var item StockItem
+        if err := json.Unmarshal(queryResponse.Value, &item); err != nil {
+            return nil, err
+        }
+        items = append(items, &item)
+    }
+
+    return items, nil
+}
+
+// requireDispenser checks the caller holds a pharmacy role
+func (s *SmartContract) requireDispenser(ctx contractapi.TransactionContextInterface) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if !isDispenserRole(role) {
+        return fmt.Errorf("only pharmacy staff can manage stock")
+    }
+    return nil
+}
+
+// requireStockViewer lets regulators view any facility's stock and pharmacy staff their own
+func (s *SmartContract) requireStockViewer(ctx contractapi.TransactionContextInterface, facilityId string) error {
+    role, err := s.GetUserRole(ctx)
+    if err != nil {
+        return err
+    }
+    if role == RoleRegulator {
+        return nil
+    }
+    if !isDispenserRole(role) {
+        return fmt.Errorf("only regulators and pharmacy staff can view stock")
+    }
+    callerFacility, err := getCallerFacility(ctx)
+    if err != nil {
+        return err
+    }
+    if callerFacility != facilityId {
+        return fmt.Errorf("pharmacy staff can only view their own facility's stock")
+    }
+    return nil
+}
@@ -0,0 +1,75 @@
+package chaincode
+
+import (
+    "strconv"
+    "testing"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/stretchr/testify/require"
+)
+
+func TestDispenseDecrementsStock(t *testing.T) {
+    tests := []struct {
+        name       string
+        caller     *testIdentity
+        quantity   int
+        batch      string
+        expiry     string
+        claimed    string // batch expiry the pharmacist sends, when it differs from the stock record
+        onHand     int
+        wantErr    string
+        wantOnHand int
+    }{
+        {name: "prescribed quantity", caller: pharmacist("ph-mwale"), batch: "B1", onHand: 100, wantOnHand: 90},
+        {name: "partial supply", caller: pharmacist("ph-mwale"), quantity: 4, batch: "B1", onHand: 100, wantOnHand: 96},
+        {name: "pharmacy technician", caller: newIdentity("tech-phiri", "Org2MSP", map[string]string{"role": RolePharmacyTechnician, "facilityId": "KCH-PHARM"}), batch: "B1", onHand: 10, wantOnHand: 0},
+        {name: "more than prescribed", caller: pharmacist("ph-mwale"), quantity: 11, batch: "B1", onHand: 100, wantErr: "invalid dispense quantity", wantOnHand: 100},
+        {name: "insufficient stock", caller: pharmacist("ph-mwale"), batch: "B1", onHand: 5, wantErr: "insufficient stock", wantOnHand: 5},
+        {name: "batch not held", caller: pharmacist("ph-mwale"), batch: "B2", expiry: "2999-01-01", onHand: 100, wantErr: "no stock of AMOX batch B2", wantOnHand: 100},
+        {name: "expired batch", caller: pharmacist("ph-mwale"), batch: "B1", expiry: "2001-01-01", onHand: 100, wantErr: "expired", wantOnHand: 100},
+        {name: "expired batch sent with a later expiry", caller: pharmacist("ph-mwale"), batch: "B1", expiry: "2001-01-01", claimed: "2999-01-01", onHand: 100, wantErr: "expires on 2001-01-01 according to the stock record", wantOnHand: 100},
+        {name: "prescriber cannot dispense", caller: doctor("dr-banda"), batch: "B1", onHand: 100, wantErr: "only pharmacy staff", wantOnHand: 100},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ledger := newTestLedger(t)
+            ledger.seedFormulary(FormularyEntry{Code: "AMOX", AtcCode: "J01CA04", GenericName: "Amoxicillin", Strengths: []string{"500mg"}})
+            expiry := tt.expiry
+            if expiry == "" {
+                expiry = "2999-01-01"
+            }
+            ledger.putStock(StockItem{FacilityId: "KCH-PHARM", MedicationCode: "AMOX", MedicationName: "Amoxicillin", BatchNumber: "B1", BatchExpiry: expiry, Quantity: tt.onHand})
+            ledger.put("P1", Asset{PatientId: "P1", DoctorId: "DOC1", Prescriptions: []Prescription{
+                {PrescriptionId: "RX1", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Strength: "500mg", Status: "Active", Quantity: 10},
+            }})
+            ledger.grantConsent("P1", GranteeFacility, "KCH", ScopeDispense)
+            ledger.grantConsent("P1", GranteeFacility, "KCH-PHARM", ScopeDispense)
+
+            dispensation := `{"patientId":"P1","prescriptionId":"RX1","pharmacistId":"PH1","batchNumber":"` + tt.batch + `"`
+            if tt.claimed != "" {
+                dispensation += `,"batchExpiry":"` + tt.claimed + `"`
+            } else if tt.expiry != "" {
+                dispensation += `,"batchExpiry":"` + tt.expiry + `"`
+            }
+            if tt.quantity != 0 {
+                dispensation += `,"quantity":` + strconv.Itoa(tt.quantity)
+            }
+            dispensation += `}`
+            err := ledger.submit(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+                return (&SmartContract{}).DispensePrescription(ctx, dispensation)
+            })
+            if tt.wantErr != "" {
+                require.ErrorContains(t, err, tt.wantErr)
+                require.Equal(t, "Active", ledger.prescription("P1", "RX1").Status)
+            } else {
+                require.NoError(t, err)
+                dispensed := ledger.prescription("P1", "RX1")
+                require.Equal(t, "Dispensed", dispensed.Status)
+                require.Equal(t, "B1", dispensed.DispensedBatch)
+                require.Equal(t, expiry, dispensed.BatchExpiry)
+            }
+            require.Equal(t, tt.wantOnHand, ledger.stock("KCH-PHARM", "AMOX", "B1").Quantity)
+        })
+    }
+}
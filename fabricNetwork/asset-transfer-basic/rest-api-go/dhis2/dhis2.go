@@ -0,0 +1,269 @@
+// Package dhis2 builds the Ministry's pharmaceutical indicator reports for DHIS2: reporting periods, the mapping of
+// facilities and indicators to DHIS2 identifiers, and the dataValueSets JSON and ADX XML import payloads.
+package dhis2
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Indicators reported per facility, named as in the chaincode's FacilityIndicators.
+const (
+	IndicatorIssued          = "PrescriptionsIssued"
+	IndicatorDispensed       = "PrescriptionsDispensed"
+	IndicatorRevoked         = "PrescriptionsRevoked"
+	IndicatorAntibiotics     = "AntibioticPrescriptions"
+	IndicatorAntibioticShare = "AntibioticShare"
+	IndicatorStockOuts       = "StockOuts"
+)
+
+// Indicators lists every indicator in report order.
+var Indicators = []string{
+	IndicatorIssued,
+	IndicatorDispensed,
+	IndicatorRevoked,
+	IndicatorAntibiotics,
+	IndicatorAntibioticShare,
+	IndicatorStockOuts,
+}
+
+// adxNamespace is the XML namespace of IHE ADX messages.
+const adxNamespace = "urn:ihe:qrph:adx:2015"
+
+var (
+	// periodPattern matches yearly (YYYY), monthly (YYYYMM) and quarterly (YYYYQn) period identifiers.
+	periodPattern = regexp.MustCompile(`^(\d{4})(?:(\d{2})|Q([1-4]))?$`)
+	// uidPattern matches DHIS2 identifiers: eleven alphanumeric characters starting with a letter.
+	uidPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{10}$`)
+)
+
+// FacilityIndicators mirrors the chaincode's FacilityIndicators.
+type FacilityIndicators struct {
+	FacilityId              string  `json:"FacilityId"`
+	PrescriptionsIssued     int     `json:"PrescriptionsIssued"`
+	PrescriptionsDispensed  int     `json:"PrescriptionsDispensed"`
+	PrescriptionsRevoked    int     `json:"PrescriptionsRevoked"`
+	AntibioticPrescriptions int     `json:"AntibioticPrescriptions"`
+	AntibioticShare         float64 `json:"AntibioticShare"`
+	StockOuts               int     `json:"StockOuts"`
+}
+
+// Value returns an indicator's value formatted for DHIS2.
+func (facility FacilityIndicators) Value(indicator string) string {
+	switch indicator {
+	case IndicatorIssued:
+		return strconv.Itoa(facility.PrescriptionsIssued)
+	case IndicatorDispensed:
+		return strconv.Itoa(facility.PrescriptionsDispensed)
+	case IndicatorRevoked:
+		return strconv.Itoa(facility.PrescriptionsRevoked)
+	case IndicatorAntibiotics:
+		return strconv.Itoa(facility.AntibioticPrescriptions)
+	case IndicatorAntibioticShare:
+		return strconv.FormatFloat(facility.AntibioticShare, 'f', -1, 64)
+	case IndicatorStockOuts:
+		return strconv.Itoa(facility.StockOuts)
+	}
+	return ""
+}
+
+// Period is a DHIS2 reporting period.
+type Period struct {
+	ID       string    // DHIS2 period identifier, such as 202405, 2024Q2 or 2024
+	Start    time.Time // first day of the period
+	End      time.Time // day after the last day of the period
+	duration string    // ISO 8601 duration of the period, used by ADX
+}
+
+// ParsePeriod parses a monthly (YYYYMM), quarterly (YYYYQn) or yearly (YYYY) DHIS2 period.
+func ParsePeriod(id string) (Period, error) {
+	match := periodPattern.FindStringSubmatch(id)
+	if match == nil {
+		return Period{}, fmt.Errorf("invalid period %q, expected YYYYMM, YYYYQn or YYYY", id)
+	}
+	year, _ := strconv.Atoi(match[1])
+	month, months, duration := 1, 12, "P1Y"
+	switch {
+	case match[2] != "":
+		month, _ = strconv.Atoi(match[2])
+		if month < 1 || month > 12 {
+			return Period{}, fmt.Errorf("invalid month in period %q", id)
+		}
+		months, duration = 1, "P1M"
+	case match[3] != "":
+		quarter, _ := strconv.Atoi(match[3])
+		month, months, duration = (quarter-1)*3+1, 3, "P3M"
+	}
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return Period{ID: id, Start: start, End: start.AddDate(0, months, 0), duration: duration}, nil
+}
+
+// StartDate returns the first day of the period as YYYY-MM-DD.
+func (period Period) StartDate() string {
+	return period.Start.Format("2006-01-02")
+}
+
+// EndDate returns the last day of the period as YYYY-MM-DD.
+func (period Period) EndDate() string {
+	return period.End.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// adx returns the period in ADX form, the start date and ISO 8601 duration, such as 2024-05-01/P1M.
+func (period Period) adx() string {
+	return period.StartDate() + "/" + period.duration
+}
+
+// Mapping maps facilities and indicators to DHIS2 identifiers. It is kept in a local file maintained with the
+// Ministry's DHIS2 administrators.
+type Mapping struct {
+	DataSet              string            `json:"dataSet"`
+	OrgUnits             map[string]string `json:"orgUnits"`     // facility ID to organisation unit UID
+	DataElements         map[string]string `json:"dataElements"` // indicator to data element UID
+	CategoryOptionCombo  string            `json:"categoryOptionCombo,omitempty"`
+	AttributeOptionCombo string            `json:"attributeOptionCombo,omitempty"`
+}
+
+// LoadMapping reads the mapping file.
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DHIS2 mapping file: %w", err)
+	}
+	var mapping Mapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse DHIS2 mapping file %s: %w", path, err)
+	}
+	return &mapping, nil
+}
+
+// Issue is a problem found when validating a report against the mapping.
+type Issue struct {
+	FacilityID string `json:"facilityId,omitempty"`
+	Indicator  string `json:"indicator,omitempty"`
+	Message    string `json:"message"`
+}
+
+// Validate checks the mapping and that every facility and indicator in the report maps to a DHIS2 identifier.
+func (mapping *Mapping) Validate(facilities []FacilityIndicators) []Issue {
+	issues := []Issue{}
+	checkUID := func(uid string, name string, issue Issue) {
+		if uid != "" && !uidPattern.MatchString(uid) {
+			issue.Message = fmt.Sprintf("%s %q is not a valid DHIS2 UID", name, uid)
+			issues = append(issues, issue)
+		}
+	}
+
+	if mapping.DataSet == "" {
+		issues = append(issues, Issue{Message: "no data set is configured"})
+	}
+	checkUID(mapping.DataSet, "data set", Issue{})
+	checkUID(mapping.CategoryOptionCombo, "category option combo", Issue{})
+	checkUID(mapping.AttributeOptionCombo, "attribute option combo", Issue{})
+	for _, indicator := range Indicators {
+		uid, ok := mapping.DataElements[indicator]
+		if !ok {
+			issues = append(issues, Issue{Indicator: indicator, Message: "indicator has no data element"})
+			continue
+		}
+		checkUID(uid, "data element", Issue{Indicator: indicator})
+	}
+	for _, facility := range facilities {
+		uid, ok := mapping.OrgUnits[facility.FacilityId]
+		if !ok {
+			issues = append(issues, Issue{FacilityID: facility.FacilityId, Message: "facility has no organisation unit"})
+			continue
+		}
+		checkUID(uid, "organisation unit", Issue{FacilityID: facility.FacilityId})
+	}
+	return issues
+}
+
+// DataValue is one value of a DHIS2 data value set.
+type DataValue struct {
+	DataElement          string `json:"dataElement"`
+	Period               string `json:"period"`
+	OrgUnit              string `json:"orgUnit"`
+	CategoryOptionCombo  string `json:"categoryOptionCombo,omitempty"`
+	AttributeOptionCombo string `json:"attributeOptionCombo,omitempty"`
+	Value                string `json:"value"`
+}
+
+// DataValueSet is the payload of the DHIS2 dataValueSets import.
+type DataValueSet struct {
+	DataSet    string      `json:"dataSet,omitempty"`
+	DataValues []DataValue `json:"dataValues"`
+}
+
+// DataValueSet builds the dataValueSets payload for a period. Facilities and indicators without a mapping are left
+// out; Validate reports them.
+func (mapping *Mapping) DataValueSet(period Period, facilities []FacilityIndicators) *DataValueSet {
+	set := &DataValueSet{DataSet: mapping.DataSet, DataValues: []DataValue{}}
+	for _, facility := range facilities {
+		orgUnit, ok := mapping.OrgUnits[facility.FacilityId]
+		if !ok {
+			continue
+		}
+		for _, indicator := range Indicators {
+			dataElement, ok := mapping.DataElements[indicator]
+			if !ok {
+				continue
+			}
+			set.DataValues = append(set.DataValues, DataValue{
+				DataElement:          dataElement,
+				Period:               period.ID,
+				OrgUnit:              orgUnit,
+				CategoryOptionCombo:  mapping.CategoryOptionCombo,
+				AttributeOptionCombo: mapping.AttributeOptionCombo,
+				Value:                facility.Value(indicator),
+			})
+		}
+	}
+	return set
+}
+
+// ADX is an IHE ADX message, with one group per facility.
+type ADX struct {
+	XMLName  xml.Name   `xml:"adx"`
+	Xmlns    string     `xml:"xmlns,attr"`
+	Exported string     `xml:"exported,attr"`
+	Groups   []ADXGroup `xml:"group"`
+}
+
+// ADXGroup holds one facility's values for the period.
+type ADXGroup struct {
+	OrgUnit    string         `xml:"orgUnit,attr"`
+	Period     string         `xml:"period,attr"`
+	DataSet    string         `xml:"dataSet,attr"`
+	DataValues []ADXDataValue `xml:"dataValue"`
+}
+
+// ADXDataValue is one value in an ADX group.
+type ADXDataValue struct {
+	DataElement string `xml:"dataElement,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// ADX builds the ADX payload for a period, identifying everything by UID. Like DataValueSet, it leaves out
+// facilities and indicators without a mapping.
+func (mapping *Mapping) ADX(period Period, facilities []FacilityIndicators, exported time.Time) *ADX {
+	adx := &ADX{Xmlns: adxNamespace, Exported: exported.UTC().Format(time.RFC3339)}
+	for _, facility := range facilities {
+		orgUnit, ok := mapping.OrgUnits[facility.FacilityId]
+		if !ok {
+			continue
+		}
+		group := ADXGroup{OrgUnit: orgUnit, Period: period.adx(), DataSet: mapping.DataSet}
+		for _, indicator := range Indicators {
+			if dataElement, ok := mapping.DataElements[indicator]; ok {
+				group.DataValues = append(group.DataValues, ADXDataValue{DataElement: dataElement, Value: facility.Value(indicator)})
+			}
+		}
+		adx.Groups = append(adx.Groups, group)
+	}
+	return adx
+}
@@ -0,0 +1,212 @@
+package dhis2
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testMapping = &Mapping{
+	DataSet:  "UmRxPharm01",
+	OrgUnits: map[string]string{"KCH": "DiszpKrYNg8"},
+	DataElements: map[string]string{
+		IndicatorIssued:          "RxIssued001",
+		IndicatorDispensed:       "RxDispens01",
+		IndicatorRevoked:         "RxRevoked01",
+		IndicatorAntibiotics:     "RxAntibio01",
+		IndicatorAntibioticShare: "RxAbShare01",
+		IndicatorStockOuts:       "RxStockOut1",
+	},
+}
+
+var testFacilities = []FacilityIndicators{
+	{FacilityId: "KCH", PrescriptionsIssued: 120, PrescriptionsDispensed: 110, PrescriptionsRevoked: 3, AntibioticPrescriptions: 30, AntibioticShare: 0.25, StockOuts: 2},
+	{FacilityId: "UNMAPPED", PrescriptionsIssued: 5},
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		id        string
+		wantStart string
+		wantEnd   string
+		wantADX   string
+		wantErr   bool
+	}{
+		{id: "202405", wantStart: "2024-05-01", wantEnd: "2024-05-31", wantADX: "2024-05-01/P1M"},
+		{id: "202402", wantStart: "2024-02-01", wantEnd: "2024-02-29", wantADX: "2024-02-01/P1M"},
+		{id: "2024Q2", wantStart: "2024-04-01", wantEnd: "2024-06-30", wantADX: "2024-04-01/P3M"},
+		{id: "2024Q4", wantStart: "2024-10-01", wantEnd: "2024-12-31", wantADX: "2024-10-01/P3M"},
+		{id: "2024", wantStart: "2024-01-01", wantEnd: "2024-12-31", wantADX: "2024-01-01/P1Y"},
+		{id: "202413", wantErr: true},
+		{id: "2024Q5", wantErr: true},
+		{id: "2024-05", wantErr: true},
+		{id: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			period, err := ParsePeriod(tt.id)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePeriod(%q) succeeded, want an error", tt.id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePeriod(%q) error = %v", tt.id, err)
+			}
+			if got := [3]string{period.StartDate(), period.EndDate(), period.adx()}; got != [3]string{tt.wantStart, tt.wantEnd, tt.wantADX} {
+				t.Errorf("ParsePeriod(%q) = %q, want %q", tt.id, got, [3]string{tt.wantStart, tt.wantEnd, tt.wantADX})
+			}
+		})
+	}
+}
+
+func TestDataValueSetJSON(t *testing.T) {
+	period, err := ParsePeriod("202405")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mapping *Mapping
+		want    string
+	}{
+		{
+			name:    "default combos",
+			mapping: testMapping,
+			want: `{"dataSet":"UmRxPharm01","dataValues":[` +
+				`{"dataElement":"RxIssued001","period":"202405","orgUnit":"DiszpKrYNg8","value":"120"},` +
+				`{"dataElement":"RxDispens01","period":"202405","orgUnit":"DiszpKrYNg8","value":"110"},` +
+				`{"dataElement":"RxRevoked01","period":"202405","orgUnit":"DiszpKrYNg8","value":"3"},` +
+				`{"dataElement":"RxAntibio01","period":"202405","orgUnit":"DiszpKrYNg8","value":"30"},` +
+				`{"dataElement":"RxAbShare01","period":"202405","orgUnit":"DiszpKrYNg8","value":"0.25"},` +
+				`{"dataElement":"RxStockOut1","period":"202405","orgUnit":"DiszpKrYNg8","value":"2"}]}`,
+		},
+		{
+			name: "option combos and a partial mapping",
+			mapping: &Mapping{
+				OrgUnits:             testMapping.OrgUnits,
+				DataElements:         map[string]string{IndicatorIssued: "RxIssued001"},
+				CategoryOptionCombo:  "HllvX50cXC0",
+				AttributeOptionCombo: "Gz0TWvZV2Yk",
+			},
+			want: `{"dataValues":[{"dataElement":"RxIssued001","period":"202405","orgUnit":"DiszpKrYNg8",` +
+				`"categoryOptionCombo":"HllvX50cXC0","attributeOptionCombo":"Gz0TWvZV2Yk","value":"120"}]}`,
+		},
+		{
+			name:    "no mapped facilities",
+			mapping: &Mapping{DataSet: "UmRxPharm01", DataElements: testMapping.DataElements},
+			want:    `{"dataSet":"UmRxPharm01","dataValues":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := json.Marshal(tt.mapping.DataValueSet(period, testFacilities))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != tt.want {
+				t.Errorf("DataValueSet() =\n%s\nwant\n%s", payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestADXXML(t *testing.T) {
+	exported := time.Date(2024, 6, 1, 10, 30, 0, 0, time.FixedZone("CAT", 2*60*60))
+
+	tests := []struct {
+		name    string
+		period  string
+		mapping *Mapping
+		want    string
+	}{
+		{
+			name:    "month",
+			period:  "202405",
+			mapping: &Mapping{DataSet: "UmRxPharm01", OrgUnits: testMapping.OrgUnits, DataElements: map[string]string{IndicatorIssued: "RxIssued001", IndicatorAntibioticShare: "RxAbShare01"}},
+			want: `<adx xmlns="urn:ihe:qrph:adx:2015" exported="2024-06-01T08:30:00Z">` +
+				`<group orgUnit="DiszpKrYNg8" period="2024-05-01/P1M" dataSet="UmRxPharm01">` +
+				`<dataValue dataElement="RxIssued001" value="120"></dataValue>` +
+				`<dataValue dataElement="RxAbShare01" value="0.25"></dataValue>` +
+				`</group></adx>`,
+		},
+		{
+			name:    "quarter",
+			period:  "2024Q2",
+			mapping: &Mapping{DataSet: "UmRxPharm01", OrgUnits: testMapping.OrgUnits, DataElements: map[string]string{IndicatorStockOuts: "RxStockOut1"}},
+			want: `<adx xmlns="urn:ihe:qrph:adx:2015" exported="2024-06-01T08:30:00Z">` +
+				`<group orgUnit="DiszpKrYNg8" period="2024-04-01/P3M" dataSet="UmRxPharm01">` +
+				`<dataValue dataElement="RxStockOut1" value="2"></dataValue>` +
+				`</group></adx>`,
+		},
+		{
+			name:    "no mapped facilities",
+			period:  "2024",
+			mapping: &Mapping{DataSet: "UmRxPharm01", DataElements: testMapping.DataElements},
+			want:    `<adx xmlns="urn:ihe:qrph:adx:2015" exported="2024-06-01T08:30:00Z"></adx>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, err := ParsePeriod(tt.period)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := xml.Marshal(tt.mapping.ADX(period, testFacilities, exported))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != tt.want {
+				t.Errorf("ADX() =\n%s\nwant\n%s", payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping *Mapping
+		want    []Issue
+	}{
+		{
+			name:    "complete mapping",
+			mapping: testMapping,
+			want:    []Issue{{FacilityID: "UNMAPPED", Message: "facility has no organisation unit"}},
+		},
+		{
+			name: "invalid identifiers",
+			mapping: &Mapping{
+				OrgUnits:            map[string]string{"KCH": "kch", "UNMAPPED": "DiszpKrYNg8"},
+				DataElements:        map[string]string{IndicatorIssued: "1xIssued001"},
+				CategoryOptionCombo: "default",
+			},
+			want: []Issue{
+				{Message: "no data set is configured"},
+				{Message: `category option combo "default" is not a valid DHIS2 UID`},
+				{Indicator: IndicatorIssued, Message: `data element "1xIssued001" is not a valid DHIS2 UID`},
+				{Indicator: IndicatorDispensed, Message: "indicator has no data element"},
+				{Indicator: IndicatorRevoked, Message: "indicator has no data element"},
+				{Indicator: IndicatorAntibiotics, Message: "indicator has no data element"},
+				{Indicator: IndicatorAntibioticShare, Message: "indicator has no data element"},
+				{Indicator: IndicatorStockOuts, Message: "indicator has no data element"},
+				{FacilityID: "KCH", Message: `organisation unit "kch" is not a valid DHIS2 UID`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mapping.Validate(testFacilities); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
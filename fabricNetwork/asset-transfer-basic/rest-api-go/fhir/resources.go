@@ -0,0 +1,341 @@
+// Package fhir defines the subset of FHIR R4 resources the REST server exchanges with partner systems, and
+// helpers for Bundle responses, OperationOutcome errors and search parameters.
+package fhir
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Identifier and code systems used for UmodziRx data.
+const (
+	SystemPatient      = "urn:umodzirx:patient"
+	SystemPrescription = "urn:umodzirx:prescription"
+	SystemFormulary    = "urn:umodzirx:formulary"
+	SystemPractitioner = "urn:umodzirx:practitioner"
+	SystemFacility     = "urn:umodzirx:facility"
+	SystemICD10        = "http://hl7.org/fhir/sid/icd-10"
+)
+
+// Extensions carrying the prescriber's signature on a MedicationRequest, made on the prescriber's own device.
+const (
+	ExtensionSignature         = "urn:umodzirx:prescriber-signature" // base64 ECDSA signature over the canonical content
+	ExtensionSignerCertificate = "urn:umodzirx:signer-certificate"   // PEM enrolment certificate of the signing key
+)
+
+// Extension is an additional element not in the base resource definition.
+type Extension struct {
+	URL         string `json:"url"`
+	ValueString string `json:"valueString,omitempty"`
+}
+
+// Reference is a reference from one resource to another.
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+// Identifier is a business identifier of a resource.
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// Coding is a code from a code system.
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+// CodeableConcept is a concept given as codes and/or text.
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// Quantity is a measured amount.
+type Quantity struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// HumanName is a person's name.
+type HumanName struct {
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+// Period is a time range; either end may be open.
+type Period struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// Annotation is a text note.
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+// Meta holds resource metadata.
+type Meta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+// Patient is a FHIR R4 Patient resource.
+type Patient struct {
+	ResourceType        string       `json:"resourceType"`
+	ID                  string       `json:"id,omitempty"`
+	Meta                *Meta        `json:"meta,omitempty"`
+	Identifier          []Identifier `json:"identifier,omitempty"`
+	Name                []HumanName  `json:"name,omitempty"`
+	BirthDate           string       `json:"birthDate,omitempty"`
+	GeneralPractitioner []Reference  `json:"generalPractitioner,omitempty"`
+}
+
+// MedicationRequest is a FHIR R4 MedicationRequest resource.
+type MedicationRequest struct {
+	ResourceType              string            `json:"resourceType"`
+	ID                        string            `json:"id,omitempty"`
+	Meta                      *Meta             `json:"meta,omitempty"`
+	Extension                 []Extension       `json:"extension,omitempty"`
+	Identifier                []Identifier      `json:"identifier,omitempty"`
+	Status                    string            `json:"status"`
+	StatusReason              *CodeableConcept  `json:"statusReason,omitempty"`
+	Intent                    string            `json:"intent"`
+	MedicationCodeableConcept *CodeableConcept  `json:"medicationCodeableConcept,omitempty"`
+	Subject                   Reference         `json:"subject"`
+	Encounter                 *Reference        `json:"encounter,omitempty"`
+	AuthoredOn                string            `json:"authoredOn,omitempty"`
+	Requester                 *Reference        `json:"requester,omitempty"`
+	ReasonCode                []CodeableConcept `json:"reasonCode,omitempty"`
+	DosageInstruction         []Dosage          `json:"dosageInstruction,omitempty"`
+	DispenseRequest           *DispenseRequest  `json:"dispenseRequest,omitempty"`
+	Note                      []Annotation      `json:"note,omitempty"`
+}
+
+// Dosage is how a medication is to be taken.
+type Dosage struct {
+	Text               string        `json:"text,omitempty"`
+	PatientInstruction string        `json:"patientInstruction,omitempty"`
+	Timing             *Timing       `json:"timing,omitempty"`
+	DoseAndRate        []DoseAndRate `json:"doseAndRate,omitempty"`
+}
+
+// Timing is when a dose is to be taken.
+type Timing struct {
+	Repeat *TimingRepeat `json:"repeat,omitempty"`
+}
+
+// TimingRepeat is a repeating schedule: frequency times per period of periodUnit.
+type TimingRepeat struct {
+	Frequency  int     `json:"frequency,omitempty"`
+	Period     float64 `json:"period,omitempty"`
+	PeriodUnit string  `json:"periodUnit,omitempty"`
+}
+
+// DoseAndRate is the amount given per dose.
+type DoseAndRate struct {
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+}
+
+// DispenseRequest is the supply authorised by a MedicationRequest.
+type DispenseRequest struct {
+	ValidityPeriod         *Period   `json:"validityPeriod,omitempty"`
+	NumberOfRepeatsAllowed int       `json:"numberOfRepeatsAllowed,omitempty"`
+	Quantity               *Quantity `json:"quantity,omitempty"`
+}
+
+// MedicationDispense is a FHIR R4 MedicationDispense resource.
+type MedicationDispense struct {
+	ResourceType              string           `json:"resourceType"`
+	ID                        string           `json:"id,omitempty"`
+	Meta                      *Meta            `json:"meta,omitempty"`
+	Contained                 []Medication     `json:"contained,omitempty"`
+	Status                    string           `json:"status"`
+	MedicationCodeableConcept *CodeableConcept `json:"medicationCodeableConcept,omitempty"`
+	MedicationReference       *Reference       `json:"medicationReference,omitempty"`
+	Subject                   Reference        `json:"subject"`
+	Performer                 []Performer      `json:"performer,omitempty"`
+	Location                  *Reference       `json:"location,omitempty"`
+	AuthorizingPrescription   []Reference      `json:"authorizingPrescription,omitempty"`
+	Quantity                  *Quantity        `json:"quantity,omitempty"`
+	WhenHandedOver            string           `json:"whenHandedOver,omitempty"`
+	Substitution              *Substitution    `json:"substitution,omitempty"`
+	Note                      []Annotation     `json:"note,omitempty"`
+}
+
+// Performer is who performed a dispense.
+type Performer struct {
+	Actor Reference `json:"actor"`
+}
+
+// Substitution records whether a different product was dispensed than was prescribed.
+type Substitution struct {
+	WasSubstituted bool              `json:"wasSubstituted"`
+	Reason         []CodeableConcept `json:"reason,omitempty"`
+}
+
+// Medication is a FHIR R4 Medication resource, used contained in a MedicationDispense to carry the batch.
+type Medication struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id,omitempty"`
+	Code         *CodeableConcept `json:"code,omitempty"`
+	Manufacturer *Reference       `json:"manufacturer,omitempty"`
+	Batch        *Batch           `json:"batch,omitempty"`
+}
+
+// Batch is the packaged batch of a Medication.
+type Batch struct {
+	LotNumber      string `json:"lotNumber,omitempty"`
+	ExpirationDate string `json:"expirationDate,omitempty"`
+}
+
+// Bundle is a FHIR R4 Bundle of resources.
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Total        int           `json:"total"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+// BundleLink is a link related to a Bundle.
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+// BundleEntry is one resource in a Bundle.
+type BundleEntry struct {
+	FullURL  string       `json:"fullUrl,omitempty"`
+	Resource interface{}  `json:"resource"`
+	Search   *EntrySearch `json:"search,omitempty"`
+}
+
+// EntrySearch says why an entry is in a search result.
+type EntrySearch struct {
+	Mode string `json:"mode"`
+}
+
+// OperationOutcome is a FHIR R4 OperationOutcome, returned for errors.
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+// Issue is one problem reported in an OperationOutcome.
+type Issue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// NewSearchSet returns a searchset Bundle of the given entries.
+func NewSearchSet(selfURL string, entries []BundleEntry) *Bundle {
+	for i := range entries {
+		entries[i].Search = &EntrySearch{Mode: "match"}
+	}
+	return &Bundle{
+		ResourceType: "Bundle",
+		Type:         "searchset",
+		Total:        len(entries),
+		Link:         []BundleLink{{Relation: "self", URL: selfURL}},
+		Entry:        entries,
+	}
+}
+
+// NewOperationOutcome returns an OperationOutcome with a single error issue.
+func NewOperationOutcome(code string, diagnostics string) *OperationOutcome {
+	return &OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []Issue{{Severity: "error", Code: code, Diagnostics: diagnostics}},
+	}
+}
+
+// ReferenceID returns the ID from a reference of the given type, such as "Patient/P001". A bare ID is accepted
+// as well, since search parameters are often given that way.
+func ReferenceID(reference string, resourceType string) (string, bool) {
+	if id, found := strings.CutPrefix(reference, resourceType+"/"); found {
+		return id, id != ""
+	}
+	if reference == "" || strings.Contains(reference, "/") {
+		return "", false
+	}
+	return reference, true
+}
+
+// TokenValue returns the value of a token search parameter, checking the system when one is given.
+func TokenValue(token string, system string) (string, bool) {
+	tokenSystem, value, found := strings.Cut(token, "|")
+	if !found {
+		return token, token != ""
+	}
+	return value, value != "" && (tokenSystem == "" || tokenSystem == system)
+}
+
+// DateParam is a date search parameter such as "ge2026-01-01".
+type DateParam struct {
+	Prefix string
+	Date   time.Time
+}
+
+// ParseDateParams parses the values of a date search parameter. Each value must be a date, optionally
+// prefixed with eq, ne, gt, lt, ge or le.
+func ParseDateParams(values []string) ([]DateParam, error) {
+	var params []DateParam
+	for _, value := range values {
+		prefix := "eq"
+		if len(value) > 2 && value[0] >= 'a' && value[0] <= 'z' {
+			prefix, value = value[:2], value[2:]
+		}
+		switch prefix {
+		case "eq", "ne", "gt", "lt", "ge", "le":
+		default:
+			return nil, fmt.Errorf("unsupported date prefix %q", prefix)
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, fmt.Errorf("dates must be given as YYYY-MM-DD: %q", value)
+		}
+		params = append(params, DateParam{Prefix: prefix, Date: date})
+	}
+	return params, nil
+}
+
+// MatchDates reports whether an RFC 3339 timestamp or YYYY-MM-DD date falls on a day matching every parameter.
+func MatchDates(params []DateParam, timestamp string) bool {
+	if len(params) == 0 {
+		return true
+	}
+	if len(timestamp) < 10 {
+		return false
+	}
+	day, err := time.Parse("2006-01-02", timestamp[:10])
+	if err != nil {
+		return false
+	}
+	for _, param := range params {
+		var ok bool
+		switch param.Prefix {
+		case "eq":
+			ok = day.Equal(param.Date)
+		case "ne":
+			ok = !day.Equal(param.Date)
+		case "gt":
+			ok = day.After(param.Date)
+		case "lt":
+			ok = day.Before(param.Date)
+		case "ge":
+			ok = !day.Before(param.Date)
+		case "le":
+			ok = !day.After(param.Date)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
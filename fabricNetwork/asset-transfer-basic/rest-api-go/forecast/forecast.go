@@ -0,0 +1,266 @@
+// Package forecast turns the chaincode's stock and dispense events into per-facility consumption rates and
+// warns when a facility is projected to run out of a medication within a configurable horizon.
+package forecast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Chaincode events carrying stock movements
+const (
+	eventStockChanged          = "StockChanged"
+	eventPrescriptionDispensed = "PrescriptionDispensed"
+)
+
+// Config holds the forecasting parameters.
+type Config struct {
+	ChannelID   string
+	ChaincodeID string
+	Horizon     time.Duration // alert when stock is projected to run out within this period
+	Window      time.Duration // period over which the consumption rate is averaged
+}
+
+// stockChange mirrors the chaincode's StockChange event payload.
+type stockChange struct {
+	FacilityId     string `json:"FacilityId"`
+	MedicationCode string `json:"MedicationCode"`
+	MedicationName string `json:"MedicationName"`
+	Change         int    `json:"Change"`
+	FacilityStock  int    `json:"FacilityStock"`
+	Reason         string `json:"Reason"`
+}
+
+// stockEvent mirrors the chaincode's StockEvent event payload.
+type stockEvent struct {
+	Changes   []stockChange `json:"Changes"`
+	Timestamp string        `json:"Timestamp"`
+}
+
+// Forecast is the projected stock position of one medication at one facility.
+type Forecast struct {
+	FacilityId      string  `json:"facilityId"`
+	MedicationCode  string  `json:"medicationCode"`
+	MedicationName  string  `json:"medicationName"`
+	StockOnHand     int     `json:"stockOnHand"`
+	DailyRate       float64 `json:"dailyConsumption"`
+	DaysOfStock     float64 `json:"daysOfStock"` // -1 when there is no recent consumption
+	StockOutDate    string  `json:"stockOutDate,omitempty"`
+	LastMovementAt  string  `json:"lastMovementAt"`
+	ConsumptionDays float64 `json:"consumptionDays"` // length of the history the rate was computed from
+}
+
+// consumption is quantity dispensed at a point in time.
+type consumption struct {
+	at       time.Time
+	quantity int
+}
+
+// series is the event history kept for one facility and medication.
+type series struct {
+	facilityId     string
+	medicationCode string
+	medicationName string
+	stockOnHand    int
+	firstSeen      time.Time
+	lastMovement   time.Time
+	dispensed      []consumption
+}
+
+// Service consumes chaincode events and keeps the forecasts up to date.
+type Service struct {
+	network      *client.Network
+	config       Config
+	checkpointer *client.InMemoryCheckpointer
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// NewService creates a forecasting service reading events from the configured channel and chaincode.
+func NewService(gateway *client.Gateway, config Config) *Service {
+	return &Service{
+		network:      gateway.GetNetwork(config.ChannelID),
+		config:       config,
+		checkpointer: new(client.InMemoryCheckpointer),
+		series:       map[string]*series{},
+	}
+}
+
+// Run replays the chaincode events from the start of the channel and then follows new ones until the context is
+// cancelled, reconnecting from the last processed event if the event stream fails.
+func (service *Service) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		events, err := service.network.ChaincodeEvents(ctx, service.config.ChaincodeID,
+			client.WithStartBlock(0), client.WithCheckpoint(service.checkpointer))
+		if err != nil {
+			log.Printf("forecast: failed to read chaincode events: %v", err)
+		} else {
+			for event := range events {
+				service.handle(event)
+				service.checkpointer.CheckpointChaincodeEvent(event)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// handle applies one chaincode event to the series it touches.
+func (service *Service) handle(event *client.ChaincodeEvent) {
+	if event.EventName != eventStockChanged && event.EventName != eventPrescriptionDispensed {
+		return
+	}
+
+	var payload stockEvent
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		log.Printf("forecast: ignoring malformed %s event in transaction %s: %v", event.EventName, event.TransactionID, err)
+		return
+	}
+	at, err := time.Parse(time.RFC3339, payload.Timestamp)
+	if err != nil {
+		log.Printf("forecast: ignoring %s event in transaction %s with invalid timestamp: %v", event.EventName, event.TransactionID, err)
+		return
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	for _, change := range payload.Changes {
+		key := change.FacilityId + "\x00" + change.MedicationCode
+		s, ok := service.series[key]
+		if !ok {
+			s = &series{facilityId: change.FacilityId, medicationCode: change.MedicationCode, firstSeen: at}
+			service.series[key] = s
+		}
+		if change.MedicationName != "" {
+			s.medicationName = change.MedicationName
+		}
+		s.stockOnHand = change.FacilityStock
+		s.lastMovement = at
+		if event.EventName == eventPrescriptionDispensed && change.Change < 0 {
+			s.dispensed = append(s.dispensed, consumption{at: at, quantity: -change.Change})
+		}
+	}
+}
+
+// Forecasts returns the current forecast for every medication at a facility, or at every facility when
+// facilityId is empty, soonest stock-out first.
+func (service *Service) Forecasts(facilityId string, now time.Time) []Forecast {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+
+	forecasts := []Forecast{}
+	for _, s := range service.series {
+		if facilityId != "" && s.facilityId != facilityId {
+			continue
+		}
+		forecasts = append(forecasts, service.project(s, now))
+	}
+	sortForecasts(forecasts)
+	return forecasts
+}
+
+// Alerts returns the forecasts projected to run out within the horizon, including medications already out of stock.
+func (service *Service) Alerts(facilityId string, horizon time.Duration, now time.Time) []Forecast {
+	horizonDays := horizon.Hours() / 24
+	alerts := []Forecast{}
+	for _, forecast := range service.Forecasts(facilityId, now) {
+		if forecast.StockOnHand <= 0 || (forecast.DaysOfStock >= 0 && forecast.DaysOfStock <= horizonDays) {
+			alerts = append(alerts, forecast)
+		}
+	}
+	return alerts
+}
+
+// project computes the consumption rate over the averaging window and the resulting days of stock.
+func (service *Service) project(s *series, now time.Time) Forecast {
+	windowStart := now.Add(-service.config.Window)
+	if s.firstSeen.After(windowStart) {
+		windowStart = s.firstSeen
+	}
+	days := now.Sub(windowStart).Hours() / 24
+	if days < 1 {
+		days = 1 // avoid inflating the rate from a few hours of history
+	}
+
+	dispensed := 0
+	for _, c := range s.dispensed {
+		if !c.at.Before(windowStart) {
+			dispensed += c.quantity
+		}
+	}
+
+	forecast := Forecast{
+		FacilityId:      s.facilityId,
+		MedicationCode:  s.medicationCode,
+		MedicationName:  s.medicationName,
+		StockOnHand:     s.stockOnHand,
+		DailyRate:       float64(dispensed) / days,
+		DaysOfStock:     -1,
+		LastMovementAt:  s.lastMovement.Format(time.RFC3339),
+		ConsumptionDays: math.Round(days*10) / 10,
+	}
+	if forecast.DailyRate > 0 {
+		daysOfStock := math.Max(float64(s.stockOnHand), 0) / forecast.DailyRate
+		forecast.DaysOfStock = math.Round(daysOfStock*10) / 10
+		forecast.StockOutDate = now.Add(time.Duration(daysOfStock * 24 * float64(time.Hour))).Format("2006-01-02")
+	}
+	forecast.DailyRate = math.Round(forecast.DailyRate*100) / 100
+	return forecast
+}
+
+// sortForecasts orders forecasts by days of stock, with no-consumption entries last.
+func sortForecasts(forecasts []Forecast) {
+	sort.Slice(forecasts, func(i, j int) bool {
+		a, b := forecasts[i], forecasts[j]
+		if (a.DaysOfStock < 0) != (b.DaysOfStock < 0) {
+			return b.DaysOfStock < 0
+		}
+		if a.DaysOfStock != b.DaysOfStock {
+			return a.DaysOfStock < b.DaysOfStock
+		}
+		if a.FacilityId != b.FacilityId {
+			return a.FacilityId < b.FacilityId
+		}
+		return a.MedicationCode < b.MedicationCode
+	})
+}
+
+// AlertsHandler handles stock-out alert requests. The optional facilityId parameter limits the alerts to one
+// facility and horizonDays overrides the configured horizon.
+func (service *Service) AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received forecast alerts request")
+	queryParams := r.URL.Query()
+	facilityID := queryParams.Get("facilityId")
+
+	horizon := service.config.Horizon
+	if horizonDays := queryParams.Get("horizonDays"); horizonDays != "" {
+		days, err := strconv.ParseFloat(horizonDays, 64)
+		if err != nil || days <= 0 {
+			http.Error(w, "horizonDays must be a positive number", http.StatusBadRequest)
+			return
+		}
+		horizon = time.Duration(days * 24 * float64(time.Hour))
+	}
+
+	alerts := service.Alerts(facilityID, horizon, time.Now())
+	response, err := json.Marshal(alerts)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", response)
+}
@@ -0,0 +1,207 @@
+package forecast
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var now = time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+// movement is one stock change of AMOX at KCH, applied through the chaincode event it would arrive in
+type movement struct {
+	event  string
+	at     time.Time
+	change int
+	stock  int
+}
+
+func received(at time.Time, quantity int, stock int) movement {
+	return movement{event: eventStockChanged, at: at, change: quantity, stock: stock}
+}
+
+func dispensed(at time.Time, quantity int, stock int) movement {
+	return movement{event: eventPrescriptionDispensed, at: at, change: -quantity, stock: stock}
+}
+
+func newTestService(t *testing.T, movements ...movement) *Service {
+	service := &Service{config: Config{Window: 30 * 24 * time.Hour}, series: map[string]*series{}}
+	for _, m := range movements {
+		payload, err := json.Marshal(stockEvent{
+			Changes:   []stockChange{{FacilityId: "KCH", MedicationCode: "AMOX", MedicationName: "Amoxicillin", Change: m.change, FacilityStock: m.stock}},
+			Timestamp: m.at.Format(time.RFC3339),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.handle(&client.ChaincodeEvent{EventName: m.event, Payload: payload})
+	}
+	return service
+}
+
+func TestForecasts(t *testing.T) {
+	tests := []struct {
+		name             string
+		movements        []movement
+		wantRate         float64
+		wantDays         float64
+		wantStockOutDate string
+		wantHistory      float64
+	}{
+		{
+			name: "steady consumption over the window",
+			movements: []movement{
+				received(now.AddDate(0, 0, -30), 180, 180),
+				dispensed(now.AddDate(0, 0, -20), 30, 150),
+				dispensed(now.AddDate(0, 0, -10), 30, 120),
+			},
+			wantRate: 2, wantDays: 60, wantStockOutDate: "2024-07-30", wantHistory: 30,
+		},
+		{
+			name: "history shorter than the window",
+			movements: []movement{
+				received(now.AddDate(0, 0, -10), 60, 60),
+				dispensed(now.AddDate(0, 0, -5), 20, 40),
+			},
+			wantRate: 2, wantDays: 20, wantStockOutDate: "2024-06-20", wantHistory: 10,
+		},
+		{
+			name: "less than a day of history counts as a day",
+			movements: []movement{
+				received(now.Add(-6*time.Hour), 15, 15),
+				dispensed(now.Add(-time.Hour), 5, 10),
+			},
+			wantRate: 5, wantDays: 2, wantStockOutDate: "2024-06-02", wantHistory: 1,
+		},
+		{
+			name: "dispenses before the window are left out",
+			movements: []movement{
+				received(now.AddDate(0, 0, -60), 220, 220),
+				dispensed(now.AddDate(0, 0, -45), 100, 120),
+				dispensed(now.AddDate(0, 0, -15), 30, 90),
+			},
+			wantRate: 1, wantDays: 90, wantStockOutDate: "2024-08-29", wantHistory: 30,
+		},
+		{
+			name: "fractional days of stock",
+			movements: []movement{
+				received(now.AddDate(0, 0, -30), 100, 100),
+				dispensed(now.AddDate(0, 0, -1), 90, 10),
+			},
+			wantRate: 3, wantDays: 3.3, wantStockOutDate: "2024-06-03", wantHistory: 30,
+		},
+		{
+			name: "out of stock",
+			movements: []movement{
+				received(now.AddDate(0, 0, -30), 60, 60),
+				dispensed(now.AddDate(0, 0, -1), 60, 0),
+			},
+			wantRate: 2, wantDays: 0, wantStockOutDate: "2024-05-31", wantHistory: 30,
+		},
+		{
+			name:        "no consumption",
+			movements:   []movement{received(now.AddDate(0, 0, -30), 60, 60)},
+			wantRate:    0,
+			wantDays:    -1,
+			wantHistory: 30,
+		},
+		{
+			name: "stock returned to the shelf is not consumption",
+			movements: []movement{
+				received(now.AddDate(0, 0, -30), 60, 60),
+				dispensed(now.AddDate(0, 0, -1), -5, 65),
+			},
+			wantRate:    0,
+			wantDays:    -1,
+			wantHistory: 30,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forecasts := newTestService(t, tt.movements...).Forecasts("KCH", now)
+			if len(forecasts) != 1 {
+				t.Fatalf("got %d forecasts, want 1", len(forecasts))
+			}
+			got := forecasts[0]
+			if got.DailyRate != tt.wantRate {
+				t.Errorf("DailyRate = %v, want %v", got.DailyRate, tt.wantRate)
+			}
+			if got.DaysOfStock != tt.wantDays {
+				t.Errorf("DaysOfStock = %v, want %v", got.DaysOfStock, tt.wantDays)
+			}
+			if got.StockOutDate != tt.wantStockOutDate {
+				t.Errorf("StockOutDate = %q, want %q", got.StockOutDate, tt.wantStockOutDate)
+			}
+			if got.ConsumptionDays != tt.wantHistory {
+				t.Errorf("ConsumptionDays = %v, want %v", got.ConsumptionDays, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestForecastsWithoutHistory(t *testing.T) {
+	service := newTestService(t)
+	if forecasts := service.Forecasts("", now); forecasts == nil || len(forecasts) != 0 {
+		t.Errorf("Forecasts = %#v, want an empty list", forecasts)
+	}
+	if alerts := service.Alerts("", 14*24*time.Hour, now); alerts == nil || len(alerts) != 0 {
+		t.Errorf("Alerts = %#v, want an empty list", alerts)
+	}
+
+	// Another facility's history does not produce a forecast
+	service = newTestService(t, received(now.AddDate(0, 0, -1), 10, 10))
+	if forecasts := service.Forecasts("ZCH", now); len(forecasts) != 0 {
+		t.Errorf("Forecasts(ZCH) = %#v, want an empty list", forecasts)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	const horizon = 14 * 24 * time.Hour
+
+	tests := []struct {
+		name      string
+		movements []movement
+		wantAlert bool
+	}{
+		{
+			name:      "runs out before the horizon",
+			movements: []movement{received(now.AddDate(0, 0, -30), 87, 87), dispensed(now.AddDate(0, 0, -1), 60, 27)},
+			wantAlert: true,
+		},
+		{
+			name:      "runs out on the horizon",
+			movements: []movement{received(now.AddDate(0, 0, -30), 88, 88), dispensed(now.AddDate(0, 0, -1), 60, 28)},
+			wantAlert: true,
+		},
+		{
+			name:      "runs out after the horizon",
+			movements: []movement{received(now.AddDate(0, 0, -30), 89, 89), dispensed(now.AddDate(0, 0, -1), 60, 29)},
+		},
+		{
+			name:      "out of stock",
+			movements: []movement{received(now.AddDate(0, 0, -30), 60, 60), dispensed(now.AddDate(0, 0, -1), 60, 0)},
+			wantAlert: true,
+		},
+		{
+			name:      "out of stock without consumption",
+			movements: []movement{received(now.AddDate(0, 0, -30), 0, 0)},
+			wantAlert: true,
+		},
+		{
+			name:      "stocked without consumption",
+			movements: []movement{received(now.AddDate(0, 0, -30), 5, 5)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts := newTestService(t, tt.movements...).Alerts("KCH", horizon, now)
+			if got := len(alerts) == 1; got != tt.wantAlert {
+				t.Errorf("alerted = %v, want %v (%#v)", got, tt.wantAlert, alerts)
+			}
+		})
+	}
+}
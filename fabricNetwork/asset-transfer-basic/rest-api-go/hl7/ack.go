@@ -0,0 +1,78 @@
+package hl7
+
+import "strconv"
+
+// Acknowledgment codes (HL7 table 0008).
+const (
+	AckAccept = "AA" // the message was processed
+	AckError  = "AE" // the message was understood but could not be processed
+	AckReject = "AR" // the message was not understood or is not supported
+)
+
+// Error codes (HL7 table 0357).
+const (
+	ErrSegmentSequence      = "100"
+	ErrRequiredFieldMissing = "101"
+	ErrDataType             = "102"
+	ErrTableValueNotFound   = "103"
+	ErrUnsupportedMessage   = "200"
+	ErrApplicationInternal  = "207"
+)
+
+// errorCodeNames are the table 0357 display names of the error codes.
+var errorCodeNames = map[string]string{
+	ErrSegmentSequence:      "Segment sequence error",
+	ErrRequiredFieldMissing: "Required field missing",
+	ErrDataType:             "Data type error",
+	ErrTableValueNotFound:   "Table value not found",
+	ErrUnsupportedMessage:   "Unsupported message type",
+	ErrApplicationInternal:  "Application internal error",
+}
+
+// Error is a problem with a received message, reported in an ERR segment of the acknowledgment.
+type Error struct {
+	Segment  string // segment ID, such as "RXE"
+	Sequence int    // occurrence of the segment in the message, from 1
+	Field    int    // field position, or 0 for the whole segment
+	Code     string // table 0357 error code
+	Text     string
+}
+
+// Error implements error.
+func (err *Error) Error() string {
+	if err.Segment == "" {
+		return err.Text
+	}
+	return err.Segment + ": " + err.Text
+}
+
+// NewAck builds the acknowledgment of a received message, with an ERR segment per error.
+func NewAck(received *Message, code string, sendingApp string, sendingFacility string, errs []*Error) *Message {
+	receivingApp, receivingFacility, trigger := "", "", ""
+	if header := received.Segment("MSH"); header != nil {
+		receivingApp, receivingFacility = header.Field(3), header.Field(4)
+		trigger = header.Component(9, 2)
+	}
+
+	ack := &Message{Segments: []*Segment{
+		Header(sendingApp, sendingFacility, receivingApp, receivingFacility, []string{"ACK", trigger, "ACK"}, NewControlID()),
+		NewSegment("MSA", code, received.ControlID()),
+	}}
+	for _, err := range errs {
+		location := []string{}
+		if err.Segment != "" {
+			location = []string{err.Segment, itoa(err.Sequence), itoa(err.Field)}
+		}
+		ack.Segments = append(ack.Segments, NewSegment("ERR", "", location,
+			[]string{err.Code, errorCodeNames[err.Code], "HL70357"}, "E", "", "", "", err.Text))
+	}
+	return ack
+}
+
+// itoa formats a position, leaving zero empty.
+func itoa(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,84 @@
+package hl7
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewAck(t *testing.T) {
+	received, err := Parse("MSH|^~\\&|HIS|KCH|UMODZIRX|Org1MSP|20240501120000||RDE^O11^RDE_O11|MSG0001|P|2.5\rPID|1||P1\r")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		errs    []*Error
+		wantERR []string // ERR-2 location, ERR-3 code, ERR-8 text of each ERR segment
+	}{
+		{name: "accepted", code: AckAccept},
+		{
+			name:    "field error",
+			code:    AckError,
+			errs:    []*Error{{Segment: "RXE", Sequence: 2, Field: 10, Code: ErrDataType, Text: "dispense amount \"x\" is not a whole number"}},
+			wantERR: []string{"RXE^2^10", "102^Data type error^HL70357", "dispense amount \"x\" is not a whole number"},
+		},
+		{
+			name:    "segment error",
+			code:    AckError,
+			errs:    []*Error{{Segment: "ORC", Sequence: 1, Code: ErrSegmentSequence, Text: "ORC must be followed by an RXE"}},
+			wantERR: []string{"ORC^1", "100^Segment sequence error^HL70357", "ORC must be followed by an RXE"},
+		},
+		{
+			name:    "application error without a location",
+			code:    AckError,
+			errs:    []*Error{{Code: ErrApplicationInternal, Text: "consent denied"}},
+			wantERR: []string{"", "207^Application internal error^HL70357", "consent denied"},
+		},
+		{
+			name:    "rejected",
+			code:    AckReject,
+			errs:    []*Error{{Segment: "MSH", Sequence: 1, Field: 9, Code: ErrUnsupportedMessage, Text: "message type ADT^A01 is not supported"}},
+			wantERR: []string{"MSH^1^9", "200^Unsupported message type^HL70357", "message type ADT^A01 is not supported"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Round-trip through the wire format, as the sender reads it
+			ack, err := Parse(NewAck(received, tt.code, "UMODZIRX", "Org1MSP", tt.errs).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := ack.Segment("MSH")
+			got := [5]string{header.Field(3), header.Field(4), header.Field(5), header.Field(6), header.Field(9)}
+			if want := [5]string{"UMODZIRX", "Org1MSP", "HIS", "KCH", "ACK^O11^ACK"}; got != want {
+				t.Errorf("MSH-3 to MSH-6 and MSH-9 = %q, want %q", got, want)
+			}
+			msa := ack.Segment("MSA")
+			if msa.Field(1) != tt.code || msa.Field(2) != "MSG0001" {
+				t.Errorf("MSA = %q, %q, want %q, MSG0001", msa.Field(1), msa.Field(2), tt.code)
+			}
+
+			var errSegments []*Segment
+			for _, segment := range ack.Segments {
+				if segment.Name == "ERR" {
+					errSegments = append(errSegments, segment)
+				}
+			}
+			if len(errSegments) != len(tt.errs) {
+				t.Fatalf("got %d ERR segments, want %d", len(errSegments), len(tt.errs))
+			}
+			for _, segment := range errSegments {
+				if got := []string{segment.Fields[2], segment.Fields[3], segment.Field(8)}; strings.Join(got, "|") != strings.Join(tt.wantERR, "|") {
+					t.Errorf("ERR-2, ERR-3 and ERR-8 = %q, want %q", got, tt.wantERR)
+				}
+				if segment.Field(4) != "E" {
+					t.Errorf("ERR-4 = %q, want E", segment.Field(4))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+// Package hl7 parses and builds HL7 v2 messages and carries them over MLLP, for hospital systems that exchange
+// pharmacy orders and dispenses in HL7 v2 rather than FHIR.
+package hl7
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version is the HL7 version of the messages this package builds.
+const Version = "2.5.1"
+
+// Delimiters used when building messages. Parsed messages may declare their own in MSH-1 and MSH-2.
+const (
+	fieldSeparator        = '|'
+	componentSeparator    = '^'
+	repetitionSeparator   = '~'
+	escapeCharacter       = '\\'
+	subcomponentSeparator = '&'
+)
+
+// encodingCharacters is MSH-2 for the default delimiters.
+const encodingCharacters = "^~\\&"
+
+// Segment is one segment of a message. Fields are kept escaped; Fields[n] is field n of the segment, so for MSH
+// Fields[1] is the field separator and Fields[2] the encoding characters, as the standard numbers them.
+type Segment struct {
+	Name   string
+	Fields []string
+	delims delimiters
+}
+
+// Message is a parsed or built HL7 v2 message.
+type Message struct {
+	Segments []*Segment
+}
+
+// delimiters are a message's separators and escape character.
+type delimiters struct {
+	field, component, repetition, escape, subcomponent byte
+}
+
+var defaultDelimiters = delimiters{fieldSeparator, componentSeparator, repetitionSeparator, escapeCharacter, subcomponentSeparator}
+
+// Parse parses a message whose first segment is MSH. Segments may be separated by CR, LF or CRLF.
+func Parse(text string) (*Message, error) {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\r"), "\n", "\r")
+	lines := strings.Split(strings.Trim(text, "\r"), "\r")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "MSH") || len(lines[0]) < 8 {
+		return nil, fmt.Errorf("message must start with an MSH segment")
+	}
+	header := lines[0]
+	delims := delimiters{
+		field:        header[3],
+		component:    header[4],
+		repetition:   header[5],
+		escape:       header[6],
+		subcomponent: header[7],
+	}
+
+	message := &Message{}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, string(delims.field))
+		if len(fields[0]) != 3 {
+			return nil, fmt.Errorf("invalid segment %q", line)
+		}
+		if fields[0] == "MSH" {
+			fields = append([]string{"MSH", string(delims.field)}, fields[1:]...)
+		}
+		message.Segments = append(message.Segments, &Segment{Name: fields[0], Fields: fields, delims: delims})
+	}
+	return message, nil
+}
+
+// String encodes the message with CR segment separators.
+func (message *Message) String() string {
+	lines := make([]string, len(message.Segments))
+	for i, segment := range message.Segments {
+		fields := segment.Fields
+		if segment.Name == "MSH" {
+			fields = append([]string{"MSH"}, fields[2:]...)
+		}
+		lines[i] = strings.Join(fields, string(segment.delims.field))
+	}
+	return strings.Join(lines, "\r") + "\r"
+}
+
+// Segment returns the first segment with the given name, or nil.
+func (message *Message) Segment(name string) *Segment {
+	for _, segment := range message.Segments {
+		if segment.Name == name {
+			return segment
+		}
+	}
+	return nil
+}
+
+// Type returns the message code and trigger event from MSH-9, such as "RDE" and "O11".
+func (message *Message) Type() (string, string) {
+	header := message.Segment("MSH")
+	if header == nil {
+		return "", ""
+	}
+	return header.Component(9, 1), header.Component(9, 2)
+}
+
+// ControlID returns the message control ID from MSH-10.
+func (message *Message) ControlID() string {
+	if header := message.Segment("MSH"); header != nil {
+		return header.Field(10)
+	}
+	return ""
+}
+
+// Field returns field n, unescaped, with all its repetitions and components.
+func (segment *Segment) Field(n int) string {
+	if n >= len(segment.Fields) {
+		return ""
+	}
+	if segment.Name == "MSH" && n <= 2 {
+		return segment.Fields[n]
+	}
+	return segment.unescape(segment.Fields[n])
+}
+
+// Repetitions returns the repetitions of field n, still escaped.
+func (segment *Segment) Repetitions(n int) []string {
+	if n >= len(segment.Fields) || segment.Fields[n] == "" {
+		return nil
+	}
+	return strings.Split(segment.Fields[n], string(segment.delims.repetition))
+}
+
+// Component returns component c of the first repetition of field n, unescaped. Components are numbered from 1.
+func (segment *Segment) Component(n int, c int) string {
+	repetitions := segment.Repetitions(n)
+	if len(repetitions) == 0 {
+		return ""
+	}
+	return segment.RepetitionComponent(repetitions[0], c)
+}
+
+// RepetitionComponent returns component c of one repetition of a field, unescaped.
+func (segment *Segment) RepetitionComponent(repetition string, c int) string {
+	components := strings.Split(repetition, string(segment.delims.component))
+	if c < 1 || c > len(components) {
+		return ""
+	}
+	return segment.unescape(components[c-1])
+}
+
+// unescape replaces HL7 escape sequences with the delimiters they stand for.
+func (segment *Segment) unescape(value string) string {
+	escape := string(segment.delims.escape)
+	if !strings.Contains(value, escape) {
+		return value
+	}
+	return strings.NewReplacer(
+		escape+"F"+escape, string(segment.delims.field),
+		escape+"S"+escape, string(segment.delims.component),
+		escape+"R"+escape, string(segment.delims.repetition),
+		escape+"T"+escape, string(segment.delims.subcomponent),
+		escape+"E"+escape, escape,
+		escape+".br"+escape, "\n",
+	).Replace(value)
+}
+
+// NewSegment builds a segment from field values, escaping each value. A value may be a []string, which is
+// encoded as components.
+func NewSegment(name string, values ...interface{}) *Segment {
+	fields := []string{name}
+	if name == "MSH" {
+		fields = append(fields, string(fieldSeparator), encodingCharacters)
+	}
+	for _, value := range values {
+		switch v := value.(type) {
+		case []string:
+			components := make([]string, len(v))
+			for i, component := range v {
+				components[i] = Escape(component)
+			}
+			fields = append(fields, strings.TrimRight(strings.Join(components, string(componentSeparator)), string(componentSeparator)))
+		case string:
+			fields = append(fields, Escape(v))
+		default:
+			fields = append(fields, Escape(fmt.Sprint(v)))
+		}
+	}
+	return &Segment{Name: name, Fields: fields, delims: defaultDelimiters}
+}
+
+// Escape escapes the delimiters in a value.
+func Escape(value string) string {
+	return strings.NewReplacer(
+		string(escapeCharacter), `\E\`,
+		string(fieldSeparator), `\F\`,
+		string(componentSeparator), `\S\`,
+		string(repetitionSeparator), `\R\`,
+		string(subcomponentSeparator), `\T\`,
+		"\r", `\.br\`,
+		"\n", `\.br\`,
+	).Replace(value)
+}
+
+// Header builds an MSH segment. The remaining MSH fields after MSH-12 are left empty.
+func Header(sendingApp string, sendingFacility string, receivingApp string, receivingFacility string, messageType []string, controlID string) *Segment {
+	return NewSegment("MSH", sendingApp, sendingFacility, receivingApp, receivingFacility, FormatTime(time.Now()), "", messageType, controlID, "P", Version)
+}
+
+// NewControlID returns a random message control ID.
+func NewControlID() string {
+	id := make([]byte, 10)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+// FormatTime formats a time as an HL7 DTM value.
+func FormatTime(t time.Time) string {
+	return t.Format("20060102150405")
+}
+
+// ParseDate converts the date part of an HL7 DT or DTM value to YYYY-MM-DD.
+func ParseDate(value string) (string, error) {
+	if len(value) < 8 {
+		return "", fmt.Errorf("invalid date %q", value)
+	}
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q", value)
+	}
+	return date.Format("2006-01-02"), nil
+}
+
+// FormatDate converts a YYYY-MM-DD date or RFC 3339 timestamp to an HL7 DT or DTM value.
+func FormatDate(value string) string {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return FormatTime(t)
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Format("20060102")
+	}
+	return ""
+}
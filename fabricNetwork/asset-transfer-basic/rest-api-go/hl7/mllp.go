@@ -0,0 +1,197 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// MLLP frame delimiters.
+const (
+	startBlock     = 0x0b
+	endBlock       = 0x1c
+	carriageReturn = 0x0d
+)
+
+// Timeouts for MLLP connections.
+const (
+	idleTimeout  = 5 * time.Minute  // an inbound connection with no message for this long is closed
+	replyTimeout = 30 * time.Second // how long Send waits for an acknowledgment
+)
+
+// Peer is the sending system at the other end of an MLLP connection.
+type Peer struct {
+	Address     string
+	Certificate *x509.Certificate // verified TLS client certificate, or nil on a plain connection
+}
+
+// Handler processes a message received from a peer and returns its acknowledgment.
+type Handler interface {
+	HandleMessage(peer *Peer, message *Message) *Message
+}
+
+// ServerTLSConfig returns a TLS configuration that presents the certificate and key and requires each client to
+// present a certificate issued by the CA in clientCAPath.
+func ServerTLSConfig(certPath string, keyPath string, clientCAPath string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", clientCAPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ListenAndServe accepts MLLP connections on the address until the context is cancelled. Each framed message is
+// passed to the handler, and the handler's acknowledgment is sent back on the same connection. With a TLS
+// configuration, connections are accepted over TLS and the handler is given the peer's client certificate.
+func ListenAndServe(ctx context.Context, address string, tlsConfig *tls.Config, handler Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveConn(conn, handler)
+	}
+}
+
+// serveConn reads framed messages from a connection until it is closed or idle.
+func serveConn(conn net.Conn, handler Handler) {
+	defer conn.Close()
+	peer := &Peer{Address: conn.RemoteAddr().String()}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(replyTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("hl7: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+			peer.Certificate = certificates[0]
+		}
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		frame, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("hl7: closing connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var ack *Message
+		message, err := Parse(frame)
+		if err != nil {
+			ack = NewAck(&Message{}, AckReject, "", "", []*Error{{Code: ErrSegmentSequence, Text: err.Error()}})
+		} else {
+			ack = handler.HandleMessage(peer, message)
+		}
+		if err := writeFrame(conn, ack.String()); err != nil {
+			log.Printf("hl7: failed to acknowledge message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Send delivers a message to an MLLP receiver and returns its acknowledgment. It fails unless the receiver
+// accepts the message.
+func Send(ctx context.Context, address string, message *Message) (*Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+
+	if err := writeFrame(conn, message.String()); err != nil {
+		return nil, err
+	}
+	frame, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		return nil, fmt.Errorf("no acknowledgment: %w", err)
+	}
+	ack, err := Parse(frame)
+	if err != nil {
+		return nil, fmt.Errorf("invalid acknowledgment: %w", err)
+	}
+	msa := ack.Segment("MSA")
+	if msa == nil {
+		return nil, fmt.Errorf("acknowledgment has no MSA segment")
+	}
+	if code := msa.Field(1); code != AckAccept && code != "CA" {
+		reason := ""
+		if errSegment := ack.Segment("ERR"); errSegment != nil {
+			reason = ": " + errSegment.Field(8)
+		}
+		return ack, fmt.Errorf("message %s was not accepted (%s)%s", message.ControlID(), code, reason)
+	}
+	return ack, nil
+}
+
+// readFrame reads one MLLP frame and returns its content.
+func readFrame(reader *bufio.Reader) (string, error) {
+	// Skip anything before the start of the frame
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	content, err := reader.ReadString(endBlock)
+	if err != nil {
+		return "", fmt.Errorf("incomplete frame: %w", err)
+	}
+	if b, err := reader.ReadByte(); err != nil || b != carriageReturn {
+		return "", fmt.Errorf("frame does not end with CR")
+	}
+	return content[:len(content)-1], nil
+}
+
+// writeFrame writes content as one MLLP frame.
+func writeFrame(writer io.Writer, content string) error {
+	frame := make([]byte, 0, len(content)+3)
+	frame = append(frame, startBlock)
+	frame = append(frame, content...)
+	frame = append(frame, endBlock, carriageReturn)
+	_, err := writer.Write(frame)
+	return err
+}
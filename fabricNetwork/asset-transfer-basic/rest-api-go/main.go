@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"os"
+	"rest-api-go/dhis2"
+	"rest-api-go/forecast"
+	"rest-api-go/hl7"
 	"rest-api-go/web"
+	"strconv"
+	"time"
 )
 
 func main() {
@@ -22,5 +30,117 @@ func main() {
 	if err != nil {
 		fmt.Println("Error initializing setup for Org1: ", err)
 	}
-	web.Serve(web.OrgSetup(*orgSetup))
+
+	orgSetup.PublicURL = envOrDefault("PUBLIC_URL", "http://localhost:45000")
+
+	//Load the facility letterheads printed on paper prescriptions
+	orgSetup.Letterheads, err = web.LoadLetterheads(envOrDefault("LETTERHEAD_CONFIG", "letterhead.json"))
+	if err != nil {
+		fmt.Println("Error loading letterheads: ", err)
+	}
+
+	//Load the DHIS2 identifiers that facility indicator reports are exported with
+	orgSetup.DHIS2Mapping, err = dhis2.LoadMapping(envOrDefault("DHIS2_MAPPING", "dhis2-mapping.json"))
+	if err != nil {
+		fmt.Println("Error loading DHIS2 mapping: ", err)
+	}
+
+	//Key patient hashes in QR tokens and credentials with a server-held secret, and limit how long tokens are accepted
+	orgSetup.PatientHashKey = []byte(os.Getenv("PATIENT_HASH_SECRET"))
+	if len(orgSetup.PatientHashKey) == 0 {
+		fmt.Println("PATIENT_HASH_SECRET is not set; prescription tokens and credentials cannot be issued or verified")
+	}
+	orgSetup.TokenMaxAge = envDays("TOKEN_MAX_AGE_DAYS", 90)
+
+	//Act for signed-in users with their own enrolled identities, authenticated by the backend's session tokens
+	orgSetup.SessionSecret = []byte(os.Getenv("SESSION_TOKEN_SECRET"))
+	if len(orgSetup.SessionSecret) == 0 {
+		fmt.Println("SESSION_TOKEN_SECRET is not set; requests made as a signed-in user will be refused")
+	}
+	orgSetup.Wallet = &web.Wallet{Dir: envOrDefault("WALLET_DIR", "wallet/org1")}
+
+	//Serve patients as their own Org3 identities, if the organization has been added to the network
+	var patientSetup *web.OrgSetup
+	org3CryptoPath := "../../primary-network/organizations/peerOrganizations/org3.example.com"
+	if _, err := os.Stat(org3CryptoPath); err == nil {
+		patientSetup = &web.OrgSetup{
+			OrgName:       "Org3",
+			MSPID:         "Org3MSP",
+			TLSCertPath:   org3CryptoPath + "/peers/peer0.org3.example.com/tls/ca.crt",
+			PeerEndpoint:  "dns:///localhost:11051",
+			GatewayPeer:   "peer0.org3.example.com",
+			SessionSecret: orgSetup.SessionSecret,
+			Wallet:        &web.Wallet{Dir: envOrDefault("PATIENT_WALLET_DIR", "wallet/org3")},
+		}
+	}
+
+	//Start stock-out forecasting from the chaincode's stock and dispense events
+	forecaster := forecast.NewService(&orgSetup.Gateway, forecast.Config{
+		ChannelID:   envOrDefault("FORECAST_CHANNEL", "mychannel"),
+		ChaincodeID: envOrDefault("FORECAST_CHAINCODE", "basic"),
+		Horizon:     envDays("FORECAST_HORIZON_DAYS", 14),
+		Window:      envDays("FORECAST_WINDOW_DAYS", 30),
+	})
+	go forecaster.Run(context.Background())
+
+	//Serve FHIR resources from the prescription chaincode
+	fhirServer := web.NewFHIRServer(orgSetup,
+		envOrDefault("FHIR_CHANNEL", "mychannel"),
+		envOrDefault("FHIR_CHAINCODE", "basic"))
+
+	//Accept HL7 v2 pharmacy orders over MLLP from the allowed senders, and send dispenses back when a destination is configured
+	hl7Senders, err := web.LoadHL7Senders(envOrDefault("HL7_SENDERS", "hl7-senders.json"))
+	if err != nil {
+		fmt.Println("Error loading HL7 senders, the HL7 listener will not start: ", err)
+	}
+	hl7Service := web.NewHL7Service(orgSetup,
+		envOrDefault("HL7_CHANNEL", "mychannel"),
+		envOrDefault("HL7_CHAINCODE", "basic"),
+		hl7Senders)
+	if hl7Senders != nil {
+		go serveHL7(hl7Service)
+	}
+	if destination := os.Getenv("HL7_RDS_DESTINATION"); destination != "" {
+		go hl7Service.RunDispenseFeed(context.Background(), destination,
+			envOrDefault("HL7_CHECKPOINT", "hl7-checkpoint.json"),
+			envOrDefault("HL7_DEAD_LETTER", "hl7-dead-letter.jsonl"))
+	}
+
+	web.Serve(web.OrgSetup(*orgSetup), patientSetup, forecaster, fhirServer)
+}
+
+// serveHL7 runs the MLLP listener, over TLS with client certificates when HL7_TLS_CERT, HL7_TLS_KEY and
+// HL7_CLIENT_CA are set.
+func serveHL7(service *web.HL7Service) {
+	var tlsConfig *tls.Config
+	if certPath := os.Getenv("HL7_TLS_CERT"); certPath != "" {
+		var err error
+		tlsConfig, err = hl7.ServerTLSConfig(certPath, os.Getenv("HL7_TLS_KEY"), os.Getenv("HL7_CLIENT_CA"))
+		if err != nil {
+			fmt.Println("Error loading HL7 TLS configuration, the HL7 listener will not start: ", err)
+			return
+		}
+	} else {
+		fmt.Println("HL7_TLS_CERT is not set; the HL7 listener accepts plain connections and trusts the sending facility in MSH-4")
+	}
+	if err := hl7.ListenAndServe(context.Background(), envOrDefault("HL7_MLLP_ADDRESS", ":2575"), tlsConfig, service); err != nil {
+		fmt.Println("Error running HL7 listener: ", err)
+	}
+}
+
+// envOrDefault returns the environment variable, or the fallback when it is not set.
+func envOrDefault(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envDays reads a number of days from the environment, or uses the fallback when it is not set or invalid.
+func envDays(key string, fallback int) time.Duration {
+	days, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || days <= 0 {
+		days = fallback
+	}
+	return time.Duration(days) * 24 * time.Hour
 }
@@ -1,29 +1,71 @@
 package web
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"rest-api-go/dhis2"
+	"rest-api-go/forecast"
+	"time"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
 )
 
 // OrgSetup contains organization's config to interact with the network.
 type OrgSetup struct {
-	OrgName      string
-	MSPID        string
-	CryptoPath   string
-	CertPath     string
-	KeyPath      string
-	TLSCertPath  string
-	PeerEndpoint string
-	GatewayPeer  string
-	Gateway      client.Gateway
+	OrgName        string
+	MSPID          string
+	CryptoPath     string
+	CertPath       string
+	KeyPath        string
+	TLSCertPath    string
+	PeerEndpoint   string
+	GatewayPeer    string
+	Gateway        client.Gateway
+	Sign           identity.Sign         // signs tokens and credentials with the organization user's key
+	Certificate    *x509.Certificate     // certificate matching Sign, used to verify tokens this server issued
+	Letterheads    map[string]Letterhead // facility letterheads for printed prescriptions, keyed by facility ID
+	PublicURL      string                // base URL of this server, used in links embedded in issued credentials
+	DHIS2Mapping   *dhis2.Mapping        // organisation unit and data element identifiers for DHIS2 reports
+	PatientHashKey []byte                // server-held HMAC key for the patient hashes in tokens and credentials
+	TokenMaxAge    time.Duration         // how long a prescription QR token is accepted after it was issued
+	SessionSecret  []byte                // secret the backend signs users' session tokens with
+	Wallet         *Wallet               // enrolled identities of individual users, for requests made as the user
 }
 
-// Serve starts http web server.
-func Serve(setups OrgSetup) {
+// Serve starts http web server. Patient self-service endpoints are only registered when a
+// patient organization setup is given, stock-out alerts when a forecasting service is running,
+// and the FHIR API when a FHIR server is given.
+func Serve(setups OrgSetup, patientSetup *OrgSetup, forecaster *forecast.Service, fhirServer *FHIRServer) {
 	http.HandleFunc("/query", setups.Query)
 	http.HandleFunc("/invoke", setups.Invoke)
+	http.HandleFunc("/records/access", setups.AccessRecord)
+	http.HandleFunc("/prescriptions", setups.IssuePrescriptions)
+	http.HandleFunc("/prescriptions/update", setups.UpdatePrescription)
+	http.HandleFunc("/prescriptions/content", setups.PrescriptionContent)
+	http.HandleFunc("/prescriptions/proof", setups.PrescriptionProof)
+	http.HandleFunc("/prescriptions/qr", setups.PrescriptionQR)
+	http.HandleFunc("/prescriptions/pdf", setups.PrescriptionPDF)
+	http.HandleFunc("/verify", setups.Verify)
+	http.HandleFunc("/credentials/issue", setups.IssueCredential)
+	http.HandleFunc("/credentials/status", setups.CredentialStatus)
+	http.HandleFunc("/credentials/verify", setups.VerifyCredential)
+	http.HandleFunc("/reports/dhis2", setups.DHIS2Report)
+	if patientSetup != nil {
+		http.HandleFunc("/patient/record", patientSetup.patientQuery("GetMyRecord"))
+		http.HandleFunc("/patient/prescriptions/active", patientSetup.patientQuery("GetMyActivePrescriptions"))
+		http.HandleFunc("/patient/dispenses", patientSetup.patientQuery("GetMyDispenseHistory"))
+		http.HandleFunc("/patient/accesslog", patientSetup.patientQuery("GetMyAccessLog"))
+		http.HandleFunc("/patient/consents", patientSetup.PatientConsents)
+		http.HandleFunc("/patient/consents/revoke", patientSetup.PatientRevokeConsent)
+	}
+	if forecaster != nil {
+		http.HandleFunc("/forecast/alerts", forecaster.AlertsHandler)
+	}
+	if fhirServer != nil {
+		http.Handle("/fhir/", fhirServer)
+	}
 	fmt.Println("Listening (http://localhost:45000/)...")
 	if err := http.ListenAndServe(":45000", nil); err != nil {
 		fmt.Println(err)
@@ -0,0 +1,417 @@
+package web
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// credentialType is the type a prescription carries in addition to VerifiableCredential.
+const credentialType = "PrescriptionCredential"
+
+// credentialStatusType identifies the status check served by /credentials/status.
+const credentialStatusType = "UmodziRxLedgerStatus"
+
+// jwk is an EC public key in JSON Web Key form, as embedded in a did:jwk identifier.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtHeader is the protected header of a JWT-VC.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// credentialClaims are the JWT claims of a prescription credential, following the JWT encoding of the
+// W3C Verifiable Credentials data model.
+type credentialClaims struct {
+	Issuer    string               `json:"iss"`
+	Subject   string               `json:"sub"`
+	ID        string               `json:"jti"`
+	IssuedAt  int64                `json:"iat"`
+	NotBefore int64                `json:"nbf"`
+	Expires   int64                `json:"exp,omitempty"`
+	VC        verifiableCredential `json:"vc"`
+}
+
+// verifiableCredential is the "vc" claim of a prescription credential.
+type verifiableCredential struct {
+	Context           []string          `json:"@context"`
+	Type              []string          `json:"type"`
+	Issuer            string            `json:"issuer"`
+	IssuanceDate      string            `json:"issuanceDate"`
+	ExpirationDate    string            `json:"expirationDate,omitempty"`
+	CredentialSubject credentialSubject `json:"credentialSubject"`
+	CredentialStatus  credentialStatus  `json:"credentialStatus"`
+}
+
+// credentialSubject holds the prescription's canonical content as signed by the prescriber, and the hashes
+// used to look up its ledger status. The subject is identified by the keyed patient hash, so the credential
+// does not disclose the patient ID.
+type credentialSubject struct {
+	ID             string          `json:"id"`
+	PrescriptionID string          `json:"prescriptionId"`
+	PatientHash    string          `json:"patientHash"`
+	ContentHash    string          `json:"contentHash"`
+	Prescription   json.RawMessage `json:"prescription"`
+}
+
+// credentialStatus points a verifier at the ledger status check for the credential.
+type credentialStatus struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// credentialVerification is the result returned by the /credentials/verify endpoint.
+type credentialVerification struct {
+	Valid         bool               `json:"valid"`
+	Reason        string             `json:"reason,omitempty"`
+	Issuer        string             `json:"issuer,omitempty"`
+	TrustedIssuer bool               `json:"trustedIssuer"`
+	Revoked       bool               `json:"revoked"`
+	ExpiresAt     string             `json:"expiresAt,omitempty"`
+	Subject       *credentialSubject `json:"credentialSubject,omitempty"`
+	Status        *verification      `json:"status,omitempty"`
+}
+
+// IssueCredential handles credential issuance requests. It returns the prescription as a JWT-VC signed with
+// ES256 by this server's key, for import into a patient's digital wallet. The issuer is a did:jwk identifier
+// derived from the server's certificate, so a verifier needs no registry to check the signature.
+func (setup *OrgSetup) IssueCredential(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received IssueCredential request")
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	patientID := queryParams.Get("patientId")
+	prescriptionID := queryParams.Get("prescriptionId")
+	if patientID == "" || prescriptionID == "" {
+		http.Error(w, "patientId and prescriptionId are required", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, prescription: %s\n", channelID, chainCodeName, patientID, prescriptionID)
+
+	contract := setup.Gateway.GetNetwork(channelID).GetContract(chainCodeName)
+	proofJSON, err := contract.EvaluateTransaction("GetPrescriptionProof", patientID, prescriptionID)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	var proof prescriptionProof
+	if err := json.Unmarshal(proofJSON, &proof); err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+
+	credential, err := setup.issueCredential(channelID, chainCodeName, &proof, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwt")
+	fmt.Fprint(w, credential)
+}
+
+// CredentialStatus handles status checks for issued credentials. A credential is revoked once its prescription
+// is no longer active on the ledger, or when its content has since been changed.
+func (setup *OrgSetup) CredentialStatus(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received CredentialStatus request")
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	prescriptionID := queryParams.Get("prescriptionId")
+	patientHash := queryParams.Get("ph")
+	contentHash := queryParams.Get("ch")
+	if prescriptionID == "" || patientHash == "" || contentHash == "" {
+		http.Error(w, "prescriptionId, ph and ch are required", http.StatusBadRequest)
+		return
+	}
+
+	status := setup.prescriptionStatus(channelID, chainCodeName, prescriptionID, patientHash, contentHash)
+	response, err := json.Marshal(struct {
+		Revoked bool          `json:"revoked"`
+		Status  *verification `json:"status"`
+	}{credentialRevoked(status), status})
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", response)
+}
+
+// VerifyCredential handles credential verification requests. It checks the JWT-VC signature against the key in
+// the issuer's did:jwk, its validity period, that it was issued by this server, and its ledger status.
+func (setup *OrgSetup) VerifyCredential(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received VerifyCredential request")
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	chainCodeName := r.FormValue("chaincodeid")
+	channelID := r.FormValue("channelid")
+	credential := r.FormValue("credential")
+	if credential == "" {
+		http.Error(w, "credential is required", http.StatusBadRequest)
+		return
+	}
+
+	result := setup.verifyCredential(credential, time.Now(), func(subject *credentialSubject) *verification {
+		return setup.prescriptionStatus(channelID, chainCodeName, subject.PrescriptionID, subject.PatientHash, subject.ContentHash)
+	})
+	response, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", response)
+}
+
+// issueCredential builds and signs the JWT-VC for a prescription proof.
+func (setup *OrgSetup) issueCredential(channelID string, chainCodeName string, proof *prescriptionProof, now time.Time) (string, error) {
+	issuer, err := setup.issuerDID()
+	if err != nil {
+		return "", err
+	}
+	var content struct {
+		ExpiryDate string `json:"expiryDate"`
+	}
+	if err := json.Unmarshal([]byte(proof.Content), &content); err != nil {
+		return "", fmt.Errorf("failed to read prescription content: %w", err)
+	}
+
+	patientHash, err := setup.patientHash(proof.PatientId)
+	if err != nil {
+		return "", err
+	}
+	subject := credentialSubject{
+		ID:             "urn:umodzirx:patient:" + patientHash,
+		PrescriptionID: proof.PrescriptionId,
+		PatientHash:    patientHash,
+		ContentHash:    proof.ContentHash,
+		Prescription:   json.RawMessage(proof.Content),
+	}
+	statusURL := setup.PublicURL + "/credentials/status?" + url.Values{
+		"channelid":      {channelID},
+		"chaincodeid":    {chainCodeName},
+		"prescriptionId": {subject.PrescriptionID},
+		"ph":             {subject.PatientHash},
+		"ch":             {subject.ContentHash},
+	}.Encode()
+
+	claims := credentialClaims{
+		Issuer:    issuer,
+		Subject:   subject.ID,
+		ID:        "urn:umodzirx:prescription:" + proof.PrescriptionId + ":" + proof.ContentHash,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		VC: verifiableCredential{
+			Context:           []string{"https://www.w3.org/2018/credentials/v1"},
+			Type:              []string{"VerifiableCredential", credentialType},
+			Issuer:            issuer,
+			IssuanceDate:      now.Format(time.RFC3339),
+			CredentialSubject: subject,
+			CredentialStatus:  credentialStatus{ID: statusURL, Type: credentialStatusType},
+		},
+	}
+	// The credential lapses with the prescription, at the end of its expiry date
+	if expiry, err := time.Parse("2006-01-02", content.ExpiryDate); err == nil {
+		expiresAt := expiry.AddDate(0, 0, 1)
+		claims.Expires = expiresAt.Unix()
+		claims.VC.ExpirationDate = expiresAt.Format(time.RFC3339)
+	}
+
+	header, err := json.Marshal(jwtHeader{Alg: "ES256", Typ: "JWT", Kid: issuer + "#0"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := setup.signES256(signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyCredential checks a JWT-VC and looks up its prescription's ledger status with the status function.
+func (setup *OrgSetup) verifyCredential(credential string, now time.Time, status func(subject *credentialSubject) *verification) *credentialVerification {
+	parts := strings.Split(strings.TrimSpace(credential), ".")
+	if len(parts) != 3 {
+		return &credentialVerification{Reason: "malformed credential"}
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return &credentialVerification{Reason: "malformed credential header: " + err.Error()}
+	}
+	var claims credentialClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return &credentialVerification{Reason: "malformed credential payload: " + err.Error()}
+	}
+
+	result := &credentialVerification{Issuer: claims.Issuer, Subject: &claims.VC.CredentialSubject}
+	if claims.Expires != 0 {
+		result.ExpiresAt = time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339)
+	}
+	if header.Alg != "ES256" {
+		result.Reason = fmt.Sprintf("unsupported algorithm %q", header.Alg)
+		return result
+	}
+	did, _, _ := strings.Cut(header.Kid, "#")
+	if did != claims.Issuer {
+		result.Reason = "key does not belong to the issuer"
+		return result
+	}
+	publicKey, err := resolveDIDJWK(did)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		result.Reason = "malformed credential signature"
+		return result
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		result.Reason = "credential signature is invalid"
+		return result
+	}
+
+	if issuer, err := setup.issuerDID(); err == nil && issuer == claims.Issuer {
+		result.TrustedIssuer = true
+	} else {
+		result.Reason = "credential was not issued by this server"
+		return result
+	}
+	if now.Unix() < claims.NotBefore {
+		result.Reason = "credential is not yet valid"
+		return result
+	}
+	if claims.Expires != 0 && now.Unix() >= claims.Expires {
+		result.Reason = "credential has expired"
+		return result
+	}
+
+	result.Status = status(&claims.VC.CredentialSubject)
+	if result.Status.Status == "" {
+		result.Reason = result.Status.Reason
+		return result
+	}
+	result.Revoked = credentialRevoked(result.Status)
+	if result.Revoked {
+		result.Reason = "credential has been revoked"
+		return result
+	}
+	result.Valid = true
+	return result
+}
+
+// credentialRevoked reports whether a prescription's ledger status invalidates credentials issued for it. Only an
+// active prescription with unchanged content keeps its credentials valid, so a dispensed prescription cannot be
+// presented again.
+func credentialRevoked(status *verification) bool {
+	return status.Status != "Active" || !status.ContentMatches
+}
+
+// issuerDID returns the did:jwk identifier of this server's certificate key.
+func (setup *OrgSetup) issuerDID() (string, error) {
+	if setup.Certificate == nil {
+		return "", fmt.Errorf("no certificate configured for %s", setup.OrgName)
+	}
+	publicKey, ok := setup.Certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return "", fmt.Errorf("certificate for %s does not hold a P-256 key", setup.OrgName)
+	}
+	ecdhKey, err := publicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	point := ecdhKey.Bytes() // 0x04 || X || Y
+	key, err := json.Marshal(jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "did:jwk:" + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// resolveDIDJWK returns the P-256 public key embedded in a did:jwk identifier.
+func resolveDIDJWK(did string) (*ecdsa.PublicKey, error) {
+	encoded, found := strings.CutPrefix(did, "did:jwk:")
+	if !found {
+		return nil, fmt.Errorf("unsupported issuer %q", did)
+	}
+	var key jwk
+	if err := decodeSegment(encoded, &key); err != nil {
+		return nil, fmt.Errorf("malformed issuer key: %w", err)
+	}
+	if key.Kty != "EC" || key.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported issuer key type %s %s", key.Kty, key.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil || len(x) != 32 {
+		return nil, fmt.Errorf("malformed issuer key")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil || len(y) != 32 {
+		return nil, fmt.Errorf("malformed issuer key")
+	}
+	// Reject points that are not on the curve before using the key
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, fmt.Errorf("malformed issuer key: %w", err)
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// signES256 signs the JWS signing input and returns the signature in the fixed-length R || S form JWS requires,
+// converting from the ASN.1 form produced by the Fabric signer.
+func (setup *OrgSetup) signES256(signingInput string) ([]byte, error) {
+	if setup.Sign == nil {
+		return nil, fmt.Errorf("no signing key configured for %s", setup.OrgName)
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	der, err := setup.Sign(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	var signature struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &signature); err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	raw := make([]byte, 64)
+	signature.R.FillBytes(raw[:32])
+	signature.S.FillBytes(raw[32:])
+	return raw, nil
+}
+
+// decodeSegment decodes a base64url JSON segment into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
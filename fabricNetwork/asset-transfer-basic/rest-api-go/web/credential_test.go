@@ -0,0 +1,106 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCredential(t *testing.T) {
+	setup := testSetup(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	proof := &prescriptionProof{
+		PrescriptionId: "RX1",
+		PatientId:      "P1",
+		Content:        `{"prescriptionId":"RX1","expiryDate":"2024-05-31"}`,
+		ContentHash:    "abc",
+	}
+	credential, err := setup.issueCredential("mychannel", "basic", proof, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patientHash, err := setup.patientHash("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		credential  string
+		at          time.Time
+		status      verification
+		wantValid   bool
+		wantRevoked bool
+		wantReason  string
+	}{
+		{name: "active", credential: credential, at: now, status: verification{Status: "Active", ContentMatches: true}, wantValid: true},
+		{name: "dispensed", credential: credential, at: now, status: verification{Status: "Dispensed", ContentMatches: true}, wantRevoked: true, wantReason: "revoked"},
+		{name: "revoked", credential: credential, at: now, status: verification{Status: "Revoked", ContentMatches: true}, wantRevoked: true, wantReason: "revoked"},
+		{name: "changed", credential: credential, at: now, status: verification{Status: "Active"}, wantRevoked: true, wantReason: "revoked"},
+		{name: "not on the ledger", credential: credential, at: now, status: verification{Reason: "prescription not found"}, wantReason: "prescription not found"},
+		{name: "after the expiry date", credential: credential, at: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), wantReason: "credential has expired"},
+		{name: "tampered", credential: tamperCredential(t, credential), at: now, wantReason: "signature is invalid"},
+		{name: "malformed", credential: "not a credential", at: now, wantReason: "malformed credential"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := setup.verifyCredential(tt.credential, tt.at, func(subject *credentialSubject) *verification {
+				if subject.PrescriptionID != "RX1" || subject.PatientHash != patientHash || subject.ContentHash != "abc" {
+					t.Fatalf("status looked up for subject %+v", subject)
+				}
+				status := tt.status
+				return &status
+			})
+			if result.Valid != tt.wantValid || result.Revoked != tt.wantRevoked {
+				t.Fatalf("verifyCredential() = %+v, want valid %v, revoked %v", result, tt.wantValid, tt.wantRevoked)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Fatalf("verifyCredential() reason = %q, want %q", result.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestCredentialSubjectHidesPatientID(t *testing.T) {
+	setup := testSetup(t)
+	proof := &prescriptionProof{PrescriptionId: "RX1", PatientId: "P-12345", Content: `{"prescriptionId":"RX1"}`, ContentHash: "abc"}
+	credential, err := setup.issueCredential("mychannel", "basic", proof, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := strings.Cut(credential, ".")
+	payload, _, _ = strings.Cut(payload, ".")
+	var claims credentialClaims
+	if err := decodeSegment(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	patientHash, err := setup.patientHash("P-12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "urn:umodzirx:patient:"+patientHash || claims.VC.CredentialSubject.ID != claims.Subject {
+		t.Fatalf("credential subject = %q, want the patient hash", claims.Subject)
+	}
+	if strings.Contains(claims.Subject, "P-12345") {
+		t.Fatal("credential subject should not contain the patient ID")
+	}
+}
+
+// tamperCredential swaps the credential's payload for one naming another prescription, keeping the signature.
+func tamperCredential(t *testing.T, credential string) string {
+	t.Helper()
+	parts := strings.Split(credential, ".")
+	var claims credentialClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims.VC.CredentialSubject.PrescriptionID = "RX2"
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
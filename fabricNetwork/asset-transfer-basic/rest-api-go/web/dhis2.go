@@ -0,0 +1,98 @@
+package web
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"rest-api-go/dhis2"
+	"time"
+)
+
+// dhis2DryRun is the result of validating a report against the DHIS2 mapping without exporting it.
+type dhis2DryRun struct {
+	Period     string                     `json:"period"`
+	StartDate  string                     `json:"startDate"`
+	EndDate    string                     `json:"endDate"`
+	Valid      bool                       `json:"valid"`
+	Facilities int                        `json:"facilities"`
+	DataValues int                        `json:"dataValues"`
+	Issues     []dhis2.Issue              `json:"issues"`
+	Indicators []dhis2.FacilityIndicators `json:"indicators"`
+}
+
+// DHIS2Report handles requests for a period's facility indicators as a DHIS2 import, in dataValueSets JSON
+// (format=json, the default) or ADX XML (format=adx). The report is only exported when every facility and
+// indicator maps to a DHIS2 identifier; dryRun=true returns the validation result and the computed indicators
+// instead.
+func (setup *OrgSetup) DHIS2Report(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received DHIS2Report request")
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	format := queryParams.Get("format")
+	dryRun := queryParams.Get("dryRun") == "true"
+	if setup.DHIS2Mapping == nil {
+		http.Error(w, "no DHIS2 mapping is configured", http.StatusServiceUnavailable)
+		return
+	}
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "adx" {
+		http.Error(w, "format must be json or adx", http.StatusBadRequest)
+		return
+	}
+	period, err := dhis2.ParsePeriod(queryParams.Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("channel: %s, chaincode: %s, period: %s, format: %s, dry run: %t\n", channelID, chainCodeName, period.ID, format, dryRun)
+
+	contract := setup.Gateway.GetNetwork(channelID).GetContract(chainCodeName)
+	indicatorsJSON, err := contract.EvaluateTransaction("GetFacilityIndicators", period.StartDate(), period.EndDate())
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	var facilities []dhis2.FacilityIndicators
+	if err := json.Unmarshal(indicatorsJSON, &facilities); err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+
+	mapping := setup.DHIS2Mapping
+	issues := mapping.Validate(facilities)
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dhis2DryRun{
+			Period:     period.ID,
+			StartDate:  period.StartDate(),
+			EndDate:    period.EndDate(),
+			Valid:      len(issues) == 0,
+			Facilities: len(facilities),
+			DataValues: len(mapping.DataValueSet(period, facilities).DataValues),
+			Issues:     issues,
+			Indicators: facilities,
+		})
+		return
+	}
+	if len(issues) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "the report does not match the DHIS2 mapping", "issues": issues})
+		return
+	}
+
+	if format == "adx" {
+		w.Header().Set("Content-Type", "application/adx+xml")
+		fmt.Fprint(w, xml.Header)
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		encoder.Encode(mapping.ADX(period, facilities, time.Now()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mapping.DataValueSet(period, facilities))
+}
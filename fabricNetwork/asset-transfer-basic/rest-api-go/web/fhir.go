@@ -0,0 +1,482 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"rest-api-go/fhir"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/status"
+)
+
+// fhirContentType is the media type of FHIR JSON responses.
+const fhirContentType = "application/fhir+json"
+
+// defaultPurposeOfUse is recorded in the access log for FHIR reads that do not send X-Purpose-Of-Use.
+const defaultPurposeOfUse = "FHIR API"
+
+// FHIRServer serves FHIR R4 Patient, MedicationRequest and MedicationDispense resources from one channel and
+// chaincode. Resource IDs are ledger IDs: the patient ID for a Patient, and the prescription ID for both the
+// MedicationRequest and the MedicationDispense of a prescription.
+type FHIRServer struct {
+	setup       *OrgSetup
+	channelID   string
+	chaincodeID string
+}
+
+// NewFHIRServer returns a FHIR server using the organization's gateway.
+func NewFHIRServer(setup *OrgSetup, channelID string, chaincodeID string) *FHIRServer {
+	return &FHIRServer{setup: setup, channelID: channelID, chaincodeID: chaincodeID}
+}
+
+// ServeHTTP routes /fhir/[type][/id] requests.
+func (server *FHIRServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Received FHIR request: %s %s\n", r.Method, r.URL.Path)
+	resourceType, id, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/fhir"), "/"), "/")
+
+	switch {
+	case resourceType == "metadata" && r.Method == http.MethodGet:
+		server.capabilities(w)
+	case id != "" && r.Method == http.MethodGet:
+		server.read(w, r, resourceType, id)
+	case id == "" && r.Method == http.MethodGet:
+		server.search(w, r, resourceType)
+	case id == "" && r.Method == http.MethodPost:
+		server.create(w, r, resourceType)
+	default:
+		writeOutcome(w, http.StatusMethodNotAllowed, "not-supported", fmt.Sprintf("%s %s is not supported", r.Method, r.URL.Path))
+	}
+}
+
+// read handles GET [type]/[id].
+func (server *FHIRServer) read(w http.ResponseWriter, r *http.Request, resourceType string, id string) {
+	contract := server.contract()
+	purpose := purposeOfUse(r)
+
+	var resource interface{}
+	switch resourceType {
+	case "Patient":
+		record, err := accessPatientRecord(contract, id, purpose)
+		if err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		resource = patientResource(record)
+	case "MedicationRequest", "MedicationDispense":
+		record, err := readPrescription(contract.SubmitTransaction, id, purpose)
+		if err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		prescription := &record.Prescriptions[0]
+		if resourceType == "MedicationRequest" {
+			resource = medicationRequestResource(record, prescription, time.Now())
+		} else if prescription.DispensingTimestamp != "" {
+			resource = medicationDispenseResource(record, prescription)
+		} else {
+			writeOutcome(w, http.StatusNotFound, "not-found", fmt.Sprintf("prescription %s has not been dispensed", id))
+			return
+		}
+	default:
+		writeOutcome(w, http.StatusNotFound, "not-supported", fmt.Sprintf("resource type %s is not supported", resourceType))
+		return
+	}
+	writeFHIR(w, http.StatusOK, resource)
+}
+
+// search handles GET [type]?params. Prescription searches are per patient, since the ledger is keyed by patient.
+func (server *FHIRServer) search(w http.ResponseWriter, r *http.Request, resourceType string) {
+	params := r.URL.Query()
+	contract := server.contract()
+	purpose := purposeOfUse(r)
+	selfURL := server.setup.PublicURL + r.URL.RequestURI()
+	var entries []fhir.BundleEntry
+
+	switch resourceType {
+	case "Patient":
+		for name := range params {
+			if name != "identifier" && name != "_id" {
+				writeOutcome(w, http.StatusBadRequest, "not-supported", fmt.Sprintf("search parameter %s is not supported", name))
+				return
+			}
+		}
+		patientID, ok := fhir.TokenValue(params.Get("identifier"), fhir.SystemPatient)
+		if params.Get("_id") != "" {
+			patientID, ok = params.Get("_id"), true
+		}
+		if !ok {
+			writeOutcome(w, http.StatusBadRequest, "required", "identifier or _id is required")
+			return
+		}
+		record, err := accessPatientRecord(contract, patientID, purpose)
+		if err != nil && !isNotFound(err) {
+			writeChaincodeError(w, err)
+			return
+		}
+		if err == nil {
+			entries = append(entries, server.entry("Patient", record.PatientId, patientResource(record)))
+		}
+
+	case "MedicationRequest", "MedicationDispense":
+		dateParam := "authoredon"
+		if resourceType == "MedicationDispense" {
+			dateParam = "whenhandedover"
+		}
+		for name := range params {
+			if name != "patient" && name != "subject" && name != "status" && name != dateParam && name != "prescription" {
+				writeOutcome(w, http.StatusBadRequest, "not-supported", fmt.Sprintf("search parameter %s is not supported", name))
+				return
+			}
+		}
+		patient := params.Get("patient")
+		if patient == "" {
+			patient = params.Get("subject")
+		}
+		patientID, ok := fhir.ReferenceID(patient, "Patient")
+		if !ok {
+			writeOutcome(w, http.StatusBadRequest, "required", "patient is required")
+			return
+		}
+		dates, err := fhir.ParseDateParams(params[dateParam])
+		if err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		var statuses []string
+		if value := params.Get("status"); value != "" {
+			statuses = strings.Split(value, ",")
+		}
+		prescriptionID := ""
+		if value := params.Get("prescription"); value != "" {
+			if prescriptionID, ok = fhir.ReferenceID(value, "MedicationRequest"); !ok {
+				writeOutcome(w, http.StatusBadRequest, "invalid", "prescription must reference a MedicationRequest")
+				return
+			}
+		}
+
+		record, err := accessPatientRecord(contract, patientID, purpose)
+		if err != nil && !isNotFound(err) {
+			writeChaincodeError(w, err)
+			return
+		}
+		if record != nil {
+			entries = server.prescriptionEntries(resourceType, record, prescriptionID, statuses, dates)
+		}
+
+	default:
+		writeOutcome(w, http.StatusNotFound, "not-supported", fmt.Sprintf("resource type %s is not supported", resourceType))
+		return
+	}
+	writeFHIR(w, http.StatusOK, fhir.NewSearchSet(selfURL, entries))
+}
+
+// create handles POST [type]. New MedicationRequests must carry the prescriber's signature, as prescriptions
+// issued through /prescriptions do.
+func (server *FHIRServer) create(w http.ResponseWriter, r *http.Request, resourceType string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	contract := server.contract()
+
+	switch resourceType {
+	case "Patient":
+		var patient fhir.Patient
+		if err := json.Unmarshal(body, &patient); err != nil || patient.ResourceType != "Patient" {
+			writeOutcome(w, http.StatusBadRequest, "invalid", "body must be a Patient resource")
+			return
+		}
+		record, err := recordFromPatient(&patient)
+		if err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			writeOutcome(w, http.StatusInternalServerError, "exception", err.Error())
+			return
+		}
+		if _, err := contract.SubmitTransaction("CreatePatient", string(recordJSON)); err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		server.created(w, "Patient", record.PatientId, patientResource(record))
+
+	case "MedicationRequest":
+		var request fhir.MedicationRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", "body must be a MedicationRequest resource")
+			return
+		}
+		patientID, prescriberID, prescription, err := prescriptionFromRequest(&request)
+		if err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		prescriptionsJSON, err := json.Marshal([]interface{}{prescription})
+		if err != nil {
+			writeOutcome(w, http.StatusInternalServerError, "exception", err.Error())
+			return
+		}
+		if _, err := contract.SubmitTransaction("AddPrescriptions", patientID, prescriberID, string(prescriptionsJSON)); err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		prescriptionID := prescription["PrescriptionId"].(string)
+		record, err := readPrescription(contract.EvaluateTransaction, prescriptionID, defaultPurposeOfUse)
+		if err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		server.created(w, resourceType, prescriptionID, medicationRequestResource(record, &record.Prescriptions[0], time.Now()))
+
+	case "MedicationDispense":
+		var dispense fhir.MedicationDispense
+		if err := json.Unmarshal(body, &dispense); err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", "body must be a MedicationDispense resource")
+			return
+		}
+		_, dispensation, err := dispensationFromDispense(&dispense)
+		if err != nil {
+			writeOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		dispensationJSON, err := json.Marshal(dispensation)
+		if err != nil {
+			writeOutcome(w, http.StatusInternalServerError, "exception", err.Error())
+			return
+		}
+		if _, err := contract.SubmitTransaction("DispensePrescription", string(dispensationJSON)); err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		prescriptionID := dispensation["prescriptionId"].(string)
+		record, err := readPrescription(contract.EvaluateTransaction, prescriptionID, defaultPurposeOfUse)
+		if err != nil {
+			writeChaincodeError(w, err)
+			return
+		}
+		server.created(w, resourceType, prescriptionID, medicationDispenseResource(record, &record.Prescriptions[0]))
+
+	default:
+		writeOutcome(w, http.StatusNotFound, "not-supported", fmt.Sprintf("resource type %s is not supported", resourceType))
+	}
+}
+
+// prescriptionEntries returns the patient's MedicationRequests or MedicationDispenses matching the search.
+func (server *FHIRServer) prescriptionEntries(resourceType string, record *patientRecord, prescriptionID string, statuses []string, dates []fhir.DateParam) []fhir.BundleEntry {
+	var entries []fhir.BundleEntry
+	now := time.Now()
+	for i := range record.Prescriptions {
+		prescription := &record.Prescriptions[i]
+		if prescriptionID != "" && prescription.PrescriptionId != prescriptionID {
+			continue
+		}
+		if resourceType == "MedicationRequest" {
+			request := medicationRequestResource(record, prescription, now)
+			if matchStatus(statuses, request.Status) && fhir.MatchDates(dates, prescription.Timestamp) {
+				entries = append(entries, server.entry(resourceType, request.ID, request))
+			}
+		} else if prescription.DispensingTimestamp != "" {
+			dispense := medicationDispenseResource(record, prescription)
+			if matchStatus(statuses, dispense.Status) && fhir.MatchDates(dates, prescription.DispensingTimestamp) {
+				entries = append(entries, server.entry(resourceType, dispense.ID, dispense))
+			}
+		}
+	}
+	return entries
+}
+
+// capabilities handles GET metadata with a CapabilityStatement describing the supported interactions.
+func (server *FHIRServer) capabilities(w http.ResponseWriter) {
+	interactions := []map[string]string{{"code": "read"}, {"code": "search-type"}, {"code": "create"}}
+	searchParams := func(names ...string) []map[string]string {
+		var params []map[string]string
+		for _, name := range names {
+			kind := "token"
+			switch name {
+			case "patient", "subject", "prescription":
+				kind = "reference"
+			case "authoredon", "whenhandedover":
+				kind = "date"
+			}
+			params = append(params, map[string]string{"name": name, "type": kind})
+		}
+		return params
+	}
+	writeFHIR(w, http.StatusOK, map[string]interface{}{
+		"resourceType": "CapabilityStatement",
+		"status":       "active",
+		"kind":         "instance",
+		"fhirVersion":  "4.0.1",
+		"format":       []string{"json"},
+		"rest": []map[string]interface{}{{
+			"mode": "server",
+			"resource": []map[string]interface{}{
+				{"type": "Patient", "interaction": interactions, "searchParam": searchParams("_id", "identifier")},
+				{"type": "MedicationRequest", "interaction": interactions, "searchParam": searchParams("patient", "subject", "status", "authoredon")},
+				{"type": "MedicationDispense", "interaction": interactions, "searchParam": searchParams("patient", "subject", "status", "whenhandedover", "prescription")},
+			},
+		}},
+	})
+}
+
+// contract returns the chaincode the FHIR server reads and writes.
+func (server *FHIRServer) contract() *client.Contract {
+	return server.setup.Gateway.GetNetwork(server.channelID).GetContract(server.chaincodeID)
+}
+
+// entry returns a Bundle entry for a resource.
+func (server *FHIRServer) entry(resourceType string, id string, resource interface{}) fhir.BundleEntry {
+	return fhir.BundleEntry{FullURL: server.setup.PublicURL + "/fhir/" + resourceType + "/" + id, Resource: resource}
+}
+
+// created writes a 201 response with the new resource and its location.
+func (server *FHIRServer) created(w http.ResponseWriter, resourceType string, id string, resource interface{}) {
+	w.Header().Set("Location", server.setup.PublicURL+"/fhir/"+resourceType+"/"+id)
+	writeFHIR(w, http.StatusCreated, resource)
+}
+
+// recordFromPatient maps a Patient being created to a patient record. The general practitioner becomes the
+// record's doctor.
+func recordFromPatient(patient *fhir.Patient) (*patientRecord, error) {
+	record := &patientRecord{PatientId: patient.ID, DateOfBirth: patient.BirthDate}
+	for _, identifier := range patient.Identifier {
+		if identifier.System == fhir.SystemPatient {
+			record.PatientId = identifier.Value
+		}
+	}
+	if record.PatientId == "" {
+		return nil, fmt.Errorf("an identifier with system %s is required", fhir.SystemPatient)
+	}
+	if len(patient.Name) > 0 {
+		name := patient.Name[0]
+		record.PatientName = name.Text
+		if record.PatientName == "" {
+			record.PatientName = strings.Join(append(append([]string{}, name.Given...), name.Family), " ")
+		}
+	}
+	if len(patient.GeneralPractitioner) == 0 {
+		return nil, fmt.Errorf("generalPractitioner is required")
+	}
+	doctorID, ok := fhir.ReferenceID(patient.GeneralPractitioner[0].Reference, "Practitioner")
+	if !ok {
+		return nil, fmt.Errorf("generalPractitioner must reference a Practitioner")
+	}
+	record.DoctorId = doctorID
+	return record, nil
+}
+
+// accessPatientRecord reads a patient record through AccessPatientRecord, so the read is audited.
+func accessPatientRecord(contract *client.Contract, patientID string, purpose string) (*patientRecord, error) {
+	recordJSON, err := contract.SubmitTransaction("AccessPatientRecord", patientID, purpose)
+	if err != nil {
+		return nil, err
+	}
+	var record patientRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// readPrescription reads a single prescription with ReadPrescription, submitted when the read must be audited.
+func readPrescription(transact func(string, ...string) ([]byte, error), prescriptionID string, purpose string) (*patientRecord, error) {
+	recordJSON, err := transact("ReadPrescription", prescriptionID, purpose)
+	if err != nil {
+		return nil, err
+	}
+	var record patientRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	if len(record.Prescriptions) != 1 {
+		return nil, fmt.Errorf("prescription %s not found", prescriptionID)
+	}
+	return &record, nil
+}
+
+// purposeOfUse returns the access purpose sent by the client, for the patient's access log.
+func purposeOfUse(r *http.Request) string {
+	if purpose := strings.TrimSpace(r.Header.Get("X-Purpose-Of-Use")); purpose != "" {
+		return purpose
+	}
+	return defaultPurposeOfUse
+}
+
+// matchStatus reports whether a status is one of the requested statuses, or any status when none are given.
+func matchStatus(statuses []string, status string) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, wanted := range statuses {
+		if strings.TrimSpace(wanted) == status {
+			return true
+		}
+	}
+	return false
+}
+
+// chaincodeMessage returns the chaincode's error message from a gateway error, which carries it in the
+// error details rather than the error text.
+func chaincodeMessage(err error) string {
+	var messages []string
+	for _, detail := range status.Convert(err).Details() {
+		if errorDetail, ok := detail.(*gateway.ErrorDetail); ok {
+			messages = append(messages, errorDetail.GetMessage())
+		}
+	}
+	if len(messages) == 0 {
+		return err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// isNotFound reports whether the chaincode rejected a request because a record does not exist.
+func isNotFound(err error) bool {
+	message := chaincodeMessage(err)
+	return strings.Contains(message, "does not exist") || strings.Contains(message, "not found")
+}
+
+// writeChaincodeError writes an OperationOutcome for a failed transaction, with the HTTP status that best
+// matches the chaincode's reason.
+func writeChaincodeError(w http.ResponseWriter, err error) {
+	message := chaincodeMessage(err)
+	var commitErr *client.CommitStatusError
+	switch {
+	case isNotFound(err):
+		writeOutcome(w, http.StatusNotFound, "not-found", message)
+	case strings.Contains(message, "consent denied") || strings.Contains(message, "only "):
+		writeOutcome(w, http.StatusForbidden, "forbidden", message)
+	case strings.Contains(message, "already exists") || strings.Contains(message, "already in use"):
+		writeOutcome(w, http.StatusConflict, "duplicate", message)
+	case errors.As(err, &commitErr):
+		writeOutcome(w, http.StatusConflict, "conflict", message)
+	default:
+		writeOutcome(w, http.StatusUnprocessableEntity, "processing", message)
+	}
+}
+
+// writeOutcome writes an OperationOutcome error response.
+func writeOutcome(w http.ResponseWriter, statusCode int, code string, diagnostics string) {
+	writeFHIR(w, statusCode, fhir.NewOperationOutcome(code, diagnostics))
+}
+
+// writeFHIR writes a FHIR JSON response.
+func writeFHIR(w http.ResponseWriter, statusCode int, resource interface{}) {
+	body, err := json.Marshal(resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", fhirContentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,395 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"rest-api-go/fhir"
+	"strings"
+	"time"
+)
+
+// containedMedicationID is the local ID of the Medication contained in a MedicationDispense.
+const containedMedicationID = "med"
+
+// patientResource maps a patient record to a FHIR Patient.
+func patientResource(record *patientRecord) *fhir.Patient {
+	patient := &fhir.Patient{
+		ResourceType: "Patient",
+		ID:           record.PatientId,
+		Identifier:   []fhir.Identifier{{System: fhir.SystemPatient, Value: record.PatientId}},
+		BirthDate:    record.DateOfBirth,
+	}
+	if record.LastUpdated != "" {
+		patient.Meta = &fhir.Meta{LastUpdated: record.LastUpdated}
+	}
+	if record.PatientName != "" {
+		patient.Name = []fhir.HumanName{{Text: record.PatientName}}
+	}
+	if record.DoctorId != "" {
+		patient.GeneralPractitioner = []fhir.Reference{{Reference: "Practitioner/" + record.DoctorId}}
+	}
+	return patient
+}
+
+// medicationRequestStatus maps a ledger prescription status to a MedicationRequest status, with the ledger
+// status as the reason where the FHIR status alone loses it. Active prescriptions past their expiry date
+// are reported as stopped, as GetPrescriptionStatus reports them as Expired.
+func medicationRequestStatus(prescription *recordPrescription, now time.Time) (string, string) {
+	status := prescription.Status
+	if status == "Active" && prescription.ExpiryDate != "" {
+		if expiry, err := time.Parse("2006-01-02", prescription.ExpiryDate); err == nil && now.After(expiry.AddDate(0, 0, 1)) {
+			status = "Expired"
+		}
+	}
+	switch status {
+	case "Active":
+		return "active", ""
+	case "PendingApproval":
+		return "on-hold", "Pending approval"
+	case "Dispensed":
+		return "completed", ""
+	case "Rejected":
+		return "cancelled", "Rejected"
+	case "Revoked", "Expired":
+		return "stopped", status
+	default:
+		return "unknown", status
+	}
+}
+
+// medicationRequestResource maps a prescription to a FHIR MedicationRequest.
+func medicationRequestResource(record *patientRecord, prescription *recordPrescription, now time.Time) *fhir.MedicationRequest {
+	status, reason := medicationRequestStatus(prescription, now)
+	request := &fhir.MedicationRequest{
+		ResourceType:              "MedicationRequest",
+		ID:                        prescription.PrescriptionId,
+		Identifier:                []fhir.Identifier{{System: fhir.SystemPrescription, Value: prescription.PrescriptionId}},
+		Status:                    status,
+		Intent:                    "order",
+		MedicationCodeableConcept: medicationConcept(prescription.MedicationCode, prescription.MedicationName, prescription.Strength, prescription.DosageForm),
+		Subject:                   fhir.Reference{Reference: "Patient/" + record.PatientId, Display: record.PatientName},
+		AuthoredOn:                prescription.Timestamp,
+		Requester:                 &fhir.Reference{Reference: "Practitioner/" + prescription.CreatedBy},
+	}
+	if prescription.Timestamp != "" {
+		request.Meta = &fhir.Meta{LastUpdated: prescription.Timestamp}
+	}
+	if reason != "" {
+		request.StatusReason = &fhir.CodeableConcept{Text: reason}
+	}
+	if prescription.EncounterId != "" {
+		request.Encounter = &fhir.Reference{Reference: "Encounter/" + prescription.EncounterId}
+	}
+	for _, code := range prescription.DiagnosisCodes {
+		request.ReasonCode = append(request.ReasonCode, fhir.CodeableConcept{Coding: []fhir.Coding{{System: fhir.SystemICD10, Code: code}}})
+	}
+
+	dosage := fhir.Dosage{Text: prescription.Dosage, PatientInstruction: prescription.Instructions}
+	if prescription.DosesPerDay > 0 {
+		dosage.Timing = &fhir.Timing{Repeat: &fhir.TimingRepeat{Frequency: prescription.DosesPerDay, Period: 1, PeriodUnit: "d"}}
+	}
+	if prescription.DoseAmount > 0 {
+		dosage.DoseAndRate = []fhir.DoseAndRate{{DoseQuantity: &fhir.Quantity{Value: prescription.DoseAmount, Unit: prescription.DoseUnit}}}
+	}
+	request.DosageInstruction = []fhir.Dosage{dosage}
+
+	request.DispenseRequest = &fhir.DispenseRequest{NumberOfRepeatsAllowed: prescription.Refills}
+	if prescription.ExpiryDate != "" {
+		request.DispenseRequest.ValidityPeriod = &fhir.Period{End: prescription.ExpiryDate}
+	}
+	if prescription.Quantity > 0 {
+		request.DispenseRequest.Quantity = &fhir.Quantity{Value: float64(prescription.Quantity)}
+	}
+	return request
+}
+
+// medicationDispenseResource maps a dispensed prescription to a FHIR MedicationDispense with the same ID. The
+// product and batch actually supplied are carried in a contained Medication.
+func medicationDispenseResource(record *patientRecord, prescription *recordPrescription) *fhir.MedicationDispense {
+	code, name, strength := prescription.MedicationCode, prescription.MedicationName, prescription.Strength
+	if prescription.DispensedCode != "" {
+		code, name, strength = prescription.DispensedCode, prescription.DispensedName, prescription.DispensedStrength
+	}
+	medication := fhir.Medication{
+		ResourceType: "Medication",
+		ID:           containedMedicationID,
+		Code:         medicationConcept(code, name, strength, prescription.DosageForm),
+	}
+	if prescription.BatchManufacturer != "" {
+		medication.Manufacturer = &fhir.Reference{Display: prescription.BatchManufacturer}
+	}
+	if prescription.DispensedBatch != "" {
+		medication.Batch = &fhir.Batch{LotNumber: prescription.DispensedBatch, ExpirationDate: prescription.BatchExpiry}
+	}
+
+	dispense := &fhir.MedicationDispense{
+		ResourceType:            "MedicationDispense",
+		ID:                      prescription.PrescriptionId,
+		Contained:               []fhir.Medication{medication},
+		Status:                  "completed",
+		MedicationReference:     &fhir.Reference{Reference: "#" + containedMedicationID},
+		Subject:                 fhir.Reference{Reference: "Patient/" + record.PatientId, Display: record.PatientName},
+		AuthorizingPrescription: []fhir.Reference{{Reference: "MedicationRequest/" + prescription.PrescriptionId}},
+		WhenHandedOver:          prescription.DispensingTimestamp,
+		Substitution:            &fhir.Substitution{WasSubstituted: prescription.Substituted},
+	}
+	if prescription.DispensingPharmacist != "" {
+		dispense.Performer = []fhir.Performer{{Actor: fhir.Reference{Reference: "Practitioner/" + prescription.DispensingPharmacist}}}
+	}
+	if prescription.DispensingFacility != "" {
+		dispense.Location = &fhir.Reference{Reference: "Location/" + prescription.DispensingFacility}
+	}
+	if prescription.DispensedQuantity > 0 {
+		dispense.Quantity = &fhir.Quantity{Value: float64(prescription.DispensedQuantity)}
+	}
+	if prescription.SubstitutionReason != "" {
+		dispense.Substitution.Reason = []fhir.CodeableConcept{{Text: prescription.SubstitutionReason}}
+	}
+	return dispense
+}
+
+// medicationConcept codes a formulary product, with its name, strength and form as the text.
+func medicationConcept(code string, name string, strength string, form string) *fhir.CodeableConcept {
+	concept := &fhir.CodeableConcept{Text: strings.Join(strings.Fields(name+" "+strength+" "+form), " ")}
+	if code != "" {
+		concept.Coding = []fhir.Coding{{System: fhir.SystemFormulary, Code: code, Display: name}}
+	}
+	return concept
+}
+
+// formularyCode returns the formulary code from a medication concept. Codings without a system are taken to be
+// formulary codes.
+func formularyCode(concept *fhir.CodeableConcept) string {
+	if concept == nil {
+		return ""
+	}
+	for _, coding := range concept.Coding {
+		if coding.System == fhir.SystemFormulary || coding.System == "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+// prescriptionFromRequest maps a MedicationRequest being created to the patient ID, prescriber ID and
+// chaincode Prescription JSON fields.
+func prescriptionFromRequest(request *fhir.MedicationRequest) (string, string, map[string]interface{}, error) {
+	if request.ResourceType != "MedicationRequest" {
+		return "", "", nil, fmt.Errorf("resourceType must be MedicationRequest")
+	}
+	if request.Intent != "order" {
+		return "", "", nil, fmt.Errorf("intent must be order")
+	}
+	if request.Status != "" && request.Status != "active" {
+		return "", "", nil, fmt.Errorf("new prescriptions must have status active")
+	}
+	patientID, ok := fhir.ReferenceID(request.Subject.Reference, "Patient")
+	if !ok {
+		return "", "", nil, fmt.Errorf("subject must reference a Patient")
+	}
+	if request.Requester == nil {
+		return "", "", nil, fmt.Errorf("requester is required")
+	}
+	prescriberID, ok := fhir.ReferenceID(request.Requester.Reference, "Practitioner")
+	if !ok {
+		return "", "", nil, fmt.Errorf("requester must reference a Practitioner")
+	}
+	code := formularyCode(request.MedicationCodeableConcept)
+	if code == "" {
+		return "", "", nil, fmt.Errorf("medicationCodeableConcept must carry a %s code", fhir.SystemFormulary)
+	}
+
+	prescriptionID := ""
+	for _, identifier := range request.Identifier {
+		if identifier.System == fhir.SystemPrescription {
+			prescriptionID = identifier.Value
+		}
+	}
+	// The prescription ID is part of the signed content, so the prescriber's system assigns it
+	if prescriptionID == "" {
+		return "", "", nil, fmt.Errorf("identifier must carry a %s prescription ID", fhir.SystemPrescription)
+	}
+
+	prescription := map[string]interface{}{
+		"PrescriptionId": prescriptionID,
+		"MedicationCode": code,
+	}
+	if request.Encounter != nil {
+		if encounterID, ok := fhir.ReferenceID(request.Encounter.Reference, "Encounter"); ok {
+			prescription["EncounterId"] = encounterID
+		}
+	}
+	var diagnosisCodes []interface{}
+	for _, reason := range request.ReasonCode {
+		for _, coding := range reason.Coding {
+			if coding.System == fhir.SystemICD10 || coding.System == "" {
+				diagnosisCodes = append(diagnosisCodes, coding.Code)
+			}
+		}
+	}
+	if len(diagnosisCodes) > 0 {
+		prescription["DiagnosisCodes"] = diagnosisCodes
+	}
+
+	if len(request.DosageInstruction) > 1 {
+		return "", "", nil, fmt.Errorf("only one dosageInstruction is supported")
+	}
+	if len(request.DosageInstruction) == 1 {
+		dosage := request.DosageInstruction[0]
+		prescription["Dosage"] = dosage.Text
+		prescription["Instructions"] = dosage.PatientInstruction
+		if len(dosage.DoseAndRate) > 0 && dosage.DoseAndRate[0].DoseQuantity != nil {
+			prescription["DoseAmount"] = dosage.DoseAndRate[0].DoseQuantity.Value
+			prescription["DoseUnit"] = dosage.DoseAndRate[0].DoseQuantity.Unit
+		}
+		if dosage.Timing != nil && dosage.Timing.Repeat != nil {
+			dosesPerDay, err := dosesPerDay(dosage.Timing.Repeat)
+			if err != nil {
+				return "", "", nil, err
+			}
+			prescription["DosesPerDay"] = dosesPerDay
+		}
+	}
+
+	if dispense := request.DispenseRequest; dispense != nil {
+		if dispense.Quantity != nil {
+			if dispense.Quantity.Value != math.Trunc(dispense.Quantity.Value) || dispense.Quantity.Value < 0 {
+				return "", "", nil, fmt.Errorf("dispenseRequest.quantity must be a whole number")
+			}
+			prescription["Quantity"] = int(dispense.Quantity.Value)
+		}
+		prescription["Refills"] = dispense.NumberOfRepeatsAllowed
+		if dispense.ValidityPeriod != nil && len(dispense.ValidityPeriod.End) >= 10 {
+			prescription["ExpiryDate"] = dispense.ValidityPeriod.End[:10]
+		}
+	}
+
+	// The prescriber signs on their own device; the signature is passed to the chaincode unchanged
+	for _, extension := range request.Extension {
+		switch extension.URL {
+		case fhir.ExtensionSignature:
+			prescription["Signature"] = extension.ValueString
+		case fhir.ExtensionSignerCertificate:
+			prescription["SignerCertificate"] = extension.ValueString
+		}
+	}
+	signature, _ := prescription["Signature"].(string)
+	certificate, _ := prescription["SignerCertificate"].(string)
+	if signature == "" || certificate == "" {
+		return "", "", nil, fmt.Errorf("the %s and %s extensions are required", fhir.ExtensionSignature, fhir.ExtensionSignerCertificate)
+	}
+	return patientID, prescriberID, prescription, nil
+}
+
+// dosesPerDay converts a repeating timing to the number of doses per day the chaincode records.
+func dosesPerDay(repeat *fhir.TimingRepeat) (int, error) {
+	frequency := repeat.Frequency
+	if frequency == 0 {
+		frequency = 1
+	}
+	period := repeat.Period
+	if period == 0 {
+		period = 1
+	}
+	var perDay float64
+	switch repeat.PeriodUnit {
+	case "d":
+		perDay = float64(frequency) / period
+	case "h":
+		perDay = float64(frequency) * 24 / period
+	default:
+		return 0, fmt.Errorf("dosage timing must be given per day or per hour")
+	}
+	if perDay < 1 || perDay != math.Trunc(perDay) {
+		return 0, fmt.Errorf("dosage timing must come to a whole number of doses per day")
+	}
+	return int(perDay), nil
+}
+
+// dispensationFromDispense maps a MedicationDispense being created to the patient ID and the chaincode's
+// dispensation JSON fields.
+func dispensationFromDispense(dispense *fhir.MedicationDispense) (string, map[string]interface{}, error) {
+	if dispense.ResourceType != "MedicationDispense" {
+		return "", nil, fmt.Errorf("resourceType must be MedicationDispense")
+	}
+	if dispense.Status != "" && dispense.Status != "completed" {
+		return "", nil, fmt.Errorf("only completed dispenses can be recorded")
+	}
+	patientID, ok := fhir.ReferenceID(dispense.Subject.Reference, "Patient")
+	if !ok {
+		return "", nil, fmt.Errorf("subject must reference a Patient")
+	}
+	if len(dispense.AuthorizingPrescription) != 1 {
+		return "", nil, fmt.Errorf("exactly one authorizingPrescription is required")
+	}
+	prescriptionID, ok := fhir.ReferenceID(dispense.AuthorizingPrescription[0].Reference, "MedicationRequest")
+	if !ok {
+		return "", nil, fmt.Errorf("authorizingPrescription must reference a MedicationRequest")
+	}
+	if len(dispense.Performer) == 0 {
+		return "", nil, fmt.Errorf("performer is required")
+	}
+	pharmacistID, ok := fhir.ReferenceID(dispense.Performer[0].Actor.Reference, "Practitioner")
+	if !ok {
+		return "", nil, fmt.Errorf("performer must reference a Practitioner")
+	}
+
+	dispensation := map[string]interface{}{
+		"patientId":      patientID,
+		"prescriptionId": prescriptionID,
+		"pharmacistId":   pharmacistID,
+	}
+	if dispense.Quantity != nil {
+		if dispense.Quantity.Value != math.Trunc(dispense.Quantity.Value) || dispense.Quantity.Value <= 0 {
+			return "", nil, fmt.Errorf("quantity must be a positive whole number")
+		}
+		dispensation["quantity"] = int(dispense.Quantity.Value)
+	}
+	if len(dispense.Note) > 0 {
+		dispensation["note"] = dispense.Note[0].Text
+	}
+	if dispense.Substitution != nil && dispense.Substitution.WasSubstituted {
+		for _, reason := range dispense.Substitution.Reason {
+			text := reason.Text
+			if text == "" && len(reason.Coding) > 0 {
+				text = reason.Coding[0].Display
+			}
+			if text != "" {
+				dispensation["substitutionReason"] = text
+				break
+			}
+		}
+	}
+
+	// The product and batch come from a contained Medication, or just the product from a codeable concept
+	concept := dispense.MedicationCodeableConcept
+	if dispense.MedicationReference != nil {
+		localID, found := strings.CutPrefix(dispense.MedicationReference.Reference, "#")
+		if !found {
+			return "", nil, fmt.Errorf("medicationReference must refer to a contained Medication")
+		}
+		var medication *fhir.Medication
+		for i := range dispense.Contained {
+			if dispense.Contained[i].ID == localID {
+				medication = &dispense.Contained[i]
+			}
+		}
+		if medication == nil {
+			return "", nil, fmt.Errorf("contained Medication %s not found", localID)
+		}
+		concept = medication.Code
+		if medication.Batch != nil {
+			dispensation["batchNumber"] = medication.Batch.LotNumber
+			if len(medication.Batch.ExpirationDate) >= 10 {
+				dispensation["batchExpiry"] = medication.Batch.ExpirationDate[:10]
+			}
+		}
+		if medication.Manufacturer != nil {
+			dispensation["manufacturer"] = medication.Manufacturer.Display
+		}
+	}
+	if code := formularyCode(concept); code != "" {
+		dispensation["dispensedCode"] = code
+	}
+	return patientID, dispensation, nil
+}
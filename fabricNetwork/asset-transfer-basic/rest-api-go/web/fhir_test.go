@@ -0,0 +1,439 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"rest-api-go/fhir"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testRecord = &patientRecord{PatientId: "P1", PatientName: "Jane Banda", DoctorId: "DOC1"}
+
+// fhirRoundTrip marshals a resource and unmarshals it into another, as a client receiving it would.
+func fhirRoundTrip(t *testing.T, resource interface{}, into interface{}) {
+	t.Helper()
+	body, err := json.Marshal(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(body, into); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMedicationRequestStatus(t *testing.T) {
+	now := time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status     string
+		expiry     string
+		wantStatus string
+		wantReason string
+	}{
+		{status: "Active", wantStatus: "active"},
+		{status: "Active", expiry: "2024-06-02", wantStatus: "active"},
+		{status: "Active", expiry: "2024-06-03", wantStatus: "active"},
+		{status: "Active", expiry: "2024-06-01", wantStatus: "stopped", wantReason: "Expired"},
+		{status: "PendingApproval", wantStatus: "on-hold", wantReason: "Pending approval"},
+		{status: "Dispensed", expiry: "2024-05-31", wantStatus: "completed"},
+		{status: "Rejected", wantStatus: "cancelled", wantReason: "Rejected"},
+		{status: "Revoked", wantStatus: "stopped", wantReason: "Revoked"},
+		{status: "Expired", wantStatus: "stopped", wantReason: "Expired"},
+		{status: "Archived", wantStatus: "unknown", wantReason: "Archived"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status+" "+tt.expiry, func(t *testing.T) {
+			request := medicationRequestResource(testRecord, &recordPrescription{PrescriptionId: "RX1", Status: tt.status, ExpiryDate: tt.expiry}, now)
+			if request.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", request.Status, tt.wantStatus)
+			}
+			reason := ""
+			if request.StatusReason != nil {
+				reason = request.StatusReason.Text
+			}
+			if reason != tt.wantReason {
+				t.Errorf("statusReason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestMedicationRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		prescription recordPrescription
+	}{
+		{
+			name: "coded medication and diagnoses",
+			prescription: recordPrescription{
+				PrescriptionId: "RX1", MedicationCode: "AMOX500", MedicationName: "Amoxicillin", Strength: "500mg", DosageForm: "capsule",
+				EncounterId: "ENC1", DiagnosisCodes: []string{"J18.9", "R50.9"},
+				Dosage: "1 capsule three times a day", Instructions: "Take with food", DoseAmount: 500, DoseUnit: "mg", DosesPerDay: 3,
+				Quantity: 21, Refills: 1, ExpiryDate: "2024-06-01",
+			},
+		},
+		{
+			name: "single diagnosis",
+			prescription: recordPrescription{
+				PrescriptionId: "RX2", MedicationCode: "PCM", MedicationName: "Paracetamol", DiagnosisCodes: []string{"R50.9"},
+				Dosage: "2 tablets when needed", Quantity: 20, ExpiryDate: "2024-06-01",
+			},
+		},
+		{
+			name: "no diagnosis or encounter",
+			prescription: recordPrescription{
+				PrescriptionId: "RX3", MedicationCode: "ORS", MedicationName: "Oral rehydration salts", DosageForm: "sachet",
+				Dosage: "1 sachet after each loose stool", Quantity: 10,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prescription := tt.prescription
+			prescription.Status, prescription.CreatedBy, prescription.Timestamp = "Active", "DOC1", "2024-05-01T08:00:00Z"
+			request := medicationRequestResource(testRecord, &prescription, time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+
+			coding := request.MedicationCodeableConcept.Coding
+			if len(coding) != 1 || coding[0].System != fhir.SystemFormulary || coding[0].Code != prescription.MedicationCode {
+				t.Errorf("medicationCodeableConcept.coding = %+v, want %s|%s", coding, fhir.SystemFormulary, prescription.MedicationCode)
+			}
+			if len(request.ReasonCode) != len(prescription.DiagnosisCodes) {
+				t.Fatalf("got %d reasonCodes, want %d", len(request.ReasonCode), len(prescription.DiagnosisCodes))
+			}
+			for i, reason := range request.ReasonCode {
+				if want := (fhir.Coding{System: fhir.SystemICD10, Code: prescription.DiagnosisCodes[i]}); len(reason.Coding) != 1 || reason.Coding[0] != want {
+					t.Errorf("reasonCode[%d] = %+v, want %+v", i, reason.Coding, want)
+				}
+			}
+
+			// Post the resource back, signed, as a prescriber's system would
+			var posted fhir.MedicationRequest
+			fhirRoundTrip(t, request, &posted)
+			posted.ID, posted.Status = "", ""
+			posted.Extension = []fhir.Extension{{URL: fhir.ExtensionSignature, ValueString: "MEUCIQ"}, {URL: fhir.ExtensionSignerCertificate, ValueString: "-----BEGIN CERTIFICATE-----"}}
+			patientID, prescriberID, fields, err := prescriptionFromRequest(&posted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patientID != "P1" || prescriberID != "DOC1" {
+				t.Errorf("patient, prescriber = %q, %q, want P1, DOC1", patientID, prescriberID)
+			}
+
+			var got recordPrescription
+			fhirRoundTrip(t, fields, &got)
+			want := recordPrescription{
+				PrescriptionId: prescription.PrescriptionId, MedicationCode: prescription.MedicationCode, EncounterId: prescription.EncounterId,
+				DiagnosisCodes: prescription.DiagnosisCodes, Dosage: prescription.Dosage, Instructions: prescription.Instructions,
+				DoseAmount: prescription.DoseAmount, DoseUnit: prescription.DoseUnit, DosesPerDay: prescription.DosesPerDay,
+				Quantity: prescription.Quantity, Refills: prescription.Refills, ExpiryDate: prescription.ExpiryDate, Signature: "MEUCIQ",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("prescription = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPrescriptionFromRequestErrors(t *testing.T) {
+	valid := func() *fhir.MedicationRequest {
+		return &fhir.MedicationRequest{
+			ResourceType:              "MedicationRequest",
+			Identifier:                []fhir.Identifier{{System: fhir.SystemPrescription, Value: "RX1"}},
+			Intent:                    "order",
+			MedicationCodeableConcept: &fhir.CodeableConcept{Coding: []fhir.Coding{{System: fhir.SystemFormulary, Code: "AMOX500"}}},
+			Subject:                   fhir.Reference{Reference: "Patient/P1"},
+			Requester:                 &fhir.Reference{Reference: "Practitioner/DOC1"},
+			Extension:                 []fhir.Extension{{URL: fhir.ExtensionSignature, ValueString: "MEUCIQ"}, {URL: fhir.ExtensionSignerCertificate, ValueString: "PEM"}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(request *fhir.MedicationRequest)
+		wantErr string
+	}{
+		{name: "valid", change: func(request *fhir.MedicationRequest) {}},
+		{name: "plan intent", change: func(request *fhir.MedicationRequest) { request.Intent = "plan" }, wantErr: "intent must be order"},
+		{name: "stopped", change: func(request *fhir.MedicationRequest) { request.Status = "stopped" }, wantErr: "status active"},
+		{name: "subject is not a patient", change: func(request *fhir.MedicationRequest) { request.Subject.Reference = "Group/G1" }, wantErr: "subject must reference a Patient"},
+		{name: "no requester", change: func(request *fhir.MedicationRequest) { request.Requester = nil }, wantErr: "requester is required"},
+		{
+			name: "medication coded in another system",
+			change: func(request *fhir.MedicationRequest) {
+				request.MedicationCodeableConcept.Coding[0].System = "http://snomed.info/sct"
+			},
+			wantErr: "medicationCodeableConcept must carry",
+		},
+		{name: "no prescription ID", change: func(request *fhir.MedicationRequest) { request.Identifier = nil }, wantErr: "prescription ID"},
+		{
+			name: "fractional quantity",
+			change: func(request *fhir.MedicationRequest) {
+				request.DispenseRequest = &fhir.DispenseRequest{Quantity: &fhir.Quantity{Value: 2.5}}
+			},
+			wantErr: "whole number",
+		},
+		{
+			name: "weekly timing",
+			change: func(request *fhir.MedicationRequest) {
+				request.DosageInstruction = []fhir.Dosage{{Timing: &fhir.Timing{Repeat: &fhir.TimingRepeat{Frequency: 1, Period: 1, PeriodUnit: "wk"}}}}
+			},
+			wantErr: "per day or per hour",
+		},
+		{name: "unsigned", change: func(request *fhir.MedicationRequest) { request.Extension = request.Extension[1:] }, wantErr: "extensions are required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := valid()
+			tt.change(request)
+			_, _, _, err := prescriptionFromRequest(request)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMedicationDispenseRoundTrip(t *testing.T) {
+	dispensed := recordPrescription{
+		PrescriptionId: "RX1", MedicationCode: "AMOX500", MedicationName: "Amoxicillin", Strength: "500mg", DosageForm: "capsule",
+		Status: "Dispensed", DispensingPharmacist: "PH1", DispensingFacility: "KCH-PHARM", DispensingTimestamp: "2024-05-01T10:00:00Z",
+		DispensedQuantity: 21,
+	}
+
+	tests := []struct {
+		name     string
+		change   func(prescription *recordPrescription)
+		wantCode string
+		want     map[string]interface{}
+	}{
+		{
+			name: "prescribed product from a batch",
+			change: func(prescription *recordPrescription) {
+				prescription.DispensedBatch, prescription.BatchExpiry, prescription.BatchManufacturer = "B1", "2025-01-31", "Medipharm"
+			},
+			wantCode: "AMOX500",
+			want:     map[string]interface{}{"batchNumber": "B1", "batchExpiry": "2025-01-31", "manufacturer": "Medipharm", "dispensedCode": "AMOX500"},
+		},
+		{
+			name: "substituted product",
+			change: func(prescription *recordPrescription) {
+				prescription.DispensedCode, prescription.DispensedName, prescription.DispensedStrength = "AMOX250", "Amoxicillin", "250mg"
+				prescription.Substituted, prescription.SubstitutionReason = true, "500mg out of stock"
+				prescription.DispensedBatch, prescription.BatchExpiry = "B7", "2025-03-31"
+			},
+			wantCode: "AMOX250",
+			want: map[string]interface{}{
+				"batchNumber": "B7", "batchExpiry": "2025-03-31", "dispensedCode": "AMOX250", "substitutionReason": "500mg out of stock",
+			},
+		},
+		{
+			name:     "legacy dispense without a batch",
+			change:   func(prescription *recordPrescription) {},
+			wantCode: "AMOX500",
+			want:     map[string]interface{}{"dispensedCode": "AMOX500"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prescription := dispensed
+			tt.change(&prescription)
+			dispense := medicationDispenseResource(testRecord, &prescription)
+
+			if len(dispense.Contained) != 1 || formularyCode(dispense.Contained[0].Code) != tt.wantCode {
+				t.Errorf("contained = %+v, want a Medication coded %s", dispense.Contained, tt.wantCode)
+			}
+			if dispense.Substitution.WasSubstituted != prescription.Substituted {
+				t.Errorf("wasSubstituted = %v, want %v", dispense.Substitution.WasSubstituted, prescription.Substituted)
+			}
+
+			var posted fhir.MedicationDispense
+			fhirRoundTrip(t, dispense, &posted)
+			patientID, dispensation, err := dispensationFromDispense(&posted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patientID != "P1" {
+				t.Errorf("patient = %q, want P1", patientID)
+			}
+			want := map[string]interface{}{"patientId": "P1", "prescriptionId": "RX1", "pharmacistId": "PH1", "quantity": 21}
+			for key, value := range tt.want {
+				want[key] = value
+			}
+			if !reflect.DeepEqual(dispensation, want) {
+				t.Errorf("dispensation = %v, want %v", dispensation, want)
+			}
+		})
+	}
+}
+
+func TestDispensationFromDispenseErrors(t *testing.T) {
+	valid := func() *fhir.MedicationDispense {
+		return &fhir.MedicationDispense{
+			ResourceType:              "MedicationDispense",
+			Status:                    "completed",
+			MedicationCodeableConcept: &fhir.CodeableConcept{Coding: []fhir.Coding{{Code: "AMOX500"}}},
+			Subject:                   fhir.Reference{Reference: "Patient/P1"},
+			Performer:                 []fhir.Performer{{Actor: fhir.Reference{Reference: "Practitioner/PH1"}}},
+			AuthorizingPrescription:   []fhir.Reference{{Reference: "MedicationRequest/RX1"}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(dispense *fhir.MedicationDispense)
+		wantErr string
+	}{
+		{name: "valid", change: func(dispense *fhir.MedicationDispense) {}},
+		{name: "in progress", change: func(dispense *fhir.MedicationDispense) { dispense.Status = "in-progress" }, wantErr: "only completed dispenses"},
+		{name: "no prescription", change: func(dispense *fhir.MedicationDispense) { dispense.AuthorizingPrescription = nil }, wantErr: "exactly one authorizingPrescription"},
+		{name: "no performer", change: func(dispense *fhir.MedicationDispense) { dispense.Performer = nil }, wantErr: "performer is required"},
+		{name: "zero quantity", change: func(dispense *fhir.MedicationDispense) { dispense.Quantity = &fhir.Quantity{Value: 0} }, wantErr: "positive whole number"},
+		{
+			name: "external medication reference",
+			change: func(dispense *fhir.MedicationDispense) {
+				dispense.MedicationReference = &fhir.Reference{Reference: "Medication/AMOX500"}
+			},
+			wantErr: "contained Medication",
+		},
+		{
+			name: "missing contained medication",
+			change: func(dispense *fhir.MedicationDispense) {
+				dispense.MedicationReference = &fhir.Reference{Reference: "#med"}
+			},
+			wantErr: "contained Medication med not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispense := valid()
+			tt.change(dispense)
+			_, _, err := dispensationFromDispense(dispense)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOperationOutcome(t *testing.T) {
+	chaincodeError := func(message string) error {
+		st, err := status.New(codes.Aborted, "failed to endorse transaction").WithDetails(&gateway.ErrorDetail{MspId: "Org1MSP", Message: message})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Err()
+	}
+
+	tests := []struct {
+		name            string
+		write           func(w http.ResponseWriter)
+		wantStatus      int
+		wantCode        string
+		wantDiagnostics string
+	}{
+		{
+			name: "unsupported interaction",
+			write: func(w http.ResponseWriter) {
+				(&FHIRServer{}).ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/fhir/Patient/P1", nil))
+			},
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantCode:        "not-supported",
+			wantDiagnostics: "DELETE /fhir/Patient/P1 is not supported",
+		},
+		{
+			name:            "missing record",
+			write:           func(w http.ResponseWriter) { writeChaincodeError(w, chaincodeError("prescription RX9 not found")) },
+			wantStatus:      http.StatusNotFound,
+			wantCode:        "not-found",
+			wantDiagnostics: "prescription RX9 not found",
+		},
+		{
+			name: "consent denied",
+			write: func(w http.ResponseWriter) {
+				writeChaincodeError(w, chaincodeError("consent denied: no read consent for patient P1"))
+			},
+			wantStatus:      http.StatusForbidden,
+			wantCode:        "forbidden",
+			wantDiagnostics: "consent denied: no read consent for patient P1",
+		},
+		{
+			name: "role refused",
+			write: func(w http.ResponseWriter) {
+				writeChaincodeError(w, chaincodeError("only prescribers can add prescriptions"))
+			},
+			wantStatus:      http.StatusForbidden,
+			wantCode:        "forbidden",
+			wantDiagnostics: "only prescribers can add prescriptions",
+		},
+		{
+			name:            "duplicate",
+			write:           func(w http.ResponseWriter) { writeChaincodeError(w, chaincodeError("prescription RX1 already exists")) },
+			wantStatus:      http.StatusConflict,
+			wantCode:        "duplicate",
+			wantDiagnostics: "prescription RX1 already exists",
+		},
+		{
+			name:            "business rule",
+			write:           func(w http.ResponseWriter) { writeChaincodeError(w, chaincodeError("batch B1 expired on 2024-01-31")) },
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantCode:        "processing",
+			wantDiagnostics: "batch B1 expired on 2024-01-31",
+		},
+		{
+			name:            "error without chaincode details",
+			write:           func(w http.ResponseWriter) { writeChaincodeError(w, errors.New("connection refused")) },
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantCode:        "processing",
+			wantDiagnostics: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.write(recorder)
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != fhirContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, fhirContentType)
+			}
+			var outcome fhir.OperationOutcome
+			if err := json.Unmarshal(recorder.Body.Bytes(), &outcome); err != nil {
+				t.Fatal(err)
+			}
+			want := fhir.OperationOutcome{
+				ResourceType: "OperationOutcome",
+				Issue:        []fhir.Issue{{Severity: "error", Code: tt.wantCode, Diagnostics: tt.wantDiagnostics}},
+			}
+			if !reflect.DeepEqual(outcome, want) {
+				t.Errorf("outcome = %+v, want %+v", outcome, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"rest-api-go/hl7"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// hl7Application names this server as the sending application and assigning authority in HL7 messages.
+const hl7Application = "UMODZIRX"
+
+// hl7DispensePurpose is recorded in the access log when a dispense is read to send an RDS message.
+const hl7DispensePurpose = "HL7 dispense notification"
+
+// maxDispenseAttempts is how many times a dispense message is sent before it is moved to the dead-letter log.
+const maxDispenseAttempts = 5
+
+// dailyFrequencies maps HL7 repeat pattern codes (table 0335) to doses per day.
+var dailyFrequencies = map[string]int{
+	"QD": 1, "QAM": 1, "QPM": 1, "QHS": 1, "Q24H": 1,
+	"BID": 2, "Q12H": 2,
+	"TID": 3, "Q8H": 3,
+	"QID": 4, "Q6H": 4,
+	"Q4H": 6,
+}
+
+// HL7Senders maps each sending facility (MSH-4) allowed to send orders to the ordering providers (ORC-12) it may
+// send orders for.
+type HL7Senders map[string][]string
+
+// HL7Service accepts HL7 v2 pharmacy orders (RDE^O11) from hospital systems and sends dispense messages
+// (RDS^O13) back to them.
+type HL7Service struct {
+	setup       *OrgSetup
+	channelID   string
+	chaincodeID string
+	senders     HL7Senders
+	sendEvent   func(ctx context.Context, destination string, event *client.ChaincodeEvent) error
+}
+
+// hl7Order is a pharmacy order message mapped to chaincode prescriptions.
+type hl7Order struct {
+	patient       patientRecord
+	prescriberID  string
+	prescriptions []map[string]interface{}
+}
+
+// NewHL7Service returns an HL7 service using the organization's gateway, accepting orders from the given senders.
+func NewHL7Service(setup *OrgSetup, channelID string, chaincodeID string, senders HL7Senders) *HL7Service {
+	service := &HL7Service{setup: setup, channelID: channelID, chaincodeID: chaincodeID, senders: senders}
+	service.sendEvent = service.sendDispense
+	return service
+}
+
+// LoadHL7Senders reads the sender allow-list, a JSON object from sending facility ID to ordering provider IDs.
+func LoadHL7Senders(path string) (HL7Senders, error) {
+	sendersJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HL7 senders: %w", err)
+	}
+	var senders HL7Senders
+	if err := json.Unmarshal(sendersJSON, &senders); err != nil {
+		return nil, fmt.Errorf("failed to parse HL7 senders: %w", err)
+	}
+	return senders, nil
+}
+
+// HandleMessage processes a received message and returns an ACK: AA when the orders were issued on the ledger,
+// AE with ERR segments when they could not be, and AR for messages from unknown senders and messages other
+// than RDE^O11.
+func (service *HL7Service) HandleMessage(peer *hl7.Peer, message *hl7.Message) *hl7.Message {
+	code, trigger := message.Type()
+	fmt.Printf("Received HL7 %s^%s message %s from %s\n", code, trigger, message.ControlID(), peer.Address)
+	providers, err := service.authorizeSender(peer, message)
+	if err != nil {
+		return service.ack(message, hl7.AckReject, err)
+	}
+	if code != "RDE" || trigger != "O11" {
+		return service.ack(message, hl7.AckReject, &hl7.Error{
+			Segment: "MSH", Sequence: 1, Field: 9, Code: hl7.ErrUnsupportedMessage,
+			Text: fmt.Sprintf("message type %s^%s is not supported", code, trigger),
+		})
+	}
+
+	order, errs := parseRDE(message)
+	if len(errs) > 0 {
+		return service.ack(message, hl7.AckError, errs...)
+	}
+	if !slices.Contains(providers, order.prescriberID) {
+		return service.ack(message, hl7.AckError, &hl7.Error{
+			Segment: "ORC", Sequence: 1, Field: 12, Code: hl7.ErrApplicationInternal,
+			Text: fmt.Sprintf("ordering provider %s is not authorized for the sending facility", order.prescriberID),
+		})
+	}
+	if err := service.submitOrder(order); err != nil {
+		return service.ack(message, hl7.AckError, &hl7.Error{Code: hl7.ErrApplicationInternal, Text: chaincodeMessage(err)})
+	}
+	return service.ack(message, hl7.AckAccept)
+}
+
+// authorizeSender checks that the message's sending facility is on the allow-list and, on a TLS connection, that
+// the client certificate was issued to that facility. It returns the providers the facility may send orders for.
+func (service *HL7Service) authorizeSender(peer *hl7.Peer, message *hl7.Message) ([]string, *hl7.Error) {
+	facility := ""
+	if header := message.Segment("MSH"); header != nil {
+		facility = header.Component(4, 1)
+	}
+	providers, ok := service.senders[facility]
+	if !ok {
+		return nil, &hl7.Error{Segment: "MSH", Sequence: 1, Field: 4, Code: hl7.ErrApplicationInternal,
+			Text: fmt.Sprintf("sending facility %q is not authorized", facility)}
+	}
+	if peer.Certificate != nil && peer.Certificate.Subject.CommonName != facility {
+		return nil, &hl7.Error{Segment: "MSH", Sequence: 1, Field: 4, Code: hl7.ErrApplicationInternal,
+			Text: fmt.Sprintf("client certificate %q does not belong to sending facility %s", peer.Certificate.Subject.CommonName, facility)}
+	}
+	return providers, nil
+}
+
+// ack builds the acknowledgment of a message.
+func (service *HL7Service) ack(message *hl7.Message, code string, errs ...*hl7.Error) *hl7.Message {
+	return hl7.NewAck(message, code, hl7Application, service.setup.MSPID, errs)
+}
+
+// submitOrder issues the order's signed prescriptions with a new record for a patient the ledger does not know
+// yet, or adds them to the patient's existing record under their consent.
+func (service *HL7Service) submitOrder(order *hl7Order) error {
+	asset := map[string]interface{}{
+		"PatientId":     order.patient.PatientId,
+		"PatientName":   order.patient.PatientName,
+		"DateOfBirth":   order.patient.DateOfBirth,
+		"DoctorId":      order.prescriberID,
+		"Prescriptions": order.prescriptions,
+	}
+	contract := service.setup.Gateway.GetNetwork(service.channelID).GetContract(service.chaincodeID)
+	_, err := issueToRecord(contract, asset)
+	return err
+}
+
+// parseRDE maps an RDE^O11 message to prescriptions. Each ORC starts an order, which takes its timing from an
+// optional TQ1 and its medication from the RXE that follows. The RXE is followed by a ZSG segment carrying the
+// prescriber's signature, made on their own device: ZSG-1 is the base64 signature over the canonical content and
+// ZSG-2 the base64 DER signer certificate. All orders in a message must come from the same ordering provider, so
+// they can be issued in one transaction.
+func parseRDE(message *hl7.Message) (*hl7Order, []*hl7.Error) {
+	order := &hl7Order{}
+	var errs []*hl7.Error
+	missing := func(segment string, sequence int, field int, name string) {
+		errs = append(errs, &hl7.Error{Segment: segment, Sequence: sequence, Field: field, Code: hl7.ErrRequiredFieldMissing, Text: name + " is required"})
+	}
+
+	pid := message.Segment("PID")
+	if pid == nil {
+		return nil, []*hl7.Error{{Segment: "PID", Code: hl7.ErrSegmentSequence, Text: "PID segment is required"}}
+	}
+	order.patient.PatientId = pid.Component(3, 1)
+	if order.patient.PatientId == "" {
+		missing("PID", 1, 3, "patient identifier")
+	}
+	order.patient.PatientName = strings.Join(strings.Fields(pid.Component(5, 2)+" "+pid.Component(5, 3)+" "+pid.Component(5, 1)), " ")
+	if birthDate := pid.Field(7); birthDate != "" {
+		date, err := hl7.ParseDate(birthDate)
+		if err != nil {
+			errs = append(errs, &hl7.Error{Segment: "PID", Sequence: 1, Field: 7, Code: hl7.ErrDataType, Text: err.Error()})
+		}
+		order.patient.DateOfBirth = date
+	}
+	encounterID := ""
+	if pv1 := message.Segment("PV1"); pv1 != nil {
+		encounterID = pv1.Component(19, 1)
+	}
+
+	var current map[string]interface{}
+	interval, endDate := "", ""
+	unsigned := 0 // sequence of the RXE still waiting for its ZSG
+	unsignedError := func() {
+		if unsigned != 0 {
+			errs = append(errs, &hl7.Error{Segment: "RXE", Sequence: unsigned, Code: hl7.ErrSegmentSequence, Text: "RXE must be followed by a ZSG segment with the prescriber's signature"})
+			unsigned = 0
+		}
+	}
+	sequences := map[string]int{}
+	for _, segment := range message.Segments {
+		sequences[segment.Name]++
+		sequence := sequences[segment.Name]
+		fieldError := func(field int, code string, text string) {
+			errs = append(errs, &hl7.Error{Segment: segment.Name, Sequence: sequence, Field: field, Code: code, Text: text})
+		}
+
+		switch segment.Name {
+		case "ORC":
+			unsignedError()
+			if current != nil {
+				fieldError(0, hl7.ErrSegmentSequence, "ORC must be followed by an RXE before the next order")
+			}
+			if control := segment.Field(1); control != "NW" {
+				fieldError(1, hl7.ErrTableValueNotFound, fmt.Sprintf("order control %s is not supported; only NW (new order) is accepted", control))
+			}
+			current = map[string]interface{}{"PrescriptionId": segment.Component(2, 1)}
+			if encounterID != "" {
+				current["EncounterId"] = encounterID
+			}
+			if current["PrescriptionId"] == "" {
+				missing("ORC", sequence, 2, "placer order number")
+			}
+			prescriberID := segment.Component(12, 1)
+			switch {
+			case prescriberID == "":
+				missing("ORC", sequence, 12, "ordering provider")
+			case order.prescriberID == "":
+				order.prescriberID = prescriberID
+			case order.prescriberID != prescriberID:
+				fieldError(12, hl7.ErrApplicationInternal, "all orders in a message must have the same ordering provider")
+			}
+			interval, endDate = "", ""
+
+		case "TQ1":
+			interval = segment.Component(3, 1)
+			endDate = segment.Field(8)
+
+		case "RXE":
+			if current == nil {
+				fieldError(0, hl7.ErrSegmentSequence, "RXE must follow an ORC")
+				continue
+			}
+			if interval == "" {
+				interval = segment.Component(1, 2)
+			}
+			if endDate == "" {
+				endDate = segment.Component(1, 5)
+			}
+
+			current["MedicationCode"] = segment.Component(2, 1)
+			if current["MedicationCode"] == "" {
+				missing("RXE", sequence, 2, "give code")
+			}
+			amount := segment.Field(3)
+			if amount != "" {
+				value, err := strconv.ParseFloat(amount, 64)
+				if err != nil {
+					fieldError(3, hl7.ErrDataType, fmt.Sprintf("give amount %q is not a number", amount))
+				}
+				current["DoseAmount"] = value
+			}
+			units := codedText(segment, 5)
+			current["DoseUnit"] = units
+			current["DosageForm"] = codedText(segment, 6)
+			if interval != "" {
+				dosesPerDay, ok := dailyFrequencies[strings.ToUpper(interval)]
+				if !ok {
+					fieldError(1, hl7.ErrTableValueNotFound, fmt.Sprintf("repeat pattern %s is not supported", interval))
+				}
+				current["DosesPerDay"] = dosesPerDay
+			}
+			current["Dosage"] = strings.Join(strings.Fields(amount+" "+units+" "+interval), " ")
+
+			var instructions []string
+			for _, repetition := range segment.Repetitions(7) {
+				text := segment.RepetitionComponent(repetition, 2)
+				if text == "" {
+					text = segment.RepetitionComponent(repetition, 1)
+				}
+				instructions = append(instructions, text)
+			}
+			current["Instructions"] = strings.Join(instructions, "; ")
+
+			for _, field := range []struct {
+				position int
+				key      string
+				name     string
+			}{{10, "Quantity", "dispense amount"}, {12, "Refills", "number of refills"}} {
+				if value := segment.Field(field.position); value != "" {
+					number, err := strconv.Atoi(value)
+					if err != nil {
+						fieldError(field.position, hl7.ErrDataType, fmt.Sprintf("%s %q is not a whole number", field.name, value))
+					}
+					current[field.key] = number
+				}
+			}
+			if strength := strings.TrimSpace(segment.Field(25) + " " + codedText(segment, 26)); strength != "" {
+				current["Strength"] = strength
+			}
+			var indications []interface{}
+			for _, repetition := range segment.Repetitions(27) {
+				if code := segment.RepetitionComponent(repetition, 1); code != "" {
+					indications = append(indications, code)
+				}
+			}
+			if len(indications) > 0 {
+				current["DiagnosisCodes"] = indications
+			}
+			if endDate != "" {
+				expiry, err := hl7.ParseDate(endDate)
+				if err != nil {
+					fieldError(1, hl7.ErrDataType, err.Error())
+				}
+				current["ExpiryDate"] = expiry
+			}
+
+			order.prescriptions = append(order.prescriptions, current)
+			current = nil
+			unsigned = sequence
+
+		case "ZSG":
+			if unsigned == 0 {
+				fieldError(0, hl7.ErrSegmentSequence, "ZSG must follow an RXE")
+				continue
+			}
+			signed := order.prescriptions[len(order.prescriptions)-1]
+			unsigned = 0
+			if segment.Field(1) == "" {
+				missing("ZSG", sequence, 1, "signature")
+			}
+			signed["Signature"] = segment.Field(1)
+			certificate, err := base64.StdEncoding.DecodeString(segment.Field(2))
+			if err != nil || len(certificate) == 0 {
+				fieldError(2, hl7.ErrDataType, "signer certificate must be a base64 DER certificate")
+				continue
+			}
+			signed["SignerCertificate"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+		}
+	}
+	unsignedError()
+
+	if current != nil {
+		errs = append(errs, &hl7.Error{Segment: "ORC", Sequence: sequences["ORC"], Code: hl7.ErrSegmentSequence, Text: "ORC must be followed by an RXE"})
+	}
+	if len(order.prescriptions) == 0 && len(errs) == 0 {
+		errs = append(errs, &hl7.Error{Segment: "ORC", Code: hl7.ErrSegmentSequence, Text: "the message contains no orders"})
+	}
+	return order, errs
+}
+
+// codedText returns the text of a coded field, or its identifier when there is no text.
+func codedText(segment *hl7.Segment, field int) string {
+	if text := segment.Component(field, 2); text != "" {
+		return text
+	}
+	return segment.Component(field, 1)
+}
+
+// RunDispenseFeed sends an RDS^O13 message to the MLLP destination for every PrescriptionDispensed event until
+// the context is cancelled. Progress is kept in the checkpoint file, so a message that cannot be delivered is
+// retried and none are lost across restarts. A message still undelivered after maxDispenseAttempts is appended
+// to the dead-letter file so the feed can move on. A new checkpoint file starts with the next dispense.
+func (service *HL7Service) RunDispenseFeed(ctx context.Context, destination string, checkpointPath string, deadLetterPath string) {
+	checkpointer, err := client.NewFileCheckpointer(checkpointPath)
+	if err != nil {
+		log.Printf("hl7: failed to open checkpoint file %s: %v", checkpointPath, err)
+		return
+	}
+	defer checkpointer.Close()
+
+	network := service.setup.Gateway.GetNetwork(service.channelID)
+	attempts := map[string]int{}
+	for ctx.Err() == nil {
+		streamCtx, cancel := context.WithCancel(ctx)
+		events, err := network.ChaincodeEvents(streamCtx, service.chaincodeID, client.WithCheckpoint(checkpointer))
+		if err != nil {
+			log.Printf("hl7: failed to read chaincode events: %v", err)
+		} else {
+			for event := range events {
+				if !service.deliverDispense(ctx, destination, deadLetterPath, event, attempts) {
+					break
+				}
+				if err := checkpointer.CheckpointChaincodeEvent(event); err != nil {
+					log.Printf("hl7: failed to save checkpoint: %v", err)
+				}
+			}
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// deliverDispense sends the message for an event and reports whether the feed may move past it: when it was
+// sent, or when it failed maxDispenseAttempts times and was written to the dead-letter file. attempts counts the
+// failures of each transaction's event across reconnections.
+func (service *HL7Service) deliverDispense(ctx context.Context, destination string, deadLetterPath string, event *client.ChaincodeEvent, attempts map[string]int) bool {
+	err := service.sendEvent(ctx, destination, event)
+	if err == nil {
+		delete(attempts, event.TransactionID)
+		return true
+	}
+	attempts[event.TransactionID]++
+	if attempts[event.TransactionID] < maxDispenseAttempts {
+		log.Printf("hl7: failed to send dispense message for transaction %s (attempt %d of %d), will retry: %v",
+			event.TransactionID, attempts[event.TransactionID], maxDispenseAttempts, err)
+		return false
+	}
+	if deadLetterErr := writeDeadLetter(deadLetterPath, event, attempts[event.TransactionID], err); deadLetterErr != nil {
+		log.Printf("hl7: failed to dead-letter dispense message for transaction %s, will retry: %v", event.TransactionID, deadLetterErr)
+		return false
+	}
+	log.Printf("hl7: gave up sending dispense message for transaction %s after %d attempts, written to %s: %v",
+		event.TransactionID, attempts[event.TransactionID], deadLetterPath, err)
+	delete(attempts, event.TransactionID)
+	return true
+}
+
+// deadLetter is a line of the dead-letter file, recording an event whose dispense message could not be sent.
+type deadLetter struct {
+	TransactionID string          `json:"transactionId"`
+	BlockNumber   uint64          `json:"blockNumber"`
+	EventName     string          `json:"eventName"`
+	Payload       json.RawMessage `json:"payload"`
+	Error         string          `json:"error"`
+	Attempts      int             `json:"attempts"`
+	FailedAt      string          `json:"failedAt"`
+}
+
+// writeDeadLetter appends an undeliverable event to the dead-letter file as a JSON line.
+func writeDeadLetter(path string, event *client.ChaincodeEvent, attempts int, sendErr error) error {
+	payload := json.RawMessage(event.Payload)
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(event.Payload))
+	}
+	line, err := json.Marshal(deadLetter{
+		TransactionID: event.TransactionID,
+		BlockNumber:   event.BlockNumber,
+		EventName:     event.EventName,
+		Payload:       payload,
+		Error:         sendErr.Error(),
+		Attempts:      attempts,
+		FailedAt:      time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// sendDispense sends the RDS^O13 message for a PrescriptionDispensed event, ignoring other events.
+func (service *HL7Service) sendDispense(ctx context.Context, destination string, event *client.ChaincodeEvent) error {
+	if event.EventName != "PrescriptionDispensed" {
+		return nil
+	}
+	var payload struct {
+		PrescriptionId string `json:"PrescriptionId"`
+	}
+	if err := json.Unmarshal(event.Payload, &payload); err != nil || payload.PrescriptionId == "" {
+		log.Printf("hl7: ignoring malformed dispense event in transaction %s", event.TransactionID)
+		return nil
+	}
+
+	contract := service.setup.Gateway.GetNetwork(service.channelID).GetContract(service.chaincodeID)
+	record, err := readPrescription(contract.SubmitTransaction, payload.PrescriptionId, hl7DispensePurpose)
+	if err != nil {
+		return fmt.Errorf("failed to read prescription %s: %s", payload.PrescriptionId, chaincodeMessage(err))
+	}
+	message := service.dispenseMessage(record, &record.Prescriptions[0])
+	if _, err := hl7.Send(ctx, destination, message); err != nil {
+		return err
+	}
+	fmt.Printf("Sent HL7 RDS^O13 message %s for prescription %s\n", message.ControlID(), payload.PrescriptionId)
+	return nil
+}
+
+// dispenseMessage builds the RDS^O13 message for a dispensed prescription.
+func (service *HL7Service) dispenseMessage(record *patientRecord, prescription *recordPrescription) *hl7.Message {
+	given, family := "", record.PatientName
+	if i := strings.LastIndex(record.PatientName, " "); i >= 0 {
+		given, family = record.PatientName[:i], record.PatientName[i+1:]
+	}
+	code, name := prescription.MedicationCode, prescription.MedicationName
+	if prescription.DispensedCode != "" {
+		code, name = prescription.DispensedCode, prescription.DispensedName
+	}
+	substitution := "N"
+	if prescription.Substituted {
+		substitution = "G"
+	}
+	dispensedAt := hl7.FormatDate(prescription.DispensingTimestamp)
+	manufacturer := []string{}
+	if prescription.BatchManufacturer != "" {
+		manufacturer = []string{"", prescription.BatchManufacturer}
+	}
+
+	return &hl7.Message{Segments: []*hl7.Segment{
+		hl7.Header(hl7Application, service.setup.MSPID, "", "", []string{"RDS", "O13", "RDS_O13"}, hl7.NewControlID()),
+		hl7.NewSegment("PID", "1", "", []string{record.PatientId, "", "", hl7Application}, "",
+			[]string{family, given}, "", hl7.FormatDate(record.DateOfBirth)),
+		hl7.NewSegment("ORC", "RE", []string{prescription.PrescriptionId, hl7Application}, "", "", "CM",
+			"", "", "", dispensedAt, "", "", []string{prescription.CreatedBy}),
+		hl7.NewSegment("RXD", "1", []string{code, name, hl7Application}, dispensedAt, prescription.DispensedQuantity,
+			"", []string{"", prescription.DosageForm}, prescription.PrescriptionId, "", "",
+			[]string{prescription.DispensingPharmacist}, substitution, "", "", "", "", "", "",
+			prescription.DispensedBatch, hl7.FormatDate(prescription.BatchExpiry), manufacturer),
+	}}
+}
@@ -0,0 +1,297 @@
+package web
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"rest-api-go/hl7"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+const testMSH = "MSH|^~\\&|HIS|KCH|UMODZIRX|Org1MSP|20240501120000||RDE^O11^RDE_O11|MSG0001|P|2.5"
+
+// hl7Segment builds a segment line with the given fields set and the rest left empty.
+func hl7Segment(name string, fields map[int]string) string {
+	last := 0
+	for position := range fields {
+		if position > last {
+			last = position
+		}
+	}
+	values := make([]string, last+1)
+	values[0] = name
+	for position, value := range fields {
+		values[position] = value
+	}
+	return strings.Join(values, "|")
+}
+
+// parseTestMessage parses segment lines preceded by an RDE^O11 header.
+func parseTestMessage(t *testing.T, lines ...string) *hl7.Message {
+	t.Helper()
+	message, err := hl7.Parse(strings.Join(append([]string{testMSH}, lines...), "\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+var (
+	testPID = hl7Segment("PID", map[int]string{1: "1", 3: "P1^^^KCH^MR", 5: "Banda^Jane^Mary", 7: "19800102"})
+	testPV1 = hl7Segment("PV1", map[int]string{1: "1", 2: "O", 19: "ENC1"})
+	testORC = hl7Segment("ORC", map[int]string{1: "NW", 2: "RX1^HIS", 12: "DOC1^Phiri^John"})
+	testTQ1 = hl7Segment("TQ1", map[int]string{1: "1", 3: "TID", 8: "20240508"})
+	testRXE = hl7Segment("RXE", map[int]string{
+		2: "AMOX500^Amoxicillin", 3: "1", 5: "CAP^capsule", 6: "CAP^capsule",
+		7: "^Take with food~^Complete the course", 10: "21", 12: "0", 25: "500", 26: "mg", 27: "J18.9~R50.9",
+	})
+	testZSG = hl7Segment("ZSG", map[int]string{1: "c2lnbmF0dXJl", 2: "Y2VydGlmaWNhdGU="})
+)
+
+func TestParseRDE(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		wantErrs []string // segment^sequence^field^code of each error
+	}{
+		{name: "order", lines: []string{testPID, testPV1, testORC, testTQ1, testRXE, testZSG}},
+		{name: "no PID", lines: []string{testORC, testRXE, testZSG}, wantErrs: []string{"PID^0^0^100"}},
+		{
+			name:     "no patient identifier",
+			lines:    []string{hl7Segment("PID", map[int]string{1: "1", 5: "Banda^Jane"}), testORC, testRXE, testZSG},
+			wantErrs: []string{"PID^1^3^101"},
+		},
+		{
+			name:     "invalid birth date",
+			lines:    []string{hl7Segment("PID", map[int]string{3: "P1", 7: "1980"}), testORC, testRXE, testZSG},
+			wantErrs: []string{"PID^1^7^102"},
+		},
+		{
+			name:     "order control other than NW",
+			lines:    []string{testPID, hl7Segment("ORC", map[int]string{1: "CA", 2: "RX1", 12: "DOC1"}), testRXE, testZSG},
+			wantErrs: []string{"ORC^1^1^103"},
+		},
+		{
+			name:     "no ordering provider",
+			lines:    []string{testPID, hl7Segment("ORC", map[int]string{1: "NW", 2: "RX1"}), testRXE, testZSG},
+			wantErrs: []string{"ORC^1^12^101"},
+		},
+		{
+			name:     "orders from different providers",
+			lines:    []string{testPID, testORC, testRXE, testZSG, hl7Segment("ORC", map[int]string{1: "NW", 2: "RX2", 12: "DOC2"}), testRXE, testZSG},
+			wantErrs: []string{"ORC^2^12^207"},
+		},
+		{name: "RXE without an ORC", lines: []string{testPID, testRXE}, wantErrs: []string{"RXE^1^0^100"}},
+		{name: "ORC without an RXE", lines: []string{testPID, testORC}, wantErrs: []string{"ORC^1^0^100"}},
+		{name: "RXE without a signature", lines: []string{testPID, testORC, testRXE}, wantErrs: []string{"RXE^1^0^100"}},
+		{
+			name:     "second RXE without a signature",
+			lines:    []string{testPID, testORC, testRXE, hl7Segment("ORC", map[int]string{1: "NW", 2: "RX2", 12: "DOC1"}), testRXE, testZSG},
+			wantErrs: []string{"RXE^1^0^100"},
+		},
+		{name: "ZSG without an RXE", lines: []string{testPID, testORC, testRXE, testZSG, testZSG}, wantErrs: []string{"ZSG^2^0^100"}},
+		{
+			name:     "empty signature",
+			lines:    []string{testPID, testORC, testRXE, hl7Segment("ZSG", map[int]string{2: "Y2VydGlmaWNhdGU="})},
+			wantErrs: []string{"ZSG^1^1^101"},
+		},
+		{
+			name:     "signer certificate is not base64",
+			lines:    []string{testPID, testORC, testRXE, hl7Segment("ZSG", map[int]string{1: "c2lnbmF0dXJl", 2: "-----BEGIN"})},
+			wantErrs: []string{"ZSG^1^2^102"},
+		},
+		{
+			name:     "unsupported repeat pattern",
+			lines:    []string{testPID, testORC, hl7Segment("TQ1", map[int]string{3: "Q3D"}), testRXE, testZSG},
+			wantErrs: []string{"RXE^1^1^103"},
+		},
+		{
+			name:     "dispense amount is not a whole number",
+			lines:    []string{testPID, testORC, hl7Segment("RXE", map[int]string{2: "AMOX500", 10: "twenty"}), testZSG},
+			wantErrs: []string{"RXE^1^10^102"},
+		},
+		{
+			name:     "missing give code",
+			lines:    []string{testPID, testORC, hl7Segment("RXE", map[int]string{3: "1", 10: "21"}), testZSG},
+			wantErrs: []string{"RXE^1^2^101"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, errs := parseRDE(parseTestMessage(t, tt.lines...))
+
+			var gotErrs []string
+			for _, err := range errs {
+				gotErrs = append(gotErrs, strings.Join([]string{err.Segment, strconv.Itoa(err.Sequence), strconv.Itoa(err.Field), err.Code}, "^"))
+			}
+			if !reflect.DeepEqual(gotErrs, tt.wantErrs) {
+				t.Fatalf("parseRDE() errors = %q, want %q", gotErrs, tt.wantErrs)
+			}
+			if len(tt.wantErrs) > 0 {
+				return
+			}
+
+			if order.patient.PatientId != "P1" || order.patient.PatientName != "Jane Mary Banda" || order.patient.DateOfBirth != "1980-01-02" {
+				t.Errorf("patient = %+v", order.patient)
+			}
+			if order.prescriberID != "DOC1" {
+				t.Errorf("prescriberID = %q, want DOC1", order.prescriberID)
+			}
+			want := []map[string]interface{}{{
+				"PrescriptionId":    "RX1",
+				"EncounterId":       "ENC1",
+				"MedicationCode":    "AMOX500",
+				"DoseAmount":        1.0,
+				"DoseUnit":          "capsule",
+				"DosageForm":        "capsule",
+				"DosesPerDay":       3,
+				"Dosage":            "1 capsule TID",
+				"Instructions":      "Take with food; Complete the course",
+				"Quantity":          21,
+				"Refills":           0,
+				"Strength":          "500 mg",
+				"DiagnosisCodes":    []interface{}{"J18.9", "R50.9"},
+				"ExpiryDate":        "2024-05-08",
+				"Signature":         "c2lnbmF0dXJl",
+				"SignerCertificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("certificate")})),
+			}}
+			if !reflect.DeepEqual(order.prescriptions, want) {
+				t.Errorf("prescriptions = %v, want %v", order.prescriptions, want)
+			}
+		})
+	}
+}
+
+func TestHandleMessageAck(t *testing.T) {
+	service := NewHL7Service(&OrgSetup{MSPID: "Org1MSP"}, "mychannel", "basic", HL7Senders{"KCH": {"DOC1"}})
+	plain := &hl7.Peer{Address: "192.0.2.1:40000"}
+
+	tests := []struct {
+		name     string
+		peer     *hl7.Peer
+		message  string
+		wantCode string
+		wantERR  []string // ERR-3 code of each ERR segment
+	}{
+		{
+			name:     "unsupported message type",
+			peer:     plain,
+			message:  "MSH|^~\\&|HIS|KCH|UMODZIRX|Org1MSP|20240501120000||ADT^A01|MSG0001|P|2.5\r" + testPID,
+			wantCode: hl7.AckReject,
+			wantERR:  []string{"200"},
+		},
+		{
+			name:     "invalid order",
+			peer:     plain,
+			message:  strings.Join([]string{testMSH, testPID, hl7Segment("ORC", map[int]string{1: "NW"}), testRXE, testZSG}, "\r"),
+			wantCode: hl7.AckError,
+			wantERR:  []string{"101", "101"},
+		},
+		{
+			name:     "unknown sending facility",
+			peer:     plain,
+			message:  strings.Join([]string{strings.Replace(testMSH, "|KCH|", "|QECH|", 1), testPID, testORC, testRXE, testZSG}, "\r"),
+			wantCode: hl7.AckReject,
+			wantERR:  []string{"207"},
+		},
+		{
+			name:     "client certificate of another facility",
+			peer:     &hl7.Peer{Address: plain.Address, Certificate: &x509.Certificate{Subject: pkix.Name{CommonName: "QECH"}}},
+			message:  strings.Join([]string{testMSH, testPID, testORC, testRXE, testZSG}, "\r"),
+			wantCode: hl7.AckReject,
+			wantERR:  []string{"207"},
+		},
+		{
+			name:     "ordering provider not allowed for the facility",
+			peer:     &hl7.Peer{Address: plain.Address, Certificate: &x509.Certificate{Subject: pkix.Name{CommonName: "KCH"}}},
+			message:  strings.Join([]string{testMSH, testPID, hl7Segment("ORC", map[int]string{1: "NW", 2: "RX1", 12: "DOC2"}), testRXE, testZSG}, "\r"),
+			wantCode: hl7.AckError,
+			wantERR:  []string{"207"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := hl7.Parse(tt.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ack := service.HandleMessage(tt.peer, message)
+
+			msa := ack.Segment("MSA")
+			if msa.Field(1) != tt.wantCode || msa.Field(2) != "MSG0001" {
+				t.Errorf("MSA = %q, %q, want %q, MSG0001", msa.Field(1), msa.Field(2), tt.wantCode)
+			}
+			var gotERR []string
+			for _, segment := range ack.Segments {
+				if segment.Name == "ERR" {
+					gotERR = append(gotERR, segment.Component(3, 1))
+				}
+			}
+			if !reflect.DeepEqual(gotERR, tt.wantERR) {
+				t.Errorf("ERR codes = %q, want %q", gotERR, tt.wantERR)
+			}
+		})
+	}
+}
+
+func TestDeliverDispenseDeadLetters(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	sendErr := errors.New("connection refused")
+	service := NewHL7Service(&OrgSetup{MSPID: "Org1MSP"}, "mychannel", "basic", nil)
+	service.sendEvent = func(ctx context.Context, destination string, event *client.ChaincodeEvent) error {
+		if event.TransactionID == "tx-ok" {
+			return nil
+		}
+		return sendErr
+	}
+	failing := &client.ChaincodeEvent{TransactionID: "tx-fail", BlockNumber: 7, EventName: "PrescriptionDispensed", Payload: []byte(`{"PrescriptionId":"RX1"}`)}
+	attempts := map[string]int{}
+
+	for attempt := 1; attempt < maxDispenseAttempts; attempt++ {
+		if service.deliverDispense(context.Background(), "localhost:2576", deadLetterPath, failing, attempts) {
+			t.Fatalf("attempt %d: deliverDispense() = true, want false so the event is retried", attempt)
+		}
+	}
+	if _, err := os.Stat(deadLetterPath); !os.IsNotExist(err) {
+		t.Fatalf("dead-letter file written before the last attempt: %v", err)
+	}
+	if !service.deliverDispense(context.Background(), "localhost:2576", deadLetterPath, failing, attempts) {
+		t.Fatal("last attempt: deliverDispense() = false, want true so the checkpoint moves on")
+	}
+	if _, ok := attempts["tx-fail"]; ok {
+		t.Error("attempts not cleared after dead-lettering")
+	}
+
+	contents, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("dead-letter file has %d lines, want 1", len(lines))
+	}
+	var got deadLetter
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TransactionID != "tx-fail" || got.BlockNumber != 7 || got.EventName != "PrescriptionDispensed" ||
+		got.Attempts != maxDispenseAttempts || got.Error != sendErr.Error() || string(got.Payload) != `{"PrescriptionId":"RX1"}` {
+		t.Errorf("dead letter = %+v", got)
+	}
+
+	if !service.deliverDispense(context.Background(), "localhost:2576", deadLetterPath, &client.ChaincodeEvent{TransactionID: "tx-ok"}, attempts) {
+		t.Error("deliverDispense() = false for a sent message, want true")
+	}
+}
@@ -36,6 +36,11 @@ func Initialize(setup OrgSetup) (*OrgSetup, error) {
 		panic(err)
 	}
 	setup.Gateway = *gateway
+	setup.Sign = sign
+	setup.Certificate, err = loadCertificate(setup.CertPath)
+	if err != nil {
+		panic(err)
+	}
 	log.Println("Initialization complete")
 	return &setup, nil
 }
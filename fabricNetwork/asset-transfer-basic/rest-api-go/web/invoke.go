@@ -19,6 +19,10 @@ func (setup *OrgSetup) Invoke(w http.ResponseWriter, r *http.Request) {
 	function := r.FormValue("function")
 	args := r.Form["args"]
 	fmt.Printf("channel: %s, chaincode: %s, function: %s, args: %s\n", channelID, chainCodeName, function, args)
+	if auditedFunctions[function] {
+		http.Error(w, fmt.Sprintf("%s is an audited read; use /records/access", function), http.StatusBadRequest)
+		return
+	}
 	network := setup.Gateway.GetNetwork(channelID)
 	contract := network.GetContract(chainCodeName)
 	txn_proposal, err := contract.NewProposal(function, client.WithArguments(args...))
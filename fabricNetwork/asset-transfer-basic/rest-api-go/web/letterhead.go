@@ -0,0 +1,42 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Letterhead is the facility header printed on paper prescriptions.
+type Letterhead struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Phone   string `json:"phone,omitempty"`
+	Email   string `json:"email,omitempty"`
+}
+
+// defaultLetterheadKey is used for facilities without their own entry in the letterhead file.
+const defaultLetterheadKey = "default"
+
+// LoadLetterheads reads the letterhead file, a JSON object keyed by facility ID with an optional "default" entry.
+func LoadLetterheads(path string) (map[string]Letterhead, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read letterhead file: %w", err)
+	}
+	var letterheads map[string]Letterhead
+	if err := json.Unmarshal(data, &letterheads); err != nil {
+		return nil, fmt.Errorf("failed to parse letterhead file %s: %w", path, err)
+	}
+	return letterheads, nil
+}
+
+// letterheadFor returns the letterhead for a facility, falling back to the default entry.
+func (setup *OrgSetup) letterheadFor(facilityID string) Letterhead {
+	if letterhead, ok := setup.Letterheads[facilityID]; ok {
+		return letterhead
+	}
+	if letterhead, ok := setup.Letterheads[defaultLetterheadKey]; ok {
+		return letterhead
+	}
+	return Letterhead{Name: "UmodziRx", Address: facilityID}
+}
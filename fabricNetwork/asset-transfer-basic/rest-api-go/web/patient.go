@@ -0,0 +1,78 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// patientQuery returns a handler that evaluates a patient self-service chaincode function. It runs as the
+// signed-in patient's own enrolled identity, and the chaincode identifies the patient by its patientId attribute.
+func (setup *OrgSetup) patientQuery(function string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Received patient %s request\n", function)
+		queryParams := r.URL.Query()
+		chainCodeName := queryParams.Get("chaincodeid")
+		channelID := queryParams.Get("channelid")
+		contract := setup.userContract(w, r, channelID, chainCodeName)
+		if contract == nil {
+			return
+		}
+		evaluateResponse, err := contract.EvaluateTransaction(function)
+		if err != nil {
+			fmt.Fprintf(w, "Error: %s", err)
+			return
+		}
+		fmt.Fprintf(w, "Response: %s", evaluateResponse)
+	}
+}
+
+// PatientConsents lists the patient's consents on GET and grants a new consent on POST.
+func (setup *OrgSetup) PatientConsents(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		setup.patientQuery("GetMyConsents")(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Println("Received patient GrantConsent request")
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	contract := setup.userContract(w, r, r.FormValue("channelid"), r.FormValue("chaincodeid"))
+	if contract == nil {
+		return
+	}
+	result, err := contract.SubmitTransaction("GrantConsent", r.FormValue("consent"))
+	if err != nil {
+		fmt.Fprintf(w, "Error submitting transaction: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", result)
+}
+
+// PatientRevokeConsent withdraws one of the patient's consents.
+func (setup *OrgSetup) PatientRevokeConsent(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received patient RevokeConsent request")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	contract := setup.userContract(w, r, r.FormValue("channelid"), r.FormValue("chaincodeid"))
+	if contract == nil {
+		return
+	}
+	_, err := contract.SubmitTransaction("RevokeConsent", r.FormValue("patientId"), r.FormValue("consentId"))
+	if err != nil {
+		fmt.Fprintf(w, "Error submitting transaction: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Consent %s revoked", r.FormValue("consentId"))
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPatientEndpointsNeedOwnIdentity(t *testing.T) {
+	setup := &OrgSetup{OrgName: "Org3", SessionSecret: []byte("session-secret"), Wallet: &Wallet{Dir: t.TempDir()}}
+	token := "Bearer " + sessionToken("session-secret", "HS256", `{"id":"P1","exp":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`}`)
+	form := url.Values{"channelid": {"mychannel"}, "chaincodeid": {"basic"}, "patientId": {"P1"}, "consentId": {"C1"}}.Encode()
+
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		method        string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "record without a session", handler: setup.patientQuery("GetMyRecord"), method: http.MethodGet, wantStatus: http.StatusUnauthorized},
+		{name: "record without an enrolled identity", handler: setup.patientQuery("GetMyRecord"), method: http.MethodGet, authorization: token, wantStatus: http.StatusForbidden},
+		{name: "grant without a session", handler: setup.PatientConsents, method: http.MethodPost, wantStatus: http.StatusUnauthorized},
+		{name: "grant without an enrolled identity", handler: setup.PatientConsents, method: http.MethodPost, authorization: token, wantStatus: http.StatusForbidden},
+		{name: "revoke without a session", handler: setup.PatientRevokeConsent, method: http.MethodPost, wantStatus: http.StatusUnauthorized},
+		{name: "revoke without an enrolled identity", handler: setup.PatientRevokeConsent, method: http.MethodPost, authorization: token, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/patient?channelid=mychannel&chaincodeid=basic", strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package web
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/skip2/go-qrcode"
+)
+
+// pdfFont is the font family prescriptions are printed in. It is DejaVu Sans Condensed, embedded as UTF-8 TrueType
+// so that names and Chichewa text such as ŵ print as written; the PDF core fonts only cover cp1252.
+const pdfFont = "DejaVu"
+
+var (
+	//go:embed fonts/DejaVuSansCondensed.ttf
+	pdfFontRegular []byte
+	//go:embed fonts/DejaVuSansCondensed-Bold.ttf
+	pdfFontBold []byte
+	//go:embed fonts/DejaVuSansCondensed-Oblique.ttf
+	pdfFontItalic []byte
+)
+
+// pdfLabels holds the printed text of a prescription in one language.
+type pdfLabels struct {
+	Title        string
+	Patient      string
+	DateOfBirth  string
+	Prescriber   string
+	Facility     string
+	Directions   string
+	Instructions string
+	Quantity     string
+	Refills      string
+	Expires      string
+	Issued       string
+	Prescription string
+	Signed       string
+	Scan         string
+	Page         string
+	Sig          string // Printf format taking the dose amount, dose unit and doses per day
+}
+
+// pdfLanguages are the languages a prescription can be printed in, keyed by the lang parameter.
+var pdfLanguages = map[string]pdfLabels{
+	"en": {
+		Title:        "Prescription",
+		Patient:      "Patient",
+		DateOfBirth:  "Date of birth",
+		Prescriber:   "Prescriber",
+		Facility:     "Facility",
+		Directions:   "Directions",
+		Instructions: "Instructions",
+		Quantity:     "Quantity",
+		Refills:      "Refills",
+		Expires:      "Valid until",
+		Issued:       "Issued",
+		Prescription: "Prescription ID",
+		Signed:       "Digitally signed by the prescriber",
+		Scan:         "Scan to verify",
+		Page:         "Page %d",
+		Sig:          "Take %g %s %d times a day",
+	},
+	"ny": {
+		Title:        "Kalata ya Mankhwala",
+		Patient:      "Wodwala",
+		DateOfBirth:  "Tsiku lobadwa",
+		Prescriber:   "Dokotala",
+		Facility:     "Chipatala",
+		Directions:   "Malangizo",
+		Instructions: "Zowonjezera",
+		Quantity:     "Kuchuluka",
+		Refills:      "Kubwerezanso",
+		Expires:      "Ikugwira ntchito mpaka",
+		Issued:       "Tsiku loperekedwa",
+		Prescription: "Nambala ya mankhwala",
+		Signed:       "Yasainidwa ndi dokotala pa kompyuta",
+		Scan:         "Jambulani kuti mutsimikize",
+		Page:         "Tsamba %d",
+		Sig:          "Imwani %g %s ka %d pa tsiku",
+	},
+}
+
+// PrescriptionPDF handles printable prescription requests. It renders the patient's active prescriptions, or the
+// active one named by prescriptionId, on the prescribing facility's letterhead with a QR code that can be checked at
+// /verify. The record is read through AccessPatientRecord so that printing is audited like any other read.
+func (setup *OrgSetup) PrescriptionPDF(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	patientID := queryParams.Get("patientId")
+	prescriptionID := queryParams.Get("prescriptionId")
+	lang := queryParams.Get("lang")
+	if patientID == "" {
+		http.Error(w, "patientId is required", http.StatusBadRequest)
+		return
+	}
+	if lang == "" {
+		lang = "en"
+	}
+	labels, ok := pdfLanguages[lang]
+	if !ok {
+		http.Error(w, "lang must be en or ny", http.StatusBadRequest)
+		return
+	}
+
+	contract := setup.Gateway.GetNetwork(channelID).GetContract(chainCodeName)
+	recordJSON, err := contract.SubmitTransaction("AccessPatientRecord", patientID, "Print prescription")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read patient record: %s", err), http.StatusBadGateway)
+		return
+	}
+	var record patientRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse patient record: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Only active prescriptions are printed, so a dispensed, revoked or expired one cannot be presented again
+	var printable []recordPrescription
+	for _, prescription := range record.Prescriptions {
+		if prescriptionID != "" && prescription.PrescriptionId == prescriptionID && prescription.Status != "Active" {
+			http.Error(w, fmt.Sprintf("prescription %s is %s and cannot be printed", prescriptionID, prescription.Status), http.StatusConflict)
+			return
+		}
+		if prescription.Status == "Active" && (prescriptionID == "" || prescription.PrescriptionId == prescriptionID) {
+			printable = append(printable, prescription)
+		}
+	}
+	if len(printable) == 0 {
+		http.Error(w, "no printable prescriptions found", http.StatusNotFound)
+		return
+	}
+
+	tokens := make([]string, len(printable))
+	for i, prescription := range printable {
+		token, _, err := setup.issueToken(contract, patientID, prescription.PrescriptionId)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to issue verification token: %s", err), http.StatusBadGateway)
+			return
+		}
+		tokens[i] = token
+	}
+
+	var document bytes.Buffer
+	if err := setup.renderPrescriptionPDF(&document, &record, printable, tokens, labels); err != nil {
+		http.Error(w, fmt.Sprintf("failed to render prescription: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=prescription-%s.pdf", patientID))
+	w.Write(document.Bytes())
+}
+
+// renderPrescriptionPDF writes an A4 prescription with one block per prescription. Prescriptions from different
+// facilities start on a new page under their own letterhead.
+func (setup *OrgSetup) renderPrescriptionPDF(out *bytes.Buffer, record *patientRecord, prescriptions []recordPrescription, tokens []string, labels pdfLabels) error {
+	const (
+		margin    = 15.0
+		qrSize    = 32.0
+		pageWidth = 210.0
+		bottom    = 297.0 - margin - 10
+	)
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(margin, margin, margin)
+	pdf.SetAutoPageBreak(true, margin+10)
+	pdf.AddUTF8FontFromBytes(pdfFont, "", pdfFontRegular)
+	pdf.AddUTF8FontFromBytes(pdfFont, "B", pdfFontBold)
+	pdf.AddUTF8FontFromBytes(pdfFont, "I", pdfFontItalic)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-margin - 5)
+		pdf.SetFont(pdfFont, "I", 8)
+		pdf.SetTextColor(110, 110, 110)
+		pdf.CellFormat(0, 5, fmt.Sprintf(labels.Page, pdf.PageNo()), "", 0, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	})
+
+	header := func(facility string) {
+		pdf.AddPage()
+		letterhead := setup.letterheadFor(facility)
+		pdf.SetFont(pdfFont, "B", 16)
+		pdf.CellFormat(0, 8, letterhead.Name, "", 1, "L", false, 0, "")
+		pdf.SetFont(pdfFont, "", 10)
+		if letterhead.Address != "" {
+			pdf.CellFormat(0, 5, letterhead.Address, "", 1, "L", false, 0, "")
+		}
+		var contact []string
+		for _, value := range []string{letterhead.Phone, letterhead.Email} {
+			if value != "" {
+				contact = append(contact, value)
+			}
+		}
+		if len(contact) > 0 {
+			pdf.CellFormat(0, 5, strings.Join(contact, "  |  "), "", 1, "L", false, 0, "")
+		}
+		pdf.Ln(2)
+		pdf.SetLineWidth(0.6)
+		pdf.Line(margin, pdf.GetY(), pageWidth-margin, pdf.GetY())
+		pdf.Ln(4)
+
+		pdf.SetFont(pdfFont, "B", 14)
+		pdf.CellFormat(0, 8, labels.Title, "", 1, "L", false, 0, "")
+		pdf.SetFont(pdfFont, "", 11)
+		patient := record.PatientName + " (" + record.PatientId + ")"
+		pdfField(pdf, 0, labels.Patient, patient)
+		if record.DateOfBirth != "" {
+			pdfField(pdf, 0, labels.DateOfBirth, record.DateOfBirth)
+		}
+		pdf.Ln(3)
+	}
+
+	facility := ""
+	for i, prescription := range prescriptions {
+		if i == 0 || prescription.PrescriberFacility != facility || pdf.GetY()+qrSize+20 > bottom {
+			facility = prescription.PrescriberFacility
+			header(facility)
+		}
+
+		png, err := qrcode.Encode(tokens[i], qrcode.Medium, 512)
+		if err != nil {
+			return err
+		}
+		imageName := "qr-" + prescription.PrescriptionId
+		pdf.RegisterImageOptionsReader(imageName, fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+
+		top := pdf.GetY()
+		pdf.SetLineWidth(0.2)
+		pdf.Line(margin, top, pageWidth-margin, top)
+		pdf.Ln(2)
+		pdf.ImageOptions(imageName, pageWidth-margin-qrSize, top+2, qrSize, qrSize, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+		textWidth := pageWidth - 2*margin - qrSize - 4
+		medication := strings.TrimSpace(strings.Join([]string{prescription.MedicationName, prescription.Strength, prescription.DosageForm}, " "))
+		pdf.SetFont(pdfFont, "B", 12)
+		pdf.MultiCell(textWidth, 6, medication, "", "L", false)
+		pdf.SetFont(pdfFont, "", 10)
+		pdfField(pdf, textWidth, labels.Directions, structuredSig(prescription, labels))
+		if prescription.Instructions != "" {
+			pdfField(pdf, textWidth, labels.Instructions, prescription.Instructions)
+		}
+		pdfField(pdf, textWidth, labels.Quantity, fmt.Sprintf("%d    %s: %d", prescription.Quantity, labels.Refills, prescription.Refills))
+		pdfField(pdf, textWidth, labels.Prescriber, prescription.CreatedBy)
+		if prescription.PrescriberFacility != "" {
+			pdfField(pdf, textWidth, labels.Facility, prescription.PrescriberFacility)
+		}
+		if len(prescription.Timestamp) >= 10 {
+			pdfField(pdf, textWidth, labels.Issued, prescription.Timestamp[:10])
+		}
+		pdf.SetFont(pdfFont, "B", 10)
+		pdfField(pdf, textWidth, labels.Expires, prescription.ExpiryDate)
+		pdf.SetFont(pdfFont, "", 10)
+		pdfField(pdf, textWidth, labels.Prescription, prescription.PrescriptionId)
+		if prescription.SignerCertFingerprint != "" {
+			pdf.SetFont(pdfFont, "I", 9)
+			pdf.CellFormat(textWidth, 5, labels.Signed, "", 1, "L", false, 0, "")
+			pdf.SetFont(pdfFont, "", 10)
+		}
+
+		pdf.SetFont(pdfFont, "", 8)
+		pdf.Text(pageWidth-margin-qrSize, top+qrSize+5, labels.Scan)
+		pdf.SetFont(pdfFont, "", 10)
+		if pdf.GetY() < top+qrSize+8 {
+			pdf.SetY(top + qrSize + 8)
+		}
+		pdf.Ln(2)
+	}
+
+	return pdf.Output(out)
+}
+
+// pdfField prints a "label: value" line at the current position, wrapping within the given width.
+func pdfField(pdf *fpdf.Fpdf, width float64, label string, value string) {
+	pdf.MultiCell(width, 5, label+": "+value, "", "L", false)
+}
+
+// structuredSig renders the dose, unit and frequency as directions in the chosen language, falling back to the
+// free-text dosage for prescriptions written before structured dosing was recorded.
+func structuredSig(prescription recordPrescription, labels pdfLabels) string {
+	if prescription.DoseAmount > 0 && prescription.DoseUnit != "" && prescription.DosesPerDay > 0 {
+		return fmt.Sprintf(labels.Sig, prescription.DoseAmount, prescription.DoseUnit, prescription.DosesPerDay)
+	}
+	return prescription.Dosage
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRenderPrescriptionPDFPrintsUTF8(t *testing.T) {
+	setup := &OrgSetup{Letterheads: map[string]Letterhead{"MZH": {Name: "Chipatala cha Ŵanthu", Address: "Mzuzu"}}}
+	record := &patientRecord{PatientId: "P1", PatientName: "Ŵezi Banda", DateOfBirth: "1990-01-01"}
+	prescriptions := []recordPrescription{{
+		PrescriptionId:     "RX1",
+		MedicationName:     "Amoxicillin",
+		Strength:           "500 mg",
+		DosageForm:         "capsule",
+		DoseAmount:         1,
+		DoseUnit:           "kapisozi",
+		DosesPerDay:        3,
+		Instructions:       "Mutatha kudya – ŵiri",
+		Status:             "Active",
+		CreatedBy:          "DOC1",
+		PrescriberFacility: "MZH",
+		ExpiryDate:         "2026-12-31",
+	}}
+
+	for lang, labels := range pdfLanguages {
+		t.Run(lang, func(t *testing.T) {
+			var document bytes.Buffer
+			if err := setup.renderPrescriptionPDF(&document, record, prescriptions, []string{"token"}, labels); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(document.Bytes(), []byte("%PDF-")) {
+				t.Fatal("output is not a PDF")
+			}
+			if !bytes.Contains(document.Bytes(), []byte("/FontFile2")) {
+				t.Error("the UTF-8 font is not embedded")
+			}
+			if bytes.Contains(document.Bytes(), []byte("/Helvetica")) {
+				t.Error("a cp1252 core font is used")
+			}
+		})
+	}
+}
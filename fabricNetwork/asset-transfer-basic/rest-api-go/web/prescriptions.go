@@ -0,0 +1,269 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// prescriptionContent is the canonical prescription form the prescriber signs. It must match the chaincode's
+// PrescriptionContent field for field and in the same order, or signatures will not verify.
+type prescriptionContent struct {
+	PrescriptionId string   `json:"prescriptionId"`
+	PatientId      string   `json:"patientId"`
+	PrescriberId   string   `json:"prescriberId"`
+	MedicationCode string   `json:"medicationCode"`
+	Strength       string   `json:"strength"`
+	DosageForm     string   `json:"dosageForm"`
+	Dosage         string   `json:"dosage"`
+	DoseAmount     float64  `json:"doseAmount"`
+	DoseUnit       string   `json:"doseUnit"`
+	DosesPerDay    int      `json:"dosesPerDay"`
+	Instructions   string   `json:"instructions"`
+	Quantity       int      `json:"quantity"`
+	Refills        int      `json:"refills"`
+	DiagnosisCodes []string `json:"diagnosisCodes"`
+	ExpiryDate     string   `json:"expiryDate"`
+}
+
+// prescriptionFields are the signed fields as they appear in the chaincode's Prescription JSON.
+type prescriptionFields struct {
+	PrescriptionId string   `json:"PrescriptionId"`
+	MedicationCode string   `json:"MedicationCode"`
+	Strength       string   `json:"Strength"`
+	DosageForm     string   `json:"DosageForm"`
+	Dosage         string   `json:"Dosage"`
+	DoseAmount     float64  `json:"DoseAmount"`
+	DoseUnit       string   `json:"DoseUnit"`
+	DosesPerDay    int      `json:"DosesPerDay"`
+	Instructions   string   `json:"Instructions"`
+	Quantity       int      `json:"Quantity"`
+	Refills        int      `json:"Refills"`
+	DiagnosisCodes []string `json:"DiagnosisCodes"`
+	ExpiryDate     string   `json:"ExpiryDate"`
+}
+
+// IssuePrescriptions handles new prescriptions. Each prescription in the asset JSON must carry the Signature
+// and SignerCertificate the prescriber made on their own device; they are passed to the chaincode unchanged.
+// A patient the ledger does not know yet gets a new record, and for a known patient the prescriptions are
+// added to their record.
+func (setup *OrgSetup) IssuePrescriptions(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received IssuePrescriptions request")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	chainCodeName := r.FormValue("chaincodeid")
+	channelID := r.FormValue("channelid")
+
+	var asset map[string]interface{}
+	if err := json.Unmarshal([]byte(r.FormValue("asset")), &asset); err != nil {
+		http.Error(w, fmt.Sprintf("asset must be prescription record JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	patientID, _ := asset["PatientId"].(string)
+	doctorID, _ := asset["DoctorId"].(string)
+	prescriptions, _ := asset["Prescriptions"].([]interface{})
+	if patientID == "" || doctorID == "" || len(prescriptions) == 0 {
+		http.Error(w, "PatientId, DoctorId and at least one prescription are required", http.StatusBadRequest)
+		return
+	}
+	for _, item := range prescriptions {
+		prescription, ok := item.(map[string]interface{})
+		if !ok {
+			http.Error(w, "prescriptions must be JSON objects", http.StatusBadRequest)
+			return
+		}
+		if err := requireSignature(prescription); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, prescriptions: %d\n", channelID, chainCodeName, patientID, len(prescriptions))
+	network := setup.Gateway.GetNetwork(channelID)
+	contract := network.GetContract(chainCodeName)
+	result, err := issueToRecord(contract, asset)
+	if err != nil {
+		fmt.Fprintf(w, "Error submitting transaction: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", result)
+}
+
+// issueToRecord issues signed prescriptions with a new record for a patient the ledger does not know yet, or
+// adds them to the patient's existing record under their consent. It returns the result of the last transaction.
+func issueToRecord(contract *client.Contract, asset map[string]interface{}) ([]byte, error) {
+	assetJSON, err := json.Marshal(asset)
+	if err != nil {
+		return nil, err
+	}
+	result, err := contract.SubmitTransaction("CreatePatientIfAbsent", string(assetJSON))
+	if err != nil {
+		return nil, err
+	}
+	created, err := strconv.ParseBool(string(result))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected CreatePatientIfAbsent result %q", result)
+	}
+	if created {
+		return result, nil
+	}
+
+	patientID, _ := asset["PatientId"].(string)
+	doctorID, _ := asset["DoctorId"].(string)
+	prescriptionsJSON, err := json.Marshal(asset["Prescriptions"])
+	if err != nil {
+		return nil, err
+	}
+	return contract.SubmitTransaction("AddPrescriptions", patientID, doctorID, string(prescriptionsJSON))
+}
+
+// UpdatePrescription handles prescription updates. The prescriber signs the changed content on their own
+// device, and the signed prescription is passed to UpdatePrescription unchanged.
+func (setup *OrgSetup) UpdatePrescription(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received UpdatePrescription request")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	chainCodeName := r.FormValue("chaincodeid")
+	channelID := r.FormValue("channelid")
+	patientID := r.FormValue("patientId")
+
+	var prescription map[string]interface{}
+	if err := json.Unmarshal([]byte(r.FormValue("prescription")), &prescription); err != nil {
+		http.Error(w, fmt.Sprintf("prescription must be JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	prescriptionID, _ := prescription["PrescriptionId"].(string)
+	if patientID == "" || prescriptionID == "" {
+		http.Error(w, "patientId and PrescriptionId are required", http.StatusBadRequest)
+		return
+	}
+	if err := requireSignature(prescription); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, prescription: %s\n", channelID, chainCodeName, patientID, prescriptionID)
+	network := setup.Gateway.GetNetwork(channelID)
+	contract := network.GetContract(chainCodeName)
+	result, err := contract.SubmitTransaction("UpdatePrescription", patientID, r.FormValue("prescription"))
+	if err != nil {
+		fmt.Fprintf(w, "Error submitting transaction: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", result)
+}
+
+// PrescriptionContent returns the canonical content a prescriber signs for a prescription, and its SHA-256
+// digest, so that clients sign exactly what the chaincode verifies. The prescription is returned with its
+// fields normalized the way the chaincode stores them, and should be submitted in that form.
+func (setup *OrgSetup) PrescriptionContent(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received PrescriptionContent request")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	patientID := r.FormValue("patientId")
+	prescriberID := r.FormValue("prescriberId")
+	var prescription map[string]interface{}
+	if err := json.Unmarshal([]byte(r.FormValue("prescription")), &prescription); err != nil {
+		http.Error(w, fmt.Sprintf("prescription must be JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	if patientID == "" || prescriberID == "" {
+		http.Error(w, "patientId and prescriberId are required", http.StatusBadRequest)
+		return
+	}
+
+	content, err := canonicalContent(patientID, prescriberID, prescription)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	digest := sha256.Sum256(content)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"prescription": prescription,
+		"content":      string(content),
+		"digest":       base64.StdEncoding.EncodeToString(digest[:]),
+	})
+}
+
+// requireSignature checks that a prescription carries the prescriber's signature and certificate.
+func requireSignature(prescription map[string]interface{}) error {
+	signature, _ := prescription["Signature"].(string)
+	certificate, _ := prescription["SignerCertificate"].(string)
+	if signature == "" || certificate == "" {
+		id, _ := prescription["PrescriptionId"].(string)
+		return fmt.Errorf("prescription %s must carry the prescriber's Signature and SignerCertificate", id)
+	}
+	return nil
+}
+
+// canonicalContent normalizes the signed fields the way the chaincode stores them and returns the canonical
+// content the prescriber signs.
+func canonicalContent(patientID string, prescriberID string, prescription map[string]interface{}) ([]byte, error) {
+	// The chaincode stores diagnosis codes in upper case, and signed prescriptions need an explicit expiry
+	if codes, ok := prescription["DiagnosisCodes"].([]interface{}); ok {
+		for i, code := range codes {
+			if text, ok := code.(string); ok {
+				codes[i] = strings.ToUpper(strings.TrimSpace(text))
+			}
+		}
+	}
+	if expiry, _ := prescription["ExpiryDate"].(string); expiry == "" {
+		prescription["ExpiryDate"] = time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+	}
+
+	fieldsJSON, err := json.Marshal(prescription)
+	if err != nil {
+		return nil, err
+	}
+	var fields prescriptionFields
+	if err := json.Unmarshal(fieldsJSON, &fields); err != nil {
+		return nil, fmt.Errorf("invalid prescription: %w", err)
+	}
+	if fields.DiagnosisCodes == nil {
+		fields.DiagnosisCodes = []string{}
+	}
+
+	return json.Marshal(prescriptionContent{
+		PrescriptionId: fields.PrescriptionId,
+		PatientId:      patientID,
+		PrescriberId:   prescriberID,
+		MedicationCode: fields.MedicationCode,
+		Strength:       fields.Strength,
+		DosageForm:     fields.DosageForm,
+		Dosage:         fields.Dosage,
+		DoseAmount:     fields.DoseAmount,
+		DoseUnit:       fields.DoseUnit,
+		DosesPerDay:    fields.DosesPerDay,
+		Instructions:   fields.Instructions,
+		Quantity:       fields.Quantity,
+		Refills:        fields.Refills,
+		DiagnosisCodes: fields.DiagnosisCodes,
+		ExpiryDate:     fields.ExpiryDate,
+	})
+}
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrescriptionWritesRequireSignature(t *testing.T) {
+	setup := &OrgSetup{}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		form    url.Values
+	}{
+		{
+			name:    "issue without signature",
+			handler: setup.IssuePrescriptions,
+			form: url.Values{"asset": {`{"PatientId":"P1","DoctorId":"DOC1","Prescriptions":[
+				{"PrescriptionId":"RX1","MedicationCode":"AMOX","SignerCertificate":"-----BEGIN CERTIFICATE-----"}]}`}},
+		},
+		{
+			name:    "issue without certificate",
+			handler: setup.IssuePrescriptions,
+			form: url.Values{"asset": {`{"PatientId":"P1","DoctorId":"DOC1","Prescriptions":[
+				{"PrescriptionId":"RX1","MedicationCode":"AMOX","Signature":"MEUCIQ"}]}`}},
+		},
+		{
+			name:    "update without signature",
+			handler: setup.UpdatePrescription,
+			form:    url.Values{"patientId": {"P1"}, "prescription": {`{"PrescriptionId":"RX1","Quantity":20}`}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/prescriptions", strings.NewReader(tt.form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			tt.handler(recorder, request)
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+			}
+			if !strings.Contains(recorder.Body.String(), "Signature and SignerCertificate") {
+				t.Errorf("body = %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrescriptionContent(t *testing.T) {
+	form := url.Values{
+		"patientId":    {"P1"},
+		"prescriberId": {"DOC1"},
+		"prescription": {`{"PrescriptionId":"RX1","MedicationCode":"AMOX","Quantity":21,"DiagnosisCodes":[" j18.9 "],"ExpiryDate":"2024-05-08"}`},
+	}
+	request := httptest.NewRequest(http.MethodPost, "/prescriptions/content", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	(&OrgSetup{}).PrescriptionContent(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	var response struct {
+		Prescription map[string]interface{} `json:"prescription"`
+		Content      string                 `json:"content"`
+		Digest       string                 `json:"digest"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	wantContent := `{"prescriptionId":"RX1","patientId":"P1","prescriberId":"DOC1","medicationCode":"AMOX","strength":"",` +
+		`"dosageForm":"","dosage":"","doseAmount":0,"doseUnit":"","dosesPerDay":0,"instructions":"","quantity":21,` +
+		`"refills":0,"diagnosisCodes":["J18.9"],"expiryDate":"2024-05-08"}`
+	if response.Content != wantContent {
+		t.Errorf("content = %s, want %s", response.Content, wantContent)
+	}
+	digest := sha256.Sum256([]byte(response.Content))
+	if response.Digest != base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Errorf("digest = %s, want the SHA-256 of the content", response.Digest)
+	}
+	if codes, _ := response.Prescription["DiagnosisCodes"].([]interface{}); len(codes) != 1 || codes[0] != "J18.9" {
+		t.Errorf("prescription diagnosis codes = %v, want normalized [J18.9]", response.Prescription["DiagnosisCodes"])
+	}
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// prescriptionProof is the chaincode's proof of a prescription's content, extended with where the
+// content transaction was committed.
+type prescriptionProof struct {
+	PrescriptionId string `json:"PrescriptionId"`
+	PatientId      string `json:"PatientId"`
+	Content        string `json:"Content"`
+	ContentHash    string `json:"ContentHash"`
+	ComputedHash   string `json:"ComputedHash"`
+	Matches        bool   `json:"Matches"`
+	ContentTxID    string `json:"ContentTxID"`
+	Status         string `json:"Status"`
+	BlockNumber    uint64 `json:"BlockNumber"`
+	BlockDataHash  string `json:"BlockDataHash"`
+	ValidationCode string `json:"ValidationCode"`
+}
+
+// PrescriptionProof handles tamper-evidence proof requests. It returns the prescription's canonical content and
+// hash from the chaincode, and looks up the block and validation code of the transaction that wrote the content
+// through the query system chaincode (qscc), so a verifier can check inclusion against their own peer.
+func (setup *OrgSetup) PrescriptionProof(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received PrescriptionProof request")
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	patientID := queryParams.Get("patientId")
+	prescriptionID := queryParams.Get("prescriptionId")
+	if patientID == "" || prescriptionID == "" {
+		http.Error(w, "patientId and prescriptionId are required", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, prescription: %s\n", channelID, chainCodeName, patientID, prescriptionID)
+	network := setup.Gateway.GetNetwork(channelID)
+
+	proofJSON, err := network.GetContract(chainCodeName).EvaluateTransaction("GetPrescriptionProof", patientID, prescriptionID)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	var proof prescriptionProof
+	if err := json.Unmarshal(proofJSON, &proof); err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+
+	qscc := network.GetContract("qscc")
+	blockBytes, err := qscc.EvaluateTransaction("GetBlockByTxID", channelID, proof.ContentTxID)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	block := &common.Block{}
+	if err := proto.Unmarshal(blockBytes, block); err != nil {
+		fmt.Fprintf(w, "Error: failed to parse block: %s", err)
+		return
+	}
+	proof.BlockNumber = block.GetHeader().GetNumber()
+	proof.BlockDataHash = hex.EncodeToString(block.GetHeader().GetDataHash())
+
+	transactionBytes, err := qscc.EvaluateTransaction("GetTransactionByID", channelID, proof.ContentTxID)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	transaction := &peer.ProcessedTransaction{}
+	if err := proto.Unmarshal(transactionBytes, transaction); err != nil {
+		fmt.Fprintf(w, "Error: failed to parse transaction: %s", err)
+		return
+	}
+	proof.ValidationCode = peer.TxValidationCode(transaction.GetValidationCode()).String()
+
+	response, err := json.Marshal(proof)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", response)
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// verification is the result returned by the /verify endpoint.
+type verification struct {
+	Valid          bool   `json:"valid"`
+	Reason         string `json:"reason,omitempty"`
+	PrescriptionID string `json:"prescriptionId,omitempty"`
+	Status         string `json:"status,omitempty"`
+	MedicationName string `json:"medicationName,omitempty"`
+	Strength       string `json:"strength,omitempty"`
+	ExpiryDate     string `json:"expiryDate,omitempty"`
+	DispensedAt    string `json:"dispensedAt,omitempty"`
+	ContentMatches bool   `json:"contentMatches"`
+}
+
+// PrescriptionQR handles QR code requests. It returns a PNG (default) or SVG QR code holding a signed token for
+// the prescription, which a pharmacy without access to the prescriber's system can check at /verify.
+func (setup *OrgSetup) PrescriptionQR(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received PrescriptionQR request")
+	queryParams := r.URL.Query()
+	chainCodeName := queryParams.Get("chaincodeid")
+	channelID := queryParams.Get("channelid")
+	patientID := queryParams.Get("patientId")
+	prescriptionID := queryParams.Get("prescriptionId")
+	format := queryParams.Get("format")
+	if patientID == "" || prescriptionID == "" {
+		http.Error(w, "patientId and prescriptionId are required", http.StatusBadRequest)
+		return
+	}
+	size := 256
+	if value := queryParams.Get("size"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 64 || parsed > 2048 {
+			http.Error(w, "size must be between 64 and 2048", http.StatusBadRequest)
+			return
+		}
+		size = parsed
+	}
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, prescription: %s, format: %s\n", channelID, chainCodeName, patientID, prescriptionID, format)
+
+	contract := setup.Gateway.GetNetwork(channelID).GetContract(chainCodeName)
+	token, _, err := setup.issueToken(contract, patientID, prescriptionID)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+
+	switch format {
+	case "", "png":
+		png, err := qrcode.Encode(token, qrcode.Medium, size)
+		if err != nil {
+			fmt.Fprintf(w, "Error: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	case "svg":
+		svg, err := qrSVG(token, size)
+		if err != nil {
+			fmt.Fprintf(w, "Error: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprint(w, svg)
+	default:
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+	}
+}
+
+// Verify handles scanned prescription tokens. It checks the token signature and returns the prescription's
+// current status from the ledger (Active, Dispensed, Revoked, Expired).
+func (setup *OrgSetup) Verify(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received Verify request")
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	chainCodeName := r.FormValue("chaincodeid")
+	channelID := r.FormValue("channelid")
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	result := setup.verify(channelID, chainCodeName, token)
+	response, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", response)
+}
+
+// verify checks a token and looks up the prescription's ledger status.
+func (setup *OrgSetup) verify(channelID string, chainCodeName string, token string) *verification {
+	claims, err := setup.verifyToken(token, time.Now())
+	if err != nil {
+		return &verification{Reason: err.Error()}
+	}
+	return setup.prescriptionStatus(channelID, chainCodeName, claims.PrescriptionID, claims.PatientHash, claims.ContentHash)
+}
+
+// prescriptionStatus looks up a prescription's ledger status and whether the presented content hash is current.
+func (setup *OrgSetup) prescriptionStatus(channelID string, chainCodeName string, prescriptionID string, patientHash string, contentHash string) *verification {
+	contract := setup.Gateway.GetNetwork(channelID).GetContract(chainCodeName)
+	statusJSON, err := contract.EvaluateTransaction("GetPrescriptionStatus", prescriptionID, patientHash, contentHash)
+	if err != nil {
+		return &verification{PrescriptionID: prescriptionID, Reason: err.Error()}
+	}
+	var status ledgerStatus
+	if err := json.Unmarshal(statusJSON, &status); err != nil {
+		return &verification{PrescriptionID: prescriptionID, Reason: err.Error()}
+	}
+	return status.verification(prescriptionID)
+}
+
+// ledgerStatus is the result of the chaincode's GetPrescriptionStatus.
+type ledgerStatus struct {
+	Status         string `json:"Status"`
+	MedicationName string `json:"MedicationName"`
+	Strength       string `json:"Strength"`
+	ExpiryDate     string `json:"ExpiryDate"`
+	DispensedAt    string `json:"DispensedAt"`
+	ContentMatches bool   `json:"ContentMatches"`
+}
+
+// verification reports the prescription as valid only while it is active and unchanged since the code was issued.
+func (status *ledgerStatus) verification(prescriptionID string) *verification {
+	result := &verification{
+		Valid:          status.ContentMatches && status.Status == "Active",
+		PrescriptionID: prescriptionID,
+		Status:         status.Status,
+		MedicationName: status.MedicationName,
+		Strength:       status.Strength,
+		ExpiryDate:     status.ExpiryDate,
+		DispensedAt:    status.DispensedAt,
+		ContentMatches: status.ContentMatches,
+	}
+	switch {
+	case !status.ContentMatches:
+		result.Reason = "prescription has been changed since this code was issued"
+	case status.Status != "Active":
+		result.Reason = fmt.Sprintf("prescription is %s", status.Status)
+	}
+	return result
+}
+
+// qrSVG renders the text as an SVG QR code of the given pixel size.
+func qrSVG(text string, size int) (string, error) {
+	code, err := qrcode.New(text, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	bitmap := code.Bitmap()
+	modules := len(bitmap)
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+	return svg.String(), nil
+}
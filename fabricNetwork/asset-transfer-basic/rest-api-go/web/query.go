@@ -5,6 +5,18 @@ import (
 	"net/http"
 )
 
+// auditedFunctions are chaincode reads that record an access audit entry. Evaluating them would skip
+// the audit, since an evaluated transaction is never committed, and submitting them through /invoke
+// would record the gateway's own identity rather than the user's, so /query and /invoke both refuse
+// them and they are read through /records/access instead.
+var auditedFunctions = map[string]bool{
+	"AccessPatientRecord":       true,
+	"ReadPrescription":          true,
+	"GetAssetHistory":           true,
+	"GetPrescriptionsByPatient": true,
+	"GetPrescriptionsByStatus":  true,
+}
+
 // Query handles chaincode query requests.
 func (setup OrgSetup) Query(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received Query request")
@@ -14,6 +26,10 @@ func (setup OrgSetup) Query(w http.ResponseWriter, r *http.Request) {
 	function := queryParams.Get("function")
 	args := r.URL.Query()["args"]
 	fmt.Printf("channel: %s, chaincode: %s, function: %s, args: %s\n", channelID, chainCodeName, function, args)
+	if auditedFunctions[function] {
+		http.Error(w, fmt.Sprintf("%s is an audited read; use /records/access", function), http.StatusBadRequest)
+		return
+	}
 	network := setup.Gateway.GetNetwork(channelID)
 	contract := network.GetContract(chainCodeName)
 	evaluateResponse, err := contract.EvaluateTransaction(function, args...)
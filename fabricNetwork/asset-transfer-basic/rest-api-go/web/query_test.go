@@ -0,0 +1,40 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestQueryRejectsAuditedReads(t *testing.T) {
+	for function := range auditedFunctions {
+		t.Run(function, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/query?channelid=mychannel&chaincodeid=basic&function="+function+"&args=P1", nil)
+			recorder := httptest.NewRecorder()
+			OrgSetup{}.Query(recorder, request)
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestInvokeRejectsAuditedReads(t *testing.T) {
+	for function := range auditedFunctions {
+		t.Run(function, func(t *testing.T) {
+			form := url.Values{"channelid": {"mychannel"}, "chaincodeid": {"basic"}, "function": {function}, "args": {"P1"}}
+			request := httptest.NewRequest(http.MethodPost, "/invoke", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			(&OrgSetup{}).Invoke(recorder, request)
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+			}
+			if !strings.Contains(recorder.Body.String(), "/records/access") {
+				t.Fatalf("body = %q, want a pointer to /records/access", recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// AccessRecord handles clinical reads of a patient record. The read is submitted rather than
+// evaluated so that the chaincode commits an audit entry of who viewed the record and why, and
+// it is submitted with the signed-in user's own enrolled identity.
+// With view=history it returns the record's history from GetAssetHistory instead.
+func (setup *OrgSetup) AccessRecord(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received AccessRecord request")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprintf(w, "ParseForm() err: %s", err)
+		return
+	}
+	chainCodeName := r.FormValue("chaincodeid")
+	channelID := r.FormValue("channelid")
+	patientID := r.FormValue("patientId")
+	purpose := r.FormValue("purpose")
+	view := r.FormValue("view")
+	if patientID == "" || purpose == "" {
+		http.Error(w, "patientId and purpose are required", http.StatusBadRequest)
+		return
+	}
+	var function string
+	var args []string
+	switch view {
+	case "", "record":
+		function, args = "AccessPatientRecord", []string{patientID, purpose}
+	case "history":
+		// GetAssetHistory records its own purpose in the audit entry
+		function, args = "GetAssetHistory", []string{patientID}
+	default:
+		http.Error(w, "view must be record or history", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("channel: %s, chaincode: %s, patient: %s, purpose: %s, view: %s\n", channelID, chainCodeName, patientID, purpose, view)
+	// The read is submitted as the signed-in clinician so the audit entry names them, not the server
+	contract := setup.userContract(w, r, channelID, chainCodeName)
+	if contract == nil {
+		return
+	}
+	result, err := contract.SubmitTransaction(function, args...)
+	if err != nil {
+		fmt.Fprintf(w, "Error submitting transaction: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "Response: %s", result)
+}
+
+// patientRecord is the chaincode's Asset, limited to the fields the REST layer renders.
+type patientRecord struct {
+	DoctorId      string               `json:"DoctorId"`
+	PatientName   string               `json:"PatientName"`
+	PatientId     string               `json:"PatientId"`
+	DateOfBirth   string               `json:"DateOfBirth"`
+	Prescriptions []recordPrescription `json:"Prescriptions"`
+	LastUpdated   string               `json:"LastUpdated"`
+}
+
+// recordPrescription is the chaincode's Prescription, limited to the fields the REST layer renders.
+type recordPrescription struct {
+	PrescriptionId        string   `json:"PrescriptionId"`
+	MedicationCode        string   `json:"MedicationCode"`
+	MedicationName        string   `json:"MedicationName"`
+	Strength              string   `json:"Strength"`
+	DosageForm            string   `json:"DosageForm"`
+	Dosage                string   `json:"Dosage"`
+	Instructions          string   `json:"Instructions"`
+	Status                string   `json:"Status"`
+	CreatedBy             string   `json:"CreatedBy"`
+	TxID                  string   `json:"TxID"`
+	Timestamp             string   `json:"Timestamp"`
+	ExpiryDate            string   `json:"ExpiryDate"`
+	DispensingPharmacist  string   `json:"dispensingPharmacist"`
+	DispensingTimestamp   string   `json:"dispensingTimestamp"`
+	Quantity              int      `json:"Quantity"`
+	Refills               int      `json:"Refills"`
+	DispensedQuantity     int      `json:"DispensedQuantity"`
+	DispensingFacility    string   `json:"DispensingFacility"`
+	PrescriberFacility    string   `json:"PrescriberFacility"`
+	EncounterId           string   `json:"EncounterId"`
+	DiagnosisCodes        []string `json:"DiagnosisCodes"`
+	DoseAmount            float64  `json:"DoseAmount"`
+	DoseUnit              string   `json:"DoseUnit"`
+	DosesPerDay           int      `json:"DosesPerDay"`
+	DispensedBatch        string   `json:"DispensedBatch"`
+	BatchManufacturer     string   `json:"BatchManufacturer"`
+	BatchExpiry           string   `json:"BatchExpiry"`
+	DispensedCode         string   `json:"DispensedCode"`
+	DispensedName         string   `json:"DispensedName"`
+	DispensedStrength     string   `json:"DispensedStrength"`
+	Substituted           bool     `json:"Substituted"`
+	SubstitutionReason    string   `json:"SubstitutionReason"`
+	Signature             string   `json:"Signature"`
+	SignerCertFingerprint string   `json:"SignerCertFingerprint"`
+	ContentHash           string   `json:"ContentHash"`
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// defaultTokenMaxAge is how long a prescription token is accepted when no maximum age is configured.
+const defaultTokenMaxAge = 90 * 24 * time.Hour
+
+// tokenClockSkew allows for a token issued by a server whose clock runs slightly ahead.
+const tokenClockSkew = 5 * time.Minute
+
+// prescriptionToken is the compact claim set carried in a prescription QR code. It identifies the prescription
+// and the exact content that was issued without revealing the patient.
+type prescriptionToken struct {
+	PrescriptionID string `json:"pid"`
+	PatientHash    string `json:"ph"` // hex HMAC-SHA256 of the patient ID under the server's patient hash key
+	ContentHash    string `json:"ch"` // the prescription's ContentHash on the ledger
+	IssuedAt       int64  `json:"iat"`
+}
+
+// issueToken reads the prescription's content hash from the ledger and returns a signed token for it.
+func (setup *OrgSetup) issueToken(contract *client.Contract, patientID string, prescriptionID string) (string, *prescriptionToken, error) {
+	proofJSON, err := contract.EvaluateTransaction("GetPrescriptionProof", patientID, prescriptionID)
+	if err != nil {
+		return "", nil, err
+	}
+	var proof prescriptionProof
+	if err := json.Unmarshal(proofJSON, &proof); err != nil {
+		return "", nil, err
+	}
+
+	patientHash, err := setup.patientHash(patientID)
+	if err != nil {
+		return "", nil, err
+	}
+	claims := &prescriptionToken{
+		PrescriptionID: prescriptionID,
+		PatientHash:    patientHash,
+		ContentHash:    proof.ContentHash,
+		IssuedAt:       time.Now().Unix(),
+	}
+	token, err := setup.signToken(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// signToken encodes the claims as base64url JSON followed by "." and the base64url ECDSA signature over the
+// SHA-256 digest of the encoded claims.
+func (setup *OrgSetup) signToken(claims *prescriptionToken) (string, error) {
+	if setup.Sign == nil {
+		return "", fmt.Errorf("no signing key configured for %s", setup.OrgName)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := setup.Sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyToken checks a token's signature against this server's certificate and its age, and returns its claims.
+func (setup *OrgSetup) verifyToken(token string, now time.Time) (*prescriptionToken, error) {
+	if setup.Certificate == nil {
+		return nil, fmt.Errorf("no certificate configured for %s", setup.OrgName)
+	}
+	publicKey, ok := setup.Certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("certificate for %s does not hold an ECDSA key", setup.OrgName)
+	}
+
+	payload, encodedSignature, found := strings.Cut(strings.TrimSpace(token), ".")
+	if !found {
+		return nil, fmt.Errorf("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(payload))
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return nil, fmt.Errorf("token signature is invalid")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	var claims prescriptionToken
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	if claims.PrescriptionID == "" || claims.PatientHash == "" || claims.ContentHash == "" {
+		return nil, fmt.Errorf("token is missing claims")
+	}
+	maxAge := setup.TokenMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultTokenMaxAge
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if claims.IssuedAt == 0 || issuedAt.After(now.Add(tokenClockSkew)) {
+		return nil, fmt.Errorf("token has no valid issue time")
+	}
+	if now.Sub(issuedAt) > maxAge {
+		return nil, fmt.Errorf("token has expired; ask for a newly printed prescription")
+	}
+	return &claims, nil
+}
+
+// patientHash is the hex HMAC-SHA256 of a patient ID under this server's patient hash key. Unlike a plain hash
+// it cannot be reversed by hashing candidate patient IDs.
+func (setup *OrgSetup) patientHash(patientID string) (string, error) {
+	if len(setup.PatientHashKey) == 0 {
+		return "", fmt.Errorf("no patient hash key configured for %s", setup.OrgName)
+	}
+	mac := hmac.New(sha256.New, setup.PatientHashKey)
+	mac.Write([]byte(patientID))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
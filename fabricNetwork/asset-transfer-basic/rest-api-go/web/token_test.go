@@ -0,0 +1,155 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// testSetup returns an organization setup with a fresh signing key, certificate and patient hash key.
+func testSetup(t *testing.T) *OrgSetup {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "User1@org1.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := identity.NewPrivateKeySign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &OrgSetup{OrgName: "Org1", Sign: sign, Certificate: certificate, PatientHashKey: []byte("secret"), TokenMaxAge: 30 * 24 * time.Hour}
+}
+
+func TestVerifyToken(t *testing.T) {
+	setup := testSetup(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	patientHash, err := setup.patientHash("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		tamper   bool
+		wantErr  string
+	}{
+		{name: "fresh", issuedAt: now.Add(-time.Hour)},
+		{name: "at the maximum age", issuedAt: now.Add(-30 * 24 * time.Hour)},
+		{name: "older than the maximum age", issuedAt: now.Add(-31 * 24 * time.Hour), wantErr: "token has expired"},
+		{name: "no issue time", wantErr: "no valid issue time"},
+		{name: "issued in the future", issuedAt: now.Add(time.Hour), wantErr: "no valid issue time"},
+		{name: "tampered", issuedAt: now.Add(-time.Hour), tamper: true, wantErr: "signature is invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &prescriptionToken{PrescriptionID: "RX1", PatientHash: patientHash, ContentHash: "abc"}
+			if !tt.issuedAt.IsZero() {
+				claims.IssuedAt = tt.issuedAt.Unix()
+			}
+			token, err := setup.signToken(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper {
+				other, err := setup.signToken(&prescriptionToken{PrescriptionID: "RX2", PatientHash: patientHash, ContentHash: "abc", IssuedAt: claims.IssuedAt})
+				if err != nil {
+					t.Fatal(err)
+				}
+				// RX2's claims under RX1's signature
+				payload, _, _ := strings.Cut(other, ".")
+				_, signature, _ := strings.Cut(token, ".")
+				token = payload + "." + signature
+			}
+
+			verified, err := setup.verifyToken(token, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyToken() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyToken() error = %v", err)
+			}
+			if verified.PrescriptionID != "RX1" || verified.PatientHash != patientHash {
+				t.Fatalf("verifyToken() claims = %+v", verified)
+			}
+		})
+	}
+}
+
+func TestPatientHashIsKeyed(t *testing.T) {
+	setup := testSetup(t)
+	hash, err := setup.patientHash("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup.PatientHashKey = []byte("another secret")
+	other, err := setup.patientHash("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == other {
+		t.Fatal("patient hashes under different keys should differ")
+	}
+
+	setup.PatientHashKey = nil
+	if _, err := setup.patientHash("P1"); err == nil {
+		t.Fatal("patientHash() without a key should fail")
+	}
+}
+
+func TestLedgerStatusVerification(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     ledgerStatus
+		wantValid  bool
+		wantReason string
+	}{
+		{name: "active", status: ledgerStatus{Status: "Active", ContentMatches: true}, wantValid: true},
+		{name: "dispensed", status: ledgerStatus{Status: "Dispensed", ContentMatches: true}, wantReason: "prescription is Dispensed"},
+		{name: "revoked", status: ledgerStatus{Status: "Revoked", ContentMatches: true}, wantReason: "prescription is Revoked"},
+		{name: "expired", status: ledgerStatus{Status: "Expired", ContentMatches: true}, wantReason: "prescription is Expired"},
+		{name: "pending approval", status: ledgerStatus{Status: "PendingApproval", ContentMatches: true}, wantReason: "prescription is PendingApproval"},
+		{name: "changed", status: ledgerStatus{Status: "Active"}, wantReason: "prescription has been changed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.status.verification("RX1")
+			if result.Valid != tt.wantValid {
+				t.Errorf("Valid = %v, want %v", result.Valid, tt.wantValid)
+			}
+			if !strings.HasPrefix(result.Reason, tt.wantReason) || (tt.wantReason == "") != (result.Reason == "") {
+				t.Errorf("Reason = %q, want %q", result.Reason, tt.wantReason)
+			}
+			if result.Status != tt.status.Status || result.PrescriptionID != "RX1" {
+				t.Errorf("verification = %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/hash"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"google.golang.org/grpc"
+)
+
+// errNotEnrolled is returned for a signed-in user who has no identity of their own in the wallet.
+var errNotEnrolled = errors.New("no identity is enrolled for this user")
+
+// sessionClaims are the claims of the HS256 session token the backend issues a signed-in user.
+type sessionClaims struct {
+	ID        string `json:"id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// authenticate verifies the request's bearer session token with the secret shared with the backend and returns
+// its claims.
+func (setup *OrgSetup) authenticate(r *http.Request, now time.Time) (*sessionClaims, error) {
+	if len(setup.SessionSecret) == 0 {
+		return nil, fmt.Errorf("no session secret configured for %s", setup.OrgName)
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil, fmt.Errorf("a bearer session token is required")
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed session token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed session token header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("session token must be signed with HS256")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed session token signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, setup.SessionSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, fmt.Errorf("session token signature is invalid")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed session token payload: %w", err)
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("malformed session token payload: %w", err)
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("session token names no user")
+	}
+	if claims.ExpiresAt == 0 || !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("session token has expired")
+	}
+	return &claims, nil
+}
+
+// Wallet holds the enrolled identities of individual users, each in a Fabric MSP directory named after the user
+// ID (<dir>/<user ID>/signcerts/cert.pem and <dir>/<user ID>/keystore/), as fabric-ca-client enroll -M writes it.
+type Wallet struct {
+	Dir string
+
+	mu         sync.Mutex
+	connection *grpc.ClientConn
+	gateways   map[string]*client.Gateway
+}
+
+// userGateway returns a gateway connection that submits as the user's own enrolled identity.
+func (setup *OrgSetup) userGateway(userID string) (*client.Gateway, error) {
+	wallet := setup.Wallet
+	if wallet == nil {
+		return nil, errNotEnrolled
+	}
+	if userID == "" || userID == "." || userID == ".." || filepath.Base(userID) != userID {
+		return nil, errNotEnrolled
+	}
+
+	wallet.mu.Lock()
+	defer wallet.mu.Unlock()
+	if gateway, ok := wallet.gateways[userID]; ok {
+		return gateway, nil
+	}
+
+	mspDir := filepath.Join(wallet.Dir, userID)
+	certificate, err := loadCertificate(filepath.Join(mspDir, "signcerts", "cert.pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := identity.NewX509Identity(setup.MSPID, certificate)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := loadSign(filepath.Join(mspDir, "keystore"))
+	if err != nil {
+		return nil, err
+	}
+
+	if wallet.connection == nil {
+		wallet.connection = setup.newGrpcConnection()
+	}
+	gateway, err := client.Connect(
+		id,
+		client.WithSign(sign),
+		client.WithHash(hash.SHA256),
+		client.WithClientConnection(wallet.connection),
+		client.WithEvaluateTimeout(5*time.Second),
+		client.WithEndorseTimeout(15*time.Second),
+		client.WithSubmitTimeout(5*time.Second),
+		client.WithCommitStatusTimeout(1*time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if wallet.gateways == nil {
+		wallet.gateways = map[string]*client.Gateway{}
+	}
+	wallet.gateways[userID] = gateway
+	return gateway, nil
+}
+
+// userContract returns the contract as the signed-in user's own identity, never the server's shared one. It answers
+// 401 when the request carries no valid session token and 403 when the user has no enrolled identity, and then
+// returns nil.
+func (setup *OrgSetup) userContract(w http.ResponseWriter, r *http.Request, channelID string, chainCodeName string) *client.Contract {
+	claims, err := setup.authenticate(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	gateway, err := setup.userGateway(claims.ID)
+	if errors.Is(err, errNotEnrolled) {
+		http.Error(w, fmt.Sprintf("user %s has no enrolled identity with %s", claims.ID, setup.OrgName), http.StatusForbidden)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return gateway.GetNetwork(channelID).GetContract(chainCodeName)
+}
+
+// loadSign creates a signing function from the private key in an MSP keystore directory.
+func loadSign(keyPath string) (identity.Sign, error) {
+	files, err := os.ReadDir(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key directory: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no private key in %s", keyPath)
+	}
+	privateKeyPEM, err := os.ReadFile(filepath.Join(keyPath, files[0].Name()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+	privateKey, err := identity.PrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewPrivateKeySign(privateKey)
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionToken signs a session token the way the backend does.
+func sessionToken(secret string, alg string, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticate(t *testing.T) {
+	setup := &OrgSetup{OrgName: "Org1", SessionSecret: []byte("session-secret")}
+	now := time.Unix(1714564800, 0)
+	valid := `{"id":"dr-banda","role":"doctor","exp":1714565100}`
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantErr       string
+	}{
+		{name: "valid", authorization: "Bearer " + sessionToken("session-secret", "HS256", valid)},
+		{name: "no token", wantErr: "bearer session token is required"},
+		{name: "another secret", authorization: "Bearer " + sessionToken("guess", "HS256", valid), wantErr: "signature is invalid"},
+		{name: "unsigned", authorization: "Bearer " + sessionToken("session-secret", "none", valid), wantErr: "must be signed with HS256"},
+		{name: "expired", authorization: "Bearer " + sessionToken("session-secret", "HS256", `{"id":"dr-banda","exp":1714564800}`), wantErr: "has expired"},
+		{name: "no expiry", authorization: "Bearer " + sessionToken("session-secret", "HS256", `{"id":"dr-banda"}`), wantErr: "has expired"},
+		{name: "no user", authorization: "Bearer " + sessionToken("session-secret", "HS256", `{"exp":1714565100}`), wantErr: "names no user"},
+		{name: "malformed", authorization: "Bearer abc.def", wantErr: "malformed session token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/patient/record", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			claims, err := setup.authenticate(r, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("authenticate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.ID != "dr-banda" {
+				t.Errorf("ID = %q, want dr-banda", claims.ID)
+			}
+		})
+	}
+}
+
+func TestUserContractRefusesWithoutOwnIdentity(t *testing.T) {
+	setup := &OrgSetup{OrgName: "Org1", SessionSecret: []byte("session-secret"), Wallet: &Wallet{Dir: t.TempDir()}}
+	token := func(id string) string {
+		return "Bearer " + sessionToken("session-secret", "HS256", `{"id":"`+id+`","exp":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`}`)
+	}
+
+	tests := []struct {
+		name          string
+		setup         *OrgSetup
+		authorization string
+		wantStatus    int
+	}{
+		{name: "not signed in", setup: setup, wantStatus: http.StatusUnauthorized},
+		{name: "not enrolled", setup: setup, authorization: token("P1"), wantStatus: http.StatusForbidden},
+		{name: "user ID outside the wallet", setup: setup, authorization: token("../org1"), wantStatus: http.StatusForbidden},
+		{name: "no wallet", setup: &OrgSetup{OrgName: "Org3", SessionSecret: []byte("session-secret")}, authorization: token("P1"), wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/patient/record?channelid=mychannel&chaincodeid=basic", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			if contract := tt.setup.userContract(w, r, "mychannel", "basic"); contract != nil {
+				t.Fatal("userContract() returned a contract")
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ import { FiPlus, FiX, FiCheckCircle, FiSearch, FiChevronDown, FiChevronRight, Fi
 import axios from 'axios';
 import useAuth from '../../../hooks/useAuth';
 import { useLocation } from 'react-router-dom';
+import { loadPrescriberKey, hasPrescriberKey, signPrescription } from '../../../utils/prescriptionSigning';
 
 const FREQUENCY_OPTIONS = [
   'Once a day',
@@ -58,6 +59,13 @@ const MEDICATION_CATEGORIES = {
   ]
 };
 
+// ICD10_PATTERN matches the ICD-10 codes the ledger accepts, such as J18.9 or B54
+const ICD10_PATTERN = /^[A-Z][0-9][0-9A-Z](\.[0-9A-Z]{1,4})?$/;
+
+// parseDiagnosisCodes splits comma- or space-separated codes and upper-cases them the way the ledger stores them
+const parseDiagnosisCodes = (value) =>
+  value.split(/[\s,;]+/).map(code => code.trim().toUpperCase()).filter(Boolean);
+
 const PrescriptionButton = ({ activeView }) => {
   const [showModal, setShowModal] = useState(false);
   const [showVerificationModal, setShowVerificationModal] = useState(false);
@@ -68,7 +76,8 @@ const PrescriptionButton = ({ activeView }) => {
   const [loadingProfile, setLoadingProfile] = useState(false);
   const [prescriptionForm, setPrescriptionForm] = useState({
     diagnosis: '',
-    medications: [{ name: '', dosage: '', frequency: '' }]
+    diagnosisCodes: '',
+    medications: [{ name: '', code: '', dosage: '', frequency: '' }]
   });
   const [error, setError] = useState(null);
   const [successMessage, setSuccessMessage] = useState(null);
@@ -77,6 +86,8 @@ const PrescriptionButton = ({ activeView }) => {
   const [searchTerm, setSearchTerm] = useState('');
   const [expandedCategories, setExpandedCategories] = useState({});
   const [filteredMedications, setFilteredMedications] = useState([]);
+  const [signingKeyLoaded, setSigningKeyLoaded] = useState(hasPrescriberKey());
+  const [signingFiles, setSigningFiles] = useState({ key: null, certificate: null });
   const modalRef = useRef();
   const medicationModalRef = useRef();
   const searchInputRef = useRef();
@@ -92,7 +103,7 @@ const PrescriptionButton = ({ activeView }) => {
   const addMedication = () => {
     setPrescriptionForm({
       ...prescriptionForm,
-      medications: [...prescriptionForm.medications, { name: '', dosage: '', frequency: '' }]
+      medications: [...prescriptionForm.medications, { name: '', code: '', dosage: '', frequency: '' }]
     });
   };
 
@@ -105,7 +116,8 @@ const PrescriptionButton = ({ activeView }) => {
   const handleClearForm = () => {
     setPrescriptionForm({
       diagnosis: '',
-      medications: [{ name: '', dosage: '', frequency: '' }]
+      diagnosisCodes: '',
+      medications: [{ name: '', code: '', dosage: '', frequency: '' }]
     });
   };
   // Helper function to check if a medication is already selected
@@ -134,32 +146,35 @@ const PrescriptionButton = ({ activeView }) => {
     }, 100);
   };
   
-  // Handle medication search
-  const handleMedicationSearch = (term) => {
+  // Handle medication search against the formulary, so every prescription carries a formulary code
+  const handleMedicationSearch = async (term) => {
     setSearchTerm(term);
     
-    if (!term.trim()) {
+    if (term.trim().length < 2) {
       setFilteredMedications([]);
       return;
     }
     
-    // Search through all medications in all categories
-    const results = [];
-    Object.entries(MEDICATION_CATEGORIES).forEach(([category, medications]) => {
-      medications.forEach(medication => {
-        if (medication.toLowerCase().includes(term.toLowerCase())) {
-          results.push({ category, medication });
-        }
-      });
-    });
-    
-    setFilteredMedications(results);
+    try {
+      const response = await axios.get('http://localhost:5000/doctor/formulary', { params: { name: term.trim() } });
+      const matches = response.data && response.data.success ? response.data.data : [];
+      setFilteredMedications(matches.map(match => ({
+        medication: match.genericName,
+        code: match.code,
+        category: match.atcCode
+      })));
+    } catch (err) {
+      console.error('Error searching formulary:', err);
+      setFilteredMedications([]);
+    }
   };
-    // Select a medication from the list
-  const selectMedication = (medicationName) => {
+    // Select a formulary medication from the search results
+  const selectMedication = (medicationName, code) => {
     // Allow selection if it's for the current medication index or if it's not selected elsewhere
     if (!isMedicationSelectedElsewhere(medicationName, currentMedicationIndex)) {
-      handleMedicationChange(currentMedicationIndex, 'name', medicationName);
+      const newMeds = [...prescriptionForm.medications];
+      newMeds[currentMedicationIndex] = { ...newMeds[currentMedicationIndex], name: medicationName, code };
+      setPrescriptionForm({ ...prescriptionForm, medications: newMeds });
       setShowMedicationModal(false);
     }
   };
@@ -214,12 +229,46 @@ const PrescriptionButton = ({ activeView }) => {
     }
   };
   
+  // Load the prescriber's enrolment key and certificate; prescriptions are signed with them on this device
+  const handleLoadSigningKey = async () => {
+    if (!signingFiles.key || !signingFiles.certificate) {
+      setError('Select both your enrolment private key and certificate files.');
+      return;
+    }
+    try {
+      await loadPrescriberKey(await signingFiles.key.text(), await signingFiles.certificate.text());
+      setSigningKeyLoaded(true);
+      setError(null);
+    } catch (err) {
+      console.error('Error loading signing key:', err);
+      setError(`Could not load your signing key: ${err.message}`);
+    }
+  };
+
   const handleSubmitPrescription = async (e) => {
     e?.preventDefault();    // Validate form data
     if (!prescriptionForm.diagnosis || prescriptionForm.medications.some(med => !med.name || !med.dosage || !med.frequency)) {
       setError('All fields are required, including diagnosis and all medication details (name, dosage, and frequency).');
       return;
     }
+    const diagnosisCodes = parseDiagnosisCodes(prescriptionForm.diagnosisCodes);
+    if (diagnosisCodes.length === 0) {
+      setError('Enter at least one ICD-10 diagnosis code, for example J18.9.');
+      return;
+    }
+    const invalidCode = diagnosisCodes.find(code => !ICD10_PATTERN.test(code));
+    if (invalidCode) {
+      setError(`${invalidCode} is not an ICD-10 code. Codes look like J18.9 or B54.`);
+      return;
+    }
+    if (prescriptionForm.medications.some(med => !med.code)) {
+      setError('Select each medication from the formulary search results.');
+      return;
+    }
+    if (!hasPrescriberKey()) {
+      setError('Load your signing key before issuing prescriptions.');
+      return;
+    }
     
     // Check for valid doctor ID
     const userInfo = getUserInfo();
@@ -247,20 +296,22 @@ const PrescriptionButton = ({ activeView }) => {
         patient: verifiedPatient,
         ...prescriptionForm,
       });
-        // Format medications for the backend
-      const formattedMedications = prescriptionForm.medications.map(med => ({
-        medicationName: med.name,
-        medication: med.name, // Add this as a fallback since controller checks for both
-        dosage: med.dosage,
-        instructions: med.frequency,
-        diagnosis: prescriptionForm.diagnosis
-      }));      // Log the request payload for debugging
-      const { id: doctorId } = getUserInfo();
+      // Sign each medication as a prescription on this device; the ID is part of the signed content
+      const signedPrescriptions = await Promise.all(prescriptionForm.medications.map(med => {
+        const id = Array.from(window.crypto.getRandomValues(new Uint8Array(8)), b => b.toString(16).padStart(2, '0')).join('');
+        return signPrescription(verifiedPatient.id, doctorId, {
+          PrescriptionId: id,
+          MedicationCode: med.code,
+          Dosage: med.dosage,
+          Instructions: med.frequency,
+          DiagnosisCodes: diagnosisCodes
+        });
+      }));
       const requestPayload = {
         patientId: verifiedPatient.id,
         doctorId: doctorId, // Use auth hook to get user ID
         patientName: verifiedPatient.name,
-        prescriptions: formattedMedications
+        prescriptions: signedPrescriptions
       };
       
       console.log('Request payload:', JSON.stringify(requestPayload));
@@ -575,10 +626,10 @@ const PrescriptionButton = ({ activeView }) => {
                   Search Results
                 </h4>
                 <div className="space-y-1">                  {filteredMedications.length > 0 ? (
-                    filteredMedications.map(({ medication, category }, index) => (
+                    filteredMedications.map(({ medication, code, category }, index) => (
                       <button
-                        key={`${medication}-${index}`}
-                        onClick={() => !isMedicationSelectedElsewhere(medication, currentMedicationIndex) && selectMedication(medication)}
+                        key={`${code}-${index}`}
+                        onClick={() => !isMedicationSelectedElsewhere(medication, currentMedicationIndex) && selectMedication(medication, code)}
                         disabled={isMedicationSelectedElsewhere(medication, currentMedicationIndex)}
                         className={`w-full text-left px-4 py-2 rounded-md transition-colors flex items-center justify-between group ${
                           isMedicationSelectedElsewhere(medication, currentMedicationIndex) 
@@ -625,7 +676,7 @@ const PrescriptionButton = ({ activeView }) => {
                         {medications.map((medication, index) => (
                           <button
                             key={`${medication}-${index}`}
-                            onClick={() => !isMedicationSelectedElsewhere(medication, currentMedicationIndex) && selectMedication(medication)}
+                            onClick={() => !isMedicationSelectedElsewhere(medication, currentMedicationIndex) && handleMedicationSearch(medication)}
                             disabled={isMedicationSelectedElsewhere(medication, currentMedicationIndex)}
                             className={`w-full text-left px-4 py-2 transition-colors flex items-center justify-between ${
                               isMedicationSelectedElsewhere(medication, currentMedicationIndex)
@@ -657,7 +708,7 @@ const PrescriptionButton = ({ activeView }) => {
                 Cancel
               </button>
               <p className="text-xs text-gray-500 dark:text-gray-400">
-                Select a medication from the list or search by name
+                Search the formulary by name, or pick a category medication to find it
               </p>
             </div>
           </div>
@@ -916,6 +967,46 @@ const PrescriptionButton = ({ activeView }) => {
                     </div>
                     
                     <div className="p-6 space-y-6">
+                      {/* Signing key */}
+                      {signingKeyLoaded ? (
+                        <div className="flex items-center text-sm text-green-700 dark:text-green-400">
+                          <FiCheckCircle className="h-4 w-4 mr-1.5" />
+                          Prescriptions are signed with your enrolment key on this device
+                        </div>
+                      ) : (
+                        <div className="rounded-lg border border-yellow-300 dark:border-yellow-700 bg-yellow-50 dark:bg-yellow-900/20 p-4 space-y-3">
+                          <p className="text-sm text-yellow-800 dark:text-yellow-300">
+                            Prescriptions are signed on this device. Load your enrolment private key and certificate; the key is not uploaded.
+                          </p>
+                          <div className="grid grid-cols-2 gap-4">
+                            <label className="block text-sm font-medium text-gray-700 dark:text-gray-300">
+                              Private key
+                              <input
+                                type="file"
+                                onChange={(e) => setSigningFiles({ ...signingFiles, key: e.target.files[0] || null })}
+                                className="mt-1 block w-full text-sm text-gray-700 dark:text-gray-300"
+                              />
+                            </label>
+                            <label className="block text-sm font-medium text-gray-700 dark:text-gray-300">
+                              Certificate
+                              <input
+                                type="file"
+                                accept=".pem,.crt"
+                                onChange={(e) => setSigningFiles({ ...signingFiles, certificate: e.target.files[0] || null })}
+                                className="mt-1 block w-full text-sm text-gray-700 dark:text-gray-300"
+                              />
+                            </label>
+                          </div>
+                          <button
+                            type="button"
+                            onClick={handleLoadSigningKey}
+                            className="inline-flex items-center px-3 py-1.5 border border-transparent text-sm font-medium rounded-md text-blue-700 bg-blue-100 hover:bg-blue-200 dark:bg-blue-900/30 dark:text-blue-300 dark:hover:bg-blue-800/40 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500 transition-colors"
+                          >
+                            Load signing key
+                          </button>
+                        </div>
+                      )}
+
                       {/* Diagnosis */}
                       <div>
                         <label className="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">
@@ -930,6 +1021,21 @@ const PrescriptionButton = ({ activeView }) => {
                           required
                         />
                       </div>
+
+                      {/* ICD-10 diagnosis codes */}
+                      <div>
+                        <label className="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">
+                          ICD-10 codes
+                        </label>
+                        <input
+                          type="text"
+                          value={prescriptionForm.diagnosisCodes}
+                          onChange={(e) => setPrescriptionForm({...prescriptionForm, diagnosisCodes: e.target.value})}
+                          className="block w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-lg shadow-sm focus:ring-2 focus:ring-blue-500 focus:border-transparent dark:bg-gray-800 dark:text-gray-300 transition-shadow"
+                          placeholder="e.g. J18.9, B54"
+                          required
+                        />
+                      </div>
                       
                       {/* Medications */}
                       <div className="space-y-4">
@@ -0,0 +1,140 @@
+import axios from 'axios';
+
+const API_BASE_URL = process.env.REACT_APP_API_BASE_URL || 'http://localhost:5000';
+
+// The prescriber's enrolment key and certificate. The key is imported as non-extractable and only kept in
+// memory, so it never leaves this device and has to be loaded again after a reload.
+let signingKey = null;
+let signerCertificate = null;
+
+const pemBody = (pem, label) => {
+  const match = pem.match(new RegExp(`-----BEGIN ${label}-----([\\s\\S]+?)-----END ${label}-----`));
+  if (!match) {
+    throw new Error(`Expected a PEM ${label.toLowerCase()}`);
+  }
+  return Uint8Array.from(atob(match[1].replace(/\s+/g, '')), c => c.charCodeAt(0));
+};
+
+/**
+ * Loads the prescriber's enrolment key (PKCS#8 PEM, as written by the Fabric CA client) and certificate.
+ */
+export const loadPrescriberKey = async (keyPem, certificatePem) => {
+  pemBody(certificatePem, 'CERTIFICATE');
+  signingKey = await window.crypto.subtle.importKey(
+    'pkcs8',
+    pemBody(keyPem, 'PRIVATE KEY'),
+    { name: 'ECDSA', namedCurve: 'P-256' },
+    false,
+    ['sign']
+  );
+  signerCertificate = certificatePem;
+};
+
+export const hasPrescriberKey = () => signingKey !== null;
+
+// derInteger encodes an unsigned big-endian integer as an ASN.1 INTEGER
+const derInteger = (bytes) => {
+  let start = 0;
+  while (start < bytes.length - 1 && bytes[start] === 0) start++;
+  let value = Array.from(bytes.slice(start));
+  if (value[0] & 0x80) value = [0, ...value];
+  return [0x02, value.length, ...value];
+};
+
+// WebCrypto returns ECDSA signatures as r||s; the chaincode verifies ASN.1 DER signatures
+const rawToDer = (raw) => {
+  const half = raw.length / 2;
+  const sequence = [...derInteger(raw.slice(0, half)), ...derInteger(raw.slice(half))];
+  return new Uint8Array([0x30, sequence.length, ...sequence]);
+};
+
+// goJSONString quotes a string the way Go's encoding/json does, which also escapes <, >, & and the JavaScript
+// line terminators that JSON.stringify leaves as they are
+const goJSONString = (value) =>
+  JSON.stringify(value).replace(/[<>&\u2028\u2029]/g, c => `\\u${c.charCodeAt(0).toString(16).padStart(4, '0')}`);
+
+// oneMonthFromToday is the default expiry, as a YYYY-MM-DD date
+const oneMonthFromToday = () => {
+  const date = new Date();
+  date.setMonth(date.getMonth() + 1);
+  const pad = n => String(n).padStart(2, '0');
+  return `${date.getFullYear()}-${pad(date.getMonth() + 1)}-${pad(date.getDate())}`;
+};
+
+/**
+ * Normalizes the entered prescription the way the chaincode stores it: diagnosis codes in upper case and an
+ * explicit expiry date.
+ */
+const normalizePrescription = (prescription) => ({
+  ...prescription,
+  DiagnosisCodes: (prescription.DiagnosisCodes || []).map(code => String(code).trim().toUpperCase()),
+  ExpiryDate: prescription.ExpiryDate || oneMonthFromToday()
+});
+
+/**
+ * Builds the canonical content the chaincode verifies, field for field and in the same order as its
+ * PrescriptionContent.
+ */
+const canonicalContent = (patientId, prescriberId, prescription) => {
+  const string = value => goJSONString(value || '');
+  const number = value => {
+    const n = Number(value || 0);
+    if (!Number.isFinite(n)) {
+      throw new Error(`Invalid number in prescription ${prescription.PrescriptionId}: ${value}`);
+    }
+    return String(n);
+  };
+  const fields = [
+    ['prescriptionId', string(prescription.PrescriptionId)],
+    ['patientId', string(patientId)],
+    ['prescriberId', string(prescriberId)],
+    ['medicationCode', string(prescription.MedicationCode)],
+    ['strength', string(prescription.Strength)],
+    ['dosageForm', string(prescription.DosageForm)],
+    ['dosage', string(prescription.Dosage)],
+    ['doseAmount', number(prescription.DoseAmount)],
+    ['doseUnit', string(prescription.DoseUnit)],
+    ['dosesPerDay', number(prescription.DosesPerDay)],
+    ['instructions', string(prescription.Instructions)],
+    ['quantity', number(prescription.Quantity)],
+    ['refills', number(prescription.Refills)],
+    ['diagnosisCodes', `[${(prescription.DiagnosisCodes || []).map(string).join(',')}]`],
+    ['expiryDate', string(prescription.ExpiryDate)]
+  ];
+  return `{${fields.map(([name, value]) => `"${name}":${value}`).join(',')}}`;
+};
+
+/**
+ * Signs a prescription on this device. The canonical content is built here from the fields the prescriber
+ * entered, and the backend's copy of it is only used as a check: if the two are not byte for byte equal the
+ * prescription is not signed. The prescription is returned with its Signature and SignerCertificate set, ready
+ * to submit.
+ */
+export const signPrescription = async (patientId, prescriberId, prescription) => {
+  if (!hasPrescriberKey()) {
+    throw new Error('Load your signing key before issuing prescriptions');
+  }
+  const normalized = normalizePrescription(prescription);
+  const content = canonicalContent(patientId, prescriberId, normalized);
+
+  const response = await axios.post(`${API_BASE_URL}/doctor/prescriptions/content`, {
+    patientId,
+    prescriberId,
+    prescription: normalized
+  });
+  if (response.data.data.content !== content) {
+    throw new Error(`Prescription ${normalized.PrescriptionId} was not signed: the server's copy of it differs from what was entered`);
+  }
+
+  const signature = await window.crypto.subtle.sign(
+    { name: 'ECDSA', hash: 'SHA-256' },
+    signingKey,
+    new TextEncoder().encode(content)
+  );
+  const der = rawToDer(new Uint8Array(signature));
+  return {
+    ...normalized,
+    Signature: btoa(String.fromCharCode(...der)),
+    SignerCertificate: signerCertificate
+  };
+};